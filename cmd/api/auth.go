@@ -22,9 +22,10 @@ type Auth struct {
 }
 
 type jwtUser struct {
-	ID        int    `json:"time"`
-	FirstName string `json:"first_name"`
-	LastName  string `json:"last_name"`
+	ID             int    `json:"time"`
+	FirstName      string `json:"first_name"`
+	LastName       string `json:"last_name"`
+	SessionVersion int    `json:"ver"`
 }
 
 type TokenPairs struct {
@@ -35,6 +36,8 @@ type TokenPairs struct {
 //claims
 type Claims struct {
 	jwt.RegisteredClaims
+	// Version must match the user's session version for the token to be accepted
+	Version int `json:"ver"`
 }
 
 func (j *Auth) GenerateTokenPair(user *jwtUser) (TokenPairs, error) {
@@ -47,6 +50,7 @@ func (j *Auth) GenerateTokenPair(user *jwtUser) (TokenPairs, error) {
 	claims["iss"] = j.Issuer
 	claims["iat"] = time.Now().UTC().Unix()
 	claims["typ"] = "JWT"
+	claims["ver"] = user.SessionVersion
 
 	claims["exp"] = time.Now().UTC().Add(j.TokenExpiry).Unix()
 
@@ -59,6 +63,7 @@ func (j *Auth) GenerateTokenPair(user *jwtUser) (TokenPairs, error) {
 	refreshTokenClaims := refreshToken.Claims.(jwt.MapClaims)
 	refreshTokenClaims["sub"] = fmt.Sprint(user.ID)
 	refreshTokenClaims["iat"] = time.Now().UTC().Unix()
+	refreshTokenClaims["ver"] = user.SessionVersion
 
 	refreshTokenClaims["exp"] = time.Now().UTC().Add(j.RefreshExpiry).Unix()
 
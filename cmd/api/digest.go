@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"kstation_backend/internal/digest"
+	"kstation_backend/internal/mailer"
+	"kstation_backend/internal/models"
+	"log"
+	"time"
+)
+
+const (
+	// digestBatchSize is how many recipients are loaded at a time
+	digestBatchSize = 100
+	// digestReviewLimit is the most reviews one digest shows
+	digestReviewLimit = 50
+)
+
+// sendDigests mails the digests that are due. Every user gets at most one
+// digest per digest period.
+func (app *application) sendDigests(ctx context.Context, job *models.Job) error {
+	sent, err := app.sendDueDigests(ctx, app.DigestPeriod, time.Now())
+	if sent > 0 {
+		log.Println("Sent digests:", sent)
+	}
+
+	return err
+}
+
+// sendDueDigests mails every user who was last sent a digest over a period
+// ago the new reviews on their favorite lessons since then, and returns how
+// many digests were sent. Users with nothing new are marked as done without a
+// mail; users whose mail fails are tried again next time. It stops between
+// users once ctx is done.
+func (app *application) sendDueDigests(ctx context.Context, period time.Duration, now time.Time) (int, error) {
+	sent := 0
+	failed := make(map[int]bool)
+
+	for {
+		recipients, err := app.DB.DigestRecipients(now.Add(-period), digestBatchSize)
+		if err != nil {
+			return sent, err
+		}
+
+		progress := false
+		for _, recipient := range recipients {
+			if ctx.Err() != nil {
+				return sent, ctx.Err()
+			}
+			if failed[recipient.UserId] {
+				continue
+			}
+			progress = true
+
+			ok, err := app.sendDigest(recipient, period, now)
+			if err != nil {
+				log.Println("Error sending digest to user", recipient.UserId, err)
+				failed[recipient.UserId] = true
+				continue
+			}
+			if ok {
+				sent++
+			}
+
+			err = app.DB.MarkDigestSent(recipient.UserId, now)
+			if err != nil {
+				return sent, err
+			}
+		}
+
+		if !progress || len(recipients) < digestBatchSize {
+			return sent, nil
+		}
+	}
+}
+
+// sendDigest mails one user the reviews since their last digest, or since a
+// period ago if that is later. It reports whether there was anything to send.
+func (app *application) sendDigest(recipient *models.DigestRecipient, period time.Duration, now time.Time) (bool, error) {
+	since := now.Add(-period)
+	if recipient.LastDigestAt != nil && recipient.LastDigestAt.After(since) {
+		since = *recipient.LastDigestAt
+	}
+
+	reviews, err := app.DB.DigestReviews(recipient.UserId, since, now, digestReviewLimit)
+	if err != nil {
+		return false, err
+	}
+	if len(reviews) == 0 {
+		return false, nil
+	}
+
+	token := digest.UnsubscribeToken(app.UnsubscribeSecret, recipient.UserId)
+	subject, text, html, err := digest.Render(recipient.Language, digest.Digest{
+		FirstName:      recipient.FirstName,
+		Lessons:        digest.Group(reviews, app.Domain),
+		Since:          since,
+		Until:          now,
+		UnsubscribeURL: fmt.Sprintf("%s/digest/unsubscribe?token=%s", app.Domain, token),
+		PreferencesURL: fmt.Sprintf("%s/settings/notifications", app.Domain),
+		Location:       app.location,
+	})
+	if err != nil {
+		return false, err
+	}
+
+	err = app.mailer.Send(context.Background(), mailer.Message{
+		To:              recipient.Email,
+		Subject:         subject,
+		Text:            text,
+		HTML:            html,
+		ListUnsubscribe: fmt.Sprintf("%s/digest/unsubscribe?token=%s", app.APIURL, token),
+	})
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"kstation_backend/internal/mailer"
+	"kstation_backend/internal/models"
+	"kstation_backend/internal/repository/dbrepo"
+	"strings"
+	"testing"
+	"time"
+)
+
+// digestRepo hands out three recipients and records whose digests were marked
+// sent and from when their reviews were asked for
+type digestRepo struct {
+	dbrepo.TestDBRepo
+	lastDigestAt time.Time
+	since        map[int]time.Time
+	marked       map[int]time.Time
+}
+
+func (m *digestRepo) DigestRecipients(checkedBefore time.Time, limit int) ([]*models.DigestRecipient, error) {
+	return []*models.DigestRecipient{
+		{UserId: 1, Email: "taro@example.com", FirstName: "Taro", Language: "ja", LastDigestAt: &m.lastDigestAt},
+		{UserId: 2, Email: "jiro@example.com", FirstName: "Jiro", Language: "en"},
+		{UserId: 3, Email: "fail@example.com", FirstName: "Saburo", Language: "en"},
+	}, nil
+}
+
+func (m *digestRepo) DigestReviews(userID int, since time.Time, until time.Time, limit int) ([]*models.DigestReview, error) {
+	m.since[userID] = since
+	if userID == 2 {
+		return nil, nil
+	}
+
+	return []*models.DigestReview{
+		{LessonId: 1, LessonName: "Linear Algebra", TeacherName: "Yamada", Star: 4, Comment: "Clear lectures", Year: 2024, Term: "spring", CreatedAt: until.Add(-time.Hour)},
+	}, nil
+}
+
+func (m *digestRepo) MarkDigestSent(userID int, at time.Time) error {
+	m.marked[userID] = at
+	return nil
+}
+
+// failingMailer refuses mail to fail@example.com
+type failingMailer struct {
+	*mailer.Capture
+}
+
+func (m failingMailer) Send(ctx context.Context, msg mailer.Message) error {
+	if msg.To == "fail@example.com" {
+		return errors.New("mailbox unavailable")
+	}
+
+	return m.Capture.Send(ctx, msg)
+}
+
+func Test_app_sendDueDigests(t *testing.T) {
+	now := time.Now()
+	period := time.Hour * 24 * 7
+	repo := &digestRepo{lastDigestAt: now.Add(-time.Hour * 24 * 8), since: map[int]time.Time{}, marked: map[int]time.Time{}}
+	capture := &mailer.Capture{}
+
+	oldDB, oldMailer := app.DB, app.mailer
+	app.DB, app.mailer = repo, failingMailer{capture}
+	defer func() { app.DB, app.mailer = oldDB, oldMailer }()
+
+	sent, err := app.sendDueDigests(context.Background(), period, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if sent != 1 || len(capture.Messages()) != 1 {
+		t.Fatalf("expected 1 digest but sent %d", sent)
+	}
+
+	// a digest never reaches back further than one period
+	if !repo.since[1].Equal(now.Add(-period)) {
+		t.Errorf("expected reviews since %s but got %s", now.Add(-period), repo.since[1])
+	}
+
+	if _, ok := repo.marked[1]; !ok {
+		t.Error("expected the sent digest to be marked")
+	}
+
+	if _, ok := repo.marked[2]; !ok {
+		t.Error("expected the user with nothing new to be marked")
+	}
+
+	if _, ok := repo.marked[3]; ok {
+		t.Error("expected the failed digest to be tried again")
+	}
+
+	msg, _ := capture.Last()
+	if msg.To != "taro@example.com" || !strings.Contains(msg.Subject, "新しいレビュー") {
+		t.Errorf("unexpected digest to %s: %s", msg.To, msg.Subject)
+	}
+
+	if !strings.HasPrefix(msg.ListUnsubscribe, app.APIURL+"/digest/unsubscribe?token=1.") {
+		t.Errorf("unexpected List-Unsubscribe %s", msg.ListUnsubscribe)
+	}
+
+	if !strings.Contains(msg.Text, app.Domain+"/digest/unsubscribe?token=1.") || !strings.Contains(msg.HTML, "Linear Algebra") {
+		t.Errorf("unexpected digest body:\n%s", msg.Text)
+	}
+}
+
+func Test_app_sendDueDigestsSinceLast(t *testing.T) {
+	now := time.Now()
+	repo := &digestRepo{lastDigestAt: now.Add(-time.Hour * 24 * 3), since: map[int]time.Time{}, marked: map[int]time.Time{}}
+
+	oldDB, oldMailer := app.DB, app.mailer
+	app.DB, app.mailer = repo, failingMailer{&mailer.Capture{}}
+	defer func() { app.DB, app.mailer = oldDB, oldMailer }()
+
+	_, err := app.sendDueDigests(context.Background(), time.Hour*24*7, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !repo.since[1].Equal(repo.lastDigestAt) {
+		t.Errorf("expected reviews since the last digest at %s but got %s", repo.lastDigestAt, repo.since[1])
+	}
+}
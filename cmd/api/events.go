@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"kstation_backend/internal/models"
+	"kstation_backend/internal/pubsub"
+	"kstation_backend/internal/repository"
+	"log"
+	"time"
+)
+
+// types of the events streamed by GET /lessons/{id}/events
+const (
+	eventCommentCreated = "comment_created"
+	eventCommentUpdated = "comment_updated"
+	eventCommentDeleted = "comment_deleted"
+	eventStatsUpdated   = "stats_updated"
+)
+
+const (
+	// eventBuffer is how many events a lesson stream may fall behind by
+	// before it is dropped
+	eventBuffer = 32
+	// eventKeepAlive is how often an idle lesson stream sends a comment line
+	// so that proxies keep it open
+	eventKeepAlive = time.Second * 15
+	// eventRetry is how long clients wait before reconnecting a lesson stream
+	eventRetry = time.Second * 3
+	// notifyPayloadLimit is the size Postgres NOTIFY payloads must stay under
+	notifyPayloadLimit = 8000
+)
+
+// notifyPublisher publishes events with Postgres NOTIFY, for every API
+// instance to relay to its own hub
+type notifyPublisher struct {
+	db      repository.DatabaseRepo
+	channel string
+}
+
+func (p *notifyPublisher) Publish(event pubsub.Event) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	if len(payload) >= notifyPayloadLimit {
+		// too large for a notification, so clients get the bare event and
+		// reload the lesson
+		event.Data = nil
+		payload, err = json.Marshal(event)
+		if err != nil {
+			return err
+		}
+	}
+
+	return p.db.Notify(p.channel, string(payload))
+}
+
+// relayEvents feeds the hub with the events notified on a Postgres channel,
+// listening again after failures until ctx is done
+func (app *application) relayEvents(ctx context.Context, channel string) {
+	for {
+		err := app.DB.Listen(ctx, channel, func(payload string) {
+			var event pubsub.Event
+			err := json.Unmarshal([]byte(payload), &event)
+			if err != nil {
+				log.Println("Error decoding lesson event", err)
+				return
+			}
+
+			_ = app.hub.Publish(event)
+		})
+		if ctx.Err() != nil {
+			return
+		}
+		log.Println("Error listening for lesson events", err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(eventRetry):
+		}
+	}
+}
+
+// publishCommentChange streams a change to a review, and the lesson
+// statistics it affects, to the lesson's viewers and sends it to webhooks.
+// Reviews nobody else can see are never published; an edit that puts a review
+// on hold removes it.
+func (app *application) publishCommentChange(eventType string, lessonID int, commentID int) {
+	var data interface{} = map[string]int{"id": commentID}
+
+	if eventType != eventCommentDeleted {
+		comment, err := app.DB.GetCommentByID(commentID)
+		if err != nil {
+			log.Println("Error loading comment", commentID, "for lesson event", err)
+			return
+		}
+
+		if comment.ModerationStatus == models.CommentVisible {
+			data, err = app.presentComment(comment, false)
+			if err != nil {
+				log.Println("Error presenting comment", commentID, "for lesson event", err)
+				return
+			}
+		} else if eventType == eventCommentUpdated {
+			eventType = eventCommentDeleted
+		} else {
+			return
+		}
+	}
+
+	app.publishLessonEvent(lessonID, eventType, data)
+	app.publishWebhookEvent(reviewWebhookEvents[eventType], lessonID, data)
+
+	stats, err := app.DB.GetLessonStats(lessonID)
+	if err != nil {
+		log.Println("Error loading stats of lesson", lessonID, "for lesson event", err)
+		return
+	}
+
+	app.publishLessonEvent(lessonID, eventStatsUpdated, stats)
+}
+
+func (app *application) publishLessonEvent(lessonID int, eventType string, data interface{}) {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		log.Println("Error encoding lesson event", err)
+		return
+	}
+
+	err = app.events.Publish(pubsub.Event{LessonID: lessonID, Type: eventType, Data: payload})
+	if err != nil {
+		log.Println("Error publishing lesson event", err)
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"kstation_backend/internal/pubsub"
+	"kstation_backend/internal/repository/dbrepo"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// eventsRepo records notifications and replays a payload to listeners
+type eventsRepo struct {
+	dbrepo.TestDBRepo
+	notified []string
+	replay   string
+}
+
+func (m *eventsRepo) Notify(channel string, payload string) error {
+	m.notified = append(m.notified, payload)
+	return nil
+}
+
+func (m *eventsRepo) Listen(ctx context.Context, channel string, handle func(payload string)) error {
+	handle("not json")
+	handle(m.replay)
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+// waitForSubscribers waits until a lesson has n subscribers
+func waitForSubscribers(t *testing.T, lessonID int, n int) {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second * 2)
+	for app.hub.Subscribers(lessonID) != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d subscribers of lesson %d but got %d", n, lessonID, app.hub.Subscribers(lessonID))
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+// nextEvent reads server-sent events up to the next event line and its data
+func nextEvent(t *testing.T, reader *bufio.Reader) (string, string) {
+	t.Helper()
+
+	var eventType string
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("error reading event stream: %s", err)
+		}
+
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case strings.HasPrefix(line, "event: "):
+			eventType = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			return eventType, strings.TrimPrefix(line, "data: ")
+		}
+	}
+}
+
+func Test_app_lessonEvents(t *testing.T) {
+	ts := httptest.NewServer(app.routes())
+	defer ts.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	req, _ := http.NewRequestWithContext(ctx, "GET", ts.URL+"/lessons/1/events", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("expected an event stream but got %d %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+
+	waitForSubscribers(t, 1, 1)
+	app.publishCommentChange(eventCommentCreated, 1, 1)
+
+	reader := bufio.NewReader(resp.Body)
+
+	eventType, data := nextEvent(t, reader)
+	if eventType != eventCommentCreated || !strings.Contains(data, `"comment":"this is a test"`) {
+		t.Errorf("unexpected event %s: %s", eventType, data)
+	}
+
+	eventType, data = nextEvent(t, reader)
+	if eventType != eventStatsUpdated || !strings.Contains(data, `"comment_numbers":1`) {
+		t.Errorf("unexpected event %s: %s", eventType, data)
+	}
+
+	cancel()
+	waitForSubscribers(t, 1, 0)
+}
+
+func Test_app_lessonEventsNotFound(t *testing.T) {
+	var tests = []struct {
+		name               string
+		id                 string
+		expectedStatusCode int
+	}{
+		{"unknown lesson", "3", http.StatusNotFound},
+		{"invalid id", "abc", http.StatusBadRequest},
+	}
+
+	for _, e := range tests {
+		req, _ := http.NewRequest("GET", "/lessons/"+e.id+"/events", nil)
+		req = withURLParam(req, "id", e.id)
+
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(app.lessonEvents).ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("%s: expected status of %d but got %d", e.name, e.expectedStatusCode, rr.Code)
+		}
+	}
+}
+
+func Test_app_publishCommentChange(t *testing.T) {
+	var tests = []struct {
+		name          string
+		eventType     string
+		commentID     int
+		expectedTypes []string
+	}{
+		{"created", eventCommentCreated, 1, []string{eventCommentCreated, eventStatsUpdated}},
+		{"updated", eventCommentUpdated, 1, []string{eventCommentUpdated, eventStatsUpdated}},
+		{"deleted", eventCommentDeleted, 7, []string{eventCommentDeleted, eventStatsUpdated}},
+		{"missing comment", eventCommentCreated, 7, nil},
+	}
+
+	for _, e := range tests {
+		sub := app.hub.Subscribe(1)
+		app.publishCommentChange(e.eventType, 1, e.commentID)
+		sub.Close()
+
+		var types []string
+		for event := range sub.Events() {
+			types = append(types, event.Type)
+		}
+
+		if strings.Join(types, ",") != strings.Join(e.expectedTypes, ",") {
+			t.Errorf("%s: expected events %v but got %v", e.name, e.expectedTypes, types)
+		}
+	}
+}
+
+func Test_notifyPublisher(t *testing.T) {
+	repo := &eventsRepo{}
+	publisher := &notifyPublisher{db: repo, channel: "lesson_events"}
+
+	_ = publisher.Publish(pubsub.Event{LessonID: 1, Type: eventCommentDeleted, Data: json.RawMessage(`{"id":1}`)})
+
+	large, _ := json.Marshal(strings.Repeat("x", notifyPayloadLimit))
+	_ = publisher.Publish(pubsub.Event{LessonID: 1, Type: eventCommentCreated, Data: large})
+
+	if len(repo.notified) != 2 {
+		t.Fatalf("expected 2 notifications but got %d", len(repo.notified))
+	}
+
+	if !strings.Contains(repo.notified[0], `"data":{"id":1}`) {
+		t.Errorf("expected the event data in %s", repo.notified[0])
+	}
+
+	if len(repo.notified[1]) >= notifyPayloadLimit || strings.Contains(repo.notified[1], `"data"`) {
+		t.Errorf("expected a large event without its data, but got %d bytes", len(repo.notified[1]))
+	}
+}
+
+func Test_app_relayEvents(t *testing.T) {
+	repo := &eventsRepo{replay: `{"lesson_id":2,"type":"comment_deleted","data":{"id":3}}`}
+	oldDB := app.DB
+	app.DB = repo
+	defer func() { app.DB = oldDB }()
+
+	sub := app.hub.Subscribe(2)
+	defer sub.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		app.relayEvents(ctx, "lesson_events")
+		close(done)
+	}()
+
+	select {
+	case event := <-sub.Events():
+		if event.Type != eventCommentDeleted || string(event.Data) != `{"id":3}` {
+			t.Errorf("unexpected event %+v", event)
+		}
+	case <-time.After(time.Second * 2):
+		t.Error("expected the notified event to reach the hub")
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second * 2):
+		t.Error("expected relaying to stop when the context is done")
+	}
+}
@@ -1,12 +1,39 @@
 package main
 
 import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"database/sql"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"io"
+	"kstation_backend/internal/avatar"
+	"kstation_backend/internal/contentfilter"
+	"kstation_backend/internal/digest"
+	"kstation_backend/internal/jobs"
+	"kstation_backend/internal/mailer"
+	"kstation_backend/internal/models"
+	"kstation_backend/internal/repository"
+	"kstation_backend/internal/storage"
+	"kstation_backend/internal/timetable"
+	"log"
+	"mime"
 	"net/http"
+	"net/mail"
+	"net/url"
+	"path"
+	"path/filepath"
 	"strconv"
+	"strings"
 	"time"
+	"unicode/utf8"
 
+	"github.com/go-chi/chi/v5"
 	"github.com/golang-jwt/jwt/v4"
 )
 
@@ -38,6 +65,7 @@ func (app *application) authenticate(w http.ResponseWriter, r *http.Request) {
 		ID: user.ID,
 		FirstName: user.FirstName,
 		LastName: user.LastName,
+		SessionVersion: user.SessionVersion,
 	}
 
 	tokens, err := app.auth.GenerateTokenPair(&u)
@@ -86,10 +114,16 @@ func (app *application) refreshToken(w http.ResponseWriter, r *http.Request) {
 				return
 			}
 
+			if user.SessionVersion != claims.Version {
+				app.errorJSON(w, errors.New("session has been revoked"), http.StatusUnauthorized)
+				return
+			}
+
 			u := jwtUser{
 				ID: user.ID,
 				FirstName: user.FirstName,
 				LastName: user.LastName,
+				SessionVersion: user.SessionVersion,
 			}
 
 			tokenPairs, err := app.auth.GenerateTokenPair(&u)
@@ -105,3 +139,3551 @@ func (app *application) refreshToken(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 }
+
+func (app *application) lessonStats(w http.ResponseWriter, r *http.Request) {
+	lessonID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	_, err = app.DB.GetLessonByID(lessonID)
+	if err != nil {
+		app.errorJSON(w, errors.New("lesson not found"), http.StatusNotFound)
+		return
+	}
+
+	stats, err := app.DB.GetLessonStats(lessonID)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	app.writeJSON(w, http.StatusOK, stats)
+}
+
+func (app *application) allCommentsByLesson(w http.ResponseWriter, r *http.Request) {
+	lessonID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	how := 0
+	if r.URL.Query().Get("how") != "" {
+		how, err = strconv.Atoi(r.URL.Query().Get("how"))
+		if err != nil {
+			app.errorJSON(w, err)
+			return
+		}
+	}
+
+	// a lesson without reviews and a lesson that does not exist both list
+	// no comments, so the lesson itself is looked up
+	_, err = app.DB.GetLessonByID(lessonID)
+	if err != nil {
+		app.errorJSON(w, errors.New("lesson not found"), http.StatusNotFound)
+		return
+	}
+
+	comments, err := app.DB.AllCommentsByLessonId(lessonID, how)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	views, err := app.presentComments(comments, false)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	app.writeJSON(w, http.StatusOK, views)
+}
+
+func (app *application) voteComment(w http.ResponseWriter, r *http.Request) {
+	commentID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	var requestPayload struct {
+		Helpful bool `json:"helpful"`
+	}
+
+	err = app.readJSON(w, r, &requestPayload)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	// hidden and held reviews are not shown, so they cannot be voted on
+	comment, err := app.DB.GetCommentByID(commentID)
+	if err != nil || comment.ModerationStatus != models.CommentVisible {
+		app.errorJSON(w, errors.New("comment not found"), http.StatusNotFound)
+		return
+	}
+
+	err = app.DB.VoteComment(commentID, app.authUserID(r), requestPayload.Helpful)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	comment, err = app.DB.GetCommentByID(commentID)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	view, err := app.presentComment(comment, false)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	app.writeJSON(w, http.StatusOK, view)
+}
+
+var errCommentRejected = errors.New("comment rejected by content policy")
+
+// readComment decodes a review from the request body and attaches the lesson
+// from the url and the authenticated user
+func (app *application) readComment(w http.ResponseWriter, r *http.Request) (models.Comment, error) {
+	var comment models.Comment
+
+	lessonID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		return comment, err
+	}
+
+	err = app.readJSON(w, r, &comment)
+	if err != nil {
+		return comment, err
+	}
+
+	comment.ID = 0
+	comment.LessonId = lessonID
+	comment.UserId = app.authUserID(r)
+	comment.ModerationStatus = ""
+
+	err = app.validateComment(&comment)
+	if err != nil {
+		return comment, err
+	}
+
+	return comment, nil
+}
+
+// validateComment checks the fields of a review and runs its text through the
+// content policy, which may rewrite the text or hold the review for a moderator
+func (app *application) validateComment(comment *models.Comment) error {
+	switch {
+	case comment.Star < 1 || comment.Star > 5:
+		return errors.New("star must be between 1 and 5")
+	case comment.Year <= 0:
+		return errors.New("year is required")
+	case comment.Term == "":
+		return errors.New("term is required")
+	}
+
+	result := app.contentPolicy.Apply(comment.Comment)
+	if result.Decision == contentfilter.Reject {
+		return fmt.Errorf("%w: %s", errCommentRejected, strings.Join(result.Reasons, ", "))
+	}
+
+	// a review already held stays held when its author edits the flagged
+	// text out, so it is never published without a moderator seeing it
+	comment.Comment = result.Text
+	if result.Decision == contentfilter.Hold {
+		comment.ModerationStatus = models.CommentPending
+	} else if comment.ModerationStatus != models.CommentPending {
+		comment.ModerationStatus = models.CommentVisible
+	}
+
+	if utf8.RuneCountInString(comment.Comment) > 255 {
+		return errors.New("comment must be at most 255 characters")
+	}
+
+	return nil
+}
+
+// writeCommentError answers with 422 for reviews refused by the content policy
+// and 400 for any other invalid review
+func (app *application) writeCommentError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errCommentRejected) {
+		app.errorJSON(w, err, http.StatusUnprocessableEntity)
+		return
+	}
+
+	app.errorJSON(w, err)
+}
+
+func commentSavedMessage(comment models.Comment, message string) string {
+	if comment.ModerationStatus == models.CommentPending {
+		return "comment held for review"
+	}
+
+	return message
+}
+
+// publishNewReview tells the followers of a lesson about a new review of it,
+// unless the review is held for a moderator
+func (app *application) publishNewReview(comment models.Comment) {
+	if comment.ModerationStatus != models.CommentVisible {
+		return
+	}
+
+	app.publishFollowEvent(models.FollowEvent{
+		Kind:      models.NotificationNewReview,
+		LessonId:  comment.LessonId,
+		CommentId: comment.ID,
+		ActorId:   comment.UserId,
+	})
+}
+
+func (app *application) writeDuplicateComment(w http.ResponseWriter, commentID int) {
+	headers := http.Header{}
+	headers.Set("Location", fmt.Sprintf("/comments/%d", commentID))
+
+	payload := JSONResponse{
+		Error:   true,
+		Message: repository.ErrDuplicateComment.Error(),
+		Data:    map[string]int{"comment_id": commentID},
+	}
+
+	app.writeJSON(w, http.StatusConflict, payload, headers)
+}
+
+func (app *application) insertComment(w http.ResponseWriter, r *http.Request) {
+	comment, err := app.readComment(w, r)
+	if err != nil {
+		app.writeCommentError(w, err)
+		return
+	}
+
+	_, err = app.DB.GetLessonByID(comment.LessonId)
+	if err != nil {
+		app.errorJSON(w, errors.New("lesson not found"), http.StatusNotFound)
+		return
+	}
+
+	existing, err := app.DB.GetCommentByOffering(comment.UserId, comment.LessonId, comment.Year, comment.Term)
+	if err == nil {
+		app.writeDuplicateComment(w, existing.ID)
+		return
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	newID, err := app.DB.InsertComment(comment)
+	if errors.Is(err, repository.ErrDuplicateComment) {
+		// lost a race against another request from the same user
+		existing, err = app.DB.GetCommentByOffering(comment.UserId, comment.LessonId, comment.Year, comment.Term)
+		if err == nil {
+			app.writeDuplicateComment(w, existing.ID)
+			return
+		}
+	}
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	err = app.DB.UpdateLessonAggregates(comment.LessonId)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	comment.ID = newID
+	app.publishNewReview(comment)
+	app.publishCommentChange(eventCommentCreated, comment.LessonId, newID)
+
+	resp := JSONResponse{
+		Error:   false,
+		Message: commentSavedMessage(comment, "comment created"),
+		Data:    map[string]int{"comment_id": newID},
+	}
+
+	app.writeJSON(w, http.StatusCreated, resp)
+}
+
+// upsertComment creates the user's review of a lesson offering, or edits it
+// if the user already reviewed the same lesson, year and term
+func (app *application) upsertComment(w http.ResponseWriter, r *http.Request) {
+	comment, err := app.readComment(w, r)
+	if err != nil {
+		app.writeCommentError(w, err)
+		return
+	}
+
+	_, err = app.DB.GetLessonByID(comment.LessonId)
+	if err != nil {
+		app.errorJSON(w, errors.New("lesson not found"), http.StatusNotFound)
+		return
+	}
+
+	existing, err := app.DB.GetCommentByOffering(comment.UserId, comment.LessonId, comment.Year, comment.Term)
+	created := errors.Is(err, sql.ErrNoRows)
+	if err != nil && !created {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+	if !created && existing.ModerationStatus == models.CommentPending {
+		comment.ModerationStatus = models.CommentPending
+	}
+
+	id, err := app.DB.UpsertComment(comment)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	err = app.DB.UpdateLessonAggregates(comment.LessonId)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	if created {
+		comment.ID = id
+		app.publishNewReview(comment)
+		app.publishCommentChange(eventCommentCreated, comment.LessonId, id)
+	} else {
+		app.publishCommentChange(eventCommentUpdated, comment.LessonId, id)
+	}
+
+	resp := JSONResponse{
+		Error:   false,
+		Message: commentSavedMessage(comment, "comment saved"),
+		Data:    map[string]int{"comment_id": id},
+	}
+
+	app.writeJSON(w, http.StatusOK, resp)
+}
+
+func (app *application) reportComment(w http.ResponseWriter, r *http.Request) {
+	commentID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	var requestPayload struct {
+		Reason string `json:"reason"`
+		Detail string `json:"detail"`
+	}
+
+	err = app.readJSON(w, r, &requestPayload)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	switch requestPayload.Reason {
+	case models.ReportSpam, models.ReportAbuse, models.ReportDefamation, models.ReportPersonalInfo, models.ReportOther:
+	default:
+		app.errorJSON(w, errors.New("invalid reason"))
+		return
+	}
+
+	if utf8.RuneCountInString(requestPayload.Detail) > 255 {
+		app.errorJSON(w, errors.New("detail must be at most 255 characters"))
+		return
+	}
+
+	comment, err := app.DB.GetCommentByID(commentID)
+	if err != nil || comment.ModerationStatus != models.CommentVisible {
+		app.errorJSON(w, errors.New("comment not found"), http.StatusNotFound)
+		return
+	}
+
+	report := models.Report{
+		CommentId: commentID,
+		UserId:    app.authUserID(r),
+		Reason:    requestPayload.Reason,
+		Detail:    requestPayload.Detail,
+	}
+
+	newID, err := app.DB.InsertReport(report)
+	if errors.Is(err, repository.ErrDuplicateReport) {
+		app.errorJSON(w, err, http.StatusConflict)
+		return
+	} else if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	resp := JSONResponse{
+		Error:   false,
+		Message: "comment reported",
+		Data:    map[string]int{"report_id": newID},
+	}
+
+	app.writeJSON(w, http.StatusCreated, resp)
+}
+
+func (app *application) moderationQueue(w http.ResponseWriter, r *http.Request) {
+	reports, err := app.DB.PendingReports()
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	views, err := app.presentReports(reports)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	app.writeJSON(w, http.StatusOK, views)
+}
+
+func (app *application) moderateReport(w http.ResponseWriter, r *http.Request) {
+	reportID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	var requestPayload struct {
+		Action string `json:"action"`
+		Note   string `json:"note"`
+	}
+
+	err = app.readJSON(w, r, &requestPayload)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	switch requestPayload.Action {
+	case models.ModerationDismiss, models.ModerationHide, models.ModerationDelete, models.ModerationWarn:
+	default:
+		app.errorJSON(w, errors.New("invalid action"))
+		return
+	}
+
+	report, err := app.DB.GetReportByID(reportID)
+	if err != nil {
+		app.errorJSON(w, errors.New("report not found"), http.StatusNotFound)
+		return
+	}
+
+	if report.Status != models.ReportPending {
+		app.errorJSON(w, errors.New("report has already been handled"), http.StatusConflict)
+		return
+	}
+
+	comment, err := app.DB.GetCommentByID(report.CommentId)
+	if err != nil {
+		app.errorJSON(w, errors.New("comment not found"), http.StatusNotFound)
+		return
+	}
+
+	action := models.ModerationAction{
+		ReportId:    reportID,
+		ModeratorId: app.authUserID(r),
+		Action:      requestPayload.Action,
+		Note:        requestPayload.Note,
+	}
+
+	err = app.DB.ModerateReport(action)
+	if errors.Is(err, repository.ErrReportHandled) {
+		app.errorJSON(w, err, http.StatusConflict)
+		return
+	} else if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	if action.Action == models.ModerationHide || action.Action == models.ModerationDelete {
+		err = app.DB.UpdateLessonAggregates(comment.LessonId)
+		if err != nil {
+			app.errorJSON(w, err, http.StatusInternalServerError)
+			return
+		}
+
+		app.publishCommentChange(eventCommentDeleted, comment.LessonId, comment.ID)
+	}
+
+	resp := JSONResponse{
+		Error:   false,
+		Message: "report handled",
+	}
+
+	app.writeJSON(w, http.StatusOK, resp)
+}
+
+// updateComment lets the author of a review edit it
+func (app *application) updateComment(w http.ResponseWriter, r *http.Request) {
+	commentID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	comment, err := app.DB.GetCommentByID(commentID)
+	if err != nil {
+		app.errorJSON(w, errors.New("comment not found"), http.StatusNotFound)
+		return
+	}
+
+	if comment.UserId != app.authUserID(r) {
+		app.errorJSON(w, errors.New("you can only edit your own comments"), http.StatusForbidden)
+		return
+	}
+
+	var requestPayload struct {
+		Year         int    `json:"year"`
+		Term         string `json:"Term"`
+		Comment      string `json:"comment"`
+		TestOrReport string `json:"test_or_report"`
+		Star         int    `json:"star"`
+	}
+
+	err = app.readJSON(w, r, &requestPayload)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	comment.Year = requestPayload.Year
+	comment.Term = requestPayload.Term
+	comment.Comment = requestPayload.Comment
+	comment.TestOrReport = requestPayload.TestOrReport
+	comment.Star = requestPayload.Star
+
+	err = app.validateComment(comment)
+	if err != nil {
+		app.writeCommentError(w, err)
+		return
+	}
+
+	err = app.DB.UpdateComment(*comment, app.authUserID(r))
+	if errors.Is(err, repository.ErrDuplicateComment) {
+		app.errorJSON(w, err, http.StatusConflict)
+		return
+	} else if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	err = app.DB.UpdateLessonAggregates(comment.LessonId)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	app.publishCommentChange(eventCommentUpdated, comment.LessonId, commentID)
+
+	resp := JSONResponse{
+		Error:   false,
+		Message: commentSavedMessage(*comment, "comment updated"),
+	}
+
+	app.writeJSON(w, http.StatusOK, resp)
+}
+
+func (app *application) heldComments(w http.ResponseWriter, r *http.Request) {
+	comments, err := app.DB.HeldComments()
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	views, err := app.presentComments(comments, true)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	app.writeJSON(w, http.StatusOK, views)
+}
+
+// moderateHeldComment publishes (approve) or hides (reject) a comment held by the content filter
+func (app *application) moderateHeldComment(w http.ResponseWriter, r *http.Request) {
+	commentID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	var requestPayload struct {
+		Action string `json:"action"`
+	}
+
+	err = app.readJSON(w, r, &requestPayload)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	var status string
+	switch requestPayload.Action {
+	case "approve":
+		status = models.CommentVisible
+	case "reject":
+		status = models.CommentHidden
+	default:
+		app.errorJSON(w, errors.New("invalid action"))
+		return
+	}
+
+	comment, err := app.DB.GetCommentByID(commentID)
+	if err != nil {
+		app.errorJSON(w, errors.New("comment not found"), http.StatusNotFound)
+		return
+	}
+
+	if comment.ModerationStatus != models.CommentPending {
+		app.errorJSON(w, errors.New("comment is not held for review"), http.StatusConflict)
+		return
+	}
+
+	err = app.DB.SetCommentModerationStatus(commentID, status)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	err = app.DB.UpdateLessonAggregates(comment.LessonId)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	comment.ModerationStatus = status
+	app.publishNewReview(*comment)
+	if status == models.CommentVisible {
+		app.publishCommentChange(eventCommentCreated, comment.LessonId, commentID)
+	}
+
+	resp := JSONResponse{
+		Error:   false,
+		Message: "comment " + status,
+	}
+
+	app.writeJSON(w, http.StatusOK, resp)
+}
+
+// deleteComment lets the author of a review remove it
+func (app *application) deleteComment(w http.ResponseWriter, r *http.Request) {
+	commentID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	comment, err := app.DB.GetCommentByID(commentID)
+	if err != nil {
+		app.errorJSON(w, errors.New("comment not found"), http.StatusNotFound)
+		return
+	}
+
+	if comment.UserId != app.authUserID(r) {
+		app.errorJSON(w, errors.New("you can only delete your own comments"), http.StatusForbidden)
+		return
+	}
+
+	err = app.DB.DeleteComment(commentID)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	err = app.DB.UpdateLessonAggregates(comment.LessonId)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	app.publishCommentChange(eventCommentDeleted, comment.LessonId, commentID)
+
+	resp := JSONResponse{
+		Error:   false,
+		Message: "comment deleted",
+	}
+
+	app.writeJSON(w, http.StatusAccepted, resp)
+}
+
+func (app *application) deleteLesson(w http.ResponseWriter, r *http.Request) {
+	lessonID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	err = app.DB.DeleteLesson(lessonID)
+	if errors.Is(err, sql.ErrNoRows) {
+		app.errorJSON(w, errors.New("lesson not found"), http.StatusNotFound)
+		return
+	} else if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	resp := JSONResponse{
+		Error:   false,
+		Message: "lesson deleted",
+	}
+
+	app.writeJSON(w, http.StatusAccepted, resp)
+}
+
+func (app *application) deleteUser(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	lessonIDs, err := app.DB.DeleteUser(userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		app.errorJSON(w, errors.New("user not found"), http.StatusNotFound)
+		return
+	} else if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	for _, lessonID := range lessonIDs {
+		err = app.DB.UpdateLessonAggregates(lessonID)
+		if err != nil {
+			app.errorJSON(w, err, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	resp := JSONResponse{
+		Error:   false,
+		Message: "user deleted",
+	}
+
+	app.writeJSON(w, http.StatusAccepted, resp)
+}
+
+func (app *application) restoreComment(w http.ResponseWriter, r *http.Request) {
+	commentID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	lessonID, err := app.DB.RestoreComment(commentID)
+	if errors.Is(err, sql.ErrNoRows) {
+		app.errorJSON(w, errors.New("deleted comment not found"), http.StatusNotFound)
+		return
+	} else if errors.Is(err, repository.ErrDuplicateComment) {
+		app.errorJSON(w, err, http.StatusConflict)
+		return
+	} else if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	err = app.DB.UpdateLessonAggregates(lessonID)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	app.publishCommentChange(eventCommentCreated, lessonID, commentID)
+
+	resp := JSONResponse{
+		Error:   false,
+		Message: "comment restored",
+	}
+
+	app.writeJSON(w, http.StatusOK, resp)
+}
+
+func (app *application) restoreLesson(w http.ResponseWriter, r *http.Request) {
+	lessonID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	err = app.DB.RestoreLesson(lessonID)
+	if errors.Is(err, sql.ErrNoRows) {
+		app.errorJSON(w, errors.New("deleted lesson not found"), http.StatusNotFound)
+		return
+	} else if errors.Is(err, repository.ErrDuplicateComment) {
+		app.errorJSON(w, err, http.StatusConflict)
+		return
+	} else if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	err = app.DB.UpdateLessonAggregates(lessonID)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	resp := JSONResponse{
+		Error:   false,
+		Message: "lesson restored",
+	}
+
+	app.writeJSON(w, http.StatusOK, resp)
+}
+
+func (app *application) restoreUser(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	lessonIDs, err := app.DB.RestoreUser(userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		app.errorJSON(w, errors.New("deleted user not found"), http.StatusNotFound)
+		return
+	} else if errors.Is(err, repository.ErrDuplicateComment) {
+		app.errorJSON(w, err, http.StatusConflict)
+		return
+	} else if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	for _, lessonID := range lessonIDs {
+		err = app.DB.UpdateLessonAggregates(lessonID)
+		if err != nil {
+			app.errorJSON(w, err, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	resp := JSONResponse{
+		Error:   false,
+		Message: "user restored",
+	}
+
+	app.writeJSON(w, http.StatusOK, resp)
+}
+
+func (app *application) commentRevisions(w http.ResponseWriter, r *http.Request) {
+	commentID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	revisions, err := app.DB.CommentRevisions(commentID)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	app.writeJSON(w, http.StatusOK, revisions)
+}
+
+func (app *application) updatePrivacy(w http.ResponseWriter, r *http.Request) {
+	var requestPayload struct {
+		ShowRealName bool `json:"show_real_name"`
+	}
+
+	err := app.readJSON(w, r, &requestPayload)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	user, err := app.DB.GetUserByID(app.authUserID(r))
+	if err != nil {
+		app.errorJSON(w, errors.New("user not found"), http.StatusNotFound)
+		return
+	}
+
+	user.ShowRealName = requestPayload.ShowRealName
+
+	err = app.DB.UpdateUser(*user)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	resp := JSONResponse{
+		Error:   false,
+		Message: "privacy updated",
+	}
+
+	app.writeJSON(w, http.StatusOK, resp)
+}
+
+// validateReply runs a reply through the content policy. Replies have no
+// moderation queue of their own, so anything the policy would hold is refused.
+func (app *application) validateReply(reply *models.Reply) error {
+	result := app.contentPolicy.Apply(reply.Body)
+	if result.Decision != contentfilter.Allow {
+		return fmt.Errorf("%w: %s", errCommentRejected, strings.Join(result.Reasons, ", "))
+	}
+
+	reply.Body = result.Text
+	switch {
+	case strings.TrimSpace(reply.Body) == "":
+		return errors.New("reply is required")
+	case utf8.RuneCountInString(reply.Body) > 255:
+		return errors.New("reply must be at most 255 characters")
+	}
+
+	return nil
+}
+
+func (app *application) commentReplies(w http.ResponseWriter, r *http.Request) {
+	commentID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	limit, offset, err := app.readPage(r)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	comment, err := app.DB.GetCommentByID(commentID)
+	if err != nil || comment.ModerationStatus != models.CommentVisible {
+		app.errorJSON(w, errors.New("comment not found"), http.StatusNotFound)
+		return
+	}
+
+	replies, err := app.DB.RepliesByCommentId(commentID, limit, offset)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	views, err := app.presentReplies(replies, comment.LessonId)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	app.writeJSON(w, http.StatusOK, views)
+}
+
+func (app *application) insertReply(w http.ResponseWriter, r *http.Request) {
+	commentID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	var reply models.Reply
+	err = app.readJSON(w, r, &reply)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	comment, err := app.DB.GetCommentByID(commentID)
+	if err != nil || comment.ModerationStatus != models.CommentVisible {
+		app.errorJSON(w, errors.New("comment not found"), http.StatusNotFound)
+		return
+	}
+
+	reply.CommentId = commentID
+	reply.UserId = app.authUserID(r)
+	reply.Depth = 0
+
+	if reply.ParentId != 0 {
+		parent, err := app.DB.GetReplyByID(reply.ParentId)
+		if err != nil || parent.CommentId != commentID {
+			app.errorJSON(w, errors.New("parent reply not found"), http.StatusNotFound)
+			return
+		}
+
+		if parent.Depth >= models.MaxReplyDepth {
+			app.errorJSON(w, fmt.Errorf("replies can be nested at most %d levels deep", models.MaxReplyDepth+1))
+			return
+		}
+
+		reply.Depth = parent.Depth + 1
+	}
+
+	err = app.validateReply(&reply)
+	if err != nil {
+		app.writeCommentError(w, err)
+		return
+	}
+
+	replyID, err := app.DB.InsertReply(reply)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	resp := JSONResponse{
+		Error:   false,
+		Message: "reply created",
+		Data:    map[string]int{"reply_id": replyID},
+	}
+
+	app.writeJSON(w, http.StatusCreated, resp)
+}
+
+func (app *application) updateReply(w http.ResponseWriter, r *http.Request) {
+	replyID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	reply, err := app.DB.GetReplyByID(replyID)
+	if err != nil {
+		app.errorJSON(w, errors.New("reply not found"), http.StatusNotFound)
+		return
+	}
+
+	if reply.UserId != app.authUserID(r) {
+		app.errorJSON(w, errors.New("you can only edit your own replies"), http.StatusForbidden)
+		return
+	}
+
+	var requestPayload struct {
+		Body string `json:"body"`
+	}
+
+	err = app.readJSON(w, r, &requestPayload)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	reply.Body = requestPayload.Body
+
+	err = app.validateReply(reply)
+	if err != nil {
+		app.writeCommentError(w, err)
+		return
+	}
+
+	err = app.DB.UpdateReply(*reply)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	resp := JSONResponse{
+		Error:   false,
+		Message: "reply updated",
+	}
+
+	app.writeJSON(w, http.StatusAccepted, resp)
+}
+
+func (app *application) deleteReply(w http.ResponseWriter, r *http.Request) {
+	replyID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	reply, err := app.DB.GetReplyByID(replyID)
+	if err != nil {
+		app.errorJSON(w, errors.New("reply not found"), http.StatusNotFound)
+		return
+	}
+
+	if reply.UserId != app.authUserID(r) {
+		app.errorJSON(w, errors.New("you can only delete your own replies"), http.StatusForbidden)
+		return
+	}
+
+	err = app.DB.DeleteReply(replyID)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	resp := JSONResponse{
+		Error:   false,
+		Message: "reply deleted",
+	}
+
+	app.writeJSON(w, http.StatusAccepted, resp)
+}
+
+// attachmentTypes are the kinds of file that can be shared on a lesson, as
+// sniffed by http.DetectContentType
+var attachmentTypes = map[string]bool{
+	"application/pdf":           true,
+	"image/jpeg":                true,
+	"image/png":                 true,
+	"image/webp":                true,
+	"text/plain; charset=utf-8": true,
+}
+
+func (app *application) lessonAttachments(w http.ResponseWriter, r *http.Request) {
+	lessonID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	_, err = app.DB.GetLessonByID(lessonID)
+	if err != nil {
+		app.errorJSON(w, errors.New("lesson not found"), http.StatusNotFound)
+		return
+	}
+
+	attachments, err := app.DB.AttachmentsByLessonId(lessonID)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	if attachments == nil {
+		attachments = []*models.Attachment{}
+	}
+
+	app.writeJSON(w, http.StatusOK, attachments)
+}
+
+func (app *application) uploadAttachment(w http.ResponseWriter, r *http.Request) {
+	lessonID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	// leave some room for the other form fields
+	r.Body = http.MaxBytesReader(w, r.Body, app.MaxUploadSize+1<<16)
+	err = r.ParseMultipartForm(1 << 20)
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			app.errorJSON(w, errors.New("file is too large"), http.StatusRequestEntityTooLarge)
+			return
+		}
+		app.errorJSON(w, err)
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		app.errorJSON(w, errors.New("file is required"))
+		return
+	}
+	defer file.Close()
+
+	if header.Size > app.MaxUploadSize {
+		app.errorJSON(w, errors.New("file is too large"), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	_, err = app.DB.GetLessonByID(lessonID)
+	if err != nil {
+		app.errorJSON(w, errors.New("lesson not found"), http.StatusNotFound)
+		return
+	}
+
+	attachment := models.Attachment{
+		LessonId:     lessonID,
+		UserId:       app.authUserID(r),
+		Term:         r.FormValue("Term"),
+		TestOrReport: r.FormValue("test_or_report"),
+		FileName:     filepath.Base(filepath.Clean("/" + header.Filename)),
+		Size:         header.Size,
+	}
+
+	attachment.Year, err = strconv.Atoi(r.FormValue("year"))
+	switch {
+	case err != nil || attachment.Year <= 0:
+		app.errorJSON(w, errors.New("year is required"))
+		return
+	case attachment.Term == "":
+		app.errorJSON(w, errors.New("term is required"))
+		return
+	case attachment.FileName == "/" || utf8.RuneCountInString(attachment.FileName) > 255:
+		app.errorJSON(w, errors.New("invalid file name"))
+		return
+	}
+
+	sniff := make([]byte, 512)
+	n, err := io.ReadFull(file, sniff)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		app.errorJSON(w, err)
+		return
+	}
+
+	attachment.ContentType = http.DetectContentType(sniff[:n])
+	if !attachmentTypes[attachment.ContentType] {
+		app.errorJSON(w, fmt.Errorf("files of type %s are not allowed", attachment.ContentType), http.StatusUnsupportedMediaType)
+		return
+	}
+
+	if app.scanner != nil {
+		_, err = file.Seek(0, io.SeekStart)
+		if err != nil {
+			app.errorJSON(w, err, http.StatusInternalServerError)
+			return
+		}
+
+		err = app.scanner.Scan(r.Context(), file)
+		if errors.Is(err, storage.ErrInfected) {
+			app.errorJSON(w, err, http.StatusUnprocessableEntity)
+			return
+		} else if err != nil {
+			app.errorJSON(w, err, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	_, err = file.Seek(0, io.SeekStart)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	random := make([]byte, 16)
+	_, err = rand.Read(random)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+	attachment.StorageKey = fmt.Sprintf("attachments/%d/%s", lessonID, hex.EncodeToString(random))
+
+	err = app.blobs.Put(r.Context(), attachment.StorageKey, file, attachment.Size, attachment.ContentType)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	attachmentID, err := app.DB.InsertAttachment(attachment)
+	if err != nil {
+		_ = app.blobs.Delete(r.Context(), attachment.StorageKey)
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	resp := JSONResponse{
+		Error:   false,
+		Message: "file uploaded",
+		Data:    map[string]int{"attachment_id": attachmentID},
+	}
+
+	app.writeJSON(w, http.StatusCreated, resp)
+}
+
+// attachmentURL hands out a download link that works without a token until
+// it expires, so it can be opened directly by the browser
+func (app *application) attachmentURL(w http.ResponseWriter, r *http.Request) {
+	attachmentID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	_, err = app.DB.GetAttachmentByID(attachmentID)
+	if err != nil {
+		app.errorJSON(w, errors.New("attachment not found"), http.StatusNotFound)
+		return
+	}
+
+	expires := time.Now().Add(app.DownloadURLTTL)
+	signature := app.urlSigner.Sign(fmt.Sprintf("attachments/%d", attachmentID), expires)
+
+	payload := struct {
+		URL       string    `json:"url"`
+		ExpiresAt time.Time `json:"expires_at"`
+	}{
+		URL:       fmt.Sprintf("/attachments/%d/download?expires=%d&signature=%s", attachmentID, expires.Unix(), signature),
+		ExpiresAt: expires,
+	}
+
+	app.writeJSON(w, http.StatusOK, payload)
+}
+
+func (app *application) downloadAttachment(w http.ResponseWriter, r *http.Request) {
+	attachmentID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	resource := fmt.Sprintf("attachments/%d", attachmentID)
+	if !app.urlSigner.Verify(resource, r.URL.Query().Get("expires"), r.URL.Query().Get("signature"), time.Now()) {
+		app.errorJSON(w, errors.New("download link is invalid or has expired"), http.StatusForbidden)
+		return
+	}
+
+	attachment, err := app.DB.GetAttachmentByID(attachmentID)
+	if err != nil {
+		app.errorJSON(w, errors.New("attachment not found"), http.StatusNotFound)
+		return
+	}
+
+	body, err := app.blobs.Get(r.Context(), attachment.StorageKey)
+	if errors.Is(err, storage.ErrNotFound) {
+		app.errorJSON(w, errors.New("attachment not found"), http.StatusNotFound)
+		return
+	} else if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+	defer body.Close()
+
+	w.Header().Set("Content-Type", attachment.ContentType)
+	w.Header().Set("Content-Length", strconv.FormatInt(attachment.Size, 10))
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": attachment.FileName}))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusOK)
+
+	_, err = io.Copy(w, body)
+	if err != nil {
+		log.Println("Error sending attachment", attachmentID, err)
+	}
+}
+
+func (app *application) deleteAttachment(w http.ResponseWriter, r *http.Request) {
+	attachmentID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	attachment, err := app.DB.GetAttachmentByID(attachmentID)
+	if err != nil {
+		app.errorJSON(w, errors.New("attachment not found"), http.StatusNotFound)
+		return
+	}
+
+	if attachment.UserId != app.authUserID(r) {
+		app.errorJSON(w, errors.New("you can only delete your own files"), http.StatusForbidden)
+		return
+	}
+
+	err = app.DB.DeleteAttachment(attachmentID)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	err = app.blobs.Delete(r.Context(), attachment.StorageKey)
+	if err != nil {
+		log.Println("Error deleting attachment file", attachment.StorageKey, err)
+	}
+
+	resp := JSONResponse{
+		Error:   false,
+		Message: "file deleted",
+	}
+
+	app.writeJSON(w, http.StatusAccepted, resp)
+}
+
+// avatarKey is the storage key of one thumbnail size of an avatar
+func avatarKey(dir string, size int) string {
+	return fmt.Sprintf("%s/%d.jpg", dir, size)
+}
+
+// updateAvatar checks an uploaded picture, keeps it aside and queues a job
+// that makes its thumbnails. The response carries the url the largest
+// thumbnail will be served from once the job has run; the user's Image only
+// points at it from then on.
+func (app *application) updateAvatar(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, app.MaxAvatarSize+1<<16)
+	err := r.ParseMultipartForm(1 << 20)
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			app.errorJSON(w, errors.New("image is too large"), http.StatusRequestEntityTooLarge)
+			return
+		}
+		app.errorJSON(w, err)
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	file, header, err := r.FormFile("avatar")
+	if err != nil {
+		app.errorJSON(w, errors.New("avatar is required"))
+		return
+	}
+	defer file.Close()
+
+	if header.Size > app.MaxAvatarSize {
+		app.errorJSON(w, errors.New("image is too large"), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	data, err := io.ReadAll(file)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	format, err := avatar.Check(data)
+	if errors.Is(err, avatar.ErrUnsupportedFormat) {
+		app.errorJSON(w, err, http.StatusUnsupportedMediaType)
+		return
+	} else if errors.Is(err, avatar.ErrTooLarge) {
+		app.errorJSON(w, err, http.StatusRequestEntityTooLarge)
+		return
+	} else if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	user, err := app.DB.GetUserByID(app.authUserID(r))
+	if err != nil {
+		app.errorJSON(w, errors.New("user not found"), http.StatusNotFound)
+		return
+	}
+
+	random := make([]byte, 16)
+	_, err = rand.Read(random)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+	payload := processAvatarPayload{
+		UserID: user.ID,
+		Dir:    fmt.Sprintf("avatars/%d/%s", user.ID, hex.EncodeToString(random)),
+	}
+	// originals live outside avatars/, so serveMedia never hands them out
+	payload.Original = "uploads/" + payload.Dir
+
+	err = app.blobs.Put(r.Context(), payload.Original, bytes.NewReader(data), int64(len(data)), "image/"+format)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	urls := make(map[int]string)
+	for _, size := range avatar.DefaultSizes {
+		urls[size] = app.MediaURL + "/" + avatarKey(payload.Dir, size)
+	}
+
+	// an upload still being processed is superseded by this one
+	err = app.DB.SetPendingImage(user.ID, urls[avatar.DefaultSizes[len(avatar.DefaultSizes)-1]])
+	if err != nil {
+		_ = app.blobs.Delete(r.Context(), payload.Original)
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	_, err = app.jobs.Enqueue(jobProcessAvatar, payload)
+	if err != nil {
+		_ = app.blobs.Delete(r.Context(), payload.Original)
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	resp := JSONResponse{
+		Error:   false,
+		Message: "avatar is being processed",
+		Data: map[string]interface{}{
+			"image":      urls[avatar.DefaultSizes[len(avatar.DefaultSizes)-1]],
+			"thumbnails": urls,
+		},
+	}
+
+	app.writeJSON(w, http.StatusAccepted, resp)
+}
+
+// processAvatarPayload names an uploaded original and the directory its
+// thumbnails are stored in
+type processAvatarPayload struct {
+	UserID   int    `json:"user_id"`
+	Dir      string `json:"dir"`
+	Original string `json:"original"`
+}
+
+// processAvatar makes the thumbnails of an uploaded avatar, points the user's
+// Image at the largest one and removes the original and the previous avatar.
+// Jobs can finish in any order, so an upload that a newer one replaced is
+// thrown away instead.
+func (app *application) processAvatar(ctx context.Context, payload processAvatarPayload) error {
+	body, err := app.blobs.Get(ctx, payload.Original)
+	if errors.Is(err, storage.ErrNotFound) {
+		return jobs.Permanent(fmt.Errorf("avatar %s is gone", payload.Original))
+	} else if err != nil {
+		return err
+	}
+	data, err := io.ReadAll(body)
+	body.Close()
+	if err != nil {
+		return err
+	}
+
+	thumbnails, err := avatar.Process(data, avatar.DefaultSizes)
+	if errors.Is(err, avatar.ErrUnsupportedFormat) || errors.Is(err, avatar.ErrTooLarge) {
+		app.deleteBlob(ctx, payload.Original)
+		return jobs.Permanent(err)
+	} else if err != nil {
+		return err
+	}
+
+	for _, thumbnail := range thumbnails {
+		err = app.blobs.Put(ctx, avatarKey(payload.Dir, thumbnail.Size), bytes.NewReader(thumbnail.Data), int64(len(thumbnail.Data)), "image/jpeg")
+		if err != nil {
+			app.deleteAvatar(ctx, payload.Dir)
+			return err
+		}
+	}
+
+	image := app.MediaURL + "/" + avatarKey(payload.Dir, thumbnails[len(thumbnails)-1].Size)
+
+	oldImage, err := app.DB.ApplyPendingImage(payload.UserID, image)
+	if errors.Is(err, sql.ErrNoRows) {
+		return app.discardAvatar(ctx, payload, image)
+	} else if err != nil {
+		return err
+	}
+
+	// the previous avatar is only removed when it was one of ours
+	oldPrefix := fmt.Sprintf("%s/avatars/%d/", app.MediaURL, payload.UserID)
+	oldDir := path.Dir(strings.TrimPrefix(oldImage, app.MediaURL+"/"))
+	if strings.HasPrefix(oldImage, oldPrefix) && oldDir != payload.Dir {
+		app.deleteAvatar(ctx, oldDir)
+	}
+	app.deleteBlob(ctx, payload.Original)
+
+	return nil
+}
+
+// discardAvatar cleans up after an upload that is no longer pending: a newer
+// upload took its place, its user is gone, or a retry of this job already
+// applied it
+func (app *application) discardAvatar(ctx context.Context, payload processAvatarPayload, image string) error {
+	user, err := app.DB.GetUserByID(payload.UserID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+
+	app.deleteBlob(ctx, payload.Original)
+	if user != nil && user.Image == image {
+		return nil
+	}
+	app.deleteAvatar(ctx, payload.Dir)
+
+	if user == nil {
+		return jobs.Permanent(fmt.Errorf("user %d not found", payload.UserID))
+	}
+
+	log.Println("Skipping avatar", payload.Dir, "replaced by a newer upload")
+
+	return nil
+}
+
+func (app *application) deleteAvatar(ctx context.Context, dir string) {
+	for _, size := range avatar.DefaultSizes {
+		app.deleteBlob(ctx, avatarKey(dir, size))
+	}
+}
+
+func (app *application) deleteBlob(ctx context.Context, key string) {
+	err := app.blobs.Delete(ctx, key)
+	if err != nil {
+		log.Println("Error deleting", key, err)
+	}
+}
+
+// serveMedia serves public files such as avatars straight from blob storage.
+// Attachments are never served here; they need a signed link.
+func (app *application) serveMedia(w http.ResponseWriter, r *http.Request) {
+	key := chi.URLParam(r, "*")
+	if !strings.HasPrefix(key, "avatars/") {
+		app.errorJSON(w, errors.New("not found"), http.StatusNotFound)
+		return
+	}
+
+	body, err := app.blobs.Get(r.Context(), key)
+	if err != nil {
+		app.errorJSON(w, errors.New("not found"), http.StatusNotFound)
+		return
+	}
+	defer body.Close()
+
+	w.Header().Set("Content-Type", "image/jpeg")
+	// avatar keys are random and never reused, so they can be cached forever
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusOK)
+
+	_, err = io.Copy(w, body)
+	if err != nil {
+		log.Println("Error sending media", key, err)
+	}
+}
+
+func (app *application) getMe(w http.ResponseWriter, r *http.Request) {
+	user, err := app.DB.GetUserByID(app.authUserID(r))
+	if err != nil {
+		app.errorJSON(w, errors.New("user not found"), http.StatusNotFound)
+		return
+	}
+
+	app.writeJSON(w, http.StatusOK, user)
+}
+
+// validImage accepts an empty image, one of our own uploaded avatars or an
+// https url
+func (app *application) validImage(image string) bool {
+	if image == "" || strings.HasPrefix(image, app.MediaURL+"/avatars/") {
+		return len(image) <= 255
+	}
+
+	u, err := url.Parse(image)
+
+	return err == nil && u.Scheme == "https" && u.Host != "" && len(image) <= 255
+}
+
+// updateMe changes only the fields present in the request body
+func (app *application) updateMe(w http.ResponseWriter, r *http.Request) {
+	var requestPayload struct {
+		FirstName    *string `json:"first_name"`
+		LastName     *string `json:"last_name"`
+		Image        *string `json:"image"`
+		ShowRealName *bool   `json:"show_real_name"`
+	}
+
+	err := app.readJSON(w, r, &requestPayload)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	user, err := app.DB.GetUserByID(app.authUserID(r))
+	if err != nil {
+		app.errorJSON(w, errors.New("user not found"), http.StatusNotFound)
+		return
+	}
+
+	if requestPayload.FirstName != nil {
+		user.FirstName = strings.TrimSpace(*requestPayload.FirstName)
+	}
+	if requestPayload.LastName != nil {
+		user.LastName = strings.TrimSpace(*requestPayload.LastName)
+	}
+	if requestPayload.Image != nil {
+		user.Image = *requestPayload.Image
+	}
+	if requestPayload.ShowRealName != nil {
+		user.ShowRealName = *requestPayload.ShowRealName
+	}
+
+	switch {
+	case user.FirstName == "" || user.LastName == "":
+		app.errorJSON(w, errors.New("first and last name are required"))
+		return
+	case utf8.RuneCountInString(user.FirstName) > 255 || utf8.RuneCountInString(user.LastName) > 255:
+		app.errorJSON(w, errors.New("names must be at most 255 characters"))
+		return
+	case !app.validImage(user.Image):
+		app.errorJSON(w, errors.New("image must be an uploaded avatar or an https url"))
+		return
+	}
+
+	err = app.DB.UpdateUser(*user)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	resp := JSONResponse{
+		Error:   false,
+		Message: "profile updated",
+		Data:    user,
+	}
+
+	app.writeJSON(w, http.StatusOK, resp)
+}
+
+func (app *application) myReviews(w http.ResponseWriter, r *http.Request) {
+	comments, err := app.DB.AllCommentsByUserId(app.authUserID(r))
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	views, err := app.presentComments(comments, true)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	app.writeJSON(w, http.StatusOK, views)
+}
+
+func (app *application) getUser(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	user, err := app.DB.GetUserByID(userID)
+	if err != nil {
+		app.errorJSON(w, errors.New("user not found"), http.StatusNotFound)
+		return
+	}
+
+	app.writeJSON(w, http.StatusOK, presentPublicUser(user))
+}
+
+// userReviews lists a user's published reviews. Reviews of users who have not
+// chosen to show their real name stay unlinked from their account.
+func (app *application) userReviews(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	user, err := app.DB.GetUserByID(userID)
+	if err != nil {
+		app.errorJSON(w, errors.New("user not found"), http.StatusNotFound)
+		return
+	}
+
+	if !user.ShowRealName {
+		app.errorJSON(w, errors.New("this user's reviews are private"), http.StatusForbidden)
+		return
+	}
+
+	comments, err := app.DB.AllCommentsByUserId(userID)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	var visible []*models.Comment
+	for _, comment := range comments {
+		if comment.ModerationStatus == models.CommentVisible {
+			visible = append(visible, comment)
+		}
+	}
+
+	views, err := app.presentComments(visible, false)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	app.writeJSON(w, http.StatusOK, views)
+}
+
+func (app *application) userLessons(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	how := 0
+	if r.URL.Query().Get("how") != "" {
+		how, err = strconv.Atoi(r.URL.Query().Get("how"))
+		if err != nil {
+			app.errorJSON(w, err)
+			return
+		}
+	}
+
+	_, err = app.DB.GetUserByID(userID)
+	if err != nil {
+		app.errorJSON(w, errors.New("user not found"), http.StatusNotFound)
+		return
+	}
+
+	lessons, err := app.DB.AllLessonsByUser(userID, how)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	views, err := app.presentLessons(lessons, app.authUserID(r))
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	app.writeJSON(w, http.StatusOK, views)
+}
+
+// emailChangeExpiry is how long a confirmation link for a new address is valid
+const emailChangeExpiry = time.Hour * 24
+
+// issueTokens logs the current client back in after its other sessions were
+// revoked, so the user who made the change stays signed in
+func (app *application) issueTokens(w http.ResponseWriter, user *models.User, sessionVersion int) (TokenPairs, error) {
+	u := jwtUser{
+		ID:             user.ID,
+		FirstName:      user.FirstName,
+		LastName:       user.LastName,
+		SessionVersion: sessionVersion,
+	}
+
+	tokens, err := app.auth.GenerateTokenPair(&u)
+	if err != nil {
+		return TokenPairs{}, err
+	}
+
+	http.SetCookie(w, app.auth.GetRefreshCookie(tokens.RefreshToken))
+
+	return tokens, nil
+}
+
+// checkPassword answers with 403 and returns false unless password is the
+// user's current password
+func (app *application) checkPassword(w http.ResponseWriter, user *models.User, password string) bool {
+	valid, err := user.PasswordMatches(password)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return false
+	}
+
+	if !valid {
+		app.errorJSON(w, errors.New("current password is incorrect"), http.StatusForbidden)
+		return false
+	}
+
+	return true
+}
+
+func (app *application) changePassword(w http.ResponseWriter, r *http.Request) {
+	var requestPayload struct {
+		CurrentPassword string `json:"current_password"`
+		NewPassword     string `json:"new_password"`
+	}
+
+	err := app.readJSON(w, r, &requestPayload)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	if len(requestPayload.NewPassword) < 8 || len(requestPayload.NewPassword) > 72 {
+		app.errorJSON(w, errors.New("new password must be between 8 and 72 characters"))
+		return
+	}
+
+	user, err := app.DB.GetUserByID(app.authUserID(r))
+	if err != nil {
+		app.errorJSON(w, errors.New("user not found"), http.StatusNotFound)
+		return
+	}
+
+	if !app.checkPassword(w, user, requestPayload.CurrentPassword) {
+		return
+	}
+
+	version, err := app.DB.ChangePassword(user.ID, requestPayload.NewPassword)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	tokens, err := app.issueTokens(w, user, version)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	resp := JSONResponse{
+		Error:   false,
+		Message: "password changed",
+		Data:    tokens,
+	}
+
+	app.writeJSON(w, http.StatusOK, resp)
+}
+
+// requestEmailChange sends a confirmation link to the new address. The
+// account keeps its old address until the link is followed.
+func (app *application) requestEmailChange(w http.ResponseWriter, r *http.Request) {
+	var requestPayload struct {
+		NewEmail string `json:"new_email"`
+		Password string `json:"password"`
+	}
+
+	err := app.readJSON(w, r, &requestPayload)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	address, err := mail.ParseAddress(requestPayload.NewEmail)
+	if err != nil || address.Address != requestPayload.NewEmail || len(address.Address) > 255 {
+		app.errorJSON(w, errors.New("invalid email address"))
+		return
+	}
+
+	user, err := app.DB.GetUserByID(app.authUserID(r))
+	if err != nil {
+		app.errorJSON(w, errors.New("user not found"), http.StatusNotFound)
+		return
+	}
+
+	if !app.checkPassword(w, user, requestPayload.Password) {
+		return
+	}
+
+	if strings.EqualFold(user.Email, address.Address) {
+		app.errorJSON(w, errors.New("this is already your email address"))
+		return
+	}
+
+	_, err = app.DB.GetUserByEmail(address.Address)
+	if err == nil {
+		app.errorJSON(w, repository.ErrEmailTaken, http.StatusConflict)
+		return
+	}
+
+	random := make([]byte, 32)
+	_, err = rand.Read(random)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+	token := hex.EncodeToString(random)
+	hash := sha256.Sum256([]byte(token))
+
+	err = app.DB.InsertEmailChange(models.EmailChange{
+		UserId:    user.ID,
+		NewEmail:  address.Address,
+		TokenHash: hex.EncodeToString(hash[:]),
+		ExpiresAt: time.Now().Add(emailChangeExpiry),
+	})
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	link := fmt.Sprintf("%s/settings/email/confirm?token=%s", app.Domain, token)
+	err = app.mailer.Send(r.Context(), mailer.Message{
+		To:      address.Address,
+		Subject: "メールアドレス変更の確認 / Confirm your new email address",
+		Text: fmt.Sprintf("メールアドレスを変更するには、24時間以内に次のリンクを開いてください。\n%s\n\n"+
+			"To change your email address, open the link above within 24 hours.\n"+
+			"If you did not ask for this, you can ignore this email.\n", link),
+	})
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	resp := JSONResponse{
+		Error:   false,
+		Message: "confirmation sent to the new address",
+	}
+
+	app.writeJSON(w, http.StatusAccepted, resp)
+}
+
+func (app *application) confirmEmailChange(w http.ResponseWriter, r *http.Request) {
+	var requestPayload struct {
+		Token string `json:"token"`
+	}
+
+	err := app.readJSON(w, r, &requestPayload)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	user, err := app.DB.GetUserByID(app.authUserID(r))
+	if err != nil {
+		app.errorJSON(w, errors.New("user not found"), http.StatusNotFound)
+		return
+	}
+
+	hash := sha256.Sum256([]byte(requestPayload.Token))
+	version, err := app.DB.ConfirmEmailChange(user.ID, hex.EncodeToString(hash[:]))
+	if errors.Is(err, sql.ErrNoRows) {
+		app.errorJSON(w, errors.New("confirmation link is invalid or has expired"), http.StatusNotFound)
+		return
+	} else if errors.Is(err, repository.ErrEmailTaken) {
+		app.errorJSON(w, err, http.StatusConflict)
+		return
+	} else if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	tokens, err := app.issueTokens(w, user, version)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	resp := JSONResponse{
+		Error:   false,
+		Message: "email changed",
+		Data:    tokens,
+	}
+
+	app.writeJSON(w, http.StatusOK, resp)
+}
+
+// userExport is everything stored about a user, as handed out by GET /me/export
+type userExport struct {
+	ExportedAt  time.Time                 `json:"exported_at"`
+	Profile     *models.User              `json:"profile"`
+	Reviews     []*models.Comment         `json:"reviews"`
+	Replies     []*models.Reply           `json:"replies"`
+	Votes       []*models.Vote            `json:"votes"`
+	Attachments []*models.Attachment      `json:"attachments"`
+	Favorites   []*models.Lesson          `json:"favorites"`
+	Timetables  []*models.TimetableEntry  `json:"timetables"`
+	Follows     *models.Follows           `json:"follows"`
+	Digest      *models.DigestPreferences `json:"digest"`
+}
+
+// exportMe sends the user's data as JSON, or with ?format=zip as an archive
+// that also holds their uploaded files
+func (app *application) exportMe(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	if format != "" && format != "json" && format != "zip" {
+		app.errorJSON(w, errors.New("format must be json or zip"))
+		return
+	}
+
+	user, err := app.DB.GetUserByID(app.authUserID(r))
+	if err != nil {
+		app.errorJSON(w, errors.New("user not found"), http.StatusNotFound)
+		return
+	}
+
+	export := userExport{ExportedAt: time.Now(), Profile: user}
+
+	export.Reviews, err = app.DB.AllCommentsByUserId(user.ID)
+	if err == nil {
+		export.Replies, err = app.DB.RepliesByUserId(user.ID)
+	}
+	if err == nil {
+		export.Votes, err = app.DB.VotesByUserId(user.ID)
+	}
+	if err == nil {
+		export.Attachments, err = app.DB.AttachmentsByUserId(user.ID)
+	}
+	if err == nil {
+		export.Favorites, err = app.DB.FavoriteLessons(user.ID)
+	}
+	if err == nil {
+		export.Timetables, err = app.DB.TimetablesByUserId(user.ID)
+	}
+	if err == nil {
+		export.Follows, err = app.DB.FollowsByUserId(user.ID)
+	}
+	if err == nil {
+		export.Digest, err = app.DB.GetDigestPreferences(user.ID)
+	}
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	if format != "zip" {
+		w.Header().Set("Content-Disposition", `attachment; filename="kstation-export.json"`)
+		app.writeJSON(w, http.StatusOK, export)
+		return
+	}
+
+	var buf bytes.Buffer
+	archive := zip.NewWriter(&buf)
+
+	data, err := archive.Create("data.json")
+	if err == nil {
+		encoder := json.NewEncoder(data)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(export)
+	}
+
+	for _, attachment := range export.Attachments {
+		if err != nil {
+			break
+		}
+		err = app.copyBlob(r, archive, fmt.Sprintf("attachments/%d-%s", attachment.ID, attachment.FileName), attachment.StorageKey)
+	}
+
+	if err == nil && strings.HasPrefix(user.Image, app.MediaURL+"/avatars/") {
+		err = app.copyBlob(r, archive, "avatar.jpg", strings.TrimPrefix(user.Image, app.MediaURL+"/"))
+	}
+
+	if err == nil {
+		err = archive.Close()
+	}
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="kstation-export.zip"`)
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	w.WriteHeader(http.StatusOK)
+	_, _ = buf.WriteTo(w)
+}
+
+// copyBlob adds a stored file to a zip archive. Files that have gone missing
+// from storage are skipped.
+func (app *application) copyBlob(r *http.Request, archive *zip.Writer, name, key string) error {
+	body, err := app.blobs.Get(r.Context(), key)
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	f, err := archive.Create(name)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(f, body)
+
+	return err
+}
+
+// deleteMe closes the account of the current user. With the anonymize policy
+// their reviews stay up under "deleted user"; with cascade they are removed
+// and the lessons they reviewed are recalculated.
+func (app *application) deleteMe(w http.ResponseWriter, r *http.Request) {
+	var requestPayload struct {
+		Password string `json:"password"`
+	}
+
+	err := app.readJSON(w, r, &requestPayload)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	user, err := app.DB.GetUserByID(app.authUserID(r))
+	if err != nil {
+		app.errorJSON(w, errors.New("user not found"), http.StatusNotFound)
+		return
+	}
+
+	if !app.checkPassword(w, user, requestPayload.Password) {
+		return
+	}
+
+	cascade := app.AccountDeletion == accountDeletionCascade
+
+	var attachments []*models.Attachment
+	if cascade {
+		attachments, err = app.DB.AttachmentsByUserId(user.ID)
+		if err != nil {
+			app.errorJSON(w, err, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	lessonIDs, err := app.DB.DeleteAccount(user.ID, cascade)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	for _, lessonID := range lessonIDs {
+		err = app.DB.UpdateLessonAggregates(lessonID)
+		if err != nil {
+			app.errorJSON(w, err, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	for _, attachment := range attachments {
+		err = app.blobs.Delete(r.Context(), attachment.StorageKey)
+		if err != nil {
+			log.Println("Error deleting attachment file", attachment.StorageKey, err)
+		}
+	}
+
+	if strings.HasPrefix(user.Image, fmt.Sprintf("%s/avatars/%d/", app.MediaURL, user.ID)) {
+		app.deleteAvatar(r.Context(), path.Dir(strings.TrimPrefix(user.Image, app.MediaURL+"/")))
+	}
+
+	http.SetCookie(w, app.auth.GetExpiredRefreshCookie())
+
+	resp := JSONResponse{
+		Error:   false,
+		Message: "account deleted",
+	}
+
+	app.writeJSON(w, http.StatusAccepted, resp)
+}
+
+// allLessons lists every lesson; how selects the order the same way as for a
+// user's lessons, with 4 sorting the most favorited first
+func (app *application) allLessons(w http.ResponseWriter, r *http.Request) {
+	how := 0
+	if r.URL.Query().Get("how") != "" {
+		var err error
+		how, err = strconv.Atoi(r.URL.Query().Get("how"))
+		if err != nil {
+			app.errorJSON(w, err)
+			return
+		}
+	}
+
+	lessons, err := app.DB.AllLessons(how)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	views, err := app.presentLessons(lessons, app.authUserID(r))
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	app.writeJSON(w, http.StatusOK, views)
+}
+
+func (app *application) getLesson(w http.ResponseWriter, r *http.Request) {
+	lessonID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	lesson, err := app.DB.GetLessonByID(lessonID)
+	if err != nil {
+		app.errorJSON(w, errors.New("lesson not found"), http.StatusNotFound)
+		return
+	}
+
+	views, err := app.presentLessons([]*models.Lesson{lesson}, app.authUserID(r))
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	app.writeJSON(w, http.StatusOK, views[0])
+}
+
+func (app *application) addFavorite(w http.ResponseWriter, r *http.Request) {
+	lessonID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	err = app.DB.AddFavorite(app.authUserID(r), lessonID)
+	if errors.Is(err, sql.ErrNoRows) {
+		app.errorJSON(w, errors.New("lesson not found"), http.StatusNotFound)
+		return
+	} else if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	resp := JSONResponse{
+		Error:   false,
+		Message: "lesson added to favorites",
+	}
+
+	app.writeJSON(w, http.StatusOK, resp)
+}
+
+func (app *application) removeFavorite(w http.ResponseWriter, r *http.Request) {
+	lessonID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	err = app.DB.RemoveFavorite(app.authUserID(r), lessonID)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	resp := JSONResponse{
+		Error:   false,
+		Message: "lesson removed from favorites",
+	}
+
+	app.writeJSON(w, http.StatusOK, resp)
+}
+
+func (app *application) myFavorites(w http.ResponseWriter, r *http.Request) {
+	lessons, err := app.DB.FavoriteLessons(app.authUserID(r))
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	views, err := app.presentLessons(lessons, app.authUserID(r))
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	app.writeJSON(w, http.StatusOK, views)
+}
+
+// limits of a weekly class period: days run Monday (1) to Sunday (7)
+const (
+	maxDay    = 7
+	maxPeriod = 10
+)
+
+func (app *application) validateOffering(offering *models.Offering) error {
+	switch {
+	case offering.Year <= 0:
+		return errors.New("year is required")
+	case offering.Term == "":
+		return errors.New("term is required")
+	case offering.Credits < 0:
+		return errors.New("credits must not be negative")
+	}
+
+	seen := make(map[models.Slot]bool)
+	for _, slot := range offering.Slots {
+		if slot.Day < 1 || slot.Day > maxDay || slot.Period < 1 || slot.Period > maxPeriod {
+			return fmt.Errorf("day must be between 1 and %d and period between 1 and %d", maxDay, maxPeriod)
+		}
+		if seen[slot] {
+			return errors.New("slots must not repeat")
+		}
+		seen[slot] = true
+	}
+
+	return nil
+}
+
+func (app *application) lessonOfferings(w http.ResponseWriter, r *http.Request) {
+	lessonID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	_, err = app.DB.GetLessonByID(lessonID)
+	if err != nil {
+		app.errorJSON(w, errors.New("lesson not found"), http.StatusNotFound)
+		return
+	}
+
+	offerings, err := app.DB.OfferingsByLessonId(lessonID)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	if offerings == nil {
+		offerings = []*models.Offering{}
+	}
+
+	app.writeJSON(w, http.StatusOK, offerings)
+}
+
+// upsertOffering sets the credits and weekly periods of a lesson for a year
+// and term
+func (app *application) upsertOffering(w http.ResponseWriter, r *http.Request) {
+	lessonID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	var offering models.Offering
+	err = app.readJSON(w, r, &offering)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+	offering.ID = 0
+	offering.LessonId = lessonID
+
+	err = app.validateOffering(&offering)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	lesson, err := app.DB.GetLessonByID(lessonID)
+	if err != nil {
+		app.errorJSON(w, errors.New("lesson not found"), http.StatusNotFound)
+		return
+	}
+
+	existing, err := app.DB.OfferingsByLessonId(lessonID)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	created := true
+	for _, o := range existing {
+		if o.Year == offering.Year && o.Term == offering.Term {
+			created = false
+		}
+	}
+
+	offeringID, err := app.DB.UpsertOffering(offering)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	if created {
+		app.publishFollowEvent(models.FollowEvent{
+			Kind:       models.NotificationNewClass,
+			LessonId:   lessonID,
+			OfferingId: offeringID,
+			ActorId:    app.authUserID(r),
+		})
+
+		saved, err := app.DB.GetOfferingByID(offeringID)
+		if err != nil {
+			log.Println("Error loading offering", offeringID, "for webhooks", err)
+		} else {
+			app.publishWebhookEvent(models.WebhookLessonOffered, lessonID, map[string]interface{}{
+				"lesson":   lesson,
+				"offering": saved,
+			})
+		}
+	}
+
+	resp := JSONResponse{
+		Error:   false,
+		Message: "offering saved",
+		Data:    map[string]int{"offering_id": offeringID},
+	}
+
+	app.writeJSON(w, http.StatusOK, resp)
+}
+
+func (app *application) deleteOffering(w http.ResponseWriter, r *http.Request) {
+	offeringID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	err = app.DB.DeleteOffering(offeringID)
+	if errors.Is(err, sql.ErrNoRows) {
+		app.errorJSON(w, errors.New("offering not found"), http.StatusNotFound)
+		return
+	} else if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	resp := JSONResponse{
+		Error:   false,
+		Message: "offering deleted",
+	}
+
+	app.writeJSON(w, http.StatusAccepted, resp)
+}
+
+// getTimetable shows the user's timetable for ?year=&term= with a summary of
+// its credits, clashes and ratings
+func (app *application) getTimetable(w http.ResponseWriter, r *http.Request) {
+	year, err := strconv.Atoi(r.URL.Query().Get("year"))
+	if err != nil || year <= 0 {
+		app.errorJSON(w, errors.New("year is required"))
+		return
+	}
+
+	term := r.URL.Query().Get("term")
+	if term == "" {
+		app.errorJSON(w, errors.New("term is required"))
+		return
+	}
+
+	entries, err := app.DB.Timetable(app.authUserID(r), year, term)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	app.writeJSON(w, http.StatusOK, app.presentTimetable(entries, year, term))
+}
+
+// addTimetableEntry puts an offering in the timetable of its year and term.
+// Offerings that clash with a period already taken are refused with 409, and
+// ones that would go over the credit limit with 422.
+var (
+	errTimetableClash  = errors.New("lesson clashes with your timetable")
+	errOverCreditLimit = errors.New("lesson is over the credit limit")
+)
+
+func (app *application) addTimetableEntry(w http.ResponseWriter, r *http.Request) {
+	var requestPayload struct {
+		OfferingId int `json:"offering_id"`
+	}
+
+	err := app.readJSON(w, r, &requestPayload)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	offering, err := app.DB.GetOfferingByID(requestPayload.OfferingId)
+	if err != nil {
+		app.errorJSON(w, errors.New("offering not found"), http.StatusNotFound)
+		return
+	}
+
+	// the checks run inside the repo's transaction, against entries no other
+	// request can change until this one is added
+	var conflicts []timetable.Conflict
+	var credits int
+	status := http.StatusCreated
+	userID := app.authUserID(r)
+	err = app.DB.AddTimetableEntry(userID, offering, func(entries []*models.TimetableEntry) error {
+		for _, entry := range entries {
+			if entry.Offering.ID == offering.ID {
+				status = http.StatusOK
+				return nil
+			}
+		}
+
+		conflicts = timetable.Conflicts(entries, offering)
+		if len(conflicts) > 0 {
+			return errTimetableClash
+		}
+
+		credits = timetable.Credits(entries) + offering.Credits
+		if app.CreditLimit > 0 && credits > app.CreditLimit {
+			return errOverCreditLimit
+		}
+
+		return nil
+	})
+	if errors.Is(err, errTimetableClash) {
+		resp := JSONResponse{
+			Error:   true,
+			Message: "lesson clashes with your timetable",
+			Data:    conflicts,
+		}
+		app.writeJSON(w, http.StatusConflict, resp)
+		return
+	} else if errors.Is(err, errOverCreditLimit) {
+		app.errorJSON(w, fmt.Errorf("lesson would bring the term to %d credits, over the limit of %d", credits, app.CreditLimit), http.StatusUnprocessableEntity)
+		return
+	} else if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	entries, err := app.DB.Timetable(userID, offering.Year, offering.Term)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	app.writeJSON(w, status, app.presentTimetable(entries, offering.Year, offering.Term))
+}
+
+func (app *application) removeTimetableEntry(w http.ResponseWriter, r *http.Request) {
+	offeringID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	err = app.DB.RemoveTimetableEntry(app.authUserID(r), offeringID)
+	if errors.Is(err, sql.ErrNoRows) {
+		app.errorJSON(w, errors.New("lesson is not in your timetable"), http.StatusNotFound)
+		return
+	} else if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	resp := JSONResponse{
+		Error:   false,
+		Message: "lesson removed from timetable",
+	}
+
+	app.writeJSON(w, http.StatusOK, resp)
+}
+
+// academicTerms lists the first and last day of every term with known dates
+func (app *application) academicTerms(w http.ResponseWriter, r *http.Request) {
+	terms, err := app.DB.AcademicTerms()
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	if terms == nil {
+		terms = []*models.AcademicTerm{}
+	}
+
+	app.writeJSON(w, http.StatusOK, terms)
+}
+
+// upsertAcademicTerm sets when a term starts and ends; days are written as
+// YYYY-MM-DD
+func (app *application) upsertAcademicTerm(w http.ResponseWriter, r *http.Request) {
+	var requestPayload struct {
+		Year     int    `json:"year"`
+		Term     string `json:"term"`
+		StartsOn string `json:"starts_on"`
+		EndsOn   string `json:"ends_on"`
+	}
+
+	err := app.readJSON(w, r, &requestPayload)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	if requestPayload.Year <= 0 || requestPayload.Term == "" {
+		app.errorJSON(w, errors.New("year and term are required"))
+		return
+	}
+
+	startsOn, err := time.Parse("2006-01-02", requestPayload.StartsOn)
+	if err != nil {
+		app.errorJSON(w, errors.New("starts_on must be a date like 2024-04-10"))
+		return
+	}
+
+	endsOn, err := time.Parse("2006-01-02", requestPayload.EndsOn)
+	if err != nil {
+		app.errorJSON(w, errors.New("ends_on must be a date like 2024-08-09"))
+		return
+	}
+
+	if endsOn.Before(startsOn) {
+		app.errorJSON(w, errors.New("a term cannot end before it starts"))
+		return
+	}
+
+	err = app.DB.UpsertAcademicTerm(models.AcademicTerm{
+		Year:     requestPayload.Year,
+		Term:     requestPayload.Term,
+		StartsOn: startsOn,
+		EndsOn:   endsOn,
+	})
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	resp := JSONResponse{
+		Error:   false,
+		Message: "term dates saved",
+	}
+
+	app.writeJSON(w, http.StatusOK, resp)
+}
+
+// writeTimetableCalendar answers with every term of the user's timetable as
+// an iCalendar file
+func (app *application) writeTimetableCalendar(w http.ResponseWriter, userID int, disposition string) {
+	entries, err := app.DB.TimetablesByUserId(userID)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	terms, err := app.DB.AcademicTerms()
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	calendar := timetable.Calendar(userID, entries, timetable.CalendarOptions{
+		Terms:    terms,
+		Periods:  app.periods,
+		Location: app.location,
+		Now:      time.Now(),
+	})
+
+	var buf bytes.Buffer
+	err = calendar.Write(&buf)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	w.Header().Set("Content-Disposition", disposition+`; filename="timetable.ics"`)
+	w.Header().Set("Cache-Control", "private, no-cache")
+	w.WriteHeader(http.StatusOK)
+	_, _ = buf.WriteTo(w)
+}
+
+func (app *application) timetableCalendar(w http.ResponseWriter, r *http.Request) {
+	app.writeTimetableCalendar(w, app.authUserID(r), "attachment")
+}
+
+// subscribeTimetable creates the secret address calendar apps can poll for
+// the user's timetable. Asking again replaces the address, so an address that
+// leaked stops working.
+func (app *application) subscribeTimetable(w http.ResponseWriter, r *http.Request) {
+	random := make([]byte, 32)
+	_, err := rand.Read(random)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+	token := hex.EncodeToString(random)
+	hash := sha256.Sum256([]byte(token))
+
+	err = app.DB.SetCalendarToken(app.authUserID(r), hex.EncodeToString(hash[:]))
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	resp := JSONResponse{
+		Error:   false,
+		Message: "calendar subscription created",
+		Data:    map[string]string{"url": fmt.Sprintf("%s/calendar/%s.ics", app.APIURL, token)},
+	}
+
+	app.writeJSON(w, http.StatusCreated, resp)
+}
+
+// subscribedTimetable serves a timetable to calendar apps, which cannot send
+// a bearer token; the secret in the address stands in for it
+func (app *application) subscribedTimetable(w http.ResponseWriter, r *http.Request) {
+	hash := sha256.Sum256([]byte(chi.URLParam(r, "token")))
+	userID, err := app.DB.GetUserIDByCalendarToken(hex.EncodeToString(hash[:]))
+	if err != nil {
+		app.errorJSON(w, errors.New("calendar not found"), http.StatusNotFound)
+		return
+	}
+
+	app.writeTimetableCalendar(w, userID, "inline")
+}
+
+// myRecommendations lists lessons the user may like, best first. They are
+// computed in the background, so new reviews take effect at the next refresh.
+func (app *application) myRecommendations(w http.ResponseWriter, r *http.Request) {
+	limit, offset, err := app.readPage(r)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	recommendations, err := app.DB.RecommendationsByUserId(app.authUserID(r), limit, offset)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	if recommendations == nil {
+		recommendations = []*models.Recommendation{}
+	}
+
+	app.writeJSON(w, http.StatusOK, recommendations)
+}
+
+// lessonRankings shows a leaderboard, ?sort=top (default) by Bayesian average
+// star or ?sort=trending by recent activity, optionally limited to a
+// ?department= and, for top only, to one ?year=&term=
+func (app *application) lessonRankings(w http.ResponseWriter, r *http.Request) {
+	limit, offset, err := app.readPage(r)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	query := r.URL.Query()
+	filter := models.RankingFilter{
+		Sort:       query.Get("sort"),
+		Department: query.Get("department"),
+		Term:       query.Get("term"),
+		Limit:      limit,
+		Offset:     offset,
+	}
+
+	if filter.Sort == "" {
+		filter.Sort = models.RankingTop
+	}
+	if filter.Sort != models.RankingTop && filter.Sort != models.RankingTrending {
+		app.errorJSON(w, errors.New("sort must be top or trending"))
+		return
+	}
+
+	if query.Get("year") != "" {
+		filter.Year, err = strconv.Atoi(query.Get("year"))
+		if err != nil || filter.Year <= 0 {
+			app.errorJSON(w, errors.New("invalid year"))
+			return
+		}
+	}
+	if (filter.Year == 0) != (filter.Term == "") {
+		app.errorJSON(w, errors.New("year and term must be given together"))
+		return
+	}
+	if filter.Sort == models.RankingTrending && filter.Year != 0 {
+		app.errorJSON(w, errors.New("trending rankings are not kept per term"))
+		return
+	}
+
+	rankings, err := app.DB.LessonRankings(filter)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	if rankings == nil {
+		rankings = []*models.LessonRanking{}
+	}
+
+	app.writeJSON(w, http.StatusOK, rankings)
+}
+
+func (app *application) followLesson(w http.ResponseWriter, r *http.Request) {
+	lessonID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	err = app.DB.FollowLesson(app.authUserID(r), lessonID)
+	if errors.Is(err, sql.ErrNoRows) {
+		app.errorJSON(w, errors.New("lesson not found"), http.StatusNotFound)
+		return
+	} else if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	resp := JSONResponse{
+		Error:   false,
+		Message: "lesson followed",
+	}
+
+	app.writeJSON(w, http.StatusOK, resp)
+}
+
+func (app *application) unfollowLesson(w http.ResponseWriter, r *http.Request) {
+	lessonID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	err = app.DB.UnfollowLesson(app.authUserID(r), lessonID)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	resp := JSONResponse{
+		Error:   false,
+		Message: "lesson unfollowed",
+	}
+
+	app.writeJSON(w, http.StatusOK, resp)
+}
+
+// teacherName reads the teacher of /teachers/{name}/..., which may be
+// percent-encoded since teacher names often are not ASCII
+func (app *application) teacherName(r *http.Request) (string, error) {
+	name, err := url.PathUnescape(chi.URLParam(r, "name"))
+	if err != nil {
+		return "", err
+	}
+
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return "", errors.New("teacher name is required")
+	}
+
+	return name, nil
+}
+
+func (app *application) followTeacher(w http.ResponseWriter, r *http.Request) {
+	name, err := app.teacherName(r)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	err = app.DB.FollowTeacher(app.authUserID(r), name)
+	if errors.Is(err, sql.ErrNoRows) {
+		app.errorJSON(w, errors.New("teacher not found"), http.StatusNotFound)
+		return
+	} else if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	resp := JSONResponse{
+		Error:   false,
+		Message: "teacher followed",
+	}
+
+	app.writeJSON(w, http.StatusOK, resp)
+}
+
+func (app *application) unfollowTeacher(w http.ResponseWriter, r *http.Request) {
+	name, err := app.teacherName(r)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	err = app.DB.UnfollowTeacher(app.authUserID(r), name)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	resp := JSONResponse{
+		Error:   false,
+		Message: "teacher unfollowed",
+	}
+
+	app.writeJSON(w, http.StatusOK, resp)
+}
+
+func (app *application) myFollows(w http.ResponseWriter, r *http.Request) {
+	follows, err := app.DB.FollowsByUserId(app.authUserID(r))
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	app.writeJSON(w, http.StatusOK, follows)
+}
+
+// myNotifications lists the user's notifications, newest first, or with
+// ?unread=true only those not read yet
+func (app *application) myNotifications(w http.ResponseWriter, r *http.Request) {
+	limit, offset, err := app.readPage(r)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	unreadOnly := false
+	if r.URL.Query().Get("unread") != "" {
+		unreadOnly, err = strconv.ParseBool(r.URL.Query().Get("unread"))
+		if err != nil {
+			app.errorJSON(w, errors.New("unread must be true or false"))
+			return
+		}
+	}
+
+	notifications, err := app.DB.NotificationsByUserId(app.authUserID(r), unreadOnly, limit, offset)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	if notifications == nil {
+		notifications = []*models.Notification{}
+	}
+
+	app.writeJSON(w, http.StatusOK, notifications)
+}
+
+func (app *application) unreadNotificationCount(w http.ResponseWriter, r *http.Request) {
+	count, err := app.DB.UnreadNotificationCount(app.authUserID(r))
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	app.writeJSON(w, http.StatusOK, map[string]int{"unread": count})
+}
+
+// markNotificationRead marks one notification read
+func (app *application) markNotificationRead(w http.ResponseWriter, r *http.Request) {
+	notificationID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil || notificationID <= 0 {
+		app.errorJSON(w, errors.New("invalid notification id"))
+		return
+	}
+
+	err = app.DB.MarkNotificationsRead(app.authUserID(r), notificationID)
+	if errors.Is(err, sql.ErrNoRows) {
+		app.errorJSON(w, errors.New("notification not found"), http.StatusNotFound)
+		return
+	} else if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	resp := JSONResponse{
+		Error:   false,
+		Message: "notification marked read",
+	}
+
+	app.writeJSON(w, http.StatusOK, resp)
+}
+
+// markAllNotificationsRead empties the user's unread notifications
+func (app *application) markAllNotificationsRead(w http.ResponseWriter, r *http.Request) {
+	err := app.DB.MarkNotificationsRead(app.authUserID(r), 0)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	resp := JSONResponse{
+		Error:   false,
+		Message: "notifications marked read",
+	}
+
+	app.writeJSON(w, http.StatusOK, resp)
+}
+
+// lessonEvents streams changes to a lesson's reviews and statistics as
+// server-sent events until the client goes away
+func (app *application) lessonEvents(w http.ResponseWriter, r *http.Request) {
+	lessonID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	_, err = app.DB.GetLessonByID(lessonID)
+	if err != nil {
+		app.errorJSON(w, errors.New("lesson not found"), http.StatusNotFound)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		app.errorJSON(w, errors.New("streaming is not supported"), http.StatusInternalServerError)
+		return
+	}
+
+	// the stream outlives the server's write timeout
+	_ = http.NewResponseController(w).SetWriteDeadline(time.Time{})
+
+	sub := app.hub.Subscribe(lessonID)
+	defer sub.Close()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	_, err = fmt.Fprintf(w, "retry: %d\n\n", eventRetry.Milliseconds())
+	if err != nil {
+		return
+	}
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(eventKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			_, err = fmt.Fprint(w, ": keep-alive\n\n")
+		case event, ok := <-sub.Events():
+			if !ok {
+				// dropped for falling behind or closed by a shutdown; the
+				// client reconnects and reloads
+				return
+			}
+			_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, event.Data)
+		}
+		if err != nil {
+			return
+		}
+
+		flusher.Flush()
+	}
+}
+
+// webhookRequest is the body of the requests creating or changing a webhook
+type webhookRequest struct {
+	URL        string   `json:"url"`
+	EventTypes []string `json:"event_types"`
+	Secret     string   `json:"secret"`
+	Active     *bool    `json:"active"`
+}
+
+// minWebhookSecret is the shortest secret an admin may choose for a webhook
+const minWebhookSecret = 16
+
+// validateWebhook checks the address and event types of a webhook and the
+// secret, if one was chosen
+func (app *application) validateWebhook(webhook *models.Webhook) error {
+	address, err := url.Parse(webhook.URL)
+	if err != nil || (address.Scheme != "http" && address.Scheme != "https") || address.Host == "" {
+		return errors.New("url must be an http or https address")
+	}
+
+	if len(webhook.EventTypes) == 0 {
+		return errors.New("event_types is required")
+	}
+
+	seen := make(map[string]bool)
+	var eventTypes []string
+	for _, eventType := range webhook.EventTypes {
+		known := false
+		for _, t := range models.WebhookEventTypes {
+			known = known || t == eventType
+		}
+		if !known {
+			return fmt.Errorf("unknown event type %q", eventType)
+		}
+
+		if !seen[eventType] {
+			seen[eventType] = true
+			eventTypes = append(eventTypes, eventType)
+		}
+	}
+	webhook.EventTypes = eventTypes
+
+	if webhook.Secret != "" && len(webhook.Secret) < minWebhookSecret {
+		return fmt.Errorf("secret must be at least %d characters", minWebhookSecret)
+	}
+
+	return nil
+}
+
+// allWebhooks lists the webhooks without their secrets
+func (app *application) allWebhooks(w http.ResponseWriter, r *http.Request) {
+	webhooks, err := app.DB.AllWebhooks()
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	if webhooks == nil {
+		webhooks = []*models.Webhook{}
+	}
+	for _, webhook := range webhooks {
+		webhook.Secret = ""
+	}
+
+	app.writeJSON(w, http.StatusOK, webhooks)
+}
+
+// insertWebhook adds a webhook. Without a secret one is generated; either
+// way it is answered only this once.
+func (app *application) insertWebhook(w http.ResponseWriter, r *http.Request) {
+	var requestPayload webhookRequest
+	err := app.readJSON(w, r, &requestPayload)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	webhook := models.Webhook{
+		URL:        requestPayload.URL,
+		EventTypes: requestPayload.EventTypes,
+		Secret:     requestPayload.Secret,
+		Active:     requestPayload.Active == nil || *requestPayload.Active,
+	}
+
+	err = app.validateWebhook(&webhook)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	if webhook.Secret == "" {
+		random := make([]byte, 32)
+		_, err = rand.Read(random)
+		if err != nil {
+			app.errorJSON(w, err, http.StatusInternalServerError)
+			return
+		}
+		webhook.Secret = hex.EncodeToString(random)
+	}
+
+	newID, err := app.DB.InsertWebhook(webhook)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	resp := JSONResponse{
+		Error:   false,
+		Message: "webhook created",
+		Data:    map[string]interface{}{"webhook_id": newID, "secret": webhook.Secret},
+	}
+
+	app.writeJSON(w, http.StatusCreated, resp)
+}
+
+// updateWebhook replaces the address and event types of a webhook, and its
+// secret and active flag when they are given
+func (app *application) updateWebhook(w http.ResponseWriter, r *http.Request) {
+	webhookID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	webhook, err := app.DB.GetWebhookByID(webhookID)
+	if errors.Is(err, sql.ErrNoRows) {
+		app.errorJSON(w, errors.New("webhook not found"), http.StatusNotFound)
+		return
+	} else if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	var requestPayload webhookRequest
+	err = app.readJSON(w, r, &requestPayload)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	webhook.URL = requestPayload.URL
+	webhook.EventTypes = requestPayload.EventTypes
+	webhook.Secret = requestPayload.Secret
+	if requestPayload.Active != nil {
+		webhook.Active = *requestPayload.Active
+	}
+
+	err = app.validateWebhook(webhook)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	err = app.DB.UpdateWebhook(*webhook)
+	if errors.Is(err, sql.ErrNoRows) {
+		app.errorJSON(w, errors.New("webhook not found"), http.StatusNotFound)
+		return
+	} else if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	// deliveries held while the webhook was inactive are due again
+	if webhook.Active {
+		app.queueWebhookDelivery()
+	}
+
+	resp := JSONResponse{
+		Error:   false,
+		Message: "webhook updated",
+	}
+
+	app.writeJSON(w, http.StatusOK, resp)
+}
+
+func (app *application) deleteWebhook(w http.ResponseWriter, r *http.Request) {
+	webhookID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	err = app.DB.DeleteWebhook(webhookID)
+	if errors.Is(err, sql.ErrNoRows) {
+		app.errorJSON(w, errors.New("webhook not found"), http.StatusNotFound)
+		return
+	} else if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	resp := JSONResponse{
+		Error:   false,
+		Message: "webhook deleted",
+	}
+
+	app.writeJSON(w, http.StatusOK, resp)
+}
+
+// webhookDeliveries is the delivery log of a webhook, newest first, optionally
+// only the deliveries with a ?status=
+func (app *application) webhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	webhookID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	limit, offset, err := app.readPage(r)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	status := r.URL.Query().Get("status")
+	switch status {
+	case "", models.DeliveryPending, models.DeliverySucceeded, models.DeliveryDead:
+	default:
+		app.errorJSON(w, errors.New("status must be pending, succeeded or dead"))
+		return
+	}
+
+	_, err = app.DB.GetWebhookByID(webhookID)
+	if errors.Is(err, sql.ErrNoRows) {
+		app.errorJSON(w, errors.New("webhook not found"), http.StatusNotFound)
+		return
+	} else if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	deliveries, err := app.DB.WebhookDeliveries(webhookID, status, limit, offset)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	if deliveries == nil {
+		deliveries = []*models.WebhookDelivery{}
+	}
+
+	app.writeJSON(w, http.StatusOK, deliveries)
+}
+
+// retryWebhookDelivery queues a dead delivery again
+func (app *application) retryWebhookDelivery(w http.ResponseWriter, r *http.Request) {
+	deliveryID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	err = app.DB.RetryWebhookDelivery(deliveryID)
+	if errors.Is(err, sql.ErrNoRows) {
+		app.errorJSON(w, errors.New("dead delivery not found"), http.StatusNotFound)
+		return
+	} else if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	app.queueWebhookDelivery()
+
+	resp := JSONResponse{
+		Error:   false,
+		Message: "delivery queued again",
+	}
+
+	app.writeJSON(w, http.StatusOK, resp)
+}
+
+// myDigestPreferences returns whether and in which language the user gets the
+// email digest
+func (app *application) myDigestPreferences(w http.ResponseWriter, r *http.Request) {
+	prefs, err := app.DB.GetDigestPreferences(app.authUserID(r))
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	app.writeJSON(w, http.StatusOK, prefs)
+}
+
+// updateDigestPreferences turns the user's email digest on or off and sets
+// its language
+func (app *application) updateDigestPreferences(w http.ResponseWriter, r *http.Request) {
+	var requestPayload struct {
+		Enabled  bool   `json:"enabled"`
+		Language string `json:"language"`
+	}
+
+	err := app.readJSON(w, r, &requestPayload)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	if requestPayload.Language != models.DigestJapanese && requestPayload.Language != models.DigestEnglish {
+		app.errorJSON(w, errors.New("language must be ja or en"))
+		return
+	}
+
+	err = app.DB.UpdateDigestPreferences(models.DigestPreferences{
+		UserId:   app.authUserID(r),
+		Enabled:  requestPayload.Enabled,
+		Language: requestPayload.Language,
+	})
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	resp := JSONResponse{
+		Error:   false,
+		Message: "digest preferences updated",
+	}
+
+	app.writeJSON(w, http.StatusOK, resp)
+}
+
+// unsubscribeDigest turns off the email digest of the user an unsubscribe
+// token was made for. The token comes in the query string, as in the
+// List-Unsubscribe one-click POST sent by mail clients, or in a JSON body.
+func (app *application) unsubscribeDigest(w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		var requestPayload struct {
+			Token string `json:"token"`
+		}
+
+		err := app.readJSON(w, r, &requestPayload)
+		if err != nil {
+			app.errorJSON(w, err)
+			return
+		}
+		token = requestPayload.Token
+	}
+
+	userID, ok := digest.ParseUnsubscribeToken(app.UnsubscribeSecret, token)
+	if !ok {
+		app.errorJSON(w, errors.New("unsubscribe link is invalid"), http.StatusNotFound)
+		return
+	}
+
+	prefs, err := app.DB.GetDigestPreferences(userID)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	prefs.Enabled = false
+
+	err = app.DB.UpdateDigestPreferences(*prefs)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	resp := JSONResponse{
+		Error:   false,
+		Message: "unsubscribed from the digest",
+	}
+
+	app.writeJSON(w, http.StatusOK, resp)
+}
+
+// allJobs lists background jobs, newest first, optionally only those with a
+// ?status= or of a ?kind=
+func (app *application) allJobs(w http.ResponseWriter, r *http.Request) {
+	limit, offset, err := app.readPage(r)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	filter := models.JobFilter{
+		Status: r.URL.Query().Get("status"),
+		Kind:   r.URL.Query().Get("kind"),
+		Limit:  limit,
+		Offset: offset,
+	}
+
+	switch filter.Status {
+	case "", models.JobPending, models.JobRunning, models.JobSucceeded, models.JobFailed:
+	default:
+		app.errorJSON(w, errors.New("status must be pending, running, succeeded or failed"))
+		return
+	}
+
+	jobs, err := app.DB.Jobs(filter)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	if jobs == nil {
+		jobs = []*models.Job{}
+	}
+
+	app.writeJSON(w, http.StatusOK, jobs)
+}
+
+func (app *application) getJob(w http.ResponseWriter, r *http.Request) {
+	jobID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	job, err := app.DB.GetJobByID(jobID)
+	if errors.Is(err, sql.ErrNoRows) {
+		app.errorJSON(w, errors.New("job not found"), http.StatusNotFound)
+		return
+	} else if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	app.writeJSON(w, http.StatusOK, job)
+}
+
+// enqueueJob queues a job of any kind the runner handles, such as an
+// aggregate repair, to run now
+func (app *application) enqueueJob(w http.ResponseWriter, r *http.Request) {
+	var requestPayload struct {
+		Kind    string          `json:"kind"`
+		Payload json.RawMessage `json:"payload"`
+	}
+
+	err := app.readJSON(w, r, &requestPayload)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	if !app.jobs.Handles(requestPayload.Kind) {
+		app.errorJSON(w, fmt.Errorf("kind must be one of %s", strings.Join(app.jobs.Kinds(), ", ")))
+		return
+	}
+
+	var payload interface{}
+	if len(requestPayload.Payload) > 0 {
+		payload = requestPayload.Payload
+	}
+
+	jobID, err := app.jobs.Enqueue(requestPayload.Kind, payload)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	resp := JSONResponse{
+		Error:   false,
+		Message: "job queued",
+		Data:    map[string]int{"job_id": jobID},
+	}
+
+	app.writeJSON(w, http.StatusAccepted, resp)
+}
+
+// retryJob queues a failed job again
+func (app *application) retryJob(w http.ResponseWriter, r *http.Request) {
+	jobID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	err = app.DB.RetryJob(jobID)
+	if errors.Is(err, sql.ErrNoRows) {
+		app.errorJSON(w, errors.New("failed job not found"), http.StatusNotFound)
+		return
+	} else if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	resp := JSONResponse{
+		Error:   false,
+		Message: "job queued again",
+	}
+
+	app.writeJSON(w, http.StatusOK, resp)
+}
@@ -1,13 +1,32 @@
 package main
 
 import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
 	"io"
+	"kstation_backend/internal/digest"
+	"kstation_backend/internal/jobs"
+	"kstation_backend/internal/mailer"
+	"kstation_backend/internal/models"
+	"kstation_backend/internal/repository"
+	"kstation_backend/internal/repository/dbrepo"
+	"kstation_backend/internal/storage"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
 	// "net/url"
 	"strings"
 	"testing"
 	"time"
+
+	"github.com/go-chi/chi/v5"
 )
 
 func Test_app_authenticate(t *testing.T) {
@@ -92,4 +111,1855 @@ func Test_app_refreshToken(t *testing.T) {
 
 		app.auth.RefreshExpiry = oldRefreshTime
 	}
-}
\ No newline at end of file
+}
+
+// withURLParam sets a chi url parameter on a request built outside of the router
+func withURLParam(req *http.Request, key, value string) *http.Request {
+	chiCtx, ok := req.Context().Value(chi.RouteCtxKey).(*chi.Context)
+	if !ok {
+		chiCtx = chi.NewRouteContext()
+	}
+	chiCtx.URLParams.Add(key, value)
+	return req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, chiCtx))
+}
+
+// withUserID sets the user id that authRequired would have put on the request
+func withUserID(req *http.Request, id int) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), userIDKey, id))
+}
+
+func Test_app_lessonStats(t *testing.T) {
+	var tests = []struct {
+		name               string
+		id                 string
+		expectedStatusCode int
+	}{
+		{"valid", "1", http.StatusOK},
+		{"not found", "3", http.StatusNotFound},
+		{"invalid id", "abc", http.StatusBadRequest},
+	}
+
+	for _, e := range tests {
+		req, _ := http.NewRequest("GET", "/lessons/"+e.id+"/stats", nil)
+		req = withURLParam(req, "id", e.id)
+
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(app.lessonStats)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("%s: expected status of %d but got %d", e.name, e.expectedStatusCode, rr.Code)
+		}
+	}
+}
+
+func Test_app_allCommentsByLesson(t *testing.T) {
+	var tests = []struct {
+		name               string
+		id                 string
+		how                string
+		expectedStatusCode int
+	}{
+		{"default order", "1", "", http.StatusOK},
+		{"most helpful", "1", "1", http.StatusOK},
+		{"wilson score", "1", "2", http.StatusOK},
+		{"invalid how", "1", "x", http.StatusBadRequest},
+		{"unknown lesson", "3", "", http.StatusNotFound},
+	}
+
+	for _, e := range tests {
+		req, _ := http.NewRequest("GET", "/lessons/"+e.id+"/comments?how="+e.how, nil)
+		req = withURLParam(req, "id", e.id)
+
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(app.allCommentsByLesson)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("%s: expected status of %d but got %d", e.name, e.expectedStatusCode, rr.Code)
+		}
+	}
+}
+
+func Test_app_voteComment(t *testing.T) {
+	var tests = []struct {
+		name               string
+		id                 string
+		requestBody        string
+		expectedStatusCode int
+	}{
+		{"helpful", "1", `{"helpful":true}`, http.StatusOK},
+		{"unhelpful", "1", `{"helpful":false}`, http.StatusOK},
+		{"not json", "1", `I'm not JSON`, http.StatusBadRequest},
+		{"unknown comment", "2", `{"helpful":true}`, http.StatusNotFound},
+		{"held comment", "9", `{"helpful":true}`, http.StatusNotFound},
+	}
+
+	for _, e := range tests {
+		req, _ := http.NewRequest("POST", "/comments/"+e.id+"/vote", strings.NewReader(e.requestBody))
+		req = withURLParam(req, "id", e.id)
+		req = withUserID(req, 1)
+
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(app.voteComment)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("%s: expected status of %d but got %d", e.name, e.expectedStatusCode, rr.Code)
+		}
+
+		if strings.Contains(rr.Body.String(), "taro@example.com") {
+			t.Errorf("%s: response leaks the text of a held comment", e.name)
+		}
+	}
+}
+
+func Test_app_insertComment(t *testing.T) {
+	var tests = []struct {
+		name               string
+		lessonID           string
+		requestBody        string
+		expectedStatusCode int
+	}{
+		{"valid", "1", `{"year":2023,"Term":"latter","comment":"good","test_or_report":"test","star":4}`, http.StatusCreated},
+		{"duplicate", "1", `{"year":2023,"Term":"former","comment":"good","test_or_report":"test","star":4}`, http.StatusConflict},
+		{"invalid star", "1", `{"year":2023,"Term":"latter","comment":"good","test_or_report":"test","star":6}`, http.StatusBadRequest},
+		{"missing term", "1", `{"year":2023,"comment":"good","test_or_report":"test","star":4}`, http.StatusBadRequest},
+		{"banned word", "1", `{"year":2023,"Term":"latter","comment":"the teacher is an idiot","test_or_report":"test","star":1}`, http.StatusUnprocessableEntity},
+		{"personal info", "1", `{"year":2023,"Term":"latter","comment":"call 090-1234-5678","test_or_report":"test","star":4}`, http.StatusCreated},
+		{"255 characters of japanese", "1", `{"year":2023,"Term":"latter","comment":"` + strings.Repeat("良", 255) + `","test_or_report":"test","star":4}`, http.StatusCreated},
+		{"too long", "1", `{"year":2023,"Term":"latter","comment":"` + strings.Repeat("良", 256) + `","test_or_report":"test","star":4}`, http.StatusBadRequest},
+		{"not json", "1", `I'm not JSON`, http.StatusBadRequest},
+		{"unknown lesson", "3", `{"year":2023,"Term":"latter","comment":"good","test_or_report":"test","star":4}`, http.StatusNotFound},
+	}
+
+	for _, e := range tests {
+		req, _ := http.NewRequest("POST", "/lessons/"+e.lessonID+"/comments", strings.NewReader(e.requestBody))
+		req = withURLParam(req, "id", e.lessonID)
+		req = withUserID(req, 1)
+
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(app.insertComment)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("%s: expected status of %d but got %d", e.name, e.expectedStatusCode, rr.Code)
+		}
+
+		if e.expectedStatusCode == http.StatusConflict && rr.Header().Get("Location") != "/comments/1" {
+			t.Errorf("%s: expected location of existing comment but got %q", e.name, rr.Header().Get("Location"))
+		}
+	}
+}
+
+func Test_app_upsertComment(t *testing.T) {
+	var tests = []struct {
+		name               string
+		lessonID           string
+		requestBody        string
+		expectedStatusCode int
+		expectedBody       string
+	}{
+		{"new", "1", `{"year":2023,"Term":"latter","comment":"good","test_or_report":"test","star":4}`, http.StatusOK, `"comment_id":2`},
+		{"existing", "1", `{"year":2023,"Term":"former","comment":"better","test_or_report":"test","star":5}`, http.StatusOK, `"comment_id":1`},
+		{"invalid star", "1", `{"year":2023,"Term":"former","comment":"good","test_or_report":"test","star":0}`, http.StatusBadRequest, ""},
+		{"unknown lesson", "3", `{"year":2023,"Term":"former","comment":"good","test_or_report":"test","star":4}`, http.StatusNotFound, ""},
+	}
+
+	for _, e := range tests {
+		req, _ := http.NewRequest("PUT", "/lessons/"+e.lessonID+"/comments", strings.NewReader(e.requestBody))
+		req = withURLParam(req, "id", e.lessonID)
+		req = withUserID(req, 1)
+
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(app.upsertComment)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("%s: expected status of %d but got %d", e.name, e.expectedStatusCode, rr.Code)
+		}
+
+		if !strings.Contains(rr.Body.String(), e.expectedBody) {
+			t.Errorf("%s: expected body to contain %s but got %s", e.name, e.expectedBody, rr.Body.String())
+		}
+	}
+}
+
+func Test_app_reportComment(t *testing.T) {
+	var tests = []struct {
+		name               string
+		id                 string
+		userID             int
+		requestBody        string
+		expectedStatusCode int
+	}{
+		{"valid", "1", 2, `{"reason":"defamation","detail":"names the teacher's family"}`, http.StatusCreated},
+		{"already reported", "1", 1, `{"reason":"spam"}`, http.StatusConflict},
+		{"invalid reason", "1", 2, `{"reason":"boring"}`, http.StatusBadRequest},
+		{"255 characters of japanese", "1", 2, `{"reason":"other","detail":"` + strings.Repeat("悪", 255) + `"}`, http.StatusCreated},
+		{"detail too long", "1", 2, `{"reason":"other","detail":"` + strings.Repeat("悪", 256) + `"}`, http.StatusBadRequest},
+		{"unknown comment", "2", 2, `{"reason":"spam"}`, http.StatusNotFound},
+		{"held comment", "9", 2, `{"reason":"spam"}`, http.StatusNotFound},
+	}
+
+	for _, e := range tests {
+		req, _ := http.NewRequest("POST", "/comments/"+e.id+"/report", strings.NewReader(e.requestBody))
+		req = withURLParam(req, "id", e.id)
+		req = withUserID(req, e.userID)
+
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(app.reportComment)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("%s: expected status of %d but got %d", e.name, e.expectedStatusCode, rr.Code)
+		}
+	}
+}
+
+func Test_app_moderationQueue(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/admin/moderation", nil)
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(app.moderationQueue)
+	handler.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Errorf("expected status of %d but got %d", http.StatusOK, rr.Code)
+	}
+
+	if !strings.Contains(rr.Body.String(), `"comment":{`) {
+		t.Errorf("expected reports to include the reported comment, but got %s", rr.Body.String())
+	}
+}
+
+func Test_app_moderateReport(t *testing.T) {
+	var tests = []struct {
+		name               string
+		id                 string
+		requestBody        string
+		expectedStatusCode int
+	}{
+		{"dismiss", "1", `{"action":"dismiss"}`, http.StatusOK},
+		{"hide", "1", `{"action":"hide","note":"defamatory"}`, http.StatusOK},
+		{"delete", "1", `{"action":"delete"}`, http.StatusOK},
+		{"warn", "1", `{"action":"warn"}`, http.StatusOK},
+		{"invalid action", "1", `{"action":"ban"}`, http.StatusBadRequest},
+		{"handled by another moderator", "3", `{"action":"hide"}`, http.StatusConflict},
+		{"unknown report", "2", `{"action":"dismiss"}`, http.StatusNotFound},
+	}
+
+	for _, e := range tests {
+		req, _ := http.NewRequest("POST", "/admin/moderation/"+e.id, strings.NewReader(e.requestBody))
+		req = withURLParam(req, "id", e.id)
+		req = withUserID(req, 1)
+
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(app.moderateReport)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("%s: expected status of %d but got %d", e.name, e.expectedStatusCode, rr.Code)
+		}
+	}
+}
+
+func Test_app_updateComment(t *testing.T) {
+	var tests = []struct {
+		name               string
+		id                 string
+		userID             int
+		requestBody        string
+		expectedStatusCode int
+		expectedMessage    string
+	}{
+		{"valid", "1", 1, `{"year":2023,"Term":"former","comment":"updated","test_or_report":"test","star":4}`, http.StatusOK, "comment updated"},
+		{"held", "1", 1, `{"year":2023,"Term":"former","comment":"mail me at taro@example.com","test_or_report":"test","star":4}`, http.StatusOK, "comment held for review"},
+		{"rejected", "1", 1, `{"year":2023,"Term":"former","comment":"idiot","test_or_report":"test","star":4}`, http.StatusUnprocessableEntity, ""},
+		{"not author", "1", 2, `{"year":2023,"Term":"former","comment":"updated","test_or_report":"test","star":4}`, http.StatusForbidden, ""},
+		{"unknown comment", "2", 1, `{"year":2023,"Term":"former","comment":"updated","test_or_report":"test","star":4}`, http.StatusNotFound, ""},
+	}
+
+	for _, e := range tests {
+		req, _ := http.NewRequest("PUT", "/comments/"+e.id, strings.NewReader(e.requestBody))
+		req = withURLParam(req, "id", e.id)
+		req = withUserID(req, e.userID)
+
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(app.updateComment)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("%s: expected status of %d but got %d", e.name, e.expectedStatusCode, rr.Code)
+		}
+
+		if !strings.Contains(rr.Body.String(), e.expectedMessage) {
+			t.Errorf("%s: expected message %q but got %s", e.name, e.expectedMessage, rr.Body.String())
+		}
+	}
+}
+
+func Test_app_validateCommentKeepsHeld(t *testing.T) {
+	var tests = []struct {
+		name           string
+		status         string
+		text           string
+		expectedStatus string
+	}{
+		{"new clean review", "", "good", models.CommentVisible},
+		{"new review with email", "", "mail me at taro@example.com", models.CommentPending},
+		{"held review edited clean", models.CommentPending, "good", models.CommentPending},
+		{"visible review edited clean", models.CommentVisible, "good", models.CommentVisible},
+	}
+
+	for _, e := range tests {
+		comment := models.Comment{Year: 2023, Term: "former", Comment: e.text, Star: 4, ModerationStatus: e.status}
+
+		err := app.validateComment(&comment)
+		if err != nil {
+			t.Errorf("%s: unexpected error %s", e.name, err)
+		}
+
+		if comment.ModerationStatus != e.expectedStatus {
+			t.Errorf("%s: expected status %s but got %s", e.name, e.expectedStatus, comment.ModerationStatus)
+		}
+	}
+}
+
+func Test_app_moderateHeldComment(t *testing.T) {
+	var tests = []struct {
+		name               string
+		id                 string
+		requestBody        string
+		expectedStatusCode int
+	}{
+		{"not held", "1", `{"action":"approve"}`, http.StatusConflict},
+		{"invalid action", "1", `{"action":"publish"}`, http.StatusBadRequest},
+		{"unknown comment", "2", `{"action":"reject"}`, http.StatusNotFound},
+	}
+
+	for _, e := range tests {
+		req, _ := http.NewRequest("POST", "/admin/moderation/held/"+e.id, strings.NewReader(e.requestBody))
+		req = withURLParam(req, "id", e.id)
+
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(app.moderateHeldComment)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("%s: expected status of %d but got %d", e.name, e.expectedStatusCode, rr.Code)
+		}
+	}
+}
+
+func Test_app_deleteComment(t *testing.T) {
+	var tests = []struct {
+		name               string
+		id                 string
+		userID             int
+		expectedStatusCode int
+	}{
+		{"author", "1", 1, http.StatusAccepted},
+		{"not author", "1", 2, http.StatusForbidden},
+		{"unknown comment", "2", 1, http.StatusNotFound},
+	}
+
+	for _, e := range tests {
+		req, _ := http.NewRequest("DELETE", "/comments/"+e.id, nil)
+		req = withURLParam(req, "id", e.id)
+		req = withUserID(req, e.userID)
+
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(app.deleteComment)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("%s: expected status of %d but got %d", e.name, e.expectedStatusCode, rr.Code)
+		}
+	}
+}
+
+func Test_app_softDeleteAdmin(t *testing.T) {
+	var tests = []struct {
+		name               string
+		handler            http.HandlerFunc
+		id                 string
+		expectedStatusCode int
+	}{
+		{"delete lesson", app.deleteLesson, "1", http.StatusAccepted},
+		{"delete unknown lesson", app.deleteLesson, "3", http.StatusNotFound},
+		{"delete user", app.deleteUser, "1", http.StatusAccepted},
+		{"delete unknown user", app.deleteUser, "3", http.StatusNotFound},
+		{"restore comment", app.restoreComment, "2", http.StatusOK},
+		{"restore duplicate comment", app.restoreComment, "3", http.StatusConflict},
+		{"restore unknown comment", app.restoreComment, "4", http.StatusNotFound},
+		{"restore lesson", app.restoreLesson, "1", http.StatusOK},
+		{"restore unknown lesson", app.restoreLesson, "3", http.StatusNotFound},
+		{"restore user", app.restoreUser, "2", http.StatusOK},
+		{"restore unknown user", app.restoreUser, "3", http.StatusNotFound},
+	}
+
+	for _, e := range tests {
+		req, _ := http.NewRequest("POST", "/admin", nil)
+		req = withURLParam(req, "id", e.id)
+
+		rr := httptest.NewRecorder()
+		e.handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("%s: expected status of %d but got %d", e.name, e.expectedStatusCode, rr.Code)
+		}
+	}
+}
+
+func Test_app_commentRevisions(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/admin/comments/1/revisions", nil)
+	req = withURLParam(req, "id", "1")
+
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(app.commentRevisions)
+	handler.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Errorf("expected status of %d but got %d", http.StatusOK, rr.Code)
+	}
+
+	if !strings.Contains(rr.Body.String(), "this was the first version") {
+		t.Errorf("expected the previous version of the comment, but got %s", rr.Body.String())
+	}
+}
+
+func Test_app_updatePrivacy(t *testing.T) {
+	var tests = []struct {
+		name               string
+		userID             int
+		requestBody        string
+		expectedStatusCode int
+	}{
+		{"show real name", 1, `{"show_real_name":true}`, http.StatusOK},
+		{"not json", 1, `I'm not JSON`, http.StatusBadRequest},
+		{"unknown user", 2, `{"show_real_name":false}`, http.StatusNotFound},
+	}
+
+	for _, e := range tests {
+		req, _ := http.NewRequest("PUT", "/me/privacy", strings.NewReader(e.requestBody))
+		req = withUserID(req, e.userID)
+
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(app.updatePrivacy)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("%s: expected status of %d but got %d", e.name, e.expectedStatusCode, rr.Code)
+		}
+	}
+}
+
+func Test_app_commentReplies(t *testing.T) {
+	var tests = []struct {
+		name               string
+		id                 string
+		query              string
+		expectedStatusCode int
+	}{
+		{"first page", "1", "", http.StatusOK},
+		{"second page", "1", "?page=2&per_page=10", http.StatusOK},
+		{"bad page", "1", "?page=0", http.StatusBadRequest},
+		{"page too large", "1", "?per_page=500", http.StatusBadRequest},
+		{"unknown comment", "2", "", http.StatusNotFound},
+	}
+
+	for _, e := range tests {
+		req, _ := http.NewRequest("GET", "/comments/"+e.id+"/replies"+e.query, nil)
+		req = withURLParam(req, "id", e.id)
+
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(app.commentReplies)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("%s: expected status of %d but got %d", e.name, e.expectedStatusCode, rr.Code)
+		}
+	}
+}
+
+func Test_app_insertReply(t *testing.T) {
+	var tests = []struct {
+		name               string
+		id                 string
+		requestBody        string
+		expectedStatusCode int
+	}{
+		{"reply to review", "1", `{"body":"was the final open-book?"}`, http.StatusCreated},
+		{"nested reply", "1", `{"parent_id":1,"body":"yes it was"}`, http.StatusCreated},
+		{"too deep", "1", `{"parent_id":3,"body":"one more"}`, http.StatusBadRequest},
+		{"unknown parent", "1", `{"parent_id":9,"body":"hello"}`, http.StatusNotFound},
+		{"empty", "1", `{"body":"  "}`, http.StatusBadRequest},
+		{"255 characters of japanese", "1", `{"body":"` + strings.Repeat("は", 255) + `"}`, http.StatusCreated},
+		{"too long", "1", `{"body":"` + strings.Repeat("は", 256) + `"}`, http.StatusBadRequest},
+		{"rejected", "1", `{"body":"idiot"}`, http.StatusUnprocessableEntity},
+		{"held", "1", `{"body":"mail me at taro@example.com"}`, http.StatusUnprocessableEntity},
+		{"unknown comment", "2", `{"body":"hello"}`, http.StatusNotFound},
+	}
+
+	for _, e := range tests {
+		req, _ := http.NewRequest("POST", "/comments/"+e.id+"/replies", strings.NewReader(e.requestBody))
+		req = withURLParam(req, "id", e.id)
+		req = withUserID(req, 1)
+
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(app.insertReply)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("%s: expected status of %d but got %d", e.name, e.expectedStatusCode, rr.Code)
+		}
+	}
+}
+
+func Test_app_updateReply(t *testing.T) {
+	var tests = []struct {
+		name               string
+		id                 string
+		userID             int
+		requestBody        string
+		expectedStatusCode int
+	}{
+		{"valid", "1", 1, `{"body":"it was closed-book"}`, http.StatusAccepted},
+		{"not author", "1", 2, `{"body":"it was closed-book"}`, http.StatusForbidden},
+		{"rejected", "1", 1, `{"body":"idiot"}`, http.StatusUnprocessableEntity},
+		{"unknown reply", "2", 1, `{"body":"it was closed-book"}`, http.StatusNotFound},
+	}
+
+	for _, e := range tests {
+		req, _ := http.NewRequest("PUT", "/replies/"+e.id, strings.NewReader(e.requestBody))
+		req = withURLParam(req, "id", e.id)
+		req = withUserID(req, e.userID)
+
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(app.updateReply)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("%s: expected status of %d but got %d", e.name, e.expectedStatusCode, rr.Code)
+		}
+	}
+}
+
+func Test_app_deleteReply(t *testing.T) {
+	var tests = []struct {
+		name               string
+		id                 string
+		userID             int
+		expectedStatusCode int
+	}{
+		{"valid", "1", 1, http.StatusAccepted},
+		{"not author", "1", 2, http.StatusForbidden},
+		{"unknown reply", "2", 1, http.StatusNotFound},
+	}
+
+	for _, e := range tests {
+		req, _ := http.NewRequest("DELETE", "/replies/"+e.id, nil)
+		req = withURLParam(req, "id", e.id)
+		req = withUserID(req, e.userID)
+
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(app.deleteReply)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("%s: expected status of %d but got %d", e.name, e.expectedStatusCode, rr.Code)
+		}
+	}
+}
+
+func multipartUpload(fields map[string]string, fileName string, content []byte) (*bytes.Buffer, string) {
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	for name, value := range fields {
+		writer.WriteField(name, value)
+	}
+	if fileName != "" {
+		part, _ := writer.CreateFormFile("file", fileName)
+		part.Write(content)
+	}
+	writer.Close()
+
+	return &body, writer.FormDataContentType()
+}
+
+func Test_app_uploadAttachment(t *testing.T) {
+	fields := map[string]string{"year": "2023", "Term": "former", "test_or_report": "test"}
+	pdf := []byte("%PDF-1.4 past exam")
+
+	var tests = []struct {
+		name               string
+		lessonID           string
+		fields             map[string]string
+		fileName           string
+		content            []byte
+		expectedStatusCode int
+	}{
+		{"valid", "1", fields, "期末試験.pdf", pdf, http.StatusCreated},
+		{"no file", "1", fields, "", nil, http.StatusBadRequest},
+		{"no term", "1", map[string]string{"year": "2023"}, "exam.pdf", pdf, http.StatusBadRequest},
+		{"executable", "1", fields, "exam.pdf", []byte("MZ\x90\x00\x03\x00\x00\x00"), http.StatusUnsupportedMediaType},
+		{"too large", "1", fields, "exam.pdf", append(pdf, bytes.Repeat([]byte("x"), 2<<10)...), http.StatusRequestEntityTooLarge},
+		{"infected", "1", fields, "exam.pdf", append(pdf, []byte("EICAR")...), http.StatusUnprocessableEntity},
+		{"unknown lesson", "2", fields, "exam.pdf", pdf, http.StatusNotFound},
+		{"long japanese name", "1", fields, strings.Repeat("試", 200) + ".pdf", pdf, http.StatusCreated},
+		{"name too long", "1", fields, strings.Repeat("試", 256) + ".pdf", pdf, http.StatusBadRequest},
+	}
+
+	for _, e := range tests {
+		body, contentType := multipartUpload(e.fields, e.fileName, e.content)
+		req, _ := http.NewRequest("POST", "/lessons/"+e.lessonID+"/attachments", body)
+		req.Header.Set("Content-Type", contentType)
+		req = withURLParam(req, "id", e.lessonID)
+		req = withUserID(req, 1)
+
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(app.uploadAttachment)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("%s: expected status of %d but got %d: %s", e.name, e.expectedStatusCode, rr.Code, rr.Body.String())
+		}
+	}
+}
+
+// noAttachmentsRepo has lesson 1 without any attachments
+type noAttachmentsRepo struct {
+	dbrepo.TestDBRepo
+}
+
+func (m *noAttachmentsRepo) AttachmentsByLessonId(lessonID int) ([]*models.Attachment, error) {
+	return nil, nil
+}
+
+func Test_app_lessonAttachments(t *testing.T) {
+	var tests = []struct {
+		name               string
+		db                 repository.DatabaseRepo
+		lessonID           string
+		expectedStatusCode int
+		expectedBody       string
+	}{
+		{"with attachments", app.DB, "1", http.StatusOK, `"file_name"`},
+		{"no attachments", &noAttachmentsRepo{}, "1", http.StatusOK, "[]"},
+		{"unknown lesson", app.DB, "3", http.StatusNotFound, "lesson not found"},
+		{"invalid id", app.DB, "abc", http.StatusBadRequest, ""},
+	}
+
+	oldDB := app.DB
+	defer func() { app.DB = oldDB }()
+
+	for _, e := range tests {
+		app.DB = e.db
+
+		req, _ := http.NewRequest("GET", "/lessons/"+e.lessonID+"/attachments", nil)
+		req = withURLParam(req, "id", e.lessonID)
+
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(app.lessonAttachments).ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("%s: expected status of %d but got %d", e.name, e.expectedStatusCode, rr.Code)
+		}
+
+		if !strings.Contains(rr.Body.String(), e.expectedBody) {
+			t.Errorf("%s: expected %s in the body but got %s", e.name, e.expectedBody, rr.Body.String())
+		}
+	}
+}
+
+func Test_app_downloadAttachment(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/attachments/1/url", nil)
+	req = withURLParam(req, "id", "1")
+	req = withUserID(req, 1)
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(app.attachmentURL).ServeHTTP(rr, req)
+
+	var payload struct {
+		URL string `json:"url"`
+	}
+	_ = json.Unmarshal(rr.Body.Bytes(), &payload)
+	if rr.Code != http.StatusOK || payload.URL == "" {
+		t.Fatalf("expected a signed url but got %d %s", rr.Code, rr.Body.String())
+	}
+
+	expired := time.Now().Add(-time.Minute)
+	expiredURL := fmt.Sprintf("/attachments/1/download?expires=%d&signature=%s", expired.Unix(), app.urlSigner.Sign("attachments/1", expired))
+
+	var tests = []struct {
+		name               string
+		url                string
+		expectedStatusCode int
+	}{
+		{"signed", payload.URL, http.StatusOK},
+		{"unsigned", "/attachments/1/download", http.StatusForbidden},
+		{"tampered", strings.Replace(payload.URL, "expires=", "expires=9", 1), http.StatusForbidden},
+		{"expired", expiredURL, http.StatusForbidden},
+	}
+
+	for _, e := range tests {
+		req, _ := http.NewRequest("GET", e.url, nil)
+		req = withURLParam(req, "id", "1")
+
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(app.downloadAttachment)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("%s: expected status of %d but got %d", e.name, e.expectedStatusCode, rr.Code)
+		}
+
+		if e.expectedStatusCode == http.StatusOK && rr.Body.String() != "%PDF-1.4 past exam" {
+			t.Errorf("%s: unexpected body %q", e.name, rr.Body.String())
+		}
+	}
+}
+
+func Test_app_deleteAttachment(t *testing.T) {
+	var tests = []struct {
+		name               string
+		id                 string
+		userID             int
+		expectedStatusCode int
+	}{
+		{"not author", "1", 2, http.StatusForbidden},
+		{"unknown attachment", "2", 1, http.StatusNotFound},
+		{"valid", "1", 1, http.StatusAccepted},
+	}
+
+	for _, e := range tests {
+		req, _ := http.NewRequest("DELETE", "/attachments/"+e.id, nil)
+		req = withURLParam(req, "id", e.id)
+		req = withUserID(req, e.userID)
+
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(app.deleteAttachment)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("%s: expected status of %d but got %d", e.name, e.expectedStatusCode, rr.Code)
+		}
+	}
+}
+
+func Test_app_updateAvatar(t *testing.T) {
+	var jpg bytes.Buffer
+	jpeg.Encode(&jpg, image.NewRGBA(image.Rect(0, 0, 300, 200)), nil)
+
+	store := &jobRepo{}
+	oldJobs := app.jobs
+	app.jobs = jobs.NewRunner(store, jobs.DefaultOptions)
+	app.registerJobs(app.jobs)
+	defer func() { app.jobs = oldJobs }()
+
+	var tests = []struct {
+		name               string
+		userID             int
+		fileName           string
+		content            []byte
+		expectedStatusCode int
+	}{
+		{"valid", 1, "me.jpg", jpg.Bytes(), http.StatusAccepted},
+		{"not an image", 1, "me.jpg", []byte("hello"), http.StatusUnsupportedMediaType},
+		{"no file", 1, "", nil, http.StatusBadRequest},
+		{"too large", 1, "me.jpg", bytes.Repeat([]byte("x"), 2<<20), http.StatusRequestEntityTooLarge},
+		{"unknown user", 2, "me.jpg", jpg.Bytes(), http.StatusNotFound},
+	}
+
+	for _, e := range tests {
+		store.queued, store.results = nil, nil
+
+		var body bytes.Buffer
+		writer := multipart.NewWriter(&body)
+		if e.fileName != "" {
+			part, _ := writer.CreateFormFile("avatar", e.fileName)
+			part.Write(e.content)
+		}
+		writer.Close()
+
+		req, _ := http.NewRequest("PUT", "/me/avatar", &body)
+		req.Header.Set("Content-Type", writer.FormDataContentType())
+		req = withUserID(req, e.userID)
+
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(app.updateAvatar)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("%s: expected status of %d but got %d: %s", e.name, e.expectedStatusCode, rr.Code, rr.Body.String())
+			continue
+		}
+
+		if rr.Code != http.StatusAccepted {
+			if len(store.queued) != 0 {
+				t.Errorf("%s: queued a job for a refused upload", e.name)
+			}
+			continue
+		}
+
+		var resp struct {
+			Data struct {
+				Image string `json:"image"`
+			} `json:"data"`
+		}
+		_ = json.Unmarshal(rr.Body.Bytes(), &resp)
+
+		if !strings.HasPrefix(resp.Data.Image, "/media/avatars/1/") || !strings.HasSuffix(resp.Data.Image, "/256.jpg") {
+			t.Errorf("%s: unexpected image url %q", e.name, resp.Data.Image)
+			continue
+		}
+
+		if len(store.queued) != 1 || store.queued[0].Kind != jobProcessAvatar {
+			t.Errorf("%s: expected the avatar to be queued for processing but got %+v", e.name, store.queued)
+			continue
+		}
+
+		var payload processAvatarPayload
+		_ = json.Unmarshal(store.queued[0].Payload, &payload)
+
+		ran, err := app.jobs.RunNext(context.Background())
+		if !ran || err != nil || len(store.results) != 1 || store.results[0].Status != models.JobSucceeded {
+			t.Errorf("%s: expected the avatar to be processed but got %v, %v, %+v", e.name, ran, err, store.results)
+			continue
+		}
+
+		_, err = app.blobs.Get(context.Background(), payload.Original)
+		if !errors.Is(err, storage.ErrNotFound) {
+			t.Errorf("%s: expected the original to be removed but got %v", e.name, err)
+		}
+
+		key := strings.TrimPrefix(resp.Data.Image, "/media/")
+		req, _ = http.NewRequest("GET", resp.Data.Image, nil)
+		req = withURLParam(req, "*", key)
+
+		rr = httptest.NewRecorder()
+		http.HandlerFunc(app.serveMedia).ServeHTTP(rr, req)
+
+		img, format, err := image.Decode(rr.Body)
+		if rr.Code != http.StatusOK || err != nil || format != "jpeg" || img.Bounds().Dx() != 256 {
+			t.Errorf("%s: the stored avatar could not be served back", e.name)
+		}
+	}
+}
+
+func Test_app_processAvatar(t *testing.T) {
+	var jpg bytes.Buffer
+	jpeg.Encode(&jpg, image.NewRGBA(image.Rect(0, 0, 300, 200)), nil)
+	_ = app.blobs.Put(context.Background(), "uploads/avatars/2/deleted", bytes.NewReader(jpg.Bytes()), int64(jpg.Len()), "image/jpeg")
+	_ = app.blobs.Put(context.Background(), "uploads/avatars/1/broken", strings.NewReader("hello"), 5, "image/jpeg")
+
+	var tests = []struct {
+		name    string
+		payload processAvatarPayload
+	}{
+		{"original gone", processAvatarPayload{UserID: 1, Dir: "avatars/1/gone", Original: "uploads/avatars/1/gone"}},
+		{"not an image", processAvatarPayload{UserID: 1, Dir: "avatars/1/broken", Original: "uploads/avatars/1/broken"}},
+		{"user deleted meanwhile", processAvatarPayload{UserID: 2, Dir: "avatars/2/deleted", Original: "uploads/avatars/2/deleted"}},
+	}
+
+	for _, e := range tests {
+		store := &jobRepo{}
+		runner := jobs.NewRunner(store, jobs.DefaultOptions)
+		app.registerJobs(runner)
+
+		_, _ = runner.Enqueue(jobProcessAvatar, e.payload)
+		_, _ = runner.RunNext(context.Background())
+
+		if len(store.results) != 1 || store.results[0].Status != models.JobFailed {
+			t.Errorf("%s: expected the job to fail for good but got %+v", e.name, store.results)
+		}
+
+		_, err := app.blobs.Get(context.Background(), avatarKey(e.payload.Dir, 256))
+		if !errors.Is(err, storage.ErrNotFound) {
+			t.Errorf("%s: expected no thumbnails left behind but got %v", e.name, err)
+		}
+	}
+}
+
+// avatarRepo keeps the avatar and pending upload of user 1 in memory
+type avatarRepo struct {
+	dbrepo.TestDBRepo
+	image   string
+	pending string
+}
+
+func (m *avatarRepo) GetUserByID(id int) (*models.User, error) {
+	user, err := m.TestDBRepo.GetUserByID(id)
+	if err == nil {
+		user.Image = m.image
+	}
+	return user, err
+}
+
+func (m *avatarRepo) SetPendingImage(userID int, image string) error {
+	m.pending = image
+	return nil
+}
+
+func (m *avatarRepo) ApplyPendingImage(userID int, image string) (string, error) {
+	if image != m.pending {
+		return "", sql.ErrNoRows
+	}
+
+	old := m.image
+	m.image, m.pending = image, ""
+	return old, nil
+}
+
+func Test_app_updateAvatarTwice(t *testing.T) {
+	var jpg bytes.Buffer
+	jpeg.Encode(&jpg, image.NewRGBA(image.Rect(0, 0, 300, 200)), nil)
+
+	repo := &avatarRepo{}
+	store := &jobRepo{}
+	oldDB, oldJobs := app.DB, app.jobs
+	app.DB = repo
+	app.jobs = jobs.NewRunner(store, jobs.DefaultOptions)
+	app.registerJobs(app.jobs)
+	defer func() { app.DB, app.jobs = oldDB, oldJobs }()
+
+	var images []string
+	for i := 0; i < 2; i++ {
+		var body bytes.Buffer
+		writer := multipart.NewWriter(&body)
+		part, _ := writer.CreateFormFile("avatar", "me.jpg")
+		part.Write(jpg.Bytes())
+		writer.Close()
+
+		req, _ := http.NewRequest("PUT", "/me/avatar", &body)
+		req.Header.Set("Content-Type", writer.FormDataContentType())
+		req = withUserID(req, 1)
+
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(app.updateAvatar).ServeHTTP(rr, req)
+
+		var resp struct {
+			Data struct {
+				Image string `json:"image"`
+			} `json:"data"`
+		}
+		_ = json.Unmarshal(rr.Body.Bytes(), &resp)
+		images = append(images, resp.Data.Image)
+	}
+
+	if len(store.queued) != 2 {
+		t.Fatalf("expected two avatars queued but got %d", len(store.queued))
+	}
+
+	// the second upload is processed first, as a retry of the first would be
+	store.queued[0], store.queued[1] = store.queued[1], store.queued[0]
+	for i := 0; i < 2; i++ {
+		_, _ = app.jobs.RunNext(context.Background())
+	}
+
+	if repo.image != images[1] {
+		t.Errorf("expected the newest upload %s to win but got %s", images[1], repo.image)
+	}
+
+	for i, url := range images {
+		_, err := app.blobs.Get(context.Background(), strings.TrimPrefix(url, "/media/"))
+		if i == 1 && err != nil {
+			t.Errorf("the avatar in use was deleted: %s", err)
+		} else if i == 0 && !errors.Is(err, storage.ErrNotFound) {
+			t.Errorf("expected the superseded avatar to be removed but got %v", err)
+		}
+	}
+}
+
+func Test_app_serveMedia(t *testing.T) {
+	var tests = []struct {
+		name               string
+		key                string
+		expectedStatusCode int
+	}{
+		{"attachment", "attachments/1/test", http.StatusNotFound},
+		{"missing avatar", "avatars/1/none/256.jpg", http.StatusNotFound},
+	}
+
+	for _, e := range tests {
+		req, _ := http.NewRequest("GET", "/media/"+e.key, nil)
+		req = withURLParam(req, "*", e.key)
+
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(app.serveMedia)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("%s: expected status of %d but got %d", e.name, e.expectedStatusCode, rr.Code)
+		}
+	}
+}
+
+func Test_app_updateMe(t *testing.T) {
+	var tests = []struct {
+		name               string
+		userID             int
+		requestBody        string
+		expectedStatusCode int
+	}{
+		{"rename", 1, `{"first_name":"Taro","last_name":"Yamada"}`, http.StatusOK},
+		{"privacy only", 1, `{"show_real_name":true}`, http.StatusOK},
+		{"own avatar", 1, `{"image":"/media/avatars/1/abc/256.jpg"}`, http.StatusOK},
+		{"https image", 1, `{"image":"https://example.com/me.png"}`, http.StatusOK},
+		{"clear image", 1, `{"image":""}`, http.StatusOK},
+		{"script image", 1, `{"image":"javascript:alert(1)"}`, http.StatusBadRequest},
+		{"empty name", 1, `{"first_name":" "}`, http.StatusBadRequest},
+		{"255 characters of japanese", 1, `{"first_name":"` + strings.Repeat("山", 255) + `"}`, http.StatusOK},
+		{"name too long", 1, `{"last_name":"` + strings.Repeat("山", 256) + `"}`, http.StatusBadRequest},
+		{"unknown field", 1, `{"email":"new@example.com"}`, http.StatusBadRequest},
+		{"unknown user", 2, `{"first_name":"Taro"}`, http.StatusNotFound},
+	}
+
+	for _, e := range tests {
+		req, _ := http.NewRequest("PATCH", "/me", strings.NewReader(e.requestBody))
+		req = withUserID(req, e.userID)
+
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(app.updateMe)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("%s: expected status of %d but got %d: %s", e.name, e.expectedStatusCode, rr.Code, rr.Body.String())
+		}
+
+		if strings.Contains(rr.Body.String(), "$2a$") {
+			t.Errorf("%s: response exposes the password hash", e.name)
+		}
+	}
+}
+
+func Test_app_getMe(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/me", nil)
+	req = withUserID(req, 1)
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(app.getMe).ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), "admin@example.com") {
+		t.Errorf("expected own profile with email but got %d %s", rr.Code, rr.Body.String())
+	}
+
+	if strings.Contains(rr.Body.String(), "$2a$") {
+		t.Error("own profile exposes the password hash")
+	}
+}
+
+func Test_app_publicProfile(t *testing.T) {
+	var tests = []struct {
+		name               string
+		handler            http.HandlerFunc
+		id                 string
+		query              string
+		realName           bool
+		expectedStatusCode int
+	}{
+		{"profile", app.getUser, "1", "", false, http.StatusOK},
+		{"unknown profile", app.getUser, "2", "", false, http.StatusNotFound},
+		{"private reviews", app.userReviews, "1", "", false, http.StatusForbidden},
+		{"public reviews", app.userReviews, "1", "", true, http.StatusOK},
+		{"lessons", app.userLessons, "1", "?how=2", false, http.StatusOK},
+		{"lessons bad order", app.userLessons, "1", "?how=9", false, http.StatusBadRequest},
+		{"lessons unknown user", app.userLessons, "2", "", false, http.StatusNotFound},
+	}
+
+	for _, e := range tests {
+		oldDB := app.DB
+		if e.realName {
+			app.DB = &realNameRepo{}
+		}
+
+		req, _ := http.NewRequest("GET", "/users/"+e.id+e.query, nil)
+		req = withURLParam(req, "id", e.id)
+
+		rr := httptest.NewRecorder()
+		e.handler.ServeHTTP(rr, req)
+		app.DB = oldDB
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("%s: expected status of %d but got %d", e.name, e.expectedStatusCode, rr.Code)
+		}
+
+		if strings.Contains(rr.Body.String(), "admin@example.com") || strings.Contains(rr.Body.String(), "$2a$") {
+			t.Errorf("%s: public response exposes private data", e.name)
+		}
+	}
+}
+
+func Test_app_changePassword(t *testing.T) {
+	var tests = []struct {
+		name               string
+		userID             int
+		requestBody        string
+		expectedStatusCode int
+	}{
+		{"valid", 1, `{"current_password":"secret","new_password":"new-secret"}`, http.StatusOK},
+		{"wrong password", 1, `{"current_password":"guess","new_password":"new-secret"}`, http.StatusForbidden},
+		{"short password", 1, `{"current_password":"secret","new_password":"short"}`, http.StatusBadRequest},
+		{"unknown user", 2, `{"current_password":"secret","new_password":"new-secret"}`, http.StatusNotFound},
+	}
+
+	for _, e := range tests {
+		req, _ := http.NewRequest("POST", "/me/password", strings.NewReader(e.requestBody))
+		req = withUserID(req, e.userID)
+
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(app.changePassword)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("%s: expected status of %d but got %d: %s", e.name, e.expectedStatusCode, rr.Code, rr.Body.String())
+		}
+
+		if e.expectedStatusCode == http.StatusOK && !strings.Contains(rr.Body.String(), "access_token") {
+			t.Errorf("%s: expected new tokens for the current session", e.name)
+		}
+	}
+}
+
+func Test_app_requestEmailChange(t *testing.T) {
+	capture := app.mailer.(*mailer.Capture)
+
+	var tests = []struct {
+		name               string
+		requestBody        string
+		expectedStatusCode int
+		expectMail         bool
+	}{
+		{"valid", `{"new_email":"taro@example.com","password":"secret"}`, http.StatusAccepted, true},
+		{"wrong password", `{"new_email":"taro@example.com","password":"guess"}`, http.StatusForbidden, false},
+		{"invalid address", `{"new_email":"Taro <taro@example.com>","password":"secret"}`, http.StatusBadRequest, false},
+		{"same address", `{"new_email":"ADMIN@example.com","password":"secret"}`, http.StatusBadRequest, false},
+	}
+
+	for _, e := range tests {
+		sent := len(capture.Messages())
+
+		req, _ := http.NewRequest("POST", "/me/email", strings.NewReader(e.requestBody))
+		req = withUserID(req, 1)
+
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(app.requestEmailChange)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("%s: expected status of %d but got %d: %s", e.name, e.expectedStatusCode, rr.Code, rr.Body.String())
+		}
+
+		if (len(capture.Messages()) > sent) != e.expectMail {
+			t.Errorf("%s: expected mail to be sent: %t", e.name, e.expectMail)
+			continue
+		}
+
+		if e.expectMail {
+			msg, _ := capture.Last()
+			if msg.To != "taro@example.com" || !strings.Contains(msg.Text, app.Domain+"/settings/email/confirm?token=") {
+				t.Errorf("%s: unexpected confirmation mail %+v", e.name, msg)
+			}
+		}
+	}
+}
+
+func Test_app_confirmEmailChange(t *testing.T) {
+	var tests = []struct {
+		name               string
+		requestBody        string
+		expectedStatusCode int
+	}{
+		{"valid", `{"token":"valid-token"}`, http.StatusOK},
+		{"address taken", `{"token":"taken-token"}`, http.StatusConflict},
+		{"unknown token", `{"token":"other"}`, http.StatusNotFound},
+	}
+
+	for _, e := range tests {
+		req, _ := http.NewRequest("POST", "/me/email/confirm", strings.NewReader(e.requestBody))
+		req = withUserID(req, 1)
+
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(app.confirmEmailChange)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("%s: expected status of %d but got %d: %s", e.name, e.expectedStatusCode, rr.Code, rr.Body.String())
+		}
+	}
+}
+
+func Test_app_exportMe(t *testing.T) {
+	var tests = []struct {
+		name               string
+		userID             int
+		query              string
+		expectedStatusCode int
+	}{
+		{"json", 1, "", http.StatusOK},
+		{"zip", 1, "?format=zip", http.StatusOK},
+		{"bad format", 1, "?format=xml", http.StatusBadRequest},
+		{"unknown user", 2, "", http.StatusNotFound},
+	}
+
+	for _, e := range tests {
+		req, _ := http.NewRequest("GET", "/me/export"+e.query, nil)
+		req = withUserID(req, e.userID)
+
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(app.exportMe)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("%s: expected status of %d but got %d", e.name, e.expectedStatusCode, rr.Code)
+			continue
+		}
+
+		if rr.Code != http.StatusOK {
+			continue
+		}
+
+		body := rr.Body.Bytes()
+		if e.query == "?format=zip" {
+			archive, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+			if err != nil {
+				t.Fatalf("%s: export is not a zip archive: %s", e.name, err)
+			}
+
+			var names []string
+			for _, f := range archive.File {
+				names = append(names, f.Name)
+				if f.Name == "data.json" {
+					data, _ := f.Open()
+					body, _ = io.ReadAll(data)
+				}
+			}
+
+			if len(names) == 0 || names[0] != "data.json" {
+				t.Errorf("%s: expected data.json in the archive but got %v", e.name, names)
+			}
+		}
+
+		var export struct {
+			Profile struct {
+				Email string `json:"email"`
+			} `json:"profile"`
+			Votes []json.RawMessage `json:"votes"`
+		}
+		err := json.Unmarshal(body, &export)
+		if err != nil || export.Profile.Email != "admin@example.com" || len(export.Votes) != 1 {
+			t.Errorf("%s: unexpected export %s", e.name, body)
+		}
+
+		if bytes.Contains(body, []byte("$2a$")) {
+			t.Errorf("%s: export contains the password hash", e.name)
+		}
+	}
+}
+
+func Test_app_deleteMe(t *testing.T) {
+	var tests = []struct {
+		name               string
+		policy             string
+		userID             int
+		requestBody        string
+		expectedStatusCode int
+	}{
+		{"anonymize", accountDeletionAnonymize, 1, `{"password":"secret"}`, http.StatusAccepted},
+		{"cascade", accountDeletionCascade, 1, `{"password":"secret"}`, http.StatusAccepted},
+		{"wrong password", accountDeletionAnonymize, 1, `{"password":"guess"}`, http.StatusForbidden},
+		{"unknown user", accountDeletionAnonymize, 2, `{"password":"secret"}`, http.StatusNotFound},
+	}
+
+	for _, e := range tests {
+		app.AccountDeletion = e.policy
+
+		req, _ := http.NewRequest("DELETE", "/me", strings.NewReader(e.requestBody))
+		req = withUserID(req, e.userID)
+
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(app.deleteMe)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("%s: expected status of %d but got %d: %s", e.name, e.expectedStatusCode, rr.Code, rr.Body.String())
+		}
+	}
+
+	app.AccountDeletion = ""
+}
+
+func Test_app_getLesson(t *testing.T) {
+	var tests = []struct {
+		name               string
+		id                 string
+		userID             int
+		expectedStatusCode int
+		expectedFavorited  string
+	}{
+		{"anonymous", "1", 0, http.StatusOK, ""},
+		{"favorited", "1", 1, http.StatusOK, `"favorited":true`},
+		{"not favorited", "1", 2, http.StatusOK, `"favorited":false`},
+		{"unknown lesson", "2", 1, http.StatusNotFound, ""},
+	}
+
+	for _, e := range tests {
+		req, _ := http.NewRequest("GET", "/lessons/"+e.id, nil)
+		req = withURLParam(req, "id", e.id)
+		if e.userID != 0 {
+			req = withUserID(req, e.userID)
+		}
+
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(app.getLesson).ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("%s: expected status of %d but got %d", e.name, e.expectedStatusCode, rr.Code)
+		}
+
+		if e.expectedFavorited == "" && strings.Contains(rr.Body.String(), `"favorited"`) {
+			t.Errorf("%s: unexpected favorited flag: %s", e.name, rr.Body.String())
+		}
+
+		if e.expectedFavorited != "" && !strings.Contains(rr.Body.String(), e.expectedFavorited) {
+			t.Errorf("%s: expected %s but got %s", e.name, e.expectedFavorited, rr.Body.String())
+		}
+	}
+}
+
+func Test_app_allLessons(t *testing.T) {
+	var tests = []struct {
+		name               string
+		query              string
+		expectedStatusCode int
+	}{
+		{"default order", "", http.StatusOK},
+		{"most favorited", "?how=4", http.StatusOK},
+		{"top ranked", "?how=5", http.StatusOK},
+		{"trending", "?how=6", http.StatusOK},
+		{"bad order", "?how=9", http.StatusBadRequest},
+		{"not a number", "?how=x", http.StatusBadRequest},
+	}
+
+	for _, e := range tests {
+		req, _ := http.NewRequest("GET", "/lessons"+e.query, nil)
+
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(app.allLessons).ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("%s: expected status of %d but got %d", e.name, e.expectedStatusCode, rr.Code)
+		}
+	}
+}
+
+func Test_app_favorites(t *testing.T) {
+	var tests = []struct {
+		name               string
+		method             string
+		handler            http.HandlerFunc
+		id                 string
+		expectedStatusCode int
+	}{
+		{"add", "PUT", app.addFavorite, "1", http.StatusOK},
+		{"add unknown lesson", "PUT", app.addFavorite, "2", http.StatusNotFound},
+		{"add bad id", "PUT", app.addFavorite, "x", http.StatusBadRequest},
+		{"remove", "DELETE", app.removeFavorite, "1", http.StatusOK},
+		{"remove bad id", "DELETE", app.removeFavorite, "x", http.StatusBadRequest},
+	}
+
+	for _, e := range tests {
+		req, _ := http.NewRequest(e.method, "/lessons/"+e.id+"/favorite", nil)
+		req = withURLParam(req, "id", e.id)
+		req = withUserID(req, 1)
+
+		rr := httptest.NewRecorder()
+		e.handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("%s: expected status of %d but got %d", e.name, e.expectedStatusCode, rr.Code)
+		}
+	}
+
+	req, _ := http.NewRequest("GET", "/me/favorites", nil)
+	req = withUserID(req, 1)
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(app.myFavorites).ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), `"favorited":true`) {
+		t.Errorf("expected favorite lessons but got %d %s", rr.Code, rr.Body.String())
+	}
+}
+
+func Test_app_upsertOffering(t *testing.T) {
+	var tests = []struct {
+		name               string
+		lessonID           string
+		requestBody        string
+		expectedStatusCode int
+	}{
+		{"valid", "1", `{"year":2024,"term":"former","credits":2,"slots":[{"day":1,"period":1},{"day":3,"period":2}]}`, http.StatusOK},
+		{"no periods", "1", `{"year":2024,"term":"latter","credits":1}`, http.StatusOK},
+		{"missing term", "1", `{"year":2024,"credits":2}`, http.StatusBadRequest},
+		{"bad day", "1", `{"year":2024,"term":"former","slots":[{"day":8,"period":1}]}`, http.StatusBadRequest},
+		{"repeated period", "1", `{"year":2024,"term":"former","slots":[{"day":1,"period":1},{"day":1,"period":1}]}`, http.StatusBadRequest},
+		{"negative credits", "1", `{"year":2024,"term":"former","credits":-1}`, http.StatusBadRequest},
+		{"unknown lesson", "2", `{"year":2024,"term":"former","credits":2}`, http.StatusNotFound},
+	}
+
+	for _, e := range tests {
+		req, _ := http.NewRequest("POST", "/admin/lessons/"+e.lessonID+"/offerings", strings.NewReader(e.requestBody))
+		req = withURLParam(req, "id", e.lessonID)
+
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(app.upsertOffering).ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("%s: expected status of %d but got %d", e.name, e.expectedStatusCode, rr.Code)
+		}
+	}
+}
+
+func Test_app_lessonOfferings(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/lessons/1/offerings", nil)
+	req = withURLParam(req, "id", "1")
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(app.lessonOfferings).ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), `"slots":[{"day":1,"period":1}`) {
+		t.Errorf("expected offerings with their periods but got %d %s", rr.Code, rr.Body.String())
+	}
+}
+
+func Test_app_getTimetable(t *testing.T) {
+	var tests = []struct {
+		name               string
+		query              string
+		expectedStatusCode int
+		expectedBody       string
+	}{
+		{"timetable", "?year=2023&term=former", http.StatusOK, `"credits":2`},
+		{"empty term", "?year=2023&term=latter", http.StatusOK, `"entries":[]`},
+		{"missing year", "?term=former", http.StatusBadRequest, ""},
+		{"missing term", "?year=2023", http.StatusBadRequest, ""},
+	}
+
+	for _, e := range tests {
+		req, _ := http.NewRequest("GET", "/me/timetable"+e.query, nil)
+		req = withUserID(req, 1)
+
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(app.getTimetable).ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("%s: expected status of %d but got %d", e.name, e.expectedStatusCode, rr.Code)
+		}
+
+		if !strings.Contains(rr.Body.String(), e.expectedBody) {
+			t.Errorf("%s: expected %s in %s", e.name, e.expectedBody, rr.Body.String())
+		}
+	}
+}
+
+func Test_app_addTimetableEntry(t *testing.T) {
+	var tests = []struct {
+		name               string
+		requestBody        string
+		expectedStatusCode int
+		expectedBody       string
+	}{
+		{"fits", `{"offering_id":4}`, http.StatusCreated, `"lessons":1`},
+		{"already added", `{"offering_id":1}`, http.StatusOK, ""},
+		{"clash", `{"offering_id":2}`, http.StatusConflict, `"slot":{"day":1,"period":2},"offering_id":1`},
+		{"over credit limit", `{"offering_id":3}`, http.StatusUnprocessableEntity, "32 credits"},
+		{"unknown offering", `{"offering_id":9}`, http.StatusNotFound, ""},
+	}
+
+	for _, e := range tests {
+		req, _ := http.NewRequest("POST", "/me/timetable", strings.NewReader(e.requestBody))
+		req = withUserID(req, 1)
+
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(app.addTimetableEntry).ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("%s: expected status of %d but got %d", e.name, e.expectedStatusCode, rr.Code)
+		}
+
+		if !strings.Contains(rr.Body.String(), e.expectedBody) {
+			t.Errorf("%s: expected %s in %s", e.name, e.expectedBody, rr.Body.String())
+		}
+	}
+}
+
+func Test_app_removeTimetableEntry(t *testing.T) {
+	var tests = []struct {
+		name               string
+		id                 string
+		expectedStatusCode int
+	}{
+		{"remove", "1", http.StatusOK},
+		{"not in timetable", "4", http.StatusNotFound},
+		{"bad id", "x", http.StatusBadRequest},
+	}
+
+	for _, e := range tests {
+		req, _ := http.NewRequest("DELETE", "/me/timetable/"+e.id, nil)
+		req = withURLParam(req, "id", e.id)
+		req = withUserID(req, 1)
+
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(app.removeTimetableEntry).ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("%s: expected status of %d but got %d", e.name, e.expectedStatusCode, rr.Code)
+		}
+	}
+}
+
+func Test_app_upsertAcademicTerm(t *testing.T) {
+	var tests = []struct {
+		name               string
+		requestBody        string
+		expectedStatusCode int
+	}{
+		{"valid", `{"year":2024,"term":"former","starts_on":"2024-04-10","ends_on":"2024-08-09"}`, http.StatusOK},
+		{"missing term", `{"year":2024,"starts_on":"2024-04-10","ends_on":"2024-08-09"}`, http.StatusBadRequest},
+		{"bad date", `{"year":2024,"term":"former","starts_on":"10/04/2024","ends_on":"2024-08-09"}`, http.StatusBadRequest},
+		{"ends before start", `{"year":2024,"term":"former","starts_on":"2024-08-10","ends_on":"2024-08-09"}`, http.StatusBadRequest},
+	}
+
+	for _, e := range tests {
+		req, _ := http.NewRequest("PUT", "/admin/terms", strings.NewReader(e.requestBody))
+
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(app.upsertAcademicTerm).ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("%s: expected status of %d but got %d", e.name, e.expectedStatusCode, rr.Code)
+		}
+	}
+}
+
+func Test_app_timetableCalendar(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/me/timetable.ics", nil)
+	req = withUserID(req, 1)
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(app.timetableCalendar).ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK || rr.Header().Get("Content-Type") != "text/calendar; charset=utf-8" {
+		t.Fatalf("expected a calendar but got %d %s", rr.Code, rr.Header().Get("Content-Type"))
+	}
+
+	// offering 1 meets on monday in the first and second period; the term starts on monday 2023-04-10
+	for _, expected := range []string{
+		"UID:timetable-1-1-1-1@kstation\r\n",
+		"UID:timetable-1-1-1-2@kstation\r\n",
+		"DTSTART;TZID=Asia/Tokyo:20230410T084000\r\n",
+		"RRULE:FREQ=WEEKLY;UNTIL=20230809T145959Z\r\n",
+		"SUMMARY:Math\r\n",
+	} {
+		if !strings.Contains(rr.Body.String(), expected) {
+			t.Errorf("expected %q in %s", expected, rr.Body.String())
+		}
+	}
+}
+
+func Test_app_subscribeTimetable(t *testing.T) {
+	req, _ := http.NewRequest("POST", "/me/timetable/subscription", nil)
+	req = withUserID(req, 1)
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(app.subscribeTimetable).ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusCreated || !strings.Contains(rr.Body.String(), `"url":"http://api.example.com/calendar/`) {
+		t.Errorf("expected a subscription url but got %d %s", rr.Code, rr.Body.String())
+	}
+
+	var tests = []struct {
+		name               string
+		path               string
+		expectedStatusCode int
+	}{
+		{"valid token", "/calendar/valid-token.ics", http.StatusOK},
+		{"unknown token", "/calendar/other-token.ics", http.StatusNotFound},
+	}
+
+	routes := app.routes()
+	for _, e := range tests {
+		req, _ := http.NewRequest("GET", e.path, nil)
+
+		rr := httptest.NewRecorder()
+		routes.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("%s: expected status of %d but got %d", e.name, e.expectedStatusCode, rr.Code)
+		}
+	}
+}
+
+func Test_app_myRecommendations(t *testing.T) {
+	var tests = []struct {
+		name               string
+		userID             int
+		query              string
+		expectedStatusCode int
+		expectedBody       string
+	}{
+		{"recommendations", 1, "", http.StatusOK, `"reason":"same_teacher"`},
+		{"none yet", 2, "", http.StatusOK, `[]`},
+		{"bad page", 1, "?page=0", http.StatusBadRequest, ""},
+	}
+
+	for _, e := range tests {
+		req, _ := http.NewRequest("GET", "/me/recommendations"+e.query, nil)
+		req = withUserID(req, e.userID)
+
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(app.myRecommendations).ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("%s: expected status of %d but got %d", e.name, e.expectedStatusCode, rr.Code)
+		}
+
+		if !strings.Contains(rr.Body.String(), e.expectedBody) {
+			t.Errorf("%s: expected %s in %s", e.name, e.expectedBody, rr.Body.String())
+		}
+	}
+}
+
+func Test_app_lessonRankings(t *testing.T) {
+	var tests = []struct {
+		name               string
+		query              string
+		expectedStatusCode int
+		expectedBody       string
+	}{
+		{"top", "", http.StatusOK, `"rank":1`},
+		{"trending", "?sort=trending", http.StatusOK, `"trending_score":1.2`},
+		{"department", "?department=math", http.StatusOK, `"lesson_id":1`},
+		{"empty department", "?department=art", http.StatusOK, `[]`},
+		{"term", "?year=2023&term=spring", http.StatusOK, `"term":"spring"`},
+		{"second page", "?page=2", http.StatusOK, `"rank":21`},
+		{"year without term", "?year=2023", http.StatusBadRequest, ""},
+		{"term without year", "?term=spring", http.StatusBadRequest, ""},
+		{"bad year", "?year=x&term=spring", http.StatusBadRequest, ""},
+		{"trending per term", "?sort=trending&year=2023&term=spring", http.StatusBadRequest, ""},
+		{"bad sort", "?sort=newest", http.StatusBadRequest, ""},
+	}
+
+	for _, e := range tests {
+		req, _ := http.NewRequest("GET", "/lessons/rankings"+e.query, nil)
+
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(app.lessonRankings).ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("%s: expected status of %d but got %d", e.name, e.expectedStatusCode, rr.Code)
+		}
+
+		if !strings.Contains(rr.Body.String(), e.expectedBody) {
+			t.Errorf("%s: expected %s in %s", e.name, e.expectedBody, rr.Body.String())
+		}
+	}
+}
+
+func Test_app_follows(t *testing.T) {
+	var tests = []struct {
+		name               string
+		method             string
+		handler            http.HandlerFunc
+		param              string
+		value              string
+		expectedStatusCode int
+	}{
+		{"follow lesson", "PUT", app.followLesson, "id", "1", http.StatusOK},
+		{"follow unknown lesson", "PUT", app.followLesson, "id", "2", http.StatusNotFound},
+		{"follow bad id", "PUT", app.followLesson, "id", "x", http.StatusBadRequest},
+		{"unfollow lesson", "DELETE", app.unfollowLesson, "id", "1", http.StatusOK},
+		{"follow teacher", "PUT", app.followTeacher, "name", "Yamada", http.StatusOK},
+		{"follow escaped teacher", "PUT", app.followTeacher, "name", "%E5%B1%B1%E7%94%B0%20%E5%A4%AA%E9%83%8E", http.StatusOK},
+		{"follow unknown teacher", "PUT", app.followTeacher, "name", "Sato", http.StatusNotFound},
+		{"follow blank teacher", "PUT", app.followTeacher, "name", "%20", http.StatusBadRequest},
+		{"follow bad escape", "PUT", app.followTeacher, "name", "%zz", http.StatusBadRequest},
+		{"unfollow teacher", "DELETE", app.unfollowTeacher, "name", "Yamada", http.StatusOK},
+	}
+
+	for _, e := range tests {
+		req, _ := http.NewRequest(e.method, "/follow", nil)
+		req = withURLParam(req, e.param, e.value)
+		req = withUserID(req, 1)
+
+		rr := httptest.NewRecorder()
+		e.handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("%s: expected status of %d but got %d", e.name, e.expectedStatusCode, rr.Code)
+		}
+	}
+}
+
+func Test_app_myFollows(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/me/follows", nil)
+	req = withUserID(req, 1)
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(app.myFollows).ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status of %d but got %d", http.StatusOK, rr.Code)
+	}
+
+	if !strings.Contains(rr.Body.String(), `"teachers":["Yamada"]`) {
+		t.Errorf("expected followed teachers in %s", rr.Body.String())
+	}
+}
+
+func Test_app_notifications(t *testing.T) {
+	var tests = []struct {
+		name               string
+		method             string
+		handler            http.HandlerFunc
+		userID             int
+		query              string
+		id                 string
+		expectedStatusCode int
+		expectedBody       string
+	}{
+		{"list", "GET", app.myNotifications, 1, "", "", http.StatusOK, `"kind":"new_review"`},
+		{"unread only", "GET", app.myNotifications, 1, "?unread=true", "", http.StatusOK, `"read_at":null`},
+		{"none", "GET", app.myNotifications, 2, "", "", http.StatusOK, `[]`},
+		{"bad unread", "GET", app.myNotifications, 1, "?unread=maybe", "", http.StatusBadRequest, ""},
+		{"bad page", "GET", app.myNotifications, 1, "?page=0", "", http.StatusBadRequest, ""},
+		{"unread count", "GET", app.unreadNotificationCount, 1, "", "", http.StatusOK, `"unread":1`},
+		{"mark read", "POST", app.markNotificationRead, 1, "", "1", http.StatusOK, ""},
+		{"mark someone else's", "POST", app.markNotificationRead, 2, "", "1", http.StatusNotFound, ""},
+		{"mark bad id", "POST", app.markNotificationRead, 1, "", "x", http.StatusBadRequest, ""},
+		{"mark all read", "POST", app.markAllNotificationsRead, 1, "", "", http.StatusOK, ""},
+	}
+
+	for _, e := range tests {
+		req, _ := http.NewRequest(e.method, "/me/notifications"+e.query, nil)
+		if e.id != "" {
+			req = withURLParam(req, "id", e.id)
+		}
+		req = withUserID(req, e.userID)
+
+		rr := httptest.NewRecorder()
+		e.handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("%s: expected status of %d but got %d", e.name, e.expectedStatusCode, rr.Code)
+		}
+
+		if !strings.Contains(rr.Body.String(), e.expectedBody) {
+			t.Errorf("%s: expected %s in %s", e.name, e.expectedBody, rr.Body.String())
+		}
+	}
+}
+
+func Test_app_digestPreferences(t *testing.T) {
+	var tests = []struct {
+		name               string
+		method             string
+		handler            http.HandlerFunc
+		requestBody        string
+		expectedStatusCode int
+		expectedBody       string
+	}{
+		{"get", "GET", app.myDigestPreferences, "", http.StatusOK, `"enabled":true,"language":"ja"`},
+		{"update", "PUT", app.updateDigestPreferences, `{"enabled":false,"language":"en"}`, http.StatusOK, ""},
+		{"unknown language", "PUT", app.updateDigestPreferences, `{"enabled":true,"language":"fr"}`, http.StatusBadRequest, ""},
+		{"missing language", "PUT", app.updateDigestPreferences, `{"enabled":true}`, http.StatusBadRequest, ""},
+	}
+
+	for _, e := range tests {
+		req, _ := http.NewRequest(e.method, "/me/digest", strings.NewReader(e.requestBody))
+		req = withUserID(req, 1)
+
+		rr := httptest.NewRecorder()
+		e.handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("%s: expected status of %d but got %d", e.name, e.expectedStatusCode, rr.Code)
+		}
+
+		if !strings.Contains(rr.Body.String(), e.expectedBody) {
+			t.Errorf("%s: expected %s in %s", e.name, e.expectedBody, rr.Body.String())
+		}
+	}
+}
+
+func Test_app_unsubscribeDigest(t *testing.T) {
+	token := digest.UnsubscribeToken(app.UnsubscribeSecret, 1)
+
+	var tests = []struct {
+		name               string
+		query              string
+		requestBody        string
+		expectedStatusCode int
+	}{
+		{"one-click", "?token=" + token, "List-Unsubscribe=One-Click", http.StatusOK},
+		{"json body", "", `{"token":"` + token + `"}`, http.StatusOK},
+		{"forged token", "?token=1.abc", "", http.StatusNotFound},
+		{"other secret", "?token=" + digest.UnsubscribeToken("other", 1), "", http.StatusNotFound},
+		{"no token", "", "", http.StatusBadRequest},
+	}
+
+	for _, e := range tests {
+		req, _ := http.NewRequest("POST", "/digest/unsubscribe"+e.query, strings.NewReader(e.requestBody))
+
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(app.unsubscribeDigest).ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("%s: expected status of %d but got %d: %s", e.name, e.expectedStatusCode, rr.Code, rr.Body.String())
+		}
+	}
+}
+
+func Test_app_jobs(t *testing.T) {
+	var tests = []struct {
+		name               string
+		method             string
+		handler            http.HandlerFunc
+		query              string
+		id                 string
+		requestBody        string
+		expectedStatusCode int
+		expectedBody       string
+	}{
+		{"list", "GET", app.allJobs, "", "", "", http.StatusOK, `"last_error":"connection refused"`},
+		{"list failed", "GET", app.allJobs, "?status=failed", "", "", http.StatusOK, `"status":"failed"`},
+		{"list succeeded", "GET", app.allJobs, "?status=succeeded", "", "", http.StatusOK, `[]`},
+		{"list bad status", "GET", app.allJobs, "?status=dead", "", "", http.StatusBadRequest, ""},
+		{"get", "GET", app.getJob, "", "1", "", http.StatusOK, `"kind":"compute_rankings"`},
+		{"get unknown", "GET", app.getJob, "", "2", "", http.StatusNotFound, ""},
+		{"enqueue", "POST", app.enqueueJob, "", "", `{"kind":"repair_lesson_aggregates","payload":{"lesson_id":1}}`, http.StatusAccepted, `"job_id":1`},
+		{"enqueue without payload", "POST", app.enqueueJob, "", "", `{"kind":"compute_rankings"}`, http.StatusAccepted, ""},
+		{"enqueue unknown kind", "POST", app.enqueueJob, "", "", `{"kind":"format_disk"}`, http.StatusBadRequest, "purge_deleted"},
+		{"retry", "POST", app.retryJob, "", "1", "", http.StatusOK, ""},
+		{"retry unknown", "POST", app.retryJob, "", "2", "", http.StatusNotFound, ""},
+	}
+
+	for _, e := range tests {
+		req, _ := http.NewRequest(e.method, "/admin/jobs"+e.query, strings.NewReader(e.requestBody))
+		if e.id != "" {
+			req = withURLParam(req, "id", e.id)
+		}
+
+		rr := httptest.NewRecorder()
+		e.handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("%s: expected status of %d but got %d: %s", e.name, e.expectedStatusCode, rr.Code, rr.Body.String())
+		}
+
+		if !strings.Contains(rr.Body.String(), e.expectedBody) {
+			t.Errorf("%s: expected %s in %s", e.name, e.expectedBody, rr.Body.String())
+		}
+	}
+}
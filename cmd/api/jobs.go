@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"kstation_backend/internal/jobs"
+	"log"
+)
+
+// kinds of background jobs
+const (
+	jobPurgeDeleted           = "purge_deleted"
+	jobComputeRecommendations = "compute_recommendations"
+	jobComputeRankings        = "compute_rankings"
+	jobSendDigests            = "send_digests"
+	jobRepairAggregates       = "repair_lesson_aggregates"
+	jobNotifyFollowers        = "notify_followers"
+	jobDeliverWebhooks        = "deliver_webhooks"
+	jobProcessAvatar          = "process_avatar"
+)
+
+// repairAggregatesPayload names the lesson whose aggregates are recomputed,
+// or every lesson when LessonID is 0
+type repairAggregatesPayload struct {
+	LessonID int `json:"lesson_id"`
+}
+
+// registerJobs adds the handler of every kind of job to a runner
+func (app *application) registerJobs(runner *jobs.Runner) {
+	runner.Handle(jobPurgeDeleted, app.purgeDeleted)
+	runner.Handle(jobComputeRecommendations, app.refreshRecommendations)
+	runner.Handle(jobComputeRankings, app.refreshRankings)
+	runner.Handle(jobSendDigests, app.sendDigests)
+	runner.Handle(jobRepairAggregates, jobs.Typed(app.repairAggregates))
+	runner.Handle(jobNotifyFollowers, jobs.Typed(app.notifyFollowers))
+	runner.Handle(jobDeliverWebhooks, app.deliverWebhooks)
+	runner.Handle(jobProcessAvatar, jobs.Typed(app.processAvatar))
+}
+
+// repairAggregates recomputes the star averages and review counts stored on
+// lessons, which drift if a request fails between saving a review and
+// updating its lesson
+func (app *application) repairAggregates(ctx context.Context, payload repairAggregatesPayload) error {
+	if payload.LessonID != 0 {
+		return app.DB.UpdateLessonAggregates(payload.LessonID)
+	}
+
+	lessons, err := app.DB.AllLessons(0)
+	if err != nil {
+		return err
+	}
+
+	for _, lesson := range lessons {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		err = app.DB.UpdateLessonAggregates(lesson.ID)
+		if err != nil {
+			return err
+		}
+	}
+
+	log.Println("Repaired lesson aggregates:", len(lessons))
+
+	return nil
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"kstation_backend/internal/jobs"
+	"kstation_backend/internal/models"
+	"kstation_backend/internal/repository/dbrepo"
+	"kstation_backend/internal/storage"
+	"strings"
+	"testing"
+	"time"
+)
+
+// jobRepo records which lessons had their aggregates repaired and what was
+// purged, and queues jobs in memory
+type jobRepo struct {
+	dbrepo.TestDBRepo
+	repaired     []int
+	attachments  []*models.Attachment
+	removed      []int
+	purgedBefore time.Time
+	prunedBefore time.Time
+	queued       []models.Job
+	results      []models.Job
+}
+
+func (m *jobRepo) AllLessons(how int) ([]*models.Lesson, error) {
+	return []*models.Lesson{{ID: 1}, {ID: 2}, {ID: 3}}, nil
+}
+
+func (m *jobRepo) UpdateLessonAggregates(id int) error {
+	m.repaired = append(m.repaired, id)
+	return nil
+}
+
+func (m *jobRepo) AttachmentsOfDeletedLessons(before time.Time) ([]*models.Attachment, error) {
+	return m.attachments, nil
+}
+
+func (m *jobRepo) DeleteAttachment(id int) error {
+	m.removed = append(m.removed, id)
+	return nil
+}
+
+func (m *jobRepo) PurgeDeleted(before time.Time) (int64, error) {
+	m.purgedBefore = before
+	return 2, nil
+}
+
+func (m *jobRepo) PruneJobs(before time.Time) (int64, error) {
+	m.prunedBefore = before
+	return 1, nil
+}
+
+func (m *jobRepo) EnqueueJob(job models.Job) (int, error) {
+	job.ID = len(m.queued) + 1
+	m.queued = append(m.queued, job)
+	return job.ID, nil
+}
+
+func (m *jobRepo) ClaimJobs(kinds []string, limit int, lease time.Duration) ([]*models.Job, error) {
+	if len(m.queued) == 0 {
+		return nil, nil
+	}
+
+	job := m.queued[0]
+	m.queued = m.queued[1:]
+	job.Attempts++
+	return []*models.Job{&job}, nil
+}
+
+func (m *jobRepo) RecordJobResult(job models.Job) error {
+	m.results = append(m.results, job)
+	return nil
+}
+
+func Test_app_repairAggregatesJob(t *testing.T) {
+	var tests = []struct {
+		name     string
+		payload  interface{}
+		repaired []int
+	}{
+		{"one lesson", repairAggregatesPayload{LessonID: 2}, []int{2}},
+		{"every lesson", nil, []int{1, 2, 3}},
+	}
+
+	for _, e := range tests {
+		repo := &jobRepo{}
+		oldDB := app.DB
+		app.DB = repo
+
+		runner := jobs.NewRunner(repo, jobs.DefaultOptions)
+		app.registerJobs(runner)
+
+		_, err := runner.Enqueue(jobRepairAggregates, e.payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ran, err := runner.RunNext(context.Background())
+		app.DB = oldDB
+		if err != nil || !ran {
+			t.Fatalf("%s: expected the job to run but got %v, %v", e.name, ran, err)
+		}
+
+		if len(repo.results) != 1 || repo.results[0].Status != models.JobSucceeded {
+			t.Errorf("%s: expected the job to succeed but got %+v", e.name, repo.results)
+		}
+
+		if len(repo.repaired) != len(e.repaired) {
+			t.Fatalf("%s: expected lessons %v repaired but got %v", e.name, e.repaired, repo.repaired)
+		}
+		for i := range e.repaired {
+			if repo.repaired[i] != e.repaired[i] {
+				t.Errorf("%s: expected lessons %v repaired but got %v", e.name, e.repaired, repo.repaired)
+			}
+		}
+	}
+}
+
+func Test_app_purgeDeletedJob(t *testing.T) {
+	_ = app.blobs.Put(context.Background(), "attachments/2/deleted", strings.NewReader("old exam"), 8, "application/pdf")
+
+	repo := &jobRepo{attachments: []*models.Attachment{
+		{ID: 5, LessonId: 2, StorageKey: "attachments/2/deleted"},
+		{ID: 6, LessonId: 2, StorageKey: "attachments/2/missing"},
+	}}
+	oldDB, oldRetention := app.DB, app.PurgeRetention
+	app.DB, app.PurgeRetention = repo, time.Hour*24*30
+	defer func() { app.DB, app.PurgeRetention = oldDB, oldRetention }()
+
+	err := app.purgeDeleted(context.Background(), &models.Job{Kind: jobPurgeDeleted})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cutoff := time.Now().Add(-app.PurgeRetention)
+	if repo.purgedBefore.Sub(cutoff).Abs() > time.Minute || !repo.prunedBefore.Equal(repo.purgedBefore) {
+		t.Errorf("expected rows and jobs purged before %s but got %s and %s", cutoff, repo.purgedBefore, repo.prunedBefore)
+	}
+
+	if len(repo.removed) != 2 || repo.removed[0] != 5 || repo.removed[1] != 6 {
+		t.Errorf("expected attachments 5 and 6 removed but got %v", repo.removed)
+	}
+
+	_, err = app.blobs.Get(context.Background(), "attachments/2/deleted")
+	if !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("expected the attachment file to be deleted but got %v", err)
+	}
+}
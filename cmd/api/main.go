@@ -1,17 +1,37 @@
 package main
 
 import (
+	"kstation_backend/internal/contentfilter"
+	"kstation_backend/internal/jobs"
+	"kstation_backend/internal/mailer"
+	"kstation_backend/internal/pubsub"
+	"kstation_backend/internal/ranking"
 	"kstation_backend/internal/repository"
 	"kstation_backend/internal/repository/dbrepo"
+	"kstation_backend/internal/storage"
+	"kstation_backend/internal/timetable"
+	"kstation_backend/internal/webhook"
+	"context"
 	"flag"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
+	_ "time/tzdata"
 )
 
 const port = 8080
 
+// what happens to the content of users who delete their own account
+const (
+	accountDeletionAnonymize = "anonymize"
+	accountDeletionCascade   = "cascade"
+)
+
 type application struct {
 	DSN string
 	Domain string
@@ -21,6 +41,30 @@ type application struct {
 	JWTIssuer string
 	JWTAudience string
 	CookieDomain string
+	PseudonymSecret string
+	contentPolicy *contentfilter.Policy
+	blobs storage.BlobStore
+	scanner storage.Scanner
+	urlSigner storage.Signer
+	MaxUploadSize int64
+	DownloadURLTTL time.Duration
+	MaxAvatarSize int64
+	MediaURL string
+	mailer mailer.Mailer
+	AccountDeletion string
+	CreditLimit int
+	APIURL string
+	UnsubscribeSecret string
+	DigestPeriod time.Duration
+	PurgeRetention time.Duration
+	periods []timetable.Period
+	location *time.Location
+	rankingOptions ranking.Options
+	hub *pubsub.Hub
+	events pubsub.Publisher
+	webhooks *webhook.Sender
+	webhookRetry webhook.RetryPolicy
+	jobs *jobs.Runner
 }
 
 func main() {
@@ -31,16 +75,119 @@ func main() {
 	flag.StringVar(&app.JWTIssuer, "jwt-issuer", "example.com", "signing issuer")
 	flag.StringVar(&app.JWTAudience, "jwt-audience", "example.com", "signing audience")
 	flag.StringVar(&app.CookieDomain, "cookie-domain", "localhost", "signing secret")
-	flag.StringVar(&app.JWTSecret,"domain", "jwt-secret", "domain")
+	flag.StringVar(&app.PseudonymSecret, "pseudonym-secret", "", "secret for deriving reviewer pseudonyms; required")
+	flag.StringVar(&app.Domain, "domain", "http://localhost:3000", "url of the web client, used in links sent by email")
+	rejectWords := flag.String("reject-words", "", "file of words that get a comment rejected, one per line")
+	holdWords := flag.String("hold-words", "", "file of words that hold a comment for review, one per line")
+	flag.DurationVar(&app.PurgeRetention, "purge-retention", time.Hour * 24 * 30, "how long soft deleted rows and finished jobs are kept before being purged")
+	purgeInterval := flag.Duration("purge-interval", time.Hour * 24, "how often soft deleted rows are purged")
+	recommendInterval := flag.Duration("recommend-interval", time.Hour * 6, "how often lesson recommendations are recomputed")
+	eventChannel := flag.String("event-channel", "", "Postgres channel lesson events are shared on between API instances; empty keeps them in this process")
+	webhookInterval := flag.Duration("webhook-interval", time.Minute * 5, "how often due webhook deliveries are looked for, besides right after they are queued and when their retry is due")
+	webhookTimeout := flag.Duration("webhook-timeout", time.Second * 10, "how long a webhook receiver has to answer")
+	flag.IntVar(&app.webhookRetry.MaxAttempts, "webhook-max-attempts", 8, "how many times a webhook delivery is tried before it is dead-lettered")
+	flag.DurationVar(&app.webhookRetry.BaseDelay, "webhook-retry-delay", time.Second * 30, "how long until a failed webhook delivery is first retried; doubles after every attempt")
+	app.webhookRetry.MaxDelay = time.Hour * 6
+	digestInterval := flag.Duration("digest-interval", time.Hour, "how often users due an email digest are looked for")
+	flag.DurationVar(&app.DigestPeriod, "digest-period", time.Hour * 24 * 7, "how often a user gets an email digest of new reviews on their favorite lessons")
+	repairSchedule := flag.String("repair-schedule", "30 4 * * *", "when lesson star averages and review counts are recomputed, as an interval or a cron expression in the configured timezone")
+	jobOptions := jobs.DefaultOptions
+	flag.IntVar(&jobOptions.Workers, "job-workers", jobs.DefaultOptions.Workers, "how many background jobs run at once")
+	flag.DurationVar(&jobOptions.PollInterval, "job-poll-interval", jobs.DefaultOptions.PollInterval, "how often idle workers look for due background jobs")
+	flag.DurationVar(&jobOptions.Lease, "job-lease", jobs.DefaultOptions.Lease, "how long a background job may run before it is given to another worker")
+	flag.IntVar(&jobOptions.MaxAttempts, "job-max-attempts", jobs.DefaultOptions.MaxAttempts, "how many times a background job is tried before it fails")
+	flag.DurationVar(&jobOptions.Backoff.BaseDelay, "job-retry-delay", jobs.DefaultOptions.Backoff.BaseDelay, "how long until a failed background job is first retried; doubles after every attempt")
+	flag.StringVar(&app.UnsubscribeSecret, "unsubscribe-secret", "", "secret for signing digest unsubscribe links; required")
+	rankingInterval := flag.Duration("ranking-interval", time.Hour, "how often lesson rankings are recomputed")
+	app.rankingOptions = ranking.DefaultOptions
+	flag.Float64Var(&app.rankingOptions.PriorWeight, "ranking-prior-weight", ranking.DefaultOptions.PriorWeight, "how many reviews at the mean star are blended into every lesson's ranking")
+	flag.DurationVar(&app.rankingOptions.HalfLife, "trending-half-life", ranking.DefaultOptions.HalfLife, "how long until a review or favorite counts half toward trending")
+	studentIDPattern := flag.String("student-id-pattern", contentfilter.DefaultStudentIDPattern, "regexp matching student ids in comments")
+	blobDir := flag.String("blob-dir", "./uploads", "directory for uploaded files when no s3 endpoint is set")
+	s3Endpoint := flag.String("s3-endpoint", "", "S3-compatible endpoint for uploaded files, e.g. http://localhost:9000")
+	s3Bucket := flag.String("s3-bucket", "kstation", "bucket for uploaded files")
+	s3Region := flag.String("s3-region", "ap-northeast-1", "region of the s3 bucket")
+	s3AccessKey := flag.String("s3-access-key", "", "s3 access key")
+	s3SecretKey := flag.String("s3-secret-key", "", "s3 secret key")
+	clamdAddr := flag.String("clamd-addr", "", "clamd address (host:port or unix socket) for scanning uploads; empty disables scanning")
+	urlSecret := flag.String("url-secret", "", "secret for signing download links; required")
+	flag.Int64Var(&app.MaxUploadSize, "max-upload-size", 10 << 20, "largest file that can be uploaded, in bytes")
+	flag.Int64Var(&app.MaxAvatarSize, "max-avatar-size", 5 << 20, "largest avatar image that can be uploaded, in bytes")
+	flag.StringVar(&app.MediaURL, "media-url", "/media", "base url that avatar images are served from")
+	flag.DurationVar(&app.DownloadURLTTL, "download-url-ttl", time.Minute * 15, "how long a download link stays valid")
+	smtpAddr := flag.String("smtp-addr", "", "smtp server (host:port) for outgoing mail; empty logs mail instead")
+	smtpFrom := flag.String("smtp-from", "noreply@localhost", "sender address of outgoing mail")
+	smtpUser := flag.String("smtp-user", "", "smtp username")
+	smtpPassword := flag.String("smtp-password", "", "smtp password")
+	flag.StringVar(&app.AccountDeletion, "account-deletion", accountDeletionAnonymize, "when users delete their account, anonymize keeps their reviews as \"deleted user\" and cascade removes them")
+	flag.IntVar(&app.CreditLimit, "credit-limit", 24, "most credits a student can put in a timetable for one term; 0 disables the limit")
+	flag.StringVar(&app.APIURL, "api-url", "http://localhost:8080", "public url of this api, used in calendar subscription links")
+	periodTimes := flag.String("period-times", timetable.DefaultPeriods, "start and end of each class period, e.g. 08:40-09:55,10:10-11:25")
+	timezone := flag.String("timezone", "Asia/Tokyo", "time zone of class periods in exported calendars")
+	readTimeout := flag.Duration("read-timeout", time.Second * 30, "how long a client has to send a whole request, including uploads")
+	writeTimeout := flag.Duration("write-timeout", time.Minute, "how long a request may take to answer; event streams are exempt")
+	idleTimeout := flag.Duration("idle-timeout", time.Minute * 2, "how long an idle keep-alive connection is kept open")
+	shutdownTimeout := flag.Duration("shutdown-timeout", time.Second * 30, "how long in-flight requests and background work get to finish on SIGINT or SIGTERM")
 	flag.Parse()
 
+	if app.AccountDeletion != accountDeletionAnonymize && app.AccountDeletion != accountDeletionCascade {
+		log.Fatal("account-deletion must be anonymize or cascade")
+	}
+
+	err := checkSecret("pseudonym-secret", app.PseudonymSecret)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = checkSecret("url-secret", *urlSecret)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = checkSecret("unsubscribe-secret", app.UnsubscribeSecret)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	app.mailer = mailer.Log{}
+	if *smtpAddr != "" {
+		app.mailer = &mailer.SMTP{Addr: *smtpAddr, From: *smtpFrom, Username: *smtpUser, Password: *smtpPassword}
+	}
+
+	app.blobs = storage.NewLocalStore(*blobDir)
+	if *s3Endpoint != "" {
+		app.blobs = storage.NewS3Store(*s3Endpoint, *s3Bucket, *s3Region, *s3AccessKey, *s3SecretKey)
+	}
+	if *clamdAddr != "" {
+		app.scanner = storage.NewClamdScanner(*clamdAddr)
+	}
+	app.urlSigner = storage.Signer{Secret: []byte(*urlSecret)}
+
+	policy, err := buildContentPolicy(*rejectWords, *holdWords, *studentIDPattern)
+	if err != nil {
+		log.Fatal(err)
+	}
+	app.contentPolicy = policy
+
+	app.periods, err = timetable.ParsePeriods(*periodTimes)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	app.location, err = time.LoadLocation(*timezone)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	repairAt, err := jobs.ParseSchedule(*repairSchedule, app.location)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	conn, err := app.connectToDB()
 	if err != nil {
 		log.Fatal(err)
 	}
 
 	app.DB = &dbrepo.PostgresDBRepo{DB: conn}
-	defer app.DB.Connection().Close()
 
 	app.auth = Auth{
 		Issuer: app.JWTIssuer,
@@ -53,10 +200,108 @@ func main() {
 		CookieDomain: app.CookieDomain,
 	}
 
-	log.Println("Starting application on port", port)
+	app.jobs = jobs.NewRunner(app.DB, jobOptions)
+	app.registerJobs(app.jobs)
+	app.jobs.Schedule("purge", jobPurgeDeleted, jobs.Every(*purgeInterval))
+	app.jobs.Schedule("recommendations", jobComputeRecommendations, jobs.Every(*recommendInterval))
+	app.jobs.Schedule("rankings", jobComputeRankings, jobs.Every(*rankingInterval))
+	app.jobs.Schedule("digests", jobSendDigests, jobs.Every(*digestInterval))
+	app.jobs.Schedule("repair", jobRepairAggregates, repairAt)
+	app.jobs.Schedule("webhooks", jobDeliverWebhooks, jobs.Every(*webhookInterval))
+
+	// a fresh database, or deliveries due while the api was down, should not
+	// wait a whole interval for these
+	for _, kind := range []string{jobComputeRecommendations, jobComputeRankings, jobDeliverWebhooks} {
+		_, err = app.jobs.Enqueue(kind, nil)
+		if err != nil {
+			log.Println("Error queueing", kind, err)
+		}
+	}
+
+	app.webhooks = &webhook.Sender{
+		Client: &http.Client{Timeout: *webhookTimeout},
+		UserAgent: "kstation-webhooks",
+	}
+
+	app.hub = pubsub.NewHub(eventBuffer)
+	app.events = app.hub
+	if *eventChannel != "" {
+		app.events = &notifyPublisher{db: app.DB, channel: *eventChannel}
+	}
+
+	workers := newBackground()
+	workers.Go(app.jobs.Run)
+	if *eventChannel != "" {
+		workers.Go(func(ctx context.Context) { app.relayEvents(ctx, *eventChannel) })
+	}
+
+	srv := &http.Server{
+		Addr: fmt.Sprintf(":%d", port),
+		Handler: app.routes(),
+		ReadTimeout: *readTimeout,
+		WriteTimeout: *writeTimeout,
+		IdleTimeout: *idleTimeout,
+	}
+	// open event streams would otherwise hold up the shutdown until it times out
+	srv.RegisterOnShutdown(app.hub.Close)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	err = http.ListenAndServe(fmt.Sprintf(":%d", port), app.routes())
+	ln, err := net.Listen("tcp", srv.Addr)
+	if err == nil {
+		log.Println("Starting application on port", port)
+		err = app.serve(ctx, srv, ln, workers, *shutdownTimeout)
+	}
 	if err != nil {
-		log.Fatal(err)
+		log.Println(err)
+	}
+
+	closeErr := app.DB.Connection().Close()
+	if closeErr != nil {
+		log.Println("Error closing database", closeErr)
+	}
+
+	if err != nil || closeErr != nil {
+		os.Exit(1)
+	}
+	log.Println("Stopped")
+}
+
+// checkSecret refuses a signing secret that was left empty or at the
+// placeholder value, which anyone reading this source could use to forge
+// or reverse what it protects
+func checkSecret(name, secret string) error {
+	if secret == "" || secret == "verysecret" {
+		return fmt.Errorf("%s must be set to a private random value", name)
+	}
+	return nil
+}
+
+func buildContentPolicy(rejectWords, holdWords, studentIDPattern string) (*contentfilter.Policy, error) {
+	rules := []contentfilter.Rule{contentfilter.StripLinks{}}
+
+	if rejectWords != "" {
+		words, err := contentfilter.LoadWordList(rejectWords)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, contentfilter.BannedWords{Decision: contentfilter.Reject, Words: words})
+	}
+
+	if holdWords != "" {
+		words, err := contentfilter.LoadWordList(holdWords)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, contentfilter.BannedWords{Decision: contentfilter.Hold, Words: words})
 	}
+
+	personalInfo, err := contentfilter.NewPersonalInfo(studentIDPattern)
+	if err != nil {
+		return nil, err
+	}
+	rules = append(rules, personalInfo)
+
+	return contentfilter.NewPolicy(rules...), nil
 }
\ No newline at end of file
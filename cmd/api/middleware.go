@@ -1,9 +1,15 @@
 package main
 
 import (
+	"context"
 	"net/http"
+	"strconv"
 )
 
+type contextKey string
+
+const userIDKey contextKey = "userID"
+
 func (app *application) enableCORS(h http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "http://localhost:3000")
@@ -22,11 +28,74 @@ func (app *application) enableCORS(h http.Handler) http.Handler {
 
 func (app *application) authRequired(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		_, _, err := app.auth.GetTokenFromHeaderAndVerify(w, r)
-		if err != nil {
+		userID, ok := app.verifySession(w, r)
+		if !ok {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), userIDKey, userID)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// authOptional lets anonymous requests through, but still authenticates the
+// caller when a token is sent. A bad token is rejected rather than ignored so
+// the client knows to refresh it.
+func (app *application) authOptional(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		userID, ok := app.verifySession(w, r)
+		if !ok {
 			w.WriteHeader(http.StatusUnauthorized)
 			return
 		}
+
+		ctx := context.WithValue(r.Context(), userIDKey, userID)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// verifySession returns the user id of a request's bearer token
+func (app *application) verifySession(w http.ResponseWriter, r *http.Request) (int, bool) {
+	_, claims, err := app.auth.GetTokenFromHeaderAndVerify(w, r)
+	if err != nil {
+		return 0, false
+	}
+
+	userID, err := strconv.Atoi(claims.Subject)
+	if err != nil {
+		return 0, false
+	}
+
+	// tokens issued before a password or email change are no longer accepted
+	user, err := app.DB.GetUserByID(userID)
+	if err != nil || user.SessionVersion != claims.Version {
+		return 0, false
+	}
+
+	return userID, true
+}
+
+// authUserID returns the id of the user authenticated by authRequired, or 0
+// for an anonymous request that passed authOptional
+func (app *application) authUserID(r *http.Request) int {
+	userID, _ := r.Context().Value(userIDKey).(int)
+	return userID
+}
+
+// adminRequired must run after authRequired
+func (app *application) adminRequired(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, err := app.DB.GetUserByID(app.authUserID(r))
+		if err != nil || user.IsAdmin != 1 {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
 		next.ServeHTTP(w, r)
 	})
 }
\ No newline at end of file
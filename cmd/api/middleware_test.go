@@ -48,6 +48,14 @@ func Test_app_authRequired(t *testing.T) {
 
 	tokens, _ := app.auth.GenerateTokenPair(&testUser)
 
+	revokedUser := testUser
+	revokedUser.SessionVersion = 1
+	revokedTokens, _ := app.auth.GenerateTokenPair(&revokedUser)
+
+	unknownUser := testUser
+	unknownUser.ID = 2
+	unknownTokens, _ := app.auth.GenerateTokenPair(&unknownUser)
+
 	var tests = []struct{
 		name string
 		token string
@@ -57,6 +65,8 @@ func Test_app_authRequired(t *testing.T) {
 		{name: "valid token", token: fmt.Sprintf("Bearer %s", tokens.Token), expectAuthorized: true, setHeader: true},
 		{name: "no token", token: "", expectAuthorized: false, setHeader: false},
 		{name: "invalid token", token: fmt.Sprintf("Bearer %s", expiredToken), expectAuthorized: false, setHeader: true},
+		{name: "revoked session", token: fmt.Sprintf("Bearer %s", revokedTokens.Token), expectAuthorized: false, setHeader: true},
+		{name: "unknown user", token: fmt.Sprintf("Bearer %s", unknownTokens.Token), expectAuthorized: false, setHeader: true},
 	}
 
 	for _, e := range tests {
@@ -77,4 +87,81 @@ func Test_app_authRequired(t *testing.T) {
 			t.Errorf("%s: did not get code 402, and should have", e.name)
 		}
 	}
+}
+
+func Test_app_authOptional(t *testing.T) {
+	var gotUserID int
+	nextHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotUserID = app.authUserID(r)
+	})
+
+	testUser := jwtUser{
+		ID: 1,
+		FirstName: "Admin",
+		LastName: "User",
+	}
+
+	tokens, _ := app.auth.GenerateTokenPair(&testUser)
+
+	var tests = []struct{
+		name string
+		token string
+		expectedStatusCode int
+		expectedUserID int
+	}{
+		{"anonymous", "", http.StatusOK, 0},
+		{"valid token", fmt.Sprintf("Bearer %s", tokens.Token), http.StatusOK, 1},
+		{"invalid token", fmt.Sprintf("Bearer %s", expiredToken), http.StatusUnauthorized, 0},
+	}
+
+	for _, e := range tests {
+		gotUserID = 0
+		req, _ := http.NewRequest("GET", "/", nil)
+		if e.token != "" {
+			req.Header.Set("Authorization", e.token)
+		}
+		rr := httptest.NewRecorder()
+
+		handlerToTest := app.authOptional(nextHandler)
+		handlerToTest.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("%s: expected status of %d but got %d", e.name, e.expectedStatusCode, rr.Code)
+		}
+
+		if gotUserID != e.expectedUserID {
+			t.Errorf("%s: expected user %d but got %d", e.name, e.expectedUserID, gotUserID)
+		}
+	}
+}
+
+func Test_app_adminRequired(t *testing.T) {
+	nextHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	var tests = []struct{
+		name string
+		userID int
+		expectAllowed bool
+	}{
+		{"admin", 1, true},
+		{"unknown user", 2, false},
+		{"no user", 0, false},
+	}
+
+	for _, e := range tests {
+		req, _ := http.NewRequest("GET", "/admin", nil)
+		req = withUserID(req, e.userID)
+		rr := httptest.NewRecorder()
+
+		handlerToTest := app.adminRequired(nextHandler)
+		handlerToTest.ServeHTTP(rr, req)
+
+		if e.expectAllowed && rr.Code == http.StatusForbidden {
+			t.Errorf("%s: got code 403, and should not have", e.name)
+		}
+
+		if !e.expectAllowed && rr.Code != http.StatusForbidden {
+			t.Errorf("%s: did not get code 403, and should have", e.name)
+		}
+	}
 }
\ No newline at end of file
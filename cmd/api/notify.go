@@ -0,0 +1,31 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"kstation_backend/internal/jobs"
+	"kstation_backend/internal/models"
+	"log"
+)
+
+// publishFollowEvent queues the fan-out of an event as a background job, so
+// handlers never wait on it and the event survives a restart
+func (app *application) publishFollowEvent(event models.FollowEvent) {
+	_, err := app.jobs.Enqueue(jobNotifyFollowers, event)
+	if err != nil {
+		log.Println("Error queueing follow event", event.Kind, "on lesson", event.LessonId, err)
+	}
+}
+
+// notifyFollowers writes the notifications of an event to the inboxes of the
+// users following the lesson or its teacher
+func (app *application) notifyFollowers(ctx context.Context, event models.FollowEvent) error {
+	switch event.Kind {
+	case models.NotificationNewReview, models.NotificationNewClass:
+	default:
+		return jobs.Permanent(fmt.Errorf("unknown notification kind %q", event.Kind))
+	}
+
+	_, err := app.DB.FanOutNotifications(event)
+	return err
+}
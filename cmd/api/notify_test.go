@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"kstation_backend/internal/jobs"
+	"kstation_backend/internal/models"
+	"kstation_backend/internal/repository/dbrepo"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// notifyRepo records the follow events it is asked to fan out
+type notifyRepo struct {
+	dbrepo.TestDBRepo
+	events []models.FollowEvent
+}
+
+func (m *notifyRepo) FanOutNotifications(event models.FollowEvent) (int64, error) {
+	m.events = append(m.events, event)
+	return 1, nil
+}
+
+func Test_app_publishFollowEvent(t *testing.T) {
+	repo := &jobRepo{}
+	oldJobs := app.jobs
+	app.jobs = jobs.NewRunner(repo, jobs.DefaultOptions)
+	app.registerJobs(app.jobs)
+	defer func() { app.jobs = oldJobs }()
+
+	var tests = []struct {
+		name          string
+		method        string
+		handler       http.HandlerFunc
+		id            string
+		requestBody   string
+		expectedEvent *models.FollowEvent
+	}{
+		{
+			"new review", "POST", app.insertComment, "1",
+			`{"year":2023,"Term":"latter","comment":"good","test_or_report":"test","star":4}`,
+			&models.FollowEvent{Kind: models.NotificationNewReview, LessonId: 1, CommentId: 2, ActorId: 1},
+		},
+		{
+			"held review", "POST", app.insertComment, "1",
+			`{"year":2023,"Term":"latter","comment":"ask 山田 at 090-1234-5678 or a.b@example.com","test_or_report":"test","star":4}`,
+			nil,
+		},
+		{
+			"new review by upsert", "PUT", app.upsertComment, "1",
+			`{"year":2023,"Term":"latter","comment":"good","test_or_report":"test","star":4}`,
+			&models.FollowEvent{Kind: models.NotificationNewReview, LessonId: 1, CommentId: 2, ActorId: 1},
+		},
+		{
+			"edited review", "PUT", app.upsertComment, "1",
+			`{"year":2023,"Term":"former","comment":"better","test_or_report":"test","star":5}`,
+			nil,
+		},
+		{
+			"new class", "POST", app.upsertOffering, "1",
+			`{"year":2024,"term":"former","credits":2,"slots":[{"day":3,"period":2}]}`,
+			&models.FollowEvent{Kind: models.NotificationNewClass, LessonId: 1, OfferingId: 5, ActorId: 1},
+		},
+	}
+
+	for _, e := range tests {
+		req, _ := http.NewRequest(e.method, "/", strings.NewReader(e.requestBody))
+		req = withURLParam(req, "id", e.id)
+		req = withUserID(req, 1)
+
+		rr := httptest.NewRecorder()
+		e.handler.ServeHTTP(rr, req)
+
+		if rr.Code >= 300 {
+			t.Errorf("%s: unexpected status %d: %s", e.name, rr.Code, rr.Body.String())
+			continue
+		}
+
+		// webhook deliveries are queued alongside, only the fan-out matters here
+		var queued []models.Job
+		for _, job := range repo.queued {
+			if job.Kind == jobNotifyFollowers {
+				queued = append(queued, job)
+			}
+		}
+		repo.queued = nil
+
+		if e.expectedEvent == nil {
+			if len(queued) != 0 {
+				t.Errorf("%s: expected no event but got %s", e.name, queued[0].Payload)
+			}
+			continue
+		}
+
+		if len(queued) != 1 || queued[0].Kind != jobNotifyFollowers {
+			t.Errorf("%s: expected a follow event to be queued but got %+v", e.name, queued)
+			continue
+		}
+
+		var event models.FollowEvent
+		_ = json.Unmarshal(queued[0].Payload, &event)
+		if event != *e.expectedEvent {
+			t.Errorf("%s: expected event %+v but got %+v", e.name, *e.expectedEvent, event)
+		}
+	}
+}
+
+func Test_app_notifyFollowers(t *testing.T) {
+	repo := &notifyRepo{}
+	oldDB := app.DB
+	app.DB = repo
+	defer func() { app.DB = oldDB }()
+
+	store := &jobRepo{}
+	runner := jobs.NewRunner(store, jobs.DefaultOptions)
+	app.registerJobs(runner)
+
+	_, _ = runner.Enqueue(jobNotifyFollowers, models.FollowEvent{Kind: models.NotificationNewReview, LessonId: 1, CommentId: 2})
+	_, _ = runner.Enqueue(jobNotifyFollowers, models.FollowEvent{Kind: models.NotificationNewClass, LessonId: 1, OfferingId: 5})
+	_, _ = runner.Enqueue(jobNotifyFollowers, models.FollowEvent{Kind: "new_teacher", LessonId: 1})
+
+	for i := 0; i < 3; i++ {
+		_, _ = runner.RunNext(context.Background())
+	}
+
+	if len(repo.events) != 2 || repo.events[1].Kind != models.NotificationNewClass || repo.events[1].OfferingId != 5 {
+		t.Errorf("expected both events to be fanned out, but got %+v", repo.events)
+	}
+
+	if len(store.results) != 3 || store.results[0].Status != models.JobSucceeded || store.results[2].Status != models.JobFailed {
+		t.Errorf("expected an unknown kind of event to fail at once, but got %+v", store.results)
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"kstation_backend/internal/models"
+	"kstation_backend/internal/timetable"
+)
+
+// commentAuthor is how the writer of a review is shown to readers
+type commentAuthor struct {
+	DisplayName string `json:"display_name"`
+	Anonymous   bool   `json:"anonymous"`
+}
+
+// commentView is the JSON representation of a comment. Its UserId shadows the
+// embedded comment's, so the author's account is only exposed when the author
+// chose to show their real name or the reader is a moderator.
+type commentView struct {
+	*models.Comment
+	UserId int           `json:"user_id,omitempty"`
+	Author commentAuthor `json:"author"`
+}
+
+// replyView is the JSON representation of a reply; its author is shown the
+// same way as on the review it belongs to
+type replyView struct {
+	*models.Reply
+	UserId int           `json:"user_id,omitempty"`
+	Author commentAuthor `json:"author"`
+}
+
+// publicUser is what anyone can see of an account. Names are only included
+// when the user chose to show their real name; email and password never are.
+type publicUser struct {
+	ID           int    `json:"id"`
+	FirstName    string `json:"first_name,omitempty"`
+	LastName     string `json:"last_name,omitempty"`
+	Image        string `json:"image"`
+	ShowRealName bool   `json:"show_real_name"`
+}
+
+func presentPublicUser(user *models.User) publicUser {
+	view := publicUser{ID: user.ID, Image: user.Image, ShowRealName: user.ShowRealName}
+	if user.ShowRealName {
+		view.FirstName = user.FirstName
+		view.LastName = user.LastName
+	}
+
+	return view
+}
+
+// lessonView is the JSON representation of a lesson. Favorited is only set
+// when the caller is signed in.
+type lessonView struct {
+	*models.Lesson
+	Favorited *bool `json:"favorited,omitempty"`
+}
+
+// timetableView is a user's timetable for one term
+type timetableView struct {
+	Year    int                      `json:"year"`
+	Term    string                   `json:"term"`
+	Entries []*models.TimetableEntry `json:"entries"`
+	Summary timetable.Summary        `json:"summary"`
+}
+
+type reportView struct {
+	*models.Report
+	Comment *commentView `json:"comment,omitempty"`
+}
+
+var pseudonymAdjectives = []string{
+	"Quiet", "Brave", "Sleepy", "Curious", "Gentle", "Clever", "Swift", "Lucky",
+	"Calm", "Bright", "Merry", "Bold", "Shy", "Witty", "Kind", "Eager",
+}
+
+var pseudonymAnimals = []string{
+	"Owl", "Fox", "Tanuki", "Crane", "Otter", "Panda", "Deer", "Hare",
+	"Koi", "Sparrow", "Badger", "Seal", "Heron", "Squirrel", "Turtle", "Wolf",
+}
+
+// pseudonym derives a stable handle for a user within a lesson, so several
+// reviews by the same student on one lesson page can be told apart without
+// linking them to the student's reviews of other lessons
+func (app *application) pseudonym(userID, lessonID int) string {
+	mac := hmac.New(sha256.New, []byte(app.PseudonymSecret))
+	fmt.Fprintf(mac, "%d:%d", userID, lessonID)
+	sum := mac.Sum(nil)
+
+	adjective := pseudonymAdjectives[int(sum[0])%len(pseudonymAdjectives)]
+	animal := pseudonymAnimals[int(sum[1])%len(pseudonymAnimals)]
+
+	return fmt.Sprintf("%s %s %04x", adjective, animal, binary.BigEndian.Uint16(sum[2:4]))
+}
+
+// author resolves how userID is shown on the page of lessonID. users is the
+// result of GetUsersByIDs, so a missing entry means the account is gone.
+func (app *application) author(users map[int]*models.User, userID, lessonID int) commentAuthor {
+	user, ok := users[userID]
+	switch {
+	case !ok:
+		return commentAuthor{DisplayName: "deleted user", Anonymous: true}
+	case user.ShowRealName:
+		return commentAuthor{DisplayName: fmt.Sprintf("%s %s", user.LastName, user.FirstName)}
+	default:
+		return commentAuthor{DisplayName: app.pseudonym(userID, lessonID), Anonymous: true}
+	}
+}
+
+// presentComments renders the author of each comment according to the
+// author's privacy setting. revealAuthor keeps user ids for moderators.
+func (app *application) presentComments(comments []*models.Comment, revealAuthor bool) ([]*commentView, error) {
+	ids := make([]int, 0, len(comments))
+	for _, comment := range comments {
+		ids = append(ids, comment.UserId)
+	}
+
+	users, err := app.DB.GetUsersByIDs(ids)
+	if err != nil {
+		return nil, err
+	}
+
+	views := make([]*commentView, 0, len(comments))
+	for _, comment := range comments {
+		view := commentView{Comment: comment}
+		view.Author = app.author(users, comment.UserId, comment.LessonId)
+
+		if revealAuthor || !view.Author.Anonymous {
+			view.UserId = comment.UserId
+		}
+
+		views = append(views, &view)
+	}
+
+	return views, nil
+}
+
+func (app *application) presentComment(comment *models.Comment, revealAuthor bool) (*commentView, error) {
+	views, err := app.presentComments([]*models.Comment{comment}, revealAuthor)
+	if err != nil {
+		return nil, err
+	}
+
+	return views[0], nil
+}
+
+// presentReports renders reports for moderators, who always see comment authors
+func (app *application) presentReports(reports []*models.Report) ([]*reportView, error) {
+	comments := make([]*models.Comment, 0, len(reports))
+	for _, report := range reports {
+		if report.Comment != nil {
+			comments = append(comments, report.Comment)
+		}
+	}
+
+	commentViews, err := app.presentComments(comments, true)
+	if err != nil {
+		return nil, err
+	}
+
+	views := make([]*reportView, 0, len(reports))
+	for _, report := range reports {
+		view := reportView{Report: report}
+		if report.Comment != nil {
+			view.Comment = commentViews[0]
+			commentViews = commentViews[1:]
+		}
+		views = append(views, &view)
+	}
+
+	return views, nil
+}
+
+// presentReplies renders replies posted under a review of lessonID
+func (app *application) presentReplies(replies []*models.Reply, lessonID int) ([]*replyView, error) {
+	ids := make([]int, 0, len(replies))
+	for _, reply := range replies {
+		ids = append(ids, reply.UserId)
+	}
+
+	users, err := app.DB.GetUsersByIDs(ids)
+	if err != nil {
+		return nil, err
+	}
+
+	views := make([]*replyView, 0, len(replies))
+	for _, reply := range replies {
+		view := replyView{Reply: reply}
+		view.Author = app.author(users, reply.UserId, lessonID)
+
+		if !view.Author.Anonymous {
+			view.UserId = reply.UserId
+		}
+
+		views = append(views, &view)
+	}
+
+	return views, nil
+}
+
+// presentLessons marks which lessons the user has favorited; userID is 0 for
+// anonymous readers
+func (app *application) presentLessons(lessons []*models.Lesson, userID int) ([]*lessonView, error) {
+	views := make([]*lessonView, 0, len(lessons))
+	for _, lesson := range lessons {
+		views = append(views, &lessonView{Lesson: lesson})
+	}
+
+	if userID == 0 {
+		return views, nil
+	}
+
+	ids := make([]int, 0, len(lessons))
+	for _, lesson := range lessons {
+		ids = append(ids, lesson.ID)
+	}
+
+	favorited, err := app.DB.FavoritedLessons(userID, ids)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, view := range views {
+		isFavorite := favorited[view.ID]
+		view.Favorited = &isFavorite
+	}
+
+	return views, nil
+}
+
+func (app *application) presentTimetable(entries []*models.TimetableEntry, year int, term string) timetableView {
+	if entries == nil {
+		entries = []*models.TimetableEntry{}
+	}
+
+	return timetableView{
+		Year:    year,
+		Term:    term,
+		Entries: entries,
+		Summary: timetable.Summarize(entries, app.CreditLimit),
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"kstation_backend/internal/models"
+	"kstation_backend/internal/repository/dbrepo"
+	"strings"
+	"testing"
+)
+
+// realNameRepo is a test repository whose users all chose to show their real name
+type realNameRepo struct {
+	dbrepo.TestDBRepo
+}
+
+func (m *realNameRepo) GetUsersByIDs(ids []int) (map[int]*models.User, error) {
+	users, _ := m.TestDBRepo.GetUsersByIDs(ids)
+	for _, user := range users {
+		user.ShowRealName = true
+	}
+	return users, nil
+}
+
+func (m *realNameRepo) GetUserByID(id int) (*models.User, error) {
+	user, err := m.TestDBRepo.GetUserByID(id)
+	if err != nil {
+		return nil, err
+	}
+	user.ShowRealName = true
+	return user, nil
+}
+
+func Test_presentPublicUser(t *testing.T) {
+	user := &models.User{ID: 1, FirstName: "Taro", LastName: "Yamada", Email: "taro@example.com", Password: "$2a$12$hash", Image: "/media/avatars/1/a/256.jpg"}
+
+	out, _ := json.Marshal(presentPublicUser(user))
+	for _, private := range []string{"taro@example.com", "$2a$12$hash", "Taro", "Yamada"} {
+		if strings.Contains(string(out), private) {
+			t.Errorf("public profile exposes %q: %s", private, out)
+		}
+	}
+
+	user.ShowRealName = true
+	out, _ = json.Marshal(presentPublicUser(user))
+	if !strings.Contains(string(out), "Yamada") || strings.Contains(string(out), "taro@example.com") {
+		t.Errorf("expected the real name but not the email: %s", out)
+	}
+
+	out, _ = json.Marshal(user)
+	if strings.Contains(string(out), "$2a$12$hash") {
+		t.Errorf("user json exposes the password hash: %s", out)
+	}
+}
+
+func Test_app_pseudonym(t *testing.T) {
+	first := app.pseudonym(1, 1)
+
+	if first != app.pseudonym(1, 1) {
+		t.Error("pseudonym is not stable for the same user and lesson")
+	}
+
+	if first == app.pseudonym(1, 2) {
+		t.Error("pseudonym should differ between lessons")
+	}
+
+	if first == app.pseudonym(2, 1) {
+		t.Error("pseudonym should differ between users")
+	}
+}
+
+func Test_app_presentComments(t *testing.T) {
+	comments := []*models.Comment{
+		{ID: 1, LessonId: 1, UserId: 1, Comment: "anonymous"},
+		{ID: 2, LessonId: 1, UserId: 9, Comment: "deleted author"},
+	}
+
+	var tests = []struct {
+		name           string
+		revealAuthor   bool
+		realName       bool
+		expectedUserID bool
+		expectedAuthor string
+	}{
+		{"pseudonymous", false, false, false, app.pseudonym(1, 1)},
+		{"moderator", true, false, true, app.pseudonym(1, 1)},
+		{"real name", false, true, true, "User Admin"},
+	}
+
+	for _, e := range tests {
+		oldDB := app.DB
+		if e.realName {
+			app.DB = &realNameRepo{}
+		}
+
+		views, err := app.presentComments(comments, e.revealAuthor)
+		app.DB = oldDB
+		if err != nil {
+			t.Fatalf("%s: present comments returned an error: %s", e.name, err)
+		}
+
+		out, _ := json.Marshal(views[0])
+		if strings.Contains(string(out), `"user_id"`) != e.expectedUserID {
+			t.Errorf("%s: user id exposure should be %v, but got %s", e.name, e.expectedUserID, out)
+		}
+
+		if views[0].Author.DisplayName != e.expectedAuthor {
+			t.Errorf("%s: expected author %q but got %q", e.name, e.expectedAuthor, views[0].Author.DisplayName)
+		}
+
+		if views[1].Author.DisplayName != "deleted user" {
+			t.Errorf("%s: expected deleted user but got %q", e.name, views[1].Author.DisplayName)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"kstation_backend/internal/models"
+	"kstation_backend/internal/storage"
+	"log"
+	"time"
+)
+
+// purgeDeleted permanently removes rows that have been soft deleted for longer
+// than the retention period, and jobs that succeeded before then
+func (app *application) purgeDeleted(ctx context.Context, job *models.Job) error {
+	before := time.Now().Add(-app.PurgeRetention)
+
+	err := app.purgeLessonAttachments(ctx, before)
+	if err != nil {
+		return err
+	}
+
+	purged, err := app.DB.PurgeDeleted(before)
+	if err != nil {
+		return err
+	}
+
+	if purged > 0 {
+		log.Println("Purged deleted rows:", purged)
+	}
+
+	pruned, err := app.DB.PruneJobs(before)
+	if err != nil {
+		return err
+	}
+
+	if pruned > 0 {
+		log.Println("Pruned finished jobs:", pruned)
+	}
+
+	return nil
+}
+
+// purgeLessonAttachments removes the files of lessons deleted before the given
+// time, so the lessons can be purged. A file whose blob cannot be removed is
+// kept and tried again on the next run.
+func (app *application) purgeLessonAttachments(ctx context.Context, before time.Time) error {
+	attachments, err := app.DB.AttachmentsOfDeletedLessons(before)
+	if err != nil {
+		return err
+	}
+
+	removed := 0
+	for _, attachment := range attachments {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		err = app.blobs.Delete(ctx, attachment.StorageKey)
+		if err != nil && !errors.Is(err, storage.ErrNotFound) {
+			log.Println("Error deleting attachment file", attachment.StorageKey, err)
+			continue
+		}
+
+		err = app.DB.DeleteAttachment(attachment.ID)
+		if err != nil {
+			return err
+		}
+		removed++
+	}
+
+	if removed > 0 {
+		log.Println("Purged attachments of deleted lessons:", removed)
+	}
+
+	return nil
+}
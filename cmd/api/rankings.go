@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"kstation_backend/internal/models"
+	"kstation_backend/internal/ranking"
+	"log"
+	"time"
+)
+
+// refreshRankings recomputes the lesson rankings
+func (app *application) refreshRankings(ctx context.Context, job *models.Job) error {
+	count, err := app.computeRankings()
+	if err != nil {
+		return err
+	}
+
+	log.Println("Computed rankings:", count)
+
+	return nil
+}
+
+// computeRankings rebuilds the ranking table from all ratings and favorites
+// and returns how many ranking rows were stored
+func (app *application) computeRankings() (int, error) {
+	lessons, err := app.DB.AllLessons(0)
+	if err != nil {
+		return 0, err
+	}
+
+	ratings, err := app.DB.LessonRatings()
+	if err != nil {
+		return 0, err
+	}
+
+	favorites, err := app.DB.AllFavorites()
+	if err != nil {
+		return 0, err
+	}
+
+	rankings := ranking.Compute(lessons, ratings, favorites, app.rankingOptions, time.Now())
+
+	err = app.DB.ReplaceLessonRankings(rankings)
+	if err != nil {
+		return 0, err
+	}
+
+	return len(rankings), nil
+}
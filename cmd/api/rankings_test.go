@@ -0,0 +1,62 @@
+package main
+
+import (
+	"kstation_backend/internal/models"
+	"kstation_backend/internal/repository/dbrepo"
+	"testing"
+	"time"
+)
+
+// rankingRepo records the rankings it is asked to store
+type rankingRepo struct {
+	dbrepo.TestDBRepo
+	stored []*models.LessonRanking
+}
+
+func (m *rankingRepo) AllLessons(how int) ([]*models.Lesson, error) {
+	return []*models.Lesson{{ID: 1}, {ID: 2}}, nil
+}
+
+func (m *rankingRepo) LessonRatings() ([]*models.Rating, error) {
+	now := time.Now()
+	return []*models.Rating{
+		{UserId: 1, LessonId: 1, Star: 5, Year: 2023, Term: "spring", CreatedAt: now},
+		{UserId: 2, LessonId: 1, Star: 4, Year: 2023, Term: "spring", CreatedAt: now},
+		{UserId: 1, LessonId: 2, Star: 2, Year: 2022, Term: "fall", CreatedAt: now.Add(-time.Hour * 24 * 60)},
+	}, nil
+}
+
+func (m *rankingRepo) AllFavorites() ([]*models.Favorite, error) {
+	return nil, nil
+}
+
+func (m *rankingRepo) ReplaceLessonRankings(rankings []*models.LessonRanking) error {
+	m.stored = rankings
+	return nil
+}
+
+func Test_app_computeRankings(t *testing.T) {
+	repo := &rankingRepo{}
+	oldDB := app.DB
+	app.DB = repo
+	defer func() { app.DB = oldDB }()
+
+	count, err := app.computeRankings()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// two overall rankings and one per lesson and term
+	if count != 4 || len(repo.stored) != 4 {
+		t.Fatalf("expected 4 rankings but got %d", count)
+	}
+
+	first, second := repo.stored[0], repo.stored[1]
+	if first.BayesStar <= second.BayesStar {
+		t.Errorf("expected lesson 1 to outrank lesson 2 but got %f and %f", first.BayesStar, second.BayesStar)
+	}
+
+	if first.TrendingScore <= second.TrendingScore {
+		t.Errorf("expected lesson 1 to trend above lesson 2 but got %f and %f", first.TrendingScore, second.TrendingScore)
+	}
+}
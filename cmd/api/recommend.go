@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"kstation_backend/internal/models"
+	"kstation_backend/internal/recommend"
+	"log"
+	"time"
+)
+
+// refreshRecommendations recomputes every user's recommendations
+func (app *application) refreshRecommendations(ctx context.Context, job *models.Job) error {
+	count, err := app.computeRecommendations()
+	if err != nil {
+		return err
+	}
+
+	log.Println("Computed recommendations:", count)
+
+	return nil
+}
+
+// computeRecommendations rebuilds the recommendation table from all ratings
+// and favorites and returns how many recommendations were stored
+func (app *application) computeRecommendations() (int, error) {
+	lessons, err := app.DB.AllLessons(0)
+	if err != nil {
+		return 0, err
+	}
+
+	ratings, err := app.DB.LessonRatings()
+	if err != nil {
+		return 0, err
+	}
+
+	favorites, err := app.DB.AllFavorites()
+	if err != nil {
+		return 0, err
+	}
+
+	recommendations := recommend.Compute(lessons, ratings, favorites, recommend.DefaultOptions, time.Now())
+
+	err = app.DB.ReplaceRecommendations(recommendations)
+	if err != nil {
+		return 0, err
+	}
+
+	return len(recommendations), nil
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"kstation_backend/internal/models"
+	"kstation_backend/internal/repository/dbrepo"
+	"testing"
+)
+
+// recommendRepo records the recommendations it is asked to store
+type recommendRepo struct {
+	dbrepo.TestDBRepo
+	stored []*models.Recommendation
+}
+
+func (m *recommendRepo) AllLessons(how int) ([]*models.Lesson, error) {
+	return []*models.Lesson{
+		{ID: 1, TeacherName: "Yamada", Department: "math"},
+		{ID: 2, TeacherName: "Yamada", Department: "physics"},
+		{ID: 3, TeacherName: "Sato", Department: "art"},
+	}, nil
+}
+
+func (m *recommendRepo) ReplaceRecommendations(recommendations []*models.Recommendation) error {
+	m.stored = recommendations
+	return nil
+}
+
+func Test_app_computeRecommendations(t *testing.T) {
+	repo := &recommendRepo{}
+	oldDB := app.DB
+	app.DB = repo
+	defer func() { app.DB = oldDB }()
+
+	count, err := app.computeRecommendations()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if count != 1 || len(repo.stored) != 1 {
+		t.Fatalf("expected one recommendation but got %d", count)
+	}
+
+	if repo.stored[0].UserId != 1 || repo.stored[0].LessonId != 2 || repo.stored[0].Reason != models.ReasonSameTeacher {
+		t.Errorf("unexpected recommendation %+v", repo.stored[0])
+	}
+}
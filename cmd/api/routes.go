@@ -13,8 +13,106 @@ func (app *application) routes() http.Handler {
 	mux.Use(middleware.Recoverer)
 	mux.Use(app.enableCORS)
 
+	mux.Get("/lessons/rankings", app.lessonRankings)
+	mux.Get("/lessons/{id}/stats", app.lessonStats)
+	mux.Get("/lessons/{id}/events", app.lessonEvents)
+	mux.Get("/lessons/{id}/comments", app.allCommentsByLesson)
+	mux.Get("/comments/{id}/replies", app.commentReplies)
+	mux.Get("/lessons/{id}/attachments", app.lessonAttachments)
+	mux.Get("/lessons/{id}/offerings", app.lessonOfferings)
+	mux.Get("/attachments/{id}/download", app.downloadAttachment)
+	mux.Get("/media/*", app.serveMedia)
+	mux.Get("/terms", app.academicTerms)
+	mux.Get("/calendar/{token}.ics", app.subscribedTimetable)
+	mux.Post("/digest/unsubscribe", app.unsubscribeDigest)
+	mux.Get("/users/{id}", app.getUser)
+	mux.Get("/users/{id}/reviews", app.userReviews)
+
+	mux.Group(func(mux chi.Router) {
+		mux.Use(app.authOptional)
+
+		mux.Get("/lessons", app.allLessons)
+		mux.Get("/lessons/{id}", app.getLesson)
+		mux.Get("/users/{id}/lessons", app.userLessons)
+	})
+
+	mux.Group(func(mux chi.Router) {
+		mux.Use(app.authRequired)
+
+		mux.Get("/me", app.getMe)
+		mux.Patch("/me", app.updateMe)
+		mux.Delete("/me", app.deleteMe)
+		mux.Get("/me/reviews", app.myReviews)
+		mux.Get("/me/favorites", app.myFavorites)
+		mux.Get("/me/follows", app.myFollows)
+		mux.Get("/me/notifications", app.myNotifications)
+		mux.Get("/me/notifications/unread", app.unreadNotificationCount)
+		mux.Post("/me/notifications/read", app.markAllNotificationsRead)
+		mux.Post("/me/notifications/{id}/read", app.markNotificationRead)
+		mux.Get("/me/digest", app.myDigestPreferences)
+		mux.Put("/me/digest", app.updateDigestPreferences)
+		mux.Get("/me/recommendations", app.myRecommendations)
+		mux.Get("/me/timetable", app.getTimetable)
+		mux.Post("/me/timetable", app.addTimetableEntry)
+		mux.Delete("/me/timetable/{id}", app.removeTimetableEntry)
+		mux.Get("/me/timetable.ics", app.timetableCalendar)
+		mux.Post("/me/timetable/subscription", app.subscribeTimetable)
+		mux.Get("/me/export", app.exportMe)
+		mux.Put("/me/privacy", app.updatePrivacy)
+		mux.Post("/me/password", app.changePassword)
+		mux.Post("/me/email", app.requestEmailChange)
+		mux.Post("/me/email/confirm", app.confirmEmailChange)
+		mux.Put("/me/avatar", app.updateAvatar)
+
+		mux.Post("/lessons/{id}/comments", app.insertComment)
+		mux.Put("/lessons/{id}/comments", app.upsertComment)
+		mux.Put("/comments/{id}", app.updateComment)
+		mux.Delete("/comments/{id}", app.deleteComment)
+		mux.Post("/comments/{id}/vote", app.voteComment)
+		mux.Post("/comments/{id}/report", app.reportComment)
+		mux.Post("/comments/{id}/replies", app.insertReply)
+		mux.Put("/replies/{id}", app.updateReply)
+		mux.Delete("/replies/{id}", app.deleteReply)
+		mux.Post("/lessons/{id}/attachments", app.uploadAttachment)
+		mux.Get("/attachments/{id}/url", app.attachmentURL)
+		mux.Delete("/attachments/{id}", app.deleteAttachment)
+		mux.Put("/lessons/{id}/favorite", app.addFavorite)
+		mux.Delete("/lessons/{id}/favorite", app.removeFavorite)
+		mux.Put("/lessons/{id}/follow", app.followLesson)
+		mux.Delete("/lessons/{id}/follow", app.unfollowLesson)
+		mux.Put("/teachers/{name}/follow", app.followTeacher)
+		mux.Delete("/teachers/{name}/follow", app.unfollowTeacher)
+	})
+
 	mux.Route("/admin", func(mux chi.Router) {
 		mux.Use(app.authRequired)
+		mux.Use(app.adminRequired)
+
+		mux.Get("/moderation", app.moderationQueue)
+		mux.Post("/moderation/{id}", app.moderateReport)
+		mux.Get("/moderation/held", app.heldComments)
+		mux.Post("/moderation/held/{id}", app.moderateHeldComment)
+
+		mux.Delete("/lessons/{id}", app.deleteLesson)
+		mux.Post("/lessons/{id}/offerings", app.upsertOffering)
+		mux.Delete("/offerings/{id}", app.deleteOffering)
+		mux.Put("/terms", app.upsertAcademicTerm)
+		mux.Delete("/users/{id}", app.deleteUser)
+		mux.Get("/comments/{id}/revisions", app.commentRevisions)
+		mux.Post("/comments/{id}/restore", app.restoreComment)
+		mux.Post("/lessons/{id}/restore", app.restoreLesson)
+		mux.Post("/users/{id}/restore", app.restoreUser)
+
+		mux.Get("/webhooks", app.allWebhooks)
+		mux.Post("/webhooks", app.insertWebhook)
+		mux.Put("/webhooks/{id}", app.updateWebhook)
+		mux.Delete("/webhooks/{id}", app.deleteWebhook)
+		mux.Get("/webhooks/{id}/deliveries", app.webhookDeliveries)
+		mux.Post("/webhook-deliveries/{id}/retry", app.retryWebhookDelivery)
+		mux.Get("/jobs", app.allJobs)
+		mux.Post("/jobs", app.enqueueJob)
+		mux.Get("/jobs/{id}", app.getJob)
+		mux.Post("/jobs/{id}/retry", app.retryJob)
 	})
 
 	return mux
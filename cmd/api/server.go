@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// background runs the workers that live as long as the server, so that a
+// shutdown can stop them and wait for them to finish
+type background struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func newBackground() *background {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &background{ctx: ctx, cancel: cancel}
+}
+
+// Go runs a worker in its own goroutine. The worker must return soon after
+// its context is done.
+func (b *background) Go(worker func(ctx context.Context)) {
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		worker(b.ctx)
+	}()
+}
+
+// stop cancels every worker and waits for them to return, or until ctx is
+// done
+func (b *background) stop(ctx context.Context) error {
+	b.cancel()
+
+	done := make(chan struct{})
+	go func() {
+		b.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return errors.New("background workers did not stop in time")
+	}
+}
+
+// serve handles connections on ln until ctx is done or the server fails.
+// It then stops accepting connections and waits up to shutdownTimeout for
+// the requests in flight and then the background workers to finish.
+func (app *application) serve(ctx context.Context, srv *http.Server, ln net.Listener, workers *background, shutdownTimeout time.Duration) error {
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- srv.Serve(ln)
+	}()
+
+	var err error
+	select {
+	case err = <-serveErr:
+	case <-ctx.Done():
+		log.Println("Shutting down, waiting up to", shutdownTimeout)
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	if err == nil {
+		err = srv.Shutdown(shutdownCtx)
+		if err != nil {
+			// whatever is still running is cut off
+			_ = srv.Close()
+		}
+	}
+
+	return errors.Join(err, workers.stop(shutdownCtx))
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"kstation_backend/internal/pubsub"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_app_serveDrainsInFlightRequests(t *testing.T) {
+	started := make(chan struct{})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(time.Millisecond * 200)
+		_, _ = w.Write([]byte("done"))
+	})
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	url := "http://" + ln.Addr().String() + "/slow"
+
+	workers := newBackground()
+	workerStopped := make(chan struct{})
+	workers.Go(func(ctx context.Context) {
+		<-ctx.Done()
+		time.Sleep(time.Millisecond * 50)
+		close(workerStopped)
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() {
+		served <- app.serve(ctx, &http.Server{Handler: mux}, ln, workers, time.Second*5)
+	}()
+
+	body := make(chan string, 1)
+	go func() {
+		resp, err := http.Get(url)
+		if err != nil {
+			body <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(resp.Body)
+		body <- string(data)
+	}()
+
+	<-started
+	cancel()
+
+	if got := <-body; got != "done" {
+		t.Errorf("expected the in-flight request to complete but got %q", got)
+	}
+
+	err = <-served
+	if err != nil {
+		t.Errorf("expected a clean shutdown but got %s", err)
+	}
+
+	select {
+	case <-workerStopped:
+	default:
+		t.Error("serve returned before the background workers stopped")
+	}
+
+	_, err = http.Get(url)
+	if err == nil {
+		t.Error("accepted a request after shutting down")
+	}
+}
+
+func Test_app_serveShutdownTimeout(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	defer close(release)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/stuck", func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	})
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() {
+		served <- app.serve(ctx, &http.Server{Handler: mux}, ln, newBackground(), time.Millisecond*100)
+	}()
+
+	go func() {
+		resp, err := http.Get("http://" + ln.Addr().String() + "/stuck")
+		if err == nil {
+			resp.Body.Close()
+		}
+	}()
+
+	<-started
+	cancel()
+
+	select {
+	case err := <-served:
+		if err == nil {
+			t.Error("expected an error when requests outlive the shutdown timeout")
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("serve did not give up after the shutdown timeout")
+	}
+}
+
+func Test_app_serveEndsEventStreams(t *testing.T) {
+	oldHub := app.hub
+	app.hub = pubsub.NewHub(eventBuffer)
+	defer func() { app.hub = oldHub }()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := &http.Server{Handler: app.routes(), WriteTimeout: time.Millisecond * 100}
+	srv.RegisterOnShutdown(app.hub.Close)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() {
+		served <- app.serve(ctx, srv, ln, newBackground(), time.Second*5)
+	}()
+
+	resp, err := http.Get("http://" + ln.Addr().String() + "/lessons/1/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	reader := bufio.NewReader(resp.Body)
+
+	line, _ := reader.ReadString('\n')
+	if !strings.HasPrefix(line, "retry:") {
+		t.Fatalf("expected the stream to start but got %q", line)
+	}
+
+	// the stream is still writable past the server's write timeout
+	time.Sleep(time.Millisecond * 300)
+	_ = app.hub.Publish(pubsub.Event{LessonID: 1, Type: eventStatsUpdated, Data: []byte(`{}`)})
+
+	for !strings.HasPrefix(line, "event:") {
+		line, err = reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("stream ended before the event arrived: %s", err)
+		}
+	}
+
+	cancel()
+
+	_, err = io.ReadAll(reader)
+	if err != nil {
+		t.Errorf("expected the stream to end cleanly but got %s", err)
+	}
+
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Errorf("expected a clean shutdown but got %s", err)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("an open event stream held up the shutdown")
+	}
+}
@@ -1,7 +1,20 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"io"
+	"kstation_backend/internal/contentfilter"
+	"kstation_backend/internal/jobs"
+	"kstation_backend/internal/mailer"
+	"kstation_backend/internal/pubsub"
+	"kstation_backend/internal/ranking"
 	"kstation_backend/internal/repository/dbrepo"
+	"kstation_backend/internal/storage"
+	"kstation_backend/internal/timetable"
+	"kstation_backend/internal/webhook"
+	"log"
+	"net/http"
 	"os"
 	"testing"
 	"time"
@@ -14,6 +27,7 @@ func TestMain(m *testing.M) {
 	app.DB = &dbrepo.TestDBRepo{}
 	app.Domain = "example.com"
 	app.JWTSecret = "secretString"
+	app.PseudonymSecret = "pseudonymSecret"
 	app.auth = Auth{
 		Issuer: app.JWTIssuer,
 		Audience: app.JWTAudience,
@@ -24,5 +38,47 @@ func TestMain(m *testing.M) {
 		CookieName: "refresh_token",
 		CookieDomain: app.CookieDomain,
 	}
-	os.Exit(m.Run())
+	personalInfo, _ := contentfilter.NewPersonalInfo(contentfilter.DefaultStudentIDPattern)
+	app.contentPolicy = contentfilter.NewPolicy(
+		contentfilter.StripLinks{},
+		contentfilter.BannedWords{Decision: contentfilter.Reject, Words: []string{"idiot"}},
+		personalInfo,
+	)
+
+	blobDir, err := os.MkdirTemp("", "kstation-blobs")
+	if err != nil {
+		log.Fatal(err)
+	}
+	app.blobs = storage.NewLocalStore(blobDir)
+	_ = app.blobs.Put(context.Background(), "attachments/1/test", bytes.NewReader([]byte("%PDF-1.4 past exam")), 18, "application/pdf")
+	app.scanner = storage.ScannerFunc(func(ctx context.Context, r io.Reader) error {
+		data, _ := io.ReadAll(r)
+		if bytes.Contains(data, []byte("EICAR")) {
+			return storage.ErrInfected
+		}
+		return nil
+	})
+	app.urlSigner = storage.Signer{Secret: []byte("urlSecret")}
+	app.MaxUploadSize = 1 << 10
+	app.DownloadURLTTL = time.Minute
+	app.MaxAvatarSize = 1 << 20
+	app.MediaURL = "/media"
+	app.mailer = &mailer.Capture{}
+	app.CreditLimit = 24
+	app.rankingOptions = ranking.DefaultOptions
+	app.hub = pubsub.NewHub(eventBuffer)
+	app.events = app.hub
+	app.webhooks = &webhook.Sender{Client: &http.Client{Timeout: time.Second * 5}, UserAgent: "kstation-webhooks"}
+	app.webhookRetry = webhook.RetryPolicy{MaxAttempts: 3, BaseDelay: time.Minute, MaxDelay: time.Hour}
+	app.APIURL = "http://api.example.com"
+	app.UnsubscribeSecret = "unsubscribeSecret"
+	app.DigestPeriod = time.Hour * 24 * 7
+	app.jobs = jobs.NewRunner(app.DB, jobs.DefaultOptions)
+	app.registerJobs(app.jobs)
+	app.periods, _ = timetable.ParsePeriods(timetable.DefaultPeriods)
+	app.location = time.FixedZone("Asia/Tokyo", 9*60*60)
+
+	code := m.Run()
+	os.RemoveAll(blobDir)
+	os.Exit(code)
 }
\ No newline at end of file
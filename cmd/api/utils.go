@@ -5,6 +5,7 @@ import (
 	"errors"
 	"io"
 	"net/http"
+	"strconv"
 )
 
 type JSONResponse struct {
@@ -68,4 +69,32 @@ func (app *application) errorJSON(w http.ResponseWriter, err error, status ...in
 	payload.Message = err.Error()
 	
 	return app.writeJSON(w, statusCode, payload)
-}
\ No newline at end of file
+}
+
+const (
+	defaultPageSize = 20
+	maxPageSize     = 100
+)
+
+// readPage reads the page (from 1) and per_page query parameters and turns
+// them into a limit and offset
+func (app *application) readPage(r *http.Request) (int, int, error) {
+	page, perPage := 1, defaultPageSize
+
+	var err error
+	if r.URL.Query().Get("page") != "" {
+		page, err = strconv.Atoi(r.URL.Query().Get("page"))
+		if err != nil || page < 1 {
+			return 0, 0, errors.New("page must be a positive number")
+		}
+	}
+
+	if r.URL.Query().Get("per_page") != "" {
+		perPage, err = strconv.Atoi(r.URL.Query().Get("per_page"))
+		if err != nil || perPage < 1 || perPage > maxPageSize {
+			return 0, 0, errors.New("per_page must be between 1 and 100")
+		}
+	}
+
+	return perPage, (page - 1) * perPage, nil
+}
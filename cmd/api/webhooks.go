@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"kstation_backend/internal/models"
+	"kstation_backend/internal/webhook"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	// webhookBatchSize is how many due deliveries are sent at once
+	webhookBatchSize = 20
+	// webhookLease is how long a claimed delivery is hidden from other
+	// workers; it must outlast the webhook timeout
+	webhookLease = time.Minute * 2
+)
+
+// reviewWebhookEvents maps the lesson stream events of reviews to the webhook
+// events integrations subscribe to
+var reviewWebhookEvents = map[string]string{
+	eventCommentCreated: models.WebhookReviewCreated,
+	eventCommentUpdated: models.WebhookReviewUpdated,
+	eventCommentDeleted: models.WebhookReviewDeleted,
+}
+
+// webhookEvent is the body posted to webhooks
+type webhookEvent struct {
+	Event      string      `json:"event"`
+	LessonID   int         `json:"lesson_id"`
+	OccurredAt time.Time   `json:"occurred_at"`
+	Data       interface{} `json:"data"`
+}
+
+// publishWebhookEvent queues an event for every webhook subscribed to it
+func (app *application) publishWebhookEvent(eventType string, lessonID int, data interface{}) {
+	payload, err := json.Marshal(webhookEvent{
+		Event:      eventType,
+		LessonID:   lessonID,
+		OccurredAt: time.Now().UTC(),
+		Data:       data,
+	})
+	if err != nil {
+		log.Println("Error encoding webhook event", err)
+		return
+	}
+
+	count, err := app.DB.EnqueueWebhookDeliveries(eventType, payload)
+	if err != nil {
+		log.Println("Error queueing webhook deliveries of", eventType, err)
+		return
+	}
+
+	if count > 0 {
+		app.queueWebhookDelivery()
+	}
+}
+
+// queueWebhookDelivery queues a run of deliverWebhooks right away, so new
+// deliveries do not wait for the next sweep
+func (app *application) queueWebhookDelivery() {
+	_, err := app.jobs.Enqueue(jobDeliverWebhooks, nil)
+	if err != nil {
+		log.Println("Error queueing webhook delivery", err)
+	}
+}
+
+// deliverWebhooks sends due deliveries batch by batch until none are left or
+// ctx is done, then queues its next run for when the earliest retry is due.
+// Requests already sent are let finish, since the webhook timeout bounds them.
+func (app *application) deliverWebhooks(ctx context.Context, job *models.Job) error {
+	sent := 0
+	for {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		count, err := app.sendDueWebhooks()
+		sent += count
+		if err != nil {
+			return err
+		}
+		if count < webhookBatchSize {
+			break
+		}
+	}
+
+	if sent > 0 {
+		log.Println("Sent webhooks:", sent)
+	}
+
+	next, err := app.DB.NextWebhookAttempt()
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	// every run that finds the same retry queues it under the same key, so it
+	// is only queued once
+	_, err = app.jobs.EnqueueOnce(jobDeliverWebhooks, fmt.Sprintf("%s@%d", jobDeliverWebhooks, next.Unix()), nil, next)
+	return err
+}
+
+// sendDueWebhooks sends a batch of due deliveries concurrently and returns
+// how many were attempted
+func (app *application) sendDueWebhooks() (int, error) {
+	deliveries, err := app.DB.ClaimWebhookDeliveries(webhookBatchSize, webhookLease)
+	if err != nil {
+		return 0, err
+	}
+
+	var wg sync.WaitGroup
+	for _, delivery := range deliveries {
+		wg.Add(1)
+		go func(delivery *models.WebhookDelivery) {
+			defer wg.Done()
+			app.attemptWebhook(delivery)
+		}(delivery)
+	}
+	wg.Wait()
+
+	return len(deliveries), nil
+}
+
+// attemptWebhook sends a delivery once and records whether it succeeded, is
+// retried later or is given up on
+func (app *application) attemptWebhook(delivery *models.WebhookDelivery) {
+	// the claim set the next attempt to when the lease runs out
+	lease := delivery.NextAttemptAt
+
+	now := time.Now()
+	code, err := app.webhooks.Send(context.Background(), webhook.Request{
+		URL:        delivery.Webhook.URL,
+		Secret:     delivery.Webhook.Secret,
+		EventType:  delivery.EventType,
+		DeliveryID: delivery.ID,
+		Body:       delivery.Payload,
+	}, now)
+
+	delivery.Attempts++
+	delivery.LastStatusCode = code
+
+	if err == nil {
+		delivery.Status = models.DeliverySucceeded
+		delivery.LastError = ""
+		delivery.DeliveredAt = &now
+	} else {
+		delivery.LastError = err.Error()
+
+		delay, retry := app.webhookRetry.Next(delivery.Attempts)
+		if retry {
+			delivery.NextAttemptAt = now.Add(delay)
+		} else {
+			delivery.Status = models.DeliveryDead
+			log.Println("Giving up on webhook delivery", delivery.ID, "after", delivery.Attempts, "attempts:", err)
+		}
+	}
+
+	err = app.DB.RecordWebhookAttempt(*delivery, lease)
+	if errors.Is(err, sql.ErrNoRows) {
+		log.Println("Skipping webhook delivery", delivery.ID, "whose lease ran out before the attempt was recorded")
+	} else if err != nil {
+		log.Println("Error recording webhook delivery", delivery.ID, err)
+	}
+}
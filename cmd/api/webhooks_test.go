@@ -0,0 +1,313 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"io"
+	"kstation_backend/internal/jobs"
+	"kstation_backend/internal/models"
+	"kstation_backend/internal/repository/dbrepo"
+	"kstation_backend/internal/webhook"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// webhookRepo hands out queued deliveries and records what happens to them
+type webhookRepo struct {
+	dbrepo.TestDBRepo
+	mu       sync.Mutex
+	queued   map[string][]byte
+	due      []*models.WebhookDelivery
+	recorded map[int]models.WebhookDelivery
+	next     time.Time
+}
+
+func (m *webhookRepo) EnqueueWebhookDeliveries(eventType string, payload []byte) (int64, error) {
+	if m.queued == nil {
+		m.queued = make(map[string][]byte)
+	}
+	m.queued[eventType] = payload
+	return 1, nil
+}
+
+func (m *webhookRepo) ClaimWebhookDeliveries(limit int, lease time.Duration) ([]*models.WebhookDelivery, error) {
+	due := m.due
+	m.due = nil
+	return due, nil
+}
+
+func (m *webhookRepo) RecordWebhookAttempt(delivery models.WebhookDelivery, lease time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.recorded == nil {
+		m.recorded = make(map[int]models.WebhookDelivery)
+	}
+	m.recorded[delivery.ID] = delivery
+	return nil
+}
+
+func (m *webhookRepo) NextWebhookAttempt() (time.Time, error) {
+	if m.next.IsZero() {
+		return time.Time{}, sql.ErrNoRows
+	}
+	return m.next, nil
+}
+
+// webhookReceiver answers with status and counts the requests whose
+// signature it could verify
+type webhookReceiver struct {
+	mu       sync.Mutex
+	status   int
+	verified int
+}
+
+func (rcv *webhookReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	timestamp, _ := strconv.ParseInt(r.Header.Get(webhook.TimestampHeader), 10, 64)
+
+	rcv.mu.Lock()
+	if webhook.Verify("receiversecret", r.Header.Get(webhook.SignatureHeader), timestamp, body) {
+		rcv.verified++
+	}
+	rcv.mu.Unlock()
+
+	w.WriteHeader(rcv.status)
+}
+
+func Test_app_webhookHandlers(t *testing.T) {
+	var tests = []struct {
+		name               string
+		method             string
+		handler            http.HandlerFunc
+		id                 string
+		query              string
+		requestBody        string
+		expectedStatusCode int
+		expectedBody       string
+	}{
+		{"list", "GET", app.allWebhooks, "", "", "", http.StatusOK, `"event_types":["review.created"]`},
+		{"create", "POST", app.insertWebhook, "", "", `{"url":"https://bot.example.com/hook","event_types":["review.created","lesson.offered"]}`, http.StatusCreated, `"secret":"`},
+		{"create with secret", "POST", app.insertWebhook, "", "", `{"url":"https://bot.example.com/hook","event_types":["review.created"],"secret":"0123456789abcdef"}`, http.StatusCreated, `"secret":"0123456789abcdef"`},
+		{"create bad url", "POST", app.insertWebhook, "", "", `{"url":"ftp://bot.example.com","event_types":["review.created"]}`, http.StatusBadRequest, ""},
+		{"create without events", "POST", app.insertWebhook, "", "", `{"url":"https://bot.example.com/hook","event_types":[]}`, http.StatusBadRequest, ""},
+		{"create unknown event", "POST", app.insertWebhook, "", "", `{"url":"https://bot.example.com/hook","event_types":["lesson.deleted"]}`, http.StatusBadRequest, ""},
+		{"create short secret", "POST", app.insertWebhook, "", "", `{"url":"https://bot.example.com/hook","event_types":["review.created"],"secret":"short"}`, http.StatusBadRequest, ""},
+		{"create not json", "POST", app.insertWebhook, "", "", `I'm not JSON`, http.StatusBadRequest, ""},
+		{"update", "PUT", app.updateWebhook, "1", "", `{"url":"https://bot.example.com/v2","event_types":["review.deleted"],"active":false}`, http.StatusOK, ""},
+		{"update unknown", "PUT", app.updateWebhook, "2", "", `{"url":"https://bot.example.com/v2","event_types":["review.deleted"]}`, http.StatusNotFound, ""},
+		{"update invalid", "PUT", app.updateWebhook, "1", "", `{"url":"","event_types":["review.deleted"]}`, http.StatusBadRequest, ""},
+		{"delete", "DELETE", app.deleteWebhook, "1", "", "", http.StatusOK, ""},
+		{"delete unknown", "DELETE", app.deleteWebhook, "2", "", "", http.StatusNotFound, ""},
+		{"deliveries", "GET", app.webhookDeliveries, "1", "", "", http.StatusOK, `"status":"dead"`},
+		{"dead deliveries", "GET", app.webhookDeliveries, "1", "?status=dead", "", http.StatusOK, `"attempts":8`},
+		{"succeeded deliveries", "GET", app.webhookDeliveries, "1", "?status=succeeded", "", http.StatusOK, `[]`},
+		{"bad status", "GET", app.webhookDeliveries, "1", "?status=failed", "", http.StatusBadRequest, ""},
+		{"deliveries of unknown", "GET", app.webhookDeliveries, "2", "", "", http.StatusNotFound, ""},
+		{"retry", "POST", app.retryWebhookDelivery, "1", "", "", http.StatusOK, ""},
+		{"retry unknown", "POST", app.retryWebhookDelivery, "2", "", "", http.StatusNotFound, ""},
+	}
+
+	for _, e := range tests {
+		req, _ := http.NewRequest(e.method, "/admin/webhooks"+e.query, strings.NewReader(e.requestBody))
+		if e.id != "" {
+			req = withURLParam(req, "id", e.id)
+		}
+
+		rr := httptest.NewRecorder()
+		e.handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("%s: expected status of %d but got %d", e.name, e.expectedStatusCode, rr.Code)
+		}
+
+		if !strings.Contains(rr.Body.String(), e.expectedBody) {
+			t.Errorf("%s: expected %s in %s", e.name, e.expectedBody, rr.Body.String())
+		}
+
+		if e.name == "list" && strings.Contains(rr.Body.String(), "verysecret") {
+			t.Errorf("%s: listed a webhook secret", e.name)
+		}
+	}
+}
+
+func Test_app_attemptWebhook(t *testing.T) {
+	receiver := &webhookReceiver{}
+	ts := httptest.NewServer(receiver)
+	defer ts.Close()
+
+	repo := &webhookRepo{}
+	oldDB := app.DB
+	app.DB = repo
+	defer func() { app.DB = oldDB }()
+
+	var tests = []struct {
+		name           string
+		status         int
+		attempts       int
+		expectedStatus string
+	}{
+		{"delivered", http.StatusOK, 0, models.DeliverySucceeded},
+		{"retried", http.StatusInternalServerError, 0, models.DeliveryPending},
+		{"dead-lettered", http.StatusGone, 2, models.DeliveryDead},
+	}
+
+	for i, e := range tests {
+		receiver.status = e.status
+		before := time.Now()
+
+		app.attemptWebhook(&models.WebhookDelivery{
+			ID:        i + 1,
+			WebhookId: 1,
+			EventType: models.WebhookReviewCreated,
+			Payload:   []byte(`{"event":"review.created"}`),
+			Status:    models.DeliveryPending,
+			Attempts:  e.attempts,
+			Webhook:   &models.Webhook{ID: 1, URL: ts.URL, Secret: "receiversecret"},
+		})
+
+		recorded := repo.recorded[i+1]
+		if recorded.Status != e.expectedStatus || recorded.Attempts != e.attempts+1 || recorded.LastStatusCode != e.status {
+			t.Errorf("%s: unexpected delivery %+v", e.name, recorded)
+		}
+
+		if e.expectedStatus == models.DeliverySucceeded && (recorded.DeliveredAt == nil || recorded.LastError != "") {
+			t.Errorf("%s: expected a delivery time and no error", e.name)
+		}
+
+		if e.expectedStatus == models.DeliveryPending && recorded.NextAttemptAt.Before(before.Add(app.webhookRetry.BaseDelay)) {
+			t.Errorf("%s: expected a retry after %s but got %s", e.name, app.webhookRetry.BaseDelay, recorded.NextAttemptAt)
+		}
+	}
+
+	if receiver.verified != len(tests) {
+		t.Errorf("expected %d signed requests but verified %d", len(tests), receiver.verified)
+	}
+}
+
+func Test_app_sendDueWebhooks(t *testing.T) {
+	receiver := &webhookReceiver{status: http.StatusNoContent}
+	ts := httptest.NewServer(receiver)
+	defer ts.Close()
+
+	repo := &webhookRepo{}
+	for id := 1; id <= 3; id++ {
+		repo.due = append(repo.due, &models.WebhookDelivery{
+			ID:        id,
+			WebhookId: 1,
+			EventType: models.WebhookReviewDeleted,
+			Payload:   []byte(`{"event":"review.deleted"}`),
+			Status:    models.DeliveryPending,
+			Webhook:   &models.Webhook{ID: 1, URL: ts.URL, Secret: "receiversecret"},
+		})
+	}
+
+	oldDB := app.DB
+	app.DB = repo
+	defer func() { app.DB = oldDB }()
+
+	count, err := app.sendDueWebhooks()
+	if err != nil || count != 3 {
+		t.Fatalf("expected 3 deliveries but got %d, %v", count, err)
+	}
+
+	for id := 1; id <= 3; id++ {
+		if repo.recorded[id].Status != models.DeliverySucceeded {
+			t.Errorf("expected delivery %d to succeed but got %+v", id, repo.recorded[id])
+		}
+	}
+}
+
+func Test_app_deliverWebhooks(t *testing.T) {
+	receiver := &webhookReceiver{status: http.StatusNoContent}
+	ts := httptest.NewServer(receiver)
+	defer ts.Close()
+
+	retryAt := time.Date(2024, 5, 13, 11, 0, 0, 0, time.UTC)
+
+	var tests = []struct {
+		name        string
+		due         int
+		next        time.Time
+		expectedRun *time.Time
+	}{
+		{"retry waiting", 2, retryAt, &retryAt},
+		{"nothing left", 1, time.Time{}, nil},
+	}
+
+	for _, e := range tests {
+		repo := &webhookRepo{next: e.next}
+		for id := 1; id <= e.due; id++ {
+			repo.due = append(repo.due, &models.WebhookDelivery{
+				ID:        id,
+				WebhookId: 1,
+				EventType: models.WebhookReviewCreated,
+				Payload:   []byte(`{"event":"review.created"}`),
+				Status:    models.DeliveryPending,
+				Webhook:   &models.Webhook{ID: 1, URL: ts.URL, Secret: "receiversecret"},
+			})
+		}
+
+		store := &jobRepo{}
+		oldDB, oldJobs := app.DB, app.jobs
+		app.DB = repo
+		app.jobs = jobs.NewRunner(store, jobs.DefaultOptions)
+		app.registerJobs(app.jobs)
+
+		err := app.deliverWebhooks(context.Background(), &models.Job{Kind: jobDeliverWebhooks})
+		app.DB, app.jobs = oldDB, oldJobs
+		if err != nil {
+			t.Fatalf("%s: %s", e.name, err)
+		}
+
+		if len(repo.recorded) != e.due {
+			t.Errorf("%s: expected %d deliveries sent but got %d", e.name, e.due, len(repo.recorded))
+		}
+
+		if e.expectedRun == nil {
+			if len(store.queued) != 0 {
+				t.Errorf("%s: expected no next run but got %+v", e.name, store.queued)
+			}
+			continue
+		}
+
+		if len(store.queued) != 1 || store.queued[0].Kind != jobDeliverWebhooks || !store.queued[0].RunAt.Equal(*e.expectedRun) || store.queued[0].UniqueKey == "" {
+			t.Errorf("%s: expected the next run at %s but got %+v", e.name, *e.expectedRun, store.queued)
+		}
+	}
+}
+
+func Test_app_publishWebhookEvent(t *testing.T) {
+	repo := &webhookRepo{}
+	store := &jobRepo{}
+	oldDB, oldJobs := app.DB, app.jobs
+	app.DB = repo
+	app.jobs = jobs.NewRunner(store, jobs.DefaultOptions)
+	app.registerJobs(app.jobs)
+	defer func() { app.DB, app.jobs = oldDB, oldJobs }()
+
+	app.publishCommentChange(eventCommentDeleted, 1, 7)
+
+	var event struct {
+		Event    string         `json:"event"`
+		LessonID int            `json:"lesson_id"`
+		Data     map[string]int `json:"data"`
+	}
+	err := json.Unmarshal(repo.queued[models.WebhookReviewDeleted], &event)
+	if err != nil {
+		t.Fatalf("expected a queued review.deleted payload: %s", err)
+	}
+
+	if event.Event != models.WebhookReviewDeleted || event.LessonID != 1 || event.Data["id"] != 7 {
+		t.Errorf("unexpected payload %+v", event)
+	}
+	if len(store.queued) != 1 || store.queued[0].Kind != jobDeliverWebhooks {
+		t.Errorf("expected a delivery run to be queued but got %+v", store.queued)
+	}
+}
@@ -0,0 +1,218 @@
+// Package avatar turns an uploaded profile picture into square thumbnails.
+//
+// Uploads are decoded, turned upright according to their EXIF orientation,
+// cropped to a centred square and re-encoded as JPEG. Because only the pixels
+// are re-encoded, EXIF data such as GPS position never reaches the output.
+package avatar
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	_ "image/png"
+	"io"
+
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+var ErrUnsupportedFormat = errors.New("image must be a JPEG, PNG or WebP file")
+
+var ErrTooLarge = errors.New("image dimensions are too large")
+
+// DefaultSizes are the edge lengths in pixels of the thumbnails made for each avatar
+var DefaultSizes = []int{64, 128, 256}
+
+// maxPixels guards against images that are small on disk but huge once decoded
+const maxPixels = 40_000_000
+
+var formats = map[string]bool{"jpeg": true, "png": true, "webp": true}
+
+// Thumbnail is one encoded size of an avatar
+type Thumbnail struct {
+	Size int
+	Data []byte
+}
+
+// Check reads only the header of data and returns the error Process would
+// give for its format or dimensions, without decoding the pixels
+func Check(data []byte) (format string, err error) {
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil || !formats[format] {
+		return "", ErrUnsupportedFormat
+	}
+
+	if config.Width*config.Height > maxPixels {
+		return "", ErrTooLarge
+	}
+
+	return format, nil
+}
+
+// Process decodes data and returns a JPEG thumbnail for each of sizes
+func Process(data []byte, sizes []int) ([]Thumbnail, error) {
+	format, err := Check(data)
+	if err != nil {
+		return nil, err
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedFormat, err)
+	}
+
+	if format == "jpeg" {
+		img = orient(img, jpegOrientation(bytes.NewReader(data)))
+	}
+
+	square := cropSquare(img)
+
+	thumbnails := make([]Thumbnail, 0, len(sizes))
+	for _, size := range sizes {
+		dst := image.NewRGBA(image.Rect(0, 0, size, size))
+		// transparent areas become white, since JPEG has no alpha channel
+		draw.Draw(dst, dst.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+		draw.CatmullRom.Scale(dst, dst.Bounds(), square, square.Bounds(), draw.Over, nil)
+
+		var buf bytes.Buffer
+		err = jpeg.Encode(&buf, dst, &jpeg.Options{Quality: 85})
+		if err != nil {
+			return nil, err
+		}
+
+		thumbnails = append(thumbnails, Thumbnail{Size: size, Data: buf.Bytes()})
+	}
+
+	return thumbnails, nil
+}
+
+func cropSquare(img image.Image) image.Image {
+	b := img.Bounds()
+	side := b.Dx()
+	if b.Dy() < side {
+		side = b.Dy()
+	}
+
+	x := b.Min.X + (b.Dx()-side)/2
+	y := b.Min.Y + (b.Dy()-side)/2
+
+	dst := image.NewRGBA(image.Rect(0, 0, side, side))
+	draw.Draw(dst, dst.Bounds(), img, image.Point{X: x, Y: y}, draw.Src)
+
+	return dst
+}
+
+// orient rotates and flips img so that it is shown the way the camera
+// intended, following the EXIF orientation values 1 to 8
+func orient(img image.Image, orientation int) image.Image {
+	if orientation < 2 || orientation > 8 {
+		return img
+	}
+
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if orientation >= 5 {
+		w, h = h, w
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < b.Dy(); y++ {
+		for x := 0; x < b.Dx(); x++ {
+			var dx, dy int
+			switch orientation {
+			case 2:
+				dx, dy = b.Dx()-1-x, y
+			case 3:
+				dx, dy = b.Dx()-1-x, b.Dy()-1-y
+			case 4:
+				dx, dy = x, b.Dy()-1-y
+			case 5:
+				dx, dy = y, x
+			case 6:
+				dx, dy = b.Dy()-1-y, x
+			case 7:
+				dx, dy = b.Dy()-1-y, b.Dx()-1-x
+			case 8:
+				dx, dy = y, b.Dx()-1-x
+			}
+			dst.Set(dx, dy, img.At(b.Min.X+x, b.Min.Y+y))
+		}
+	}
+
+	return dst
+}
+
+// jpegOrientation reads the orientation tag from the EXIF segment of a JPEG
+// file. It returns 1 (upright) when the file has no usable EXIF data.
+func jpegOrientation(r io.Reader) int {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil || header[0] != 0xFF || header[1] != 0xD8 {
+		return 1
+	}
+
+	for {
+		marker := make([]byte, 4)
+		if _, err := io.ReadFull(r, marker); err != nil || marker[0] != 0xFF {
+			return 1
+		}
+
+		length := int(marker[2])<<8 | int(marker[3])
+		if length < 2 {
+			return 1
+		}
+
+		segment := make([]byte, length-2)
+		if _, err := io.ReadFull(r, segment); err != nil {
+			return 1
+		}
+
+		switch {
+		case marker[1] == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")):
+			return exifOrientation(segment[6:])
+		case marker[1] == 0xDA:
+			// start of the image data, no EXIF segment came before it
+			return 1
+		}
+	}
+}
+
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+
+	var u16 func([]byte) int
+	var u32 func([]byte) int
+	switch string(tiff[:2]) {
+	case "II":
+		u16 = func(b []byte) int { return int(b[0]) | int(b[1])<<8 }
+		u32 = func(b []byte) int { return u16(b) | u16(b[2:])<<16 }
+	case "MM":
+		u16 = func(b []byte) int { return int(b[0])<<8 | int(b[1]) }
+		u32 = func(b []byte) int { return u16(b)<<16 | u16(b[2:]) }
+	default:
+		return 1
+	}
+
+	offset := u32(tiff[4:])
+	if offset+2 > len(tiff) {
+		return 1
+	}
+
+	entries := u16(tiff[offset:])
+	for i := 0; i < entries; i++ {
+		entry := offset + 2 + i*12
+		if entry+12 > len(tiff) {
+			return 1
+		}
+
+		if u16(tiff[entry:]) == 0x0112 {
+			return u16(tiff[entry+8:])
+		}
+	}
+
+	return 1
+}
@@ -0,0 +1,165 @@
+package avatar
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+// tinyWebP is a 1x1 lossless WebP image
+const tinyWebP = "UklGRhoAAABXRUJQVlA4TA0AAAAvAAAAEAcQERGIiP4HAA=="
+
+// halves returns a w x h image whose left half is red and right half is blue
+func halves(w, h int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			c := color.RGBA{R: 255, A: 255}
+			if x >= w/2 {
+				c = color.RGBA{B: 255, A: 255}
+			}
+			img.Set(x, y, c)
+		}
+	}
+
+	return img
+}
+
+// withExif inserts an APP1 segment holding the given orientation and a fake
+// GPS marker right after the start of a JPEG file
+func withExif(jpg []byte, orientation byte) []byte {
+	tiff := []byte{
+		'M', 'M', 0, 42, 0, 0, 0, 8,
+		0, 1,
+		0x01, 0x12, 0, 3, 0, 0, 0, 1, 0, orientation, 0, 0,
+		0, 0, 0, 0,
+	}
+	payload := append([]byte("Exif\x00\x00"), tiff...)
+	payload = append(payload, []byte("GPS 35.6812N 139.7671E")...)
+
+	length := len(payload) + 2
+	segment := append([]byte{0xFF, 0xE1, byte(length >> 8), byte(length)}, payload...)
+
+	out := append([]byte{}, jpg[:2]...)
+	out = append(out, segment...)
+
+	return append(out, jpg[2:]...)
+}
+
+func isRed(c color.Color) bool {
+	r, _, b, _ := c.RGBA()
+	return r > 0xC000 && b < 0x4000
+}
+
+func TestCheck(t *testing.T) {
+	var pngBuf bytes.Buffer
+	png.Encode(&pngBuf, halves(30, 60))
+
+	var gifBuf bytes.Buffer
+	gif.Encode(&gifBuf, halves(10, 10), nil)
+
+	var tests = []struct {
+		name           string
+		data           []byte
+		expectedFormat string
+		expectedErr    error
+	}{
+		{"png", pngBuf.Bytes(), "png", nil},
+		{"header only", pngBuf.Bytes()[:40], "png", nil},
+		{"gif", gifBuf.Bytes(), "", ErrUnsupportedFormat},
+		{"not an image", []byte("hello"), "", ErrUnsupportedFormat},
+	}
+
+	for _, e := range tests {
+		format, err := Check(e.data)
+		if format != e.expectedFormat || !errors.Is(err, e.expectedErr) {
+			t.Errorf("%s: expected %q, %v but got %q, %v", e.name, e.expectedFormat, e.expectedErr, format, err)
+		}
+	}
+}
+
+func TestProcess(t *testing.T) {
+	var jpg bytes.Buffer
+	jpeg.Encode(&jpg, halves(80, 40), &jpeg.Options{Quality: 95})
+
+	var pngBuf bytes.Buffer
+	png.Encode(&pngBuf, halves(30, 60))
+
+	webp, _ := base64.StdEncoding.DecodeString(tinyWebP)
+
+	var gifBuf bytes.Buffer
+	gif.Encode(&gifBuf, halves(10, 10), nil)
+
+	var tests = []struct {
+		name        string
+		data        []byte
+		expectedErr error
+	}{
+		{"jpeg", jpg.Bytes(), nil},
+		{"jpeg with exif", withExif(jpg.Bytes(), 6), nil},
+		{"png", pngBuf.Bytes(), nil},
+		{"webp", webp, nil},
+		{"gif", gifBuf.Bytes(), ErrUnsupportedFormat},
+		{"not an image", []byte("hello"), ErrUnsupportedFormat},
+	}
+
+	for _, e := range tests {
+		thumbnails, err := Process(e.data, DefaultSizes)
+		if !errors.Is(err, e.expectedErr) {
+			t.Errorf("%s: expected error %v but got %v", e.name, e.expectedErr, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+
+		if len(thumbnails) != len(DefaultSizes) {
+			t.Fatalf("%s: expected %d thumbnails but got %d", e.name, len(DefaultSizes), len(thumbnails))
+		}
+
+		for i, thumbnail := range thumbnails {
+			img, format, err := image.Decode(bytes.NewReader(thumbnail.Data))
+			if err != nil || format != "jpeg" {
+				t.Errorf("%s: thumbnail %d is not a jpeg", e.name, thumbnail.Size)
+				continue
+			}
+
+			if img.Bounds().Dx() != DefaultSizes[i] || img.Bounds().Dy() != DefaultSizes[i] {
+				t.Errorf("%s: expected a %dpx square but got %v", e.name, DefaultSizes[i], img.Bounds())
+			}
+
+			if bytes.Contains(thumbnail.Data, []byte("Exif")) || bytes.Contains(thumbnail.Data, []byte("GPS")) {
+				t.Errorf("%s: thumbnail still carries exif data", e.name)
+			}
+		}
+	}
+}
+
+func TestProcessOrientation(t *testing.T) {
+	var jpg bytes.Buffer
+	jpeg.Encode(&jpg, halves(80, 40), &jpeg.Options{Quality: 95})
+
+	// orientation 6 means the picture must be turned a quarter clockwise, so
+	// the red left half ends up on top
+	thumbnails, err := Process(withExif(jpg.Bytes(), 6), []int{64})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	img, _, _ := image.Decode(bytes.NewReader(thumbnails[0].Data))
+	if !isRed(img.At(32, 8)) || isRed(img.At(32, 56)) {
+		t.Error("expected the red half at the top after applying the orientation")
+	}
+
+	thumbnails, _ = Process(jpg.Bytes(), []int{64})
+	img, _, _ = image.Decode(bytes.NewReader(thumbnails[0].Data))
+	if !isRed(img.At(8, 32)) || isRed(img.At(56, 32)) {
+		t.Error("expected the red half on the left without exif data")
+	}
+}
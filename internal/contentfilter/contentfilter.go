@@ -0,0 +1,194 @@
+// Package contentfilter screens review text before it is stored.
+//
+// A Policy runs a list of Rules in order. Each rule may rewrite the text
+// (for example to strip links) and returns a Decision; the strictest decision
+// of all rules wins.
+package contentfilter
+
+import (
+	"bufio"
+	"os"
+	"regexp"
+	"strings"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+type Decision int
+
+const (
+	Allow Decision = iota
+	Hold
+	Reject
+)
+
+func (d Decision) String() string {
+	switch d {
+	case Hold:
+		return "hold"
+	case Reject:
+		return "reject"
+	default:
+		return "allow"
+	}
+}
+
+type Result struct {
+	Decision Decision
+	Text     string
+	Reasons  []string
+}
+
+type Rule interface {
+	Check(text string) (string, Decision, string)
+}
+
+type Policy struct {
+	Rules []Rule
+}
+
+func NewPolicy(rules ...Rule) *Policy {
+	return &Policy{Rules: rules}
+}
+
+// Apply runs every rule over text. A nil policy allows everything.
+func (p *Policy) Apply(text string) Result {
+	result := Result{Decision: Allow, Text: text}
+	if p == nil {
+		return result
+	}
+
+	for _, rule := range p.Rules {
+		text, decision, reason := rule.Check(result.Text)
+		result.Text = text
+		if decision > result.Decision {
+			result.Decision = decision
+		}
+		if reason != "" {
+			result.Reasons = append(result.Reasons, reason)
+		}
+	}
+
+	return result
+}
+
+// normalize folds full-width characters and case so that word lists and
+// patterns match Japanese and English input written in either width
+func normalize(text string) string {
+	return strings.ToLower(norm.NFKC.String(text))
+}
+
+// BannedWords rejects or holds text containing any of the listed words.
+type BannedWords struct {
+	Decision Decision
+	Words    []string
+}
+
+func (b BannedWords) Check(text string) (string, Decision, string) {
+	normalized := normalize(text)
+	for _, word := range b.Words {
+		if word != "" && strings.Contains(normalized, normalize(word)) {
+			return text, b.Decision, "contains banned word"
+		}
+	}
+	return text, Allow, ""
+}
+
+// LoadWordList reads one word per line, skipping blank lines and lines
+// starting with #.
+func LoadWordList(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var words []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		words = append(words, line)
+	}
+
+	return words, scanner.Err()
+}
+
+var (
+	emailPattern = regexp.MustCompile(`[a-z0-9._%+\-]+@[a-z0-9.\-]+\.[a-z]{2,}`)
+	phonePattern = regexp.MustCompile(`(?:\+81[\s\-]?|\b0)\d{1,4}[\s\-]?\d{1,4}[\s\-]?\d{3,4}\b`)
+)
+
+// DefaultStudentIDPattern matches ids such as 21T1234
+const DefaultStudentIDPattern = `\b\d{2}[a-z]{1,2}\d{4,5}\b`
+
+// PersonalInfo holds text that looks like it contains an email address,
+// a phone number or a student id.
+type PersonalInfo struct {
+	StudentID *regexp.Regexp
+}
+
+func NewPersonalInfo(studentIDPattern string) (PersonalInfo, error) {
+	var p PersonalInfo
+	if studentIDPattern == "" {
+		return p, nil
+	}
+
+	re, err := regexp.Compile(studentIDPattern)
+	if err != nil {
+		return p, err
+	}
+	p.StudentID = re
+
+	return p, nil
+}
+
+func (p PersonalInfo) Check(text string) (string, Decision, string) {
+	normalized := normalize(text)
+
+	switch {
+	case emailPattern.MatchString(normalized):
+		return text, Hold, "contains an email address"
+	case phonePattern.MatchString(normalized):
+		return text, Hold, "contains a phone number"
+	case p.StudentID != nil && p.StudentID.MatchString(normalized):
+		return text, Hold, "contains a student id"
+	}
+
+	return text, Allow, ""
+}
+
+var linkPattern = regexp.MustCompile(`(?i)[ \t　]*(?:https?://|www\.)[^\s　]+`)
+
+// StripLinks removes urls from the text without holding it. Only the links
+// and the space that separated them go; line breaks and the rest of the text
+// are kept as written.
+type StripLinks struct{}
+
+func (StripLinks) Check(text string) (string, Decision, string) {
+	matches := linkPattern.FindAllStringIndex(text, -1)
+	if matches == nil {
+		return text, Allow, ""
+	}
+
+	var stripped strings.Builder
+	last := 0
+	for _, match := range matches {
+		start, end := match[0], match[1]
+		if start < last {
+			start = last
+		}
+		stripped.WriteString(text[last:start])
+
+		// a link opening a line takes the space after it rather than before
+		if stripped.Len() == 0 || strings.HasSuffix(stripped.String(), "\n") {
+			end = len(text) - len(strings.TrimLeft(text[end:], " \t　"))
+		}
+		last = end
+	}
+	stripped.WriteString(text[last:])
+
+	return stripped.String(), Allow, "links removed"
+}
@@ -0,0 +1,95 @@
+package contentfilter
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func testPolicy(t *testing.T) *Policy {
+	personalInfo, err := NewPersonalInfo(DefaultStudentIDPattern)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return NewPolicy(
+		StripLinks{},
+		BannedWords{Decision: Reject, Words: []string{"死ね", "idiot"}},
+		BannedWords{Decision: Hold, Words: []string{"カンニング"}},
+		personalInfo,
+	)
+}
+
+func TestPolicyApply(t *testing.T) {
+	var tests = []struct {
+		name             string
+		text             string
+		expectedDecision Decision
+		expectedText     string
+	}{
+		{"clean", "テストは簡単でした", Allow, "テストは簡単でした"},
+		{"english banned word", "the teacher is an IDIOT", Reject, "the teacher is an IDIOT"},
+		{"japanese banned word", "先生死ね", Reject, "先生死ね"},
+		{"hold word", "カンニングしている人がいた", Hold, "カンニングしている人がいた"},
+		{"full width banned word", "ｉｄｉｏｔ", Reject, "ｉｄｉｏｔ"},
+		{"email", "質問は taro@example.com まで", Hold, "質問は taro@example.com まで"},
+		{"phone", "電話 090-1234-5678", Hold, "電話 090-1234-5678"},
+		{"full width phone", "電話 ０９０１２３４５６７８", Hold, "電話 ０９０１２３４５６７８"},
+		{"student id", "21T1234 の人に聞いて", Hold, "21T1234 の人に聞いて"},
+		{"link", "see https://example.com/notes for notes", Allow, "see for notes"},
+		{"link opening the text", "https://example.com がおすすめ", Allow, "がおすすめ"},
+		{"links keep line breaks", "一行目\n\nsee www.example.com\nhttps://a.example https://b.example 三行目", Allow, "一行目\n\nsee\n三行目"},
+		{"paragraphs without links", "一行目\n\n二行目  です", Allow, "一行目\n\n二行目  です"},
+		{"year is not a phone", "2023年度の前期", Allow, "2023年度の前期"},
+	}
+
+	policy := testPolicy(t)
+
+	for _, e := range tests {
+		result := policy.Apply(e.text)
+
+		if result.Decision != e.expectedDecision {
+			t.Errorf("%s: expected decision %s but got %s", e.name, e.expectedDecision, result.Decision)
+		}
+
+		if result.Text != e.expectedText {
+			t.Errorf("%s: expected text %q but got %q", e.name, e.expectedText, result.Text)
+		}
+	}
+}
+
+func TestPolicyApplyReasons(t *testing.T) {
+	result := testPolicy(t).Apply("see https://example.com/notes, mail taro@example.com")
+
+	expected := []string{"links removed", "contains an email address"}
+	if strings.Join(result.Reasons, "|") != strings.Join(expected, "|") {
+		t.Errorf("expected reasons %q but got %q", expected, result.Reasons)
+	}
+}
+
+func TestNilPolicy(t *testing.T) {
+	var policy *Policy
+
+	result := policy.Apply("anything")
+	if result.Decision != Allow || result.Text != "anything" {
+		t.Errorf("nil policy should allow text unchanged")
+	}
+}
+
+func TestLoadWordList(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "words.txt")
+	err := os.WriteFile(path, []byte("# banned\nidiot\n\n死ね\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	words, err := LoadWordList(path)
+	if err != nil {
+		t.Errorf("load word list returned an error: %s", err)
+	}
+
+	if len(words) != 2 || words[0] != "idiot" || words[1] != "死ね" {
+		t.Errorf("wrong words loaded: %v", words)
+	}
+}
@@ -0,0 +1,159 @@
+// Package digest renders the email digest of new reviews on a user's favorite
+// lessons.
+//
+// Every digest is written in Japanese or English, as a plain text and an HTML
+// part, from the templates embedded in this package. Review authors are never
+// shown, since the mail leaves the app.
+package digest
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	htmltemplate "html/template"
+	"kstation_backend/internal/models"
+	"strings"
+	texttemplate "text/template"
+	"time"
+	"unicode/utf8"
+)
+
+// excerptLength is the most characters of a review shown in a digest
+const excerptLength = 200
+
+//go:embed templates
+var templateFS embed.FS
+
+// Languages are the languages a digest can be written in, the first being the
+// fallback for any other
+var Languages = []string{models.DigestJapanese, models.DigestEnglish}
+
+type templates struct {
+	text *texttemplate.Template
+	html *htmltemplate.Template
+}
+
+var byLanguage = make(map[string]templates)
+
+func init() {
+	funcs := map[string]interface{}{
+		"stars":   Stars,
+		"excerpt": excerpt,
+	}
+
+	for _, lang := range Languages {
+		byLanguage[lang] = templates{
+			text: texttemplate.Must(texttemplate.New("").Funcs(funcs).ParseFS(templateFS, fmt.Sprintf("templates/digest.%s.txt", lang))),
+			html: htmltemplate.Must(htmltemplate.New("").Funcs(funcs).ParseFS(templateFS, fmt.Sprintf("templates/digest.%s.html", lang))),
+		}
+	}
+}
+
+// Lesson is a favorite lesson with its new reviews
+type Lesson struct {
+	ID      int
+	Name    string
+	Teacher string
+	URL     string
+	Reviews []*models.DigestReview
+}
+
+// Digest is everything one digest email shows
+type Digest struct {
+	FirstName      string
+	Lessons        []Lesson
+	Since          time.Time
+	Until          time.Time
+	UnsubscribeURL string
+	PreferencesURL string
+	// Location is the time zone dates are shown in
+	Location *time.Location
+}
+
+// ReviewCount returns how many reviews the digest shows
+func (d Digest) ReviewCount() int {
+	count := 0
+	for _, lesson := range d.Lessons {
+		count += len(lesson.Reviews)
+	}
+
+	return count
+}
+
+// Date formats a time as a date in the digest's time zone
+func (d Digest) Date(t time.Time) string {
+	if d.Location != nil {
+		t = t.In(d.Location)
+	}
+
+	return t.Format("2006-01-02")
+}
+
+// Group collects reviews, which must be ordered by lesson, into lessons
+// linking to appURL
+func Group(reviews []*models.DigestReview, appURL string) []Lesson {
+	var lessons []Lesson
+	for _, review := range reviews {
+		if len(lessons) == 0 || lessons[len(lessons)-1].ID != review.LessonId {
+			lessons = append(lessons, Lesson{
+				ID:      review.LessonId,
+				Name:    review.LessonName,
+				Teacher: review.TeacherName,
+				URL:     fmt.Sprintf("%s/lessons/%d", appURL, review.LessonId),
+			})
+		}
+		last := &lessons[len(lessons)-1]
+		last.Reviews = append(last.Reviews, review)
+	}
+
+	return lessons
+}
+
+// Render returns the subject, plain text and HTML of a digest in a language,
+// falling back to Japanese for languages without templates
+func Render(lang string, d Digest) (string, string, string, error) {
+	t, ok := byLanguage[lang]
+	if !ok {
+		t = byLanguage[Languages[0]]
+	}
+
+	var subject, text, html bytes.Buffer
+	err := t.text.ExecuteTemplate(&subject, "subject", d)
+	if err != nil {
+		return "", "", "", err
+	}
+
+	err = t.text.ExecuteTemplate(&text, "text", d)
+	if err != nil {
+		return "", "", "", err
+	}
+
+	err = t.html.ExecuteTemplate(&html, "html", d)
+	if err != nil {
+		return "", "", "", err
+	}
+
+	return strings.TrimSpace(subject.String()), text.String(), html.String(), nil
+}
+
+// Stars draws a rating out of five
+func Stars(star int) string {
+	if star < 0 {
+		star = 0
+	}
+	if star > 5 {
+		star = 5
+	}
+
+	return strings.Repeat("★", star) + strings.Repeat("☆", 5-star)
+}
+
+// excerpt shortens a review to excerptLength characters on one line
+func excerpt(s string) string {
+	s = strings.Join(strings.Fields(s), " ")
+	if utf8.RuneCountInString(s) <= excerptLength {
+		return s
+	}
+
+	return string([]rune(s)[:excerptLength]) + "…"
+}
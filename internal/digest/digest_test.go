@@ -0,0 +1,136 @@
+package digest
+
+import (
+	"kstation_backend/internal/models"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testDigest() Digest {
+	jst := time.FixedZone("Asia/Tokyo", 9*60*60)
+	until := time.Date(2024, 5, 13, 0, 0, 0, 0, jst)
+	reviews := []*models.DigestReview{
+		{LessonId: 1, LessonName: "Linear Algebra", TeacherName: "Yamada", Star: 4, Comment: "Clear <b>lectures</b>", Year: 2024, Term: "spring", CreatedAt: until.Add(-time.Hour * 30)},
+		{LessonId: 1, LessonName: "Linear Algebra", TeacherName: "Yamada", Star: 2, Comment: "Hard tests", Year: 2024, Term: "spring", CreatedAt: until.Add(-time.Hour * 50)},
+		{LessonId: 2, LessonName: "Statistics", TeacherName: "Sato", Star: 5, Comment: "Great", Year: 2023, Term: "fall", CreatedAt: until.Add(-time.Hour * 70)},
+	}
+
+	return Digest{
+		FirstName:      "Taro",
+		Lessons:        Group(reviews, "https://example.com"),
+		Since:          until.Add(-time.Hour * 24 * 7),
+		Until:          until,
+		UnsubscribeURL: "https://example.com/digest/unsubscribe?token=1.abc",
+		PreferencesURL: "https://example.com/settings/notifications",
+		Location:       jst,
+	}
+}
+
+func TestGroup(t *testing.T) {
+	d := testDigest()
+
+	if len(d.Lessons) != 2 {
+		t.Fatalf("expected 2 lessons but got %d", len(d.Lessons))
+	}
+
+	if len(d.Lessons[0].Reviews) != 2 || len(d.Lessons[1].Reviews) != 1 {
+		t.Errorf("unexpected reviews per lesson %d, %d", len(d.Lessons[0].Reviews), len(d.Lessons[1].Reviews))
+	}
+
+	if d.Lessons[1].URL != "https://example.com/lessons/2" {
+		t.Errorf("unexpected lesson url %s", d.Lessons[1].URL)
+	}
+
+	if d.ReviewCount() != 3 {
+		t.Errorf("expected 3 reviews but got %d", d.ReviewCount())
+	}
+}
+
+func TestRender(t *testing.T) {
+	var tests = []struct {
+		name    string
+		lang    string
+		subject string
+		text    string
+	}{
+		{"japanese", "ja", "お気に入りの授業に新しいレビューが3件あります", "配信停止: https://example.com/digest/unsubscribe?token=1.abc"},
+		{"english", "en", "3 new reviews on your favorite lessons", "Unsubscribe: https://example.com/digest/unsubscribe?token=1.abc"},
+		{"fallback", "fr", "お気に入りの授業に新しいレビューが3件あります", "Taroさん、こんにちは。"},
+	}
+
+	for _, e := range tests {
+		subject, text, html, err := Render(e.lang, testDigest())
+		if err != nil {
+			t.Fatalf("%s: %s", e.name, err)
+		}
+
+		if subject != e.subject {
+			t.Errorf("%s: unexpected subject %q", e.name, subject)
+		}
+
+		if !strings.Contains(text, e.text) {
+			t.Errorf("%s: text does not contain %q:\n%s", e.name, e.text, text)
+		}
+
+		if !strings.Contains(text, "★★★★☆ 2024 spring") {
+			t.Errorf("%s: text does not show the rating:\n%s", e.name, text)
+		}
+
+		if !strings.Contains(html, `href="https://example.com/lessons/1"`) {
+			t.Errorf("%s: html does not link the lesson", e.name)
+		}
+
+		if strings.Contains(html, "<b>lectures</b>") || !strings.Contains(html, "&lt;b&gt;lectures&lt;/b&gt;") {
+			t.Errorf("%s: html does not escape reviews", e.name)
+		}
+	}
+}
+
+func TestRenderDates(t *testing.T) {
+	d := testDigest()
+	_, text, _, _ := Render("en", d)
+
+	if !strings.Contains(text, "from 2024-05-06 to 2024-05-13") {
+		t.Errorf("unexpected period in:\n%s", text)
+	}
+
+	// 30 hours before midnight in Tokyo is still the 11th there, but the 11th
+	// at 09:00 in UTC
+	if !strings.Contains(text, "(2024-05-11)") {
+		t.Errorf("dates are not in the digest's time zone:\n%s", text)
+	}
+}
+
+func TestExcerpt(t *testing.T) {
+	long := strings.Repeat("あ", excerptLength+10)
+
+	if got := excerpt("line one\n\nline  two"); got != "line one line two" {
+		t.Errorf("unexpected excerpt %q", got)
+	}
+
+	if got := excerpt(long); got != strings.Repeat("あ", excerptLength)+"…" {
+		t.Errorf("long review was not shortened: %d characters", len([]rune(got)))
+	}
+}
+
+func TestUnsubscribeToken(t *testing.T) {
+	token := UnsubscribeToken("secret", 42)
+
+	userID, ok := ParseUnsubscribeToken("secret", token)
+	if !ok || userID != 42 {
+		t.Errorf("expected user 42 but got %d, %v", userID, ok)
+	}
+
+	for _, bad := range []string{
+		"",
+		"42",
+		UnsubscribeToken("other", 42),
+		strings.Replace(token, "42.", "43.", 1),
+		"0." + unsubscribeMAC("secret", "0"),
+	} {
+		if _, ok := ParseUnsubscribeToken("secret", bad); ok {
+			t.Errorf("token %q should be invalid", bad)
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package digest
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"strings"
+)
+
+// UnsubscribeToken returns a token that turns off a user's digest without
+// signing in. It never expires, so a link in an old digest keeps working.
+func UnsubscribeToken(secret string, userID int) string {
+	id := strconv.Itoa(userID)
+
+	return id + "." + unsubscribeMAC(secret, id)
+}
+
+// ParseUnsubscribeToken returns the user an unsubscribe token was made for,
+// and whether the token is valid
+func ParseUnsubscribeToken(secret string, token string) (int, bool) {
+	id, mac, found := strings.Cut(token, ".")
+	if !found {
+		return 0, false
+	}
+
+	userID, err := strconv.Atoi(id)
+	if err != nil || userID <= 0 {
+		return 0, false
+	}
+
+	if !hmac.Equal([]byte(mac), []byte(unsubscribeMAC(secret, id))) {
+		return 0, false
+	}
+
+	return userID, true
+}
+
+func unsubscribeMAC(secret string, id string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte("digest-unsubscribe:" + id))
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
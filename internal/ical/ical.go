@@ -0,0 +1,154 @@
+// Package ical writes RFC 5545 calendars.
+//
+// Only what a class timetable needs is supported: timed events in a single
+// time zone that either happen once or repeat weekly until a date. The zone
+// is written with one fixed offset, so it should not observe daylight saving
+// time.
+package ical
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	dateTimeFormat    = "20060102T150405"
+	utcDateTimeFormat = "20060102T150405Z"
+
+	// maxLineLength is the longest content line allowed, in octets
+	maxLineLength = 75
+)
+
+type Calendar struct {
+	ProdID   string
+	Name     string
+	Location *time.Location
+	Events   []Event
+}
+
+// Event is a timed event. When Until is set the event repeats every week on
+// the weekday of Start up to and including the day of Until.
+type Event struct {
+	UID         string
+	Summary     string
+	Description string
+	Start       time.Time
+	End         time.Time
+	Until       time.Time
+	Stamp       time.Time
+}
+
+// Write encodes the calendar, with all times in the calendar's location
+func (c *Calendar) Write(w io.Writer) error {
+	loc := c.Location
+	if loc == nil {
+		loc = time.UTC
+	}
+	tzid := loc.String()
+
+	var buf bytes.Buffer
+	line := func(name, value string) {
+		writeLine(&buf, name+":"+value)
+	}
+
+	line("BEGIN", "VCALENDAR")
+	line("VERSION", "2.0")
+	line("PRODID", c.ProdID)
+	line("CALSCALE", "GREGORIAN")
+	line("METHOD", "PUBLISH")
+	if c.Name != "" {
+		line("X-WR-CALNAME", escapeText(c.Name))
+	}
+	line("X-WR-TIMEZONE", tzid)
+
+	writeTimezone(&buf, loc, c.Events)
+
+	for _, event := range c.Events {
+		line("BEGIN", "VEVENT")
+		line("UID", event.UID)
+		line("DTSTAMP", event.Stamp.UTC().Format(utcDateTimeFormat))
+		writeLine(&buf, "DTSTART;TZID="+tzid+":"+event.Start.In(loc).Format(dateTimeFormat))
+		writeLine(&buf, "DTEND;TZID="+tzid+":"+event.End.In(loc).Format(dateTimeFormat))
+		if !event.Until.IsZero() {
+			// UNTIL must be in UTC when the start has a time zone
+			y, m, d := event.Until.In(loc).Date()
+			until := time.Date(y, m, d, 23, 59, 59, 0, loc)
+			line("RRULE", "FREQ=WEEKLY;UNTIL="+until.UTC().Format(utcDateTimeFormat))
+		}
+		line("SUMMARY", escapeText(event.Summary))
+		if event.Description != "" {
+			line("DESCRIPTION", escapeText(event.Description))
+		}
+		line("END", "VEVENT")
+	}
+
+	line("END", "VCALENDAR")
+
+	_, err := buf.WriteTo(w)
+	return err
+}
+
+// writeTimezone describes the location with the offset it has at the first
+// event
+func writeTimezone(buf *bytes.Buffer, loc *time.Location, events []Event) {
+	at := time.Now()
+	if len(events) > 0 {
+		at = events[0].Start
+	}
+	name, offset := at.In(loc).Zone()
+
+	writeLine(buf, "BEGIN:VTIMEZONE")
+	writeLine(buf, "TZID:"+loc.String())
+	writeLine(buf, "BEGIN:STANDARD")
+	writeLine(buf, "DTSTART:19700101T000000")
+	writeLine(buf, "TZOFFSETFROM:"+formatOffset(offset))
+	writeLine(buf, "TZOFFSETTO:"+formatOffset(offset))
+	writeLine(buf, "TZNAME:"+name)
+	writeLine(buf, "END:STANDARD")
+	writeLine(buf, "END:VTIMEZONE")
+}
+
+func formatOffset(seconds int) string {
+	sign := '+'
+	if seconds < 0 {
+		sign = '-'
+		seconds = -seconds
+	}
+
+	return fmt.Sprintf("%c%02d%02d", sign, seconds/3600, seconds%3600/60)
+}
+
+// escapeText escapes a TEXT value (RFC 5545 section 3.3.11)
+func escapeText(s string) string {
+	return strings.NewReplacer(
+		`\`, `\\`,
+		";", `\;`,
+		",", `\,`,
+		"\r\n", `\n`,
+		"\n", `\n`,
+		"\r", `\n`,
+	).Replace(s)
+}
+
+// writeLine writes a content line, folding it into lines of at most 75 octets
+// without splitting a UTF-8 sequence (RFC 5545 section 3.1)
+func writeLine(buf *bytes.Buffer, s string) {
+	limit := maxLineLength
+	for len(s) > limit {
+		cut := limit
+		for cut > 0 && !utf8.RuneStart(s[cut]) {
+			cut--
+		}
+		buf.WriteString(s[:cut])
+		buf.WriteString("\r\n ")
+		s = s[cut:]
+		// the leading space of a continuation line counts toward its length
+		limit = maxLineLength - 1
+	}
+	buf.WriteString(s)
+	buf.WriteString("\r\n")
+}
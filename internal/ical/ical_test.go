@@ -0,0 +1,98 @@
+package ical
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+func TestCalendarWrite(t *testing.T) {
+	jst := time.FixedZone("Asia/Tokyo", 9*60*60)
+	start := time.Date(2024, 4, 15, 8, 40, 0, 0, jst)
+
+	calendar := Calendar{
+		ProdID:   "-//kstation//timetable//EN",
+		Name:     "Timetable",
+		Location: jst,
+		Events: []Event{
+			{
+				UID:         "1-2-1-1@kstation",
+				Summary:     "線形代数; 演習, 基礎",
+				Description: "teacher: Yamada\ncredits: 2",
+				Start:       start,
+				End:         start.Add(75 * time.Minute),
+				Until:       time.Date(2024, 7, 31, 0, 0, 0, 0, jst),
+				Stamp:       time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC),
+			},
+			{
+				UID:     "once@kstation",
+				Summary: strings.Repeat("とても長い授業名", 10),
+				Start:   start,
+				End:     start.Add(time.Hour),
+				Stamp:   time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC),
+			},
+		},
+	}
+
+	var buf bytes.Buffer
+	err := calendar.Write(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+
+	for _, expected := range []string{
+		"BEGIN:VCALENDAR\r\nVERSION:2.0\r\n",
+		"TZID:Asia/Tokyo\r\n",
+		"TZOFFSETTO:+0900\r\n",
+		"UID:1-2-1-1@kstation\r\n",
+		"DTSTART;TZID=Asia/Tokyo:20240415T084000\r\n",
+		"DTEND;TZID=Asia/Tokyo:20240415T095500\r\n",
+		"RRULE:FREQ=WEEKLY;UNTIL=20240731T145959Z\r\n",
+		`SUMMARY:線形代数\; 演習\, 基礎` + "\r\n",
+		`DESCRIPTION:teacher: Yamada\ncredits: 2` + "\r\n",
+		"DTSTAMP:20240401T000000Z\r\n",
+		"END:VCALENDAR\r\n",
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("expected %q in\n%s", expected, out)
+		}
+	}
+
+	if strings.Count(out, "RRULE") != 1 {
+		t.Error("a single event should not repeat")
+	}
+
+	for _, line := range strings.Split(strings.TrimSuffix(out, "\r\n"), "\r\n") {
+		if len(line) > maxLineLength {
+			t.Errorf("line longer than %d octets: %q", maxLineLength, line)
+		}
+		if !utf8.ValidString(line) {
+			t.Errorf("line splits a character: %q", line)
+		}
+	}
+
+	unfolded := strings.ReplaceAll(out, "\r\n ", "")
+	if !strings.Contains(unfolded, "SUMMARY:"+strings.Repeat("とても長い授業名", 10)+"\r\n") {
+		t.Error("folded summary does not unfold to the original")
+	}
+}
+
+func Test_formatOffset(t *testing.T) {
+	var tests = []struct {
+		seconds  int
+		expected string
+	}{
+		{9 * 60 * 60, "+0900"},
+		{0, "+0000"},
+		{-(3*60*60 + 30*60), "-0330"},
+	}
+
+	for _, e := range tests {
+		if got := formatOffset(e.seconds); got != e.expected {
+			t.Errorf("%d: expected %s but got %s", e.seconds, e.expected, got)
+		}
+	}
+}
@@ -0,0 +1,344 @@
+// Package jobs runs background work queued in Postgres.
+//
+// Jobs are rows that workers claim with SELECT ... FOR UPDATE SKIP LOCKED, so
+// any number of API instances can share one queue. A claimed job is leased:
+// if its worker dies, the job is claimed again once the lease runs out, and
+// the store refuses the result of a worker that outlived its lease. Failed
+// jobs are retried with exponential backoff until they run out of attempts,
+// and are then kept as failed until an admin retries them.
+//
+// Recurring jobs are queued by every instance from the same schedule under a
+// unique key, so each run is queued once however many instances are up.
+package jobs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"kstation_backend/internal/models"
+	"log"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+// Store is where jobs are queued
+type Store interface {
+	EnqueueJob(job models.Job) (int, error)
+	ClaimJobs(kinds []string, limit int, lease time.Duration) ([]*models.Job, error)
+	RecordJobResult(job models.Job) error
+}
+
+// Handler does the work of one job. Returning an error retries the job later,
+// unless the error is permanent.
+type Handler func(ctx context.Context, job *models.Job) error
+
+// Typed returns a handler that decodes the job's JSON payload into a T.
+// Payloads that do not decode fail the job without retrying.
+func Typed[T any](fn func(ctx context.Context, payload T) error) Handler {
+	return func(ctx context.Context, job *models.Job) error {
+		var payload T
+		if len(job.Payload) > 0 {
+			err := json.Unmarshal(job.Payload, &payload)
+			if err != nil {
+				return Permanent(fmt.Errorf("decoding payload: %w", err))
+			}
+		}
+
+		return fn(ctx, payload)
+	}
+}
+
+type permanentError struct {
+	err error
+}
+
+func (e permanentError) Error() string { return e.err.Error() }
+func (e permanentError) Unwrap() error { return e.err }
+
+// Permanent marks an error that retrying cannot fix, so the job fails at once
+func Permanent(err error) error {
+	return permanentError{err}
+}
+
+// Backoff is how long failed jobs wait before their next attempt
+type Backoff struct {
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+}
+
+// Delay returns how long to wait after the given number of attempts, doubling
+// after every attempt up to MaxDelay
+func (b Backoff) Delay(attempts int) time.Duration {
+	delay := b.BaseDelay
+	for i := 1; i < attempts && delay < b.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > b.MaxDelay {
+		delay = b.MaxDelay
+	}
+
+	return delay
+}
+
+type Options struct {
+	// Workers is how many jobs run at once
+	Workers int
+	// PollInterval is how often idle workers look for due jobs
+	PollInterval time.Duration
+	// Lease is how long a job may run before it is claimed again. Handlers
+	// are cancelled when it runs out.
+	Lease time.Duration
+	// MaxAttempts is how many times a job is tried before it fails
+	MaxAttempts int
+	Backoff     Backoff
+}
+
+var DefaultOptions = Options{
+	Workers:      4,
+	PollInterval: time.Second * 5,
+	Lease:        time.Minute * 10,
+	MaxAttempts:  5,
+	Backoff:      Backoff{BaseDelay: time.Second * 30, MaxDelay: time.Hour},
+}
+
+type scheduled struct {
+	name     string
+	kind     string
+	schedule Schedule
+	next     time.Time
+}
+
+// Runner claims and runs the jobs it has handlers for. Handlers and schedules
+// must all be added before Run is called.
+type Runner struct {
+	store     Store
+	opts      Options
+	handlers  map[string]Handler
+	kinds     []string
+	schedules []*scheduled
+}
+
+func NewRunner(store Store, opts Options) *Runner {
+	return &Runner{
+		store:    store,
+		opts:     opts,
+		handlers: make(map[string]Handler),
+	}
+}
+
+// Handle runs jobs of a kind with handler
+func (r *Runner) Handle(kind string, handler Handler) {
+	if _, ok := r.handlers[kind]; !ok {
+		r.kinds = append(r.kinds, kind)
+	}
+	r.handlers[kind] = handler
+}
+
+// Handles reports whether the runner has a handler for a kind
+func (r *Runner) Handles(kind string) bool {
+	_, ok := r.handlers[kind]
+	return ok
+}
+
+// Kinds returns the kinds of jobs the runner handles, in the order they were
+// added
+func (r *Runner) Kinds() []string {
+	return append([]string(nil), r.kinds...)
+}
+
+// Schedule queues a job of a kind, with an empty payload, at every time the
+// schedule gives. The name identifies the schedule across instances.
+func (r *Runner) Schedule(name string, kind string, schedule Schedule) {
+	r.schedules = append(r.schedules, &scheduled{name: name, kind: kind, schedule: schedule})
+}
+
+// Enqueue queues a job to run as soon as a worker is free
+func (r *Runner) Enqueue(kind string, payload interface{}) (int, error) {
+	return r.EnqueueAt(kind, payload, time.Now())
+}
+
+// EnqueueAt queues a job to run at a given time
+func (r *Runner) EnqueueAt(kind string, payload interface{}, runAt time.Time) (int, error) {
+	return r.EnqueueOnce(kind, "", payload, runAt)
+}
+
+// EnqueueOnce queues a job to run at a given time unless a job with the same
+// key was queued before, in which case it returns 0. An empty key is never a
+// duplicate.
+func (r *Runner) EnqueueOnce(kind string, key string, payload interface{}, runAt time.Time) (int, error) {
+	if !r.Handles(kind) {
+		return 0, fmt.Errorf("unknown job kind %q", kind)
+	}
+
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return 0, err
+	}
+	if payload == nil {
+		data = []byte("{}")
+	}
+
+	return r.store.EnqueueJob(models.Job{Kind: kind, Payload: data, MaxAttempts: r.opts.MaxAttempts, RunAt: runAt, UniqueKey: key})
+}
+
+// Run starts the workers and the schedules, and blocks until ctx is done and
+// every job that was running has returned. Running jobs are cancelled with
+// ctx and queued again to run as soon as a worker is free.
+func (r *Runner) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for i := 0; i < r.opts.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r.work(ctx)
+		}()
+	}
+
+	r.runSchedules(ctx)
+	wg.Wait()
+}
+
+// work runs due jobs one after another, and waits a poll interval whenever
+// none are due
+func (r *Runner) work(ctx context.Context) {
+	for ctx.Err() == nil {
+		ran, err := r.RunNext(ctx)
+		if err != nil {
+			log.Println("Error claiming jobs", err)
+		}
+		if ran {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+		case <-time.After(r.opts.PollInterval):
+		}
+	}
+}
+
+// RunNext claims one due job and runs it until it returns or ctx is done, and
+// reports whether there was one
+func (r *Runner) RunNext(ctx context.Context) (bool, error) {
+	if len(r.kinds) == 0 {
+		return false, nil
+	}
+
+	claimed, err := r.store.ClaimJobs(r.kinds, 1, r.opts.Lease)
+	if err != nil || len(claimed) == 0 {
+		return false, err
+	}
+
+	r.execute(ctx, claimed[0])
+
+	return true, nil
+}
+
+// execute runs a claimed job and records whether it succeeded, will be
+// retried, or failed. A job cut short by ctx is queued again at once.
+func (r *Runner) execute(ctx context.Context, job *models.Job) {
+	jobCtx, cancel := context.WithTimeout(ctx, r.opts.Lease)
+	defer cancel()
+
+	start := time.Now()
+	err := r.call(jobCtx, job)
+	now := time.Now()
+
+	var permanent permanentError
+	job.LastError = ""
+	switch {
+	case err == nil:
+		job.Status = models.JobSucceeded
+		job.FinishedAt = &now
+	case ctx.Err() != nil:
+		job.Status = models.JobPending
+		job.LastError = err.Error()
+		job.RunAt = now
+	case errors.As(err, &permanent) || job.Attempts >= job.MaxAttempts:
+		job.Status = models.JobFailed
+		job.LastError = err.Error()
+		job.FinishedAt = &now
+	default:
+		job.Status = models.JobPending
+		job.LastError = err.Error()
+		job.RunAt = now.Add(r.opts.Backoff.Delay(job.Attempts))
+	}
+
+	if err != nil {
+		log.Printf("Error running job %d (%s), attempt %d of %d: %s", job.ID, job.Kind, job.Attempts, job.MaxAttempts, err)
+	} else {
+		log.Printf("Ran job %d (%s) in %s", job.ID, job.Kind, now.Sub(start).Round(time.Millisecond))
+	}
+
+	err = r.store.RecordJobResult(*job)
+	if err != nil {
+		log.Println("Error recording job result", job.ID, err)
+	}
+}
+
+// call runs the job's handler, turning a panic into an error
+func (r *Runner) call(ctx context.Context, job *models.Job) (err error) {
+	handler, ok := r.handlers[job.Kind]
+	if !ok {
+		return Permanent(fmt.Errorf("no handler for job kind %q", job.Kind))
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			log.Printf("Job %d (%s) panicked: %v\n%s", job.ID, job.Kind, p, debug.Stack())
+			err = fmt.Errorf("panic: %v", p)
+		}
+	}()
+
+	return handler(ctx, job)
+}
+
+// runSchedules queues the scheduled jobs as they come due until ctx is done
+func (r *Runner) runSchedules(ctx context.Context) {
+	now := time.Now()
+	for _, s := range r.schedules {
+		s.next = s.schedule.Next(now)
+		if s.next.IsZero() {
+			log.Println("Schedule never runs, skipping it:", s.name)
+		}
+	}
+
+	ticker := time.NewTicker(r.opts.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			r.enqueueScheduled(now)
+		}
+	}
+}
+
+// enqueueScheduled queues every scheduled job that is due at now. Runs that
+// another instance already queued are skipped by their unique key, and
+// schedules with no next run are skipped altogether.
+func (r *Runner) enqueueScheduled(now time.Time) {
+	for _, s := range r.schedules {
+		if s.next.IsZero() || now.Before(s.next) {
+			continue
+		}
+
+		_, err := r.store.EnqueueJob(models.Job{
+			Kind:        s.kind,
+			Payload:     []byte("{}"),
+			MaxAttempts: r.opts.MaxAttempts,
+			RunAt:       s.next,
+			UniqueKey:   fmt.Sprintf("%s@%d", s.name, s.next.Unix()),
+		})
+		if err != nil {
+			log.Println("Error queueing scheduled job", s.name, err)
+			continue
+		}
+
+		s.next = s.schedule.Next(now)
+	}
+}
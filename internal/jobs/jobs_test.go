@@ -0,0 +1,351 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"kstation_backend/internal/models"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memoryStore is a queue in memory that hands out due jobs in id order
+type memoryStore struct {
+	mu   sync.Mutex
+	jobs []*models.Job
+}
+
+func (s *memoryStore) EnqueueJob(job models.Job) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, queued := range s.jobs {
+		if job.UniqueKey != "" && queued.UniqueKey == job.UniqueKey {
+			return 0, nil
+		}
+	}
+
+	job.ID = len(s.jobs) + 1
+	job.Status = models.JobPending
+	s.jobs = append(s.jobs, &job)
+
+	return job.ID, nil
+}
+
+func (s *memoryStore) ClaimJobs(kinds []string, limit int, lease time.Duration) ([]*models.Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	var claimed []*models.Job
+	for _, job := range s.jobs {
+		if len(claimed) == limit {
+			break
+		}
+		if job.Status != models.JobPending || job.RunAt.After(now) || !strings.Contains(strings.Join(kinds, ","), job.Kind) {
+			continue
+		}
+
+		job.Status = models.JobRunning
+		job.Attempts++
+		job.RunAt = now.Add(lease)
+		copied := *job
+		claimed = append(claimed, &copied)
+	}
+
+	return claimed, nil
+}
+
+func (s *memoryStore) RecordJobResult(job models.Job) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored := s.jobs[job.ID-1]
+	if stored.Status != models.JobRunning || stored.Attempts != job.Attempts {
+		return errors.New("lease lost")
+	}
+
+	*stored = job
+	return nil
+}
+
+func (s *memoryStore) job(id int) models.Job {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return *s.jobs[id-1]
+}
+
+type greeting struct {
+	Name string `json:"name"`
+}
+
+func testOptions() Options {
+	return Options{Workers: 2, PollInterval: time.Millisecond * 10, Lease: time.Minute, MaxAttempts: 3, Backoff: Backoff{BaseDelay: time.Minute, MaxDelay: time.Hour}}
+}
+
+func TestRunnerTyped(t *testing.T) {
+	store := &memoryStore{}
+	runner := NewRunner(store, testOptions())
+
+	var got string
+	runner.Handle("greet", Typed(func(ctx context.Context, payload greeting) error {
+		got = payload.Name
+		return nil
+	}))
+
+	id, err := runner.Enqueue("greet", greeting{Name: "Taro"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ran, err := runner.RunNext(context.Background())
+	if err != nil || !ran {
+		t.Fatalf("expected a job to run, but got %v, %v", ran, err)
+	}
+
+	if got != "Taro" {
+		t.Errorf("expected the payload to be decoded but got %q", got)
+	}
+
+	job := store.job(id)
+	if job.Status != models.JobSucceeded || job.FinishedAt == nil {
+		t.Errorf("expected the job to succeed but got %+v", job)
+	}
+
+	ran, _ = runner.RunNext(context.Background())
+	if ran {
+		t.Error("ran a job that already succeeded")
+	}
+}
+
+func TestRunnerRetries(t *testing.T) {
+	store := &memoryStore{}
+	runner := NewRunner(store, testOptions())
+	runner.Handle("flaky", func(ctx context.Context, job *models.Job) error {
+		return errors.New("connection refused")
+	})
+
+	id, _ := runner.Enqueue("flaky", nil)
+
+	for attempt := 1; attempt <= 3; attempt++ {
+		before := time.Now()
+		_, _ = runner.RunNext(context.Background())
+		job := store.job(id)
+
+		if job.LastError != "connection refused" || job.Attempts != attempt {
+			t.Fatalf("attempt %d: unexpected job %+v", attempt, job)
+		}
+
+		if attempt < 3 {
+			delay := testOptions().Backoff.Delay(attempt)
+			if job.Status != models.JobPending || job.RunAt.Before(before.Add(delay)) {
+				t.Fatalf("attempt %d: expected a retry after %s but got %+v", attempt, delay, job)
+			}
+
+			// make the retry due now
+			store.mu.Lock()
+			store.jobs[id-1].RunAt = time.Now()
+			store.mu.Unlock()
+		} else if job.Status != models.JobFailed {
+			t.Errorf("expected the job to fail after its last attempt but got %s", job.Status)
+		}
+	}
+}
+
+func TestRunnerPermanentFailures(t *testing.T) {
+	store := &memoryStore{}
+	runner := NewRunner(store, testOptions())
+	runner.Handle("greet", Typed(func(ctx context.Context, payload greeting) error {
+		return nil
+	}))
+	runner.Handle("panic", func(ctx context.Context, job *models.Job) error {
+		panic("boom")
+	})
+
+	bad, _ := store.EnqueueJob(models.Job{Kind: "greet", Payload: []byte(`{"name":1}`), MaxAttempts: 3, RunAt: time.Now()})
+	panicked, _ := runner.Enqueue("panic", nil)
+
+	_, _ = runner.RunNext(context.Background())
+	_, _ = runner.RunNext(context.Background())
+
+	if job := store.job(bad); job.Status != models.JobFailed || !strings.Contains(job.LastError, "decoding payload") {
+		t.Errorf("expected a payload that does not decode to fail at once, but got %+v", job)
+	}
+
+	if job := store.job(panicked); job.Status != models.JobPending || job.LastError != "panic: boom" {
+		t.Errorf("expected a panic to be retried, but got %+v", job)
+	}
+}
+
+func TestRunnerUnknownKind(t *testing.T) {
+	runner := NewRunner(&memoryStore{}, testOptions())
+
+	_, err := runner.Enqueue("missing", nil)
+	if err == nil {
+		t.Error("queued a job no handler runs")
+	}
+}
+
+func TestRunnerEnqueueOnce(t *testing.T) {
+	store := &memoryStore{}
+	runner := NewRunner(store, testOptions())
+	runner.Handle("tick", func(ctx context.Context, job *models.Job) error { return nil })
+
+	at := time.Now().Add(time.Hour)
+	first, _ := runner.EnqueueOnce("tick", "tick@1", nil, at)
+	again, _ := runner.EnqueueOnce("tick", "tick@1", nil, at)
+	other, _ := runner.EnqueueOnce("tick", "tick@2", nil, at)
+
+	if first == 0 || again != 0 || other == 0 {
+		t.Errorf("expected only the first job with a key to be queued, but got %d, %d, %d", first, again, other)
+	}
+
+	if job := store.job(first); job.UniqueKey != "tick@1" || !job.RunAt.Equal(at) {
+		t.Errorf("unexpected job %+v", job)
+	}
+}
+
+func TestRunnerSchedules(t *testing.T) {
+	store := &memoryStore{}
+	runner := NewRunner(store, testOptions())
+	runner.Handle("tick", func(ctx context.Context, job *models.Job) error { return nil })
+	runner.Schedule("hourly-tick", "tick", Every(time.Hour))
+
+	// a second instance with the same schedule
+	other := NewRunner(store, testOptions())
+	other.Handle("tick", func(ctx context.Context, job *models.Job) error { return nil })
+	other.Schedule("hourly-tick", "tick", Every(time.Hour))
+
+	start := time.Date(2024, 5, 13, 10, 17, 0, 0, time.UTC)
+	for _, r := range []*Runner{runner, other} {
+		r.schedules[0].next = r.schedules[0].schedule.Next(start)
+		r.enqueueScheduled(start.Add(time.Minute))
+		r.enqueueScheduled(start.Add(time.Minute * 50))
+	}
+
+	if len(store.jobs) != 1 {
+		t.Fatalf("expected one job queued for 11:00 but got %d", len(store.jobs))
+	}
+
+	if job := store.job(1); !job.RunAt.Equal(time.Date(2024, 5, 13, 11, 0, 0, 0, time.UTC)) || job.Kind != "tick" {
+		t.Errorf("unexpected scheduled job %+v", job)
+	}
+
+	if next := runner.schedules[0].next; !next.Equal(time.Date(2024, 5, 13, 12, 0, 0, 0, time.UTC)) {
+		t.Errorf("expected the next run at 12:00 but got %s", next)
+	}
+}
+
+func TestRunnerSkipsEndedSchedules(t *testing.T) {
+	store := &memoryStore{}
+	runner := NewRunner(store, testOptions())
+	runner.Handle("tick", func(ctx context.Context, job *models.Job) error { return nil })
+
+	never, err := ParseCron("0 0 30 2 *", time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runner.Schedule("february-30th", "tick", never)
+
+	start := time.Date(2024, 5, 13, 10, 17, 0, 0, time.UTC)
+	runner.schedules[0].next = never.Next(start)
+	runner.enqueueScheduled(start.Add(time.Minute))
+	runner.enqueueScheduled(start.Add(time.Hour))
+
+	if len(store.jobs) != 0 {
+		t.Errorf("expected a schedule that never runs to queue nothing, but got %d jobs", len(store.jobs))
+	}
+}
+
+func TestRunnerRunDrains(t *testing.T) {
+	store := &memoryStore{}
+	runner := NewRunner(store, testOptions())
+
+	started := make(chan struct{})
+	finished := make(chan struct{})
+	runner.Handle("slow", func(ctx context.Context, job *models.Job) error {
+		close(started)
+		time.Sleep(time.Millisecond * 50)
+		close(finished)
+		return nil
+	})
+	id, _ := runner.Enqueue("slow", nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		runner.Run(ctx)
+		close(done)
+	}()
+
+	<-started
+	cancel()
+	<-done
+
+	select {
+	case <-finished:
+	default:
+		t.Fatal("Run returned before the running job finished")
+	}
+
+	if job := store.job(id); job.Status != models.JobSucceeded {
+		t.Errorf("expected the running job to succeed but got %s", job.Status)
+	}
+}
+
+func TestRunnerRunCancelsJobs(t *testing.T) {
+	store := &memoryStore{}
+	runner := NewRunner(store, testOptions())
+
+	started := make(chan struct{})
+	runner.Handle("endless", func(ctx context.Context, job *models.Job) error {
+		close(started)
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	id, _ := runner.Enqueue("endless", nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		runner.Run(ctx)
+		close(done)
+	}()
+
+	<-started
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Run did not cancel the running job")
+	}
+
+	job := store.job(id)
+	if job.Status != models.JobPending || job.RunAt.After(time.Now()) || job.FinishedAt != nil {
+		t.Errorf("expected the cancelled job to be queued again at once, but got %+v", job)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	backoff := Backoff{BaseDelay: time.Second * 30, MaxDelay: time.Minute * 5}
+
+	var tests = []struct {
+		attempts int
+		expected time.Duration
+	}{
+		{1, time.Second * 30},
+		{2, time.Minute},
+		{4, time.Minute * 4},
+		{5, time.Minute * 5},
+		{50, time.Minute * 5},
+	}
+
+	for _, e := range tests {
+		if got := backoff.Delay(e.attempts); got != e.expected {
+			t.Errorf("after %d attempts: expected %s but got %s", e.attempts, e.expected, got)
+		}
+	}
+}
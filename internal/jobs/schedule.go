@@ -0,0 +1,203 @@
+package jobs
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule gives the times a recurring job runs at
+type Schedule interface {
+	// Next returns the first run strictly after t, or the zero time if there
+	// is none
+	Next(t time.Time) time.Time
+}
+
+// Every runs a job once per interval, at multiples of the interval since the
+// zero time so that every instance picks the same times
+type Every time.Duration
+
+func (e Every) Next(t time.Time) time.Time {
+	d := time.Duration(e)
+	return t.Truncate(d).Add(d)
+}
+
+// Cron runs a job at the minutes matching a standard five field cron
+// expression: minute, hour, day of month, month and day of week
+type Cron struct {
+	minute, hour, dom, month, dow uint64
+	// domAny and dowAny are set when the day fields are *; when both are
+	// restricted, a day matching either runs the job, as in cron
+	domAny, dowAny bool
+	location       *time.Location
+}
+
+var cronFields = []struct {
+	name     string
+	min, max int
+}{
+	{"minute", 0, 59},
+	{"hour", 0, 23},
+	{"day of month", 1, 31},
+	{"month", 1, 12},
+	{"day of week", 0, 6},
+}
+
+var cronAliases = map[string]string{
+	"@hourly":  "0 * * * *",
+	"@daily":   "0 0 * * *",
+	"@weekly":  "0 0 * * 0",
+	"@monthly": "0 0 1 * *",
+}
+
+// ParseCron parses a cron expression such as "30 4 * * 1-5", evaluated in
+// loc. Fields may be *, numbers, ranges, lists and steps like */15;
+// @hourly, @daily, @weekly and @monthly are also accepted.
+func ParseCron(spec string, loc *time.Location) (*Cron, error) {
+	if alias, ok := cronAliases[strings.TrimSpace(spec)]; ok {
+		spec = alias
+	}
+
+	fields := strings.Fields(spec)
+	if len(fields) != len(cronFields) {
+		return nil, fmt.Errorf("cron expression %q must have 5 fields", spec)
+	}
+
+	var sets [5]uint64
+	for i, field := range fields {
+		set, err := parseCronField(field, cronFields[i].min, cronFields[i].max)
+		if err != nil {
+			return nil, fmt.Errorf("cron %s %q: %w", cronFields[i].name, field, err)
+		}
+		sets[i] = set
+	}
+
+	if loc == nil {
+		loc = time.UTC
+	}
+
+	return &Cron{
+		minute:   sets[0],
+		hour:     sets[1],
+		dom:      sets[2],
+		month:    sets[3],
+		dow:      sets[4],
+		domAny:   fields[2] == "*",
+		dowAny:   fields[4] == "*",
+		location: loc,
+	}, nil
+}
+
+// parseCronField returns the values a field matches as a bit set
+func parseCronField(field string, min, max int) (uint64, error) {
+	var set uint64
+	for _, part := range strings.Split(field, ",") {
+		rng, step := part, 1
+		if before, after, found := strings.Cut(part, "/"); found {
+			rng = before
+			n, err := strconv.Atoi(after)
+			if err != nil || n < 1 {
+				return 0, errors.New("step must be a positive number")
+			}
+			step = n
+		}
+
+		lo, hi := min, max
+		if rng != "*" {
+			from, to, isRange := strings.Cut(rng, "-")
+			var err error
+			lo, err = strconv.Atoi(from)
+			if err != nil {
+				return 0, errors.New("not a number")
+			}
+			hi = lo
+			if isRange {
+				hi, err = strconv.Atoi(to)
+				if err != nil {
+					return 0, errors.New("not a number")
+				}
+			} else if step > 1 {
+				hi = max
+			}
+		}
+
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("must be between %d and %d", min, max)
+		}
+
+		for v := lo; v <= hi; v += step {
+			set |= 1 << uint(v)
+		}
+	}
+
+	return set, nil
+}
+
+func (c *Cron) Next(t time.Time) time.Time {
+	t = t.In(c.location)
+	t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute()+1, 0, 0, c.location)
+
+	// every match repeats within a few years, so give up after that in case
+	// the expression can never match, such as February 30th
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		if c.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, c.location)
+			continue
+		}
+		if !c.dayMatches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, c.location)
+			continue
+		}
+		if c.hour&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, c.location)
+			continue
+		}
+		if c.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+
+		return t
+	}
+
+	return time.Time{}
+}
+
+func (c *Cron) dayMatches(t time.Time) bool {
+	dom := c.dom&(1<<uint(t.Day())) != 0
+	dow := c.dow&(1<<uint(t.Weekday())) != 0
+
+	switch {
+	case c.domAny && c.dowAny:
+		return true
+	case c.domAny:
+		return dow
+	case c.dowAny:
+		return dom
+	default:
+		return dom || dow
+	}
+}
+
+// ParseSchedule parses either an interval such as "6h" or a cron expression
+func ParseSchedule(spec string, loc *time.Location) (Schedule, error) {
+	if d, err := time.ParseDuration(spec); err == nil {
+		if d <= 0 {
+			return nil, fmt.Errorf("interval %q must be positive", spec)
+		}
+		return Every(d), nil
+	}
+
+	cron, err := ParseCron(spec, loc)
+	if err != nil {
+		return nil, err
+	}
+	if cron.Next(time.Now()).IsZero() {
+		return nil, fmt.Errorf("cron expression %q never matches", spec)
+	}
+
+	return cron, nil
+}
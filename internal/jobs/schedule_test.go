@@ -0,0 +1,103 @@
+package jobs
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEvery(t *testing.T) {
+	at := time.Date(2024, 5, 13, 10, 17, 42, 0, time.UTC)
+
+	next := Every(time.Hour).Next(at)
+	if !next.Equal(time.Date(2024, 5, 13, 11, 0, 0, 0, time.UTC)) {
+		t.Errorf("unexpected next run %s", next)
+	}
+
+	if !Every(time.Hour).Next(next).Equal(next.Add(time.Hour)) {
+		t.Errorf("a run on the hour should be followed by the next hour")
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	jst := time.FixedZone("Asia/Tokyo", 9*60*60)
+	// a Monday
+	at := time.Date(2024, 5, 13, 10, 17, 0, 0, jst)
+
+	var tests = []struct {
+		name     string
+		spec     string
+		expected time.Time
+	}{
+		{"every minute", "* * * * *", time.Date(2024, 5, 13, 10, 18, 0, 0, jst)},
+		{"every quarter hour", "*/15 * * * *", time.Date(2024, 5, 13, 10, 30, 0, 0, jst)},
+		{"daily at 04:30", "30 4 * * *", time.Date(2024, 5, 14, 4, 30, 0, 0, jst)},
+		{"weekdays at 9", "0 9 * * 1-5", time.Date(2024, 5, 14, 9, 0, 0, 0, jst)},
+		{"sundays", "0 0 * * 0", time.Date(2024, 5, 19, 0, 0, 0, 0, jst)},
+		{"list of hours", "0 8,12,18 * * *", time.Date(2024, 5, 13, 12, 0, 0, 0, jst)},
+		{"first of the month", "@monthly", time.Date(2024, 6, 1, 0, 0, 0, 0, jst)},
+		{"day of month or week", "0 0 20 * 3", time.Date(2024, 5, 15, 0, 0, 0, 0, jst)},
+		{"next year", "0 0 1 1 *", time.Date(2025, 1, 1, 0, 0, 0, 0, jst)},
+		{"leap day", "0 0 29 2 *", time.Date(2028, 2, 29, 0, 0, 0, 0, jst)},
+	}
+
+	for _, e := range tests {
+		cron, err := ParseCron(e.spec, jst)
+		if err != nil {
+			t.Errorf("%s: %s", e.name, err)
+			continue
+		}
+
+		next := cron.Next(at)
+		if !next.Equal(e.expected) {
+			t.Errorf("%s: expected %s but got %s", e.name, e.expected, next)
+		}
+	}
+}
+
+func TestCronNeverMatches(t *testing.T) {
+	cron, err := ParseCron("0 0 30 2 *", time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !cron.Next(time.Now()).IsZero() {
+		t.Error("February 30th should never come")
+	}
+}
+
+func TestParseCronErrors(t *testing.T) {
+	for _, spec := range []string{
+		"",
+		"* * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 7",
+		"*/0 * * * *",
+		"5-1 * * * *",
+		"a * * * *",
+	} {
+		if _, err := ParseCron(spec, time.UTC); err == nil {
+			t.Errorf("expected %q to be rejected", spec)
+		}
+	}
+}
+
+func TestParseSchedule(t *testing.T) {
+	schedule, err := ParseSchedule("6h", time.UTC)
+	if err != nil || schedule != Every(time.Hour*6) {
+		t.Errorf("expected an interval of 6h but got %v, %v", schedule, err)
+	}
+
+	schedule, err = ParseSchedule("30 4 * * *", time.UTC)
+	if _, ok := schedule.(*Cron); err != nil || !ok {
+		t.Errorf("expected a cron schedule but got %T, %v", schedule, err)
+	}
+
+	for _, spec := range []string{"-1h", "0s", "daily", "0 0 30 2 *"} {
+		if _, err := ParseSchedule(spec, time.UTC); err == nil {
+			t.Errorf("expected %q to be rejected", spec)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+// Package mailer sends email to users.
+//
+// SMTP delivers through a mail server, Log only writes messages to the
+// application log for local development, and Capture keeps them in memory so
+// tests can inspect what would have been sent.
+package mailer
+
+import (
+	"context"
+	"log"
+	"sync"
+)
+
+type Message struct {
+	To      string
+	Subject string
+	Text    string
+	// HTML is optional; when set the message is sent with both parts
+	HTML string
+	// ListUnsubscribe is an optional address that unsubscribes the recipient
+	// with a single POST, offered by mail clients as an unsubscribe button
+	ListUnsubscribe string
+}
+
+type Mailer interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+// Log writes messages to the standard logger instead of sending them
+type Log struct{}
+
+func (Log) Send(ctx context.Context, msg Message) error {
+	log.Printf("Mail to %s: %s\n%s", msg.To, msg.Subject, msg.Text)
+	return nil
+}
+
+// Capture records every message it is asked to send
+type Capture struct {
+	mu       sync.Mutex
+	messages []Message
+}
+
+func (c *Capture) Send(ctx context.Context, msg Message) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.messages = append(c.messages, msg)
+	return nil
+}
+
+// Messages returns a copy of the messages sent so far
+func (c *Capture) Messages() []Message {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return append([]Message(nil), c.messages...)
+}
+
+// Last returns the most recent message and false if nothing was sent
+func (c *Capture) Last() (Message, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.messages) == 0 {
+		return Message{}, false
+	}
+	return c.messages[len(c.messages)-1], true
+}
@@ -0,0 +1,100 @@
+package mailer
+
+import (
+	"context"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBuildMessage(t *testing.T) {
+	msg := Message{
+		To:      "taro@example.com",
+		Subject: "メールアドレスの確認",
+		Text:    "以下のリンクを開いてください",
+		HTML:    "<p>以下のリンクを開いてください</p>",
+	}
+
+	raw, err := buildMessage("noreply@example.com", msg, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parsed, err := mail.ReadMessage(strings.NewReader(string(raw)))
+	if err != nil {
+		t.Fatalf("message could not be parsed: %s", err)
+	}
+
+	subject, _ := new(mime.WordDecoder).DecodeHeader(parsed.Header.Get("Subject"))
+	if subject != msg.Subject {
+		t.Errorf("expected subject %q but got %q", msg.Subject, subject)
+	}
+
+	mediaType, params, _ := mime.ParseMediaType(parsed.Header.Get("Content-Type"))
+	if mediaType != "multipart/alternative" {
+		t.Fatalf("expected multipart/alternative but got %s", mediaType)
+	}
+
+	reader := multipart.NewReader(parsed.Body, params["boundary"])
+	for _, expected := range []string{msg.Text, msg.HTML} {
+		part, err := reader.NextRawPart()
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(quotedprintable.NewReader(part))
+		if string(body) != expected {
+			t.Errorf("expected part %q but got %q", expected, body)
+		}
+	}
+}
+
+func TestBuildMessageTextOnly(t *testing.T) {
+	raw, _ := buildMessage("noreply@example.com", Message{To: "taro@example.com", Subject: "hello", Text: "plain"}, time.Now())
+
+	parsed, err := mail.ReadMessage(strings.NewReader(string(raw)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(parsed.Header.Get("Content-Type"), "text/plain") {
+		t.Errorf("expected a text/plain message but got %s", parsed.Header.Get("Content-Type"))
+	}
+}
+
+func TestBuildMessageListUnsubscribe(t *testing.T) {
+	msg := Message{To: "taro@example.com", Subject: "digest", Text: "plain", ListUnsubscribe: "https://api.example.com/digest/unsubscribe?token=1.abc"}
+	raw, _ := buildMessage("noreply@example.com", msg, time.Now())
+
+	parsed, err := mail.ReadMessage(strings.NewReader(string(raw)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if parsed.Header.Get("List-Unsubscribe") != "<"+msg.ListUnsubscribe+">" {
+		t.Errorf("unexpected List-Unsubscribe %q", parsed.Header.Get("List-Unsubscribe"))
+	}
+
+	if parsed.Header.Get("List-Unsubscribe-Post") != "List-Unsubscribe=One-Click" {
+		t.Errorf("unexpected List-Unsubscribe-Post %q", parsed.Header.Get("List-Unsubscribe-Post"))
+	}
+}
+
+func TestCapture(t *testing.T) {
+	var c Capture
+	if _, ok := c.Last(); ok {
+		t.Error("expected no message yet")
+	}
+
+	_ = c.Send(context.Background(), Message{To: "a@example.com"})
+	_ = c.Send(context.Background(), Message{To: "b@example.com"})
+
+	last, ok := c.Last()
+	if !ok || last.To != "b@example.com" || len(c.Messages()) != 2 {
+		t.Error("expected both messages to be captured")
+	}
+}
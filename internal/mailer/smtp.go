@@ -0,0 +1,109 @@
+package mailer
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/smtp"
+	"time"
+)
+
+// SMTP sends messages through a mail server. Username may be left empty for
+// servers that accept mail without authentication.
+type SMTP struct {
+	Addr     string
+	From     string
+	Username string
+	Password string
+}
+
+func (s *SMTP) Send(ctx context.Context, msg Message) error {
+	body, err := buildMessage(s.From, msg, time.Now())
+	if err != nil {
+		return err
+	}
+
+	var auth smtp.Auth
+	if s.Username != "" {
+		host, _, err := net.SplitHostPort(s.Addr)
+		if err != nil {
+			return err
+		}
+		auth = smtp.PlainAuth("", s.Username, s.Password, host)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- smtp.SendMail(s.Addr, auth, s.From, []string{msg.To}, body)
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// buildMessage renders msg as a MIME message. Subjects are encoded so that
+// Japanese text survives, and bodies are quoted-printable UTF-8.
+func buildMessage(from string, msg Message, now time.Time) ([]byte, error) {
+	var buf bytes.Buffer
+
+	fmt.Fprintf(&buf, "From: %s\r\n", from)
+	fmt.Fprintf(&buf, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", msg.Subject))
+	fmt.Fprintf(&buf, "Date: %s\r\n", now.Format(time.RFC1123Z))
+	if msg.ListUnsubscribe != "" {
+		fmt.Fprintf(&buf, "List-Unsubscribe: <%s>\r\n", msg.ListUnsubscribe)
+		fmt.Fprintf(&buf, "List-Unsubscribe-Post: List-Unsubscribe=One-Click\r\n")
+	}
+	fmt.Fprintf(&buf, "MIME-Version: 1.0\r\n")
+
+	if msg.HTML == "" {
+		fmt.Fprintf(&buf, "Content-Type: text/plain; charset=utf-8\r\n")
+		fmt.Fprintf(&buf, "Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+		err := writeQuotedPrintable(&buf, msg.Text)
+		return buf.Bytes(), err
+	}
+
+	random := make([]byte, 12)
+	_, err := rand.Read(random)
+	if err != nil {
+		return nil, err
+	}
+	boundary := hex.EncodeToString(random)
+
+	fmt.Fprintf(&buf, "Content-Type: multipart/alternative; boundary=%s\r\n\r\n", boundary)
+	for _, part := range []struct{ contentType, body string }{
+		{"text/plain", msg.Text},
+		{"text/html", msg.HTML},
+	} {
+		fmt.Fprintf(&buf, "--%s\r\n", boundary)
+		fmt.Fprintf(&buf, "Content-Type: %s; charset=utf-8\r\n", part.contentType)
+		fmt.Fprintf(&buf, "Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+		err = writeQuotedPrintable(&buf, part.body)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(&buf, "\r\n")
+	}
+	fmt.Fprintf(&buf, "--%s--\r\n", boundary)
+
+	return buf.Bytes(), nil
+}
+
+func writeQuotedPrintable(buf *bytes.Buffer, text string) error {
+	w := quotedprintable.NewWriter(buf)
+	_, err := w.Write([]byte(text))
+	if err != nil {
+		return err
+	}
+
+	return w.Close()
+}
@@ -0,0 +1,12 @@
+package models
+
+import "time"
+
+// AcademicTerm is when a term of an academic year starts and ends. Both days
+// are inclusive.
+type AcademicTerm struct {
+	Year     int       `json:"year"`
+	Term     string    `json:"term"`
+	StartsOn time.Time `json:"starts_on"`
+	EndsOn   time.Time `json:"ends_on"`
+}
@@ -0,0 +1,19 @@
+package models
+
+import "time"
+
+// Attachment is a file such as a past exam paper or a sample report shared on
+// a lesson. The file itself lives in a storage.BlobStore under StorageKey.
+type Attachment struct {
+	ID           int       `json:"id"`
+	LessonId     int       `json:"lesson_id"`
+	UserId       int       `json:"user_id"`
+	Year         int       `json:"year"`
+	Term         string    `json:"Term"`
+	TestOrReport string    `json:"test_or_report"`
+	FileName     string    `json:"file_name"`
+	ContentType  string    `json:"content_type"`
+	Size         int64     `json:"size"`
+	StorageKey   string    `json:"-"`
+	CreatedAt    time.Time `json:"created_at"`
+}
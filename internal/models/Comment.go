@@ -2,15 +2,28 @@ package models
 
 import "time"
 
+// moderation states of a comment; only visible comments count toward lesson aggregates.
+// pending comments were held by the content filter and wait for a moderator.
+const (
+	CommentVisible = "visible"
+	CommentPending = "pending"
+	CommentHidden  = "hidden"
+)
+
 type Comment struct {
-	ID           int       `json:"id"`
-	LessonId     int       `json:"lesson_id"`
-	UserId       int       `json:"user_id"`
-	Year         int       `json:"year"`
-	Term         string    `json:"Term"`
-	Comment      string    `json:"comment"`
-	TestOrReport string    `json:"test_or_report"`
-	Star         int       `json:"star"`
-	CreatedAt    time.Time `json:"-"`
-	UpdatedAt    time.Time `json:"-"`
+	ID               int       `json:"id"`
+	LessonId         int       `json:"lesson_id"`
+	UserId           int       `json:"user_id"`
+	Year             int       `json:"year"`
+	Term             string    `json:"Term"`
+	Comment          string    `json:"comment"`
+	TestOrReport     string    `json:"test_or_report"`
+	Star             int       `json:"star"`
+	HelpfulCount     int       `json:"helpful_count"`
+	UnhelpfulCount   int       `json:"unhelpful_count"`
+	ReplyCount       int       `json:"reply_count"`
+	ModerationStatus string    `json:"moderation_status"`
+	Edited           bool      `json:"edited"`
+	CreatedAt        time.Time `json:"-"`
+	UpdatedAt        time.Time `json:"updated_at"`
 }
@@ -0,0 +1,16 @@
+package models
+
+import "time"
+
+// CommentRevision is a previous version of a comment, saved when the comment was edited
+type CommentRevision struct {
+	ID           int       `json:"id"`
+	CommentId    int       `json:"comment_id"`
+	EditorId     int       `json:"editor_id"`
+	Year         int       `json:"year"`
+	Term         string    `json:"Term"`
+	Comment      string    `json:"comment"`
+	TestOrReport string    `json:"test_or_report"`
+	Star         int       `json:"star"`
+	CreatedAt    time.Time `json:"created_at"`
+}
@@ -0,0 +1,40 @@
+package models
+
+import "time"
+
+// languages a digest can be written in
+const (
+	DigestJapanese = "ja"
+	DigestEnglish  = "en"
+)
+
+// DigestPreferences is whether and in which language a user gets the email
+// digest of new reviews on their favorite lessons
+type DigestPreferences struct {
+	UserId       int        `json:"-"`
+	Enabled      bool       `json:"enabled"`
+	Language     string     `json:"language"`
+	LastDigestAt *time.Time `json:"last_digest_at"`
+}
+
+// DigestRecipient is a user who is due a digest
+type DigestRecipient struct {
+	UserId       int
+	Email        string
+	FirstName    string
+	Language     string
+	LastDigestAt *time.Time
+}
+
+// DigestReview is a new review on one of a user's favorite lessons. The
+// author is left out, since a digest is read outside the app.
+type DigestReview struct {
+	LessonId    int
+	LessonName  string
+	TeacherName string
+	Star        int
+	Comment     string
+	Year        int
+	Term        string
+	CreatedAt   time.Time
+}
@@ -0,0 +1,12 @@
+package models
+
+import "time"
+
+// EmailChange is a new address waiting for its owner to follow the
+// confirmation link sent to it
+type EmailChange struct {
+	UserId    int
+	NewEmail  string
+	TokenHash string
+	ExpiresAt time.Time
+}
@@ -0,0 +1,10 @@
+package models
+
+import "time"
+
+// Favorite is a lesson a user bookmarked
+type Favorite struct {
+	UserId    int       `json:"user_id"`
+	LessonId  int       `json:"lesson_id"`
+	CreatedAt time.Time `json:"created_at"`
+}
@@ -0,0 +1,7 @@
+package models
+
+// Follows lists the lessons and teachers a user follows
+type Follows struct {
+	Lessons  []*Lesson `json:"lessons"`
+	Teachers []string  `json:"teachers"`
+}
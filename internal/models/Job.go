@@ -0,0 +1,41 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// states of a background job; running jobs whose lease ran out are picked up
+// again, and failed jobs ran out of attempts
+const (
+	JobPending   = "pending"
+	JobRunning   = "running"
+	JobSucceeded = "succeeded"
+	JobFailed    = "failed"
+)
+
+// Job is a unit of background work. RunAt is when a pending job is due, or
+// when the lease of a running job runs out. UniqueKey is optional and stops
+// the same job from being queued twice.
+type Job struct {
+	ID          int             `json:"id"`
+	Kind        string          `json:"kind"`
+	Payload     json.RawMessage `json:"payload"`
+	Status      string          `json:"status"`
+	Attempts    int             `json:"attempts"`
+	MaxAttempts int             `json:"max_attempts"`
+	RunAt       time.Time       `json:"run_at"`
+	UniqueKey   string          `json:"unique_key,omitempty"`
+	LastError   string          `json:"last_error"`
+	FinishedAt  *time.Time      `json:"finished_at"`
+	CreatedAt   time.Time       `json:"created_at"`
+	UpdatedAt   time.Time       `json:"updated_at"`
+}
+
+// JobFilter narrows the jobs listed for admins
+type JobFilter struct {
+	Status string
+	Kind   string
+	Limit  int
+	Offset int
+}
@@ -7,9 +7,11 @@ type Lesson struct {
 	UserId				 int       `json:"user_id"`
 	LessonName     string    `json:"lesson_name"`
 	TeacherName    string    `json:"teacher_name"`
+	Department     string    `json:"department"`
 	AvgStar        float32   `json:"avg_star"`
 	AboutAvgStar   int       `json:"about_avg_star"`
 	CommentNumbers int       `json:"comment_numbers"`
+	FavoriteCount  int       `json:"favorite_count"`
 	CreatedAt      time.Time `json:"-"`
 	UpdatedAt      time.Time `json:"-"`
 }
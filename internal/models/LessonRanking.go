@@ -0,0 +1,35 @@
+package models
+
+import "time"
+
+// LessonRanking holds the ranking scores of a lesson, overall when Year is 0
+// or among the reviews of one year and term otherwise. BayesStar is the
+// average star pulled toward the mean of all lessons, so lessons with few
+// reviews cannot top the ranking.
+type LessonRanking struct {
+	Rank           int       `json:"rank"`
+	LessonId       int       `json:"lesson_id"`
+	Year           int       `json:"year,omitempty"`
+	Term           string    `json:"term,omitempty"`
+	BayesStar      float64   `json:"bayes_star"`
+	TrendingScore  float64   `json:"trending_score"`
+	CommentNumbers int       `json:"comment_numbers"`
+	Lesson         *Lesson   `json:"lesson,omitempty"`
+	ComputedAt     time.Time `json:"computed_at"`
+}
+
+// RankingFilter selects a leaderboard. Sort is RankingTop or RankingTrending;
+// Year and Term select a term's leaderboard.
+type RankingFilter struct {
+	Sort       string
+	Department string
+	Year       int
+	Term       string
+	Limit      int
+	Offset     int
+}
+
+const (
+	RankingTop      = "top"
+	RankingTrending = "trending"
+)
@@ -0,0 +1,27 @@
+package models
+
+import "time"
+
+type LessonStats struct {
+	LessonId       int            `json:"lesson_id"`
+	CommentNumbers int            `json:"comment_numbers"`
+	AvgStar        float32        `json:"avg_star"`
+	MedianStar     float32        `json:"median_star"`
+	StarHistogram  map[int]int    `json:"star_histogram"`
+	TestOrReport   map[string]int `json:"test_or_report"`
+	ByTerm         []*TermStats   `json:"by_term"`
+	Trend          []*TrendPoint  `json:"trend"`
+}
+
+type TermStats struct {
+	Year           int     `json:"year"`
+	Term           string  `json:"term"`
+	CommentNumbers int     `json:"comment_numbers"`
+	AvgStar        float32 `json:"avg_star"`
+}
+
+type TrendPoint struct {
+	Month          time.Time `json:"month"`
+	CommentNumbers int       `json:"comment_numbers"`
+	AvgStar        float32   `json:"avg_star"`
+}
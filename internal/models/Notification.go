@@ -0,0 +1,36 @@
+package models
+
+import "time"
+
+// kinds of notifications
+const (
+	NotificationNewReview = "new_review"
+	NotificationNewClass  = "new_class"
+	NotificationWarning   = "review_warning"
+)
+
+// Notification tells a user about a new review of a lesson they follow, a
+// new class of a teacher they follow, or a moderator's warning about one of
+// their own reviews
+type Notification struct {
+	ID         int        `json:"id"`
+	UserId     int        `json:"-"`
+	Kind       string     `json:"kind"`
+	LessonId   int        `json:"lesson_id"`
+	CommentId  int        `json:"comment_id,omitempty"`
+	OfferingId int        `json:"offering_id,omitempty"`
+	Lesson     *Lesson    `json:"lesson,omitempty"`
+	ReadAt     *time.Time `json:"read_at"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+// FollowEvent is something that happened to a lesson which the followers of
+// the lesson or of its teacher are notified of. ActorId is the user who caused
+// it, who is never notified of their own action.
+type FollowEvent struct {
+	Kind       string `json:"kind"`
+	LessonId   int    `json:"lesson_id"`
+	CommentId  int    `json:"comment_id,omitempty"`
+	OfferingId int    `json:"offering_id,omitempty"`
+	ActorId    int    `json:"actor_id"`
+}
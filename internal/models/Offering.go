@@ -0,0 +1,28 @@
+package models
+
+import "time"
+
+// Offering is a lesson as it is taught in one year and term
+type Offering struct {
+	ID        int       `json:"id"`
+	LessonId  int       `json:"lesson_id"`
+	Year      int       `json:"year"`
+	Term      string    `json:"term"`
+	Credits   int       `json:"credits"`
+	Slots     []Slot    `json:"slots"`
+	CreatedAt time.Time `json:"-"`
+	UpdatedAt time.Time `json:"-"`
+}
+
+// Slot is one weekly class period. Day runs from 1 (Monday) to 7 (Sunday).
+type Slot struct {
+	Day    int `json:"day"`
+	Period int `json:"period"`
+}
+
+// TimetableEntry is an offering a user put in their timetable
+type TimetableEntry struct {
+	Offering *Offering `json:"offering"`
+	Lesson   *Lesson   `json:"lesson"`
+	AddedAt  time.Time `json:"added_at"`
+}
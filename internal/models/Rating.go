@@ -0,0 +1,14 @@
+package models
+
+import "time"
+
+// Rating is the star a user gave a lesson in a visible review
+type Rating struct {
+	UserId       int
+	LessonId     int
+	Star         int
+	TestOrReport string
+	Year         int
+	Term         string
+	CreatedAt    time.Time
+}
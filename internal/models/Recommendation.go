@@ -0,0 +1,23 @@
+package models
+
+import "time"
+
+// reasons a lesson is recommended
+const (
+	ReasonSimilarRatings = "similar_ratings"
+	ReasonSameDepartment = "same_department"
+	ReasonSameTeacher    = "same_teacher"
+	ReasonSameAssessment = "same_assessment"
+)
+
+// Recommendation is a lesson suggested to a user. SourceLessonId is the lesson
+// the user liked that led to the suggestion, when there is a single one.
+type Recommendation struct {
+	UserId         int       `json:"-"`
+	LessonId       int       `json:"lesson_id"`
+	Score          float64   `json:"score"`
+	Reason         string    `json:"reason"`
+	SourceLessonId int       `json:"source_lesson_id,omitempty"`
+	Lesson         *Lesson   `json:"lesson,omitempty"`
+	ComputedAt     time.Time `json:"computed_at"`
+}
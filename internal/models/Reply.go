@@ -0,0 +1,18 @@
+package models
+
+import "time"
+
+// MaxReplyDepth is the deepest a reply can be nested; replies to the review
+// itself have depth 0
+const MaxReplyDepth = 3
+
+type Reply struct {
+	ID        int       `json:"id"`
+	CommentId int       `json:"comment_id"`
+	ParentId  int       `json:"parent_id,omitempty"`
+	UserId    int       `json:"user_id"`
+	Depth     int       `json:"depth"`
+	Body      string    `json:"body"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
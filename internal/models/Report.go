@@ -0,0 +1,50 @@
+package models
+
+import "time"
+
+// reason codes a user can choose when reporting a comment
+const (
+	ReportSpam         = "spam"
+	ReportAbuse        = "abuse"
+	ReportDefamation   = "defamation"
+	ReportPersonalInfo = "personal_info"
+	ReportOther        = "other"
+)
+
+// report states
+const (
+	ReportPending   = "pending"
+	ReportDismissed = "dismissed"
+	ReportResolved  = "resolved"
+)
+
+// moderator actions on a report
+const (
+	ModerationDismiss = "dismiss"
+	ModerationHide    = "hide"
+	ModerationDelete  = "delete"
+	ModerationWarn    = "warn"
+)
+
+type Report struct {
+	ID        int       `json:"id"`
+	CommentId int       `json:"comment_id"`
+	UserId    int       `json:"user_id"`
+	Reason    string    `json:"reason"`
+	Detail    string    `json:"detail"`
+	Status    string    `json:"status"`
+	Comment   *Comment  `json:"comment,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"-"`
+}
+
+type ModerationAction struct {
+	ID          int       `json:"id"`
+	ReportId    int       `json:"report_id"`
+	CommentId   int       `json:"comment_id"`
+	ModeratorId int       `json:"moderator_id"`
+	UserId      int       `json:"user_id"`
+	Action      string    `json:"action"`
+	Note        string    `json:"note"`
+	CreatedAt   time.Time `json:"created_at"`
+}
@@ -8,15 +8,17 @@ import (
 )
 
 type User struct {
-	ID        int       `json:"id"`
-	Password  string    `json:"Password"`
-	Email     string    `json:"email"`
-	LastName  string    `json:"last_name"`
-	FirstName string    `json:"first_name"`
-	Image     string    `json:"image"`
-	IsAdmin   int       `json:"is_admin"`
-	CreatedAt time.Time `json:"-"`
-	UpdatedAt time.Time `json:"-"`
+	ID             int       `json:"id"`
+	Password       string    `json:"-"`
+	Email          string    `json:"email"`
+	LastName       string    `json:"last_name"`
+	FirstName      string    `json:"first_name"`
+	Image          string    `json:"image"`
+	IsAdmin        int       `json:"is_admin"`
+	ShowRealName   bool      `json:"show_real_name"`
+	SessionVersion int       `json:"-"`
+	CreatedAt      time.Time `json:"-"`
+	UpdatedAt      time.Time `json:"-"`
 }
 
 func (u *User) PasswordMatches(plainText string) (bool, error) {
@@ -0,0 +1,11 @@
+package models
+
+import "time"
+
+// Vote is one user's helpful or unhelpful vote on a comment
+type Vote struct {
+	CommentId int       `json:"comment_id"`
+	Helpful   bool      `json:"helpful"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
@@ -0,0 +1,54 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// events webhooks can subscribe to
+const (
+	WebhookReviewCreated = "review.created"
+	WebhookReviewUpdated = "review.updated"
+	WebhookReviewDeleted = "review.deleted"
+	WebhookLessonOffered = "lesson.offered"
+)
+
+// WebhookEventTypes lists every event webhooks can subscribe to
+var WebhookEventTypes = []string{WebhookReviewCreated, WebhookReviewUpdated, WebhookReviewDeleted, WebhookLessonOffered}
+
+// Webhook is an integration that is sent the events it subscribed to. Secret
+// signs its payloads and is only shown when the webhook is created.
+type Webhook struct {
+	ID         int       `json:"id"`
+	URL        string    `json:"url"`
+	Secret     string    `json:"secret,omitempty"`
+	EventTypes []string  `json:"event_types"`
+	Active     bool      `json:"active"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// states of a webhook delivery; dead deliveries ran out of attempts
+const (
+	DeliveryPending   = "pending"
+	DeliverySucceeded = "succeeded"
+	DeliveryDead      = "dead"
+)
+
+// WebhookDelivery is one event queued for one webhook, with the outcome of
+// its latest attempt
+type WebhookDelivery struct {
+	ID             int             `json:"id"`
+	WebhookId      int             `json:"webhook_id"`
+	EventType      string          `json:"event_type"`
+	Payload        json.RawMessage `json:"payload"`
+	Status         string          `json:"status"`
+	Attempts       int             `json:"attempts"`
+	NextAttemptAt  time.Time       `json:"next_attempt_at"`
+	LastStatusCode int             `json:"last_status_code"`
+	LastError      string          `json:"last_error"`
+	DeliveredAt    *time.Time      `json:"delivered_at"`
+	Webhook        *Webhook        `json:"-"`
+	CreatedAt      time.Time       `json:"created_at"`
+	UpdatedAt      time.Time       `json:"updated_at"`
+}
@@ -0,0 +1,140 @@
+// Package pubsub delivers lesson events to the clients watching a lesson.
+//
+// A Hub only reaches the subscribers of its own process. When several API
+// instances run, events are published through a shared channel instead and
+// every instance relays what it receives to its own hub.
+package pubsub
+
+import (
+	"encoding/json"
+	"sync"
+)
+
+// Event is a change to a lesson. Data is the JSON payload sent to clients.
+type Event struct {
+	LessonID int             `json:"lesson_id"`
+	Type     string          `json:"type"`
+	Data     json.RawMessage `json:"data,omitempty"`
+}
+
+// Publisher sends an event to everyone subscribed to its lesson
+type Publisher interface {
+	Publish(event Event) error
+}
+
+// Hub fans events out to the subscribers of each lesson in this process
+type Hub struct {
+	mu          sync.Mutex
+	buffer      int
+	subscribers map[int]map[*Subscription]struct{}
+	closed      bool
+}
+
+// NewHub returns a hub whose subscribers may fall behind by buffer events
+// before they are dropped
+func NewHub(buffer int) *Hub {
+	return &Hub{
+		buffer:      buffer,
+		subscribers: make(map[int]map[*Subscription]struct{}),
+	}
+}
+
+// Subscription receives the events of one lesson until it is closed
+type Subscription struct {
+	hub      *Hub
+	lessonID int
+	events   chan Event
+}
+
+// Subscribe starts receiving the events of a lesson. Subscriptions to a
+// closed hub are closed from the start.
+func (h *Hub) Subscribe(lessonID int) *Subscription {
+	sub := &Subscription{
+		hub:      h,
+		lessonID: lessonID,
+		events:   make(chan Event, h.buffer),
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.closed {
+		close(sub.events)
+		return sub
+	}
+
+	if h.subscribers[lessonID] == nil {
+		h.subscribers[lessonID] = make(map[*Subscription]struct{})
+	}
+	h.subscribers[lessonID][sub] = struct{}{}
+
+	return sub
+}
+
+// Publish hands an event to every subscriber of its lesson without waiting.
+// A subscriber whose buffer is full is dropped and its channel closed, so it
+// can reconnect and reload rather than silently miss events.
+func (h *Hub) Publish(event Event) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for sub := range h.subscribers[event.LessonID] {
+		select {
+		case sub.events <- event:
+		default:
+			h.remove(sub)
+		}
+	}
+
+	return nil
+}
+
+// Subscribers returns how many subscribers a lesson has
+func (h *Hub) Subscribers(lessonID int) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return len(h.subscribers[lessonID])
+}
+
+// Close closes every subscription, so that their streams end, and every
+// subscription made later. It is called when the server shuts down.
+func (h *Hub) Close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.closed = true
+	for _, subs := range h.subscribers {
+		for sub := range subs {
+			h.remove(sub)
+		}
+	}
+}
+
+// remove unsubscribes and closes a subscription; h.mu must be held
+func (h *Hub) remove(sub *Subscription) {
+	subs := h.subscribers[sub.lessonID]
+	if _, ok := subs[sub]; !ok {
+		return
+	}
+
+	delete(subs, sub)
+	if len(subs) == 0 {
+		delete(h.subscribers, sub.lessonID)
+	}
+	close(sub.events)
+}
+
+// Events returns the channel events are received on. It is closed when the
+// subscription is closed or dropped for falling behind.
+func (s *Subscription) Events() <-chan Event {
+	return s.events
+}
+
+// Close stops the subscription. Closing it twice is a no-op.
+func (s *Subscription) Close() {
+	s.hub.mu.Lock()
+	defer s.hub.mu.Unlock()
+
+	s.hub.remove(s)
+}
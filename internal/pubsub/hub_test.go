@@ -0,0 +1,104 @@
+package pubsub
+
+import (
+	"testing"
+)
+
+func TestHubPublish(t *testing.T) {
+	hub := NewHub(2)
+
+	first := hub.Subscribe(1)
+	second := hub.Subscribe(1)
+	other := hub.Subscribe(2)
+
+	if hub.Subscribers(1) != 2 {
+		t.Fatalf("expected 2 subscribers but got %d", hub.Subscribers(1))
+	}
+
+	_ = hub.Publish(Event{LessonID: 1, Type: "comment_created"})
+
+	for _, sub := range []*Subscription{first, second} {
+		select {
+		case event := <-sub.Events():
+			if event.Type != "comment_created" {
+				t.Errorf("unexpected event %+v", event)
+			}
+		default:
+			t.Error("expected an event")
+		}
+	}
+
+	select {
+	case event := <-other.Events():
+		t.Errorf("subscriber of another lesson got %+v", event)
+	default:
+	}
+}
+
+func TestHubDropsSlowSubscribers(t *testing.T) {
+	hub := NewHub(1)
+	sub := hub.Subscribe(1)
+
+	_ = hub.Publish(Event{LessonID: 1, Type: "first"})
+	_ = hub.Publish(Event{LessonID: 1, Type: "second"})
+
+	if hub.Subscribers(1) != 0 {
+		t.Errorf("expected the slow subscriber to be dropped")
+	}
+
+	event, ok := <-sub.Events()
+	if !ok || event.Type != "first" {
+		t.Errorf("expected the buffered event before the channel closed, but got %+v", event)
+	}
+
+	if _, ok := <-sub.Events(); ok {
+		t.Error("expected the channel to be closed")
+	}
+
+	// closing a dropped subscription must not panic
+	sub.Close()
+}
+
+func TestSubscriptionClose(t *testing.T) {
+	hub := NewHub(1)
+	sub := hub.Subscribe(1)
+
+	sub.Close()
+	sub.Close()
+
+	if hub.Subscribers(1) != 0 {
+		t.Errorf("expected no subscribers after closing, but got %d", hub.Subscribers(1))
+	}
+
+	if _, ok := <-sub.Events(); ok {
+		t.Error("expected the channel to be closed")
+	}
+
+	// publishing to a lesson nobody watches is a no-op
+	_ = hub.Publish(Event{LessonID: 1, Type: "ignored"})
+}
+
+func TestHubClose(t *testing.T) {
+	hub := NewHub(1)
+	first := hub.Subscribe(1)
+	second := hub.Subscribe(2)
+
+	hub.Close()
+
+	for _, sub := range []*Subscription{first, second} {
+		if _, ok := <-sub.Events(); ok {
+			t.Error("expected every channel to be closed")
+		}
+		sub.Close()
+	}
+
+	late := hub.Subscribe(1)
+	if _, ok := <-late.Events(); ok {
+		t.Error("expected a subscription to a closed hub to be closed")
+	}
+	late.Close()
+
+	if hub.Subscribers(1) != 0 {
+		t.Errorf("expected no subscribers after closing, but got %d", hub.Subscribers(1))
+	}
+}
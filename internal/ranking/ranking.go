@@ -0,0 +1,145 @@
+// Package ranking scores lessons for leaderboards.
+//
+// The top ranking uses a Bayesian average: a lesson's stars are averaged
+// together with PriorWeight imaginary reviews at the mean star of all lessons,
+// so one 5-star review cannot outrank two hundred 4-star ones. The trending
+// ranking adds up recent reviews and favorites, each counting less the older
+// it is, halving every HalfLife.
+package ranking
+
+import (
+	"kstation_backend/internal/models"
+	"math"
+	"sort"
+	"time"
+)
+
+type Options struct {
+	// PriorWeight is how many reviews at the overall mean are blended into
+	// every lesson's average
+	PriorWeight float64
+	// HalfLife is how long it takes for a review or favorite to count half as
+	// much toward the trending score
+	HalfLife time.Duration
+	// FavoriteWeight is how much a favorite counts toward the trending score
+	// compared to a review
+	FavoriteWeight float64
+}
+
+var DefaultOptions = Options{PriorWeight: 5, HalfLife: time.Hour * 24 * 7, FavoriteWeight: 0.5}
+
+// BayesianAverage blends the stars of n reviews adding up to sum with weight
+// reviews at the prior mean
+func BayesianAverage(sum float64, n int, prior float64, weight float64) float64 {
+	if float64(n)+weight == 0 {
+		return 0
+	}
+
+	return (weight*prior + sum) / (weight + float64(n))
+}
+
+// Decay returns how much an event at the given time still counts at now
+func Decay(at time.Time, now time.Time, halfLife time.Duration) float64 {
+	age := now.Sub(at)
+	if age < 0 {
+		age = 0
+	}
+
+	return math.Exp2(-float64(age) / float64(halfLife))
+}
+
+type termKey struct {
+	lessonID int
+	year     int
+	term     string
+}
+
+type tally struct {
+	sum float64
+	n   int
+}
+
+// Compute returns the overall ranking scores of every lesson, followed by the
+// scores of every lesson in each year and term it was reviewed
+func Compute(lessons []*models.Lesson, ratings []*models.Rating, favorites []*models.Favorite, opts Options, now time.Time) []*models.LessonRanking {
+	overall := make(map[int]*tally, len(lessons))
+	terms := make(map[termKey]*tally)
+	trending := make(map[int]float64, len(lessons))
+	total := tally{}
+
+	for _, rating := range ratings {
+		star := float64(rating.Star)
+		total.sum += star
+		total.n++
+
+		if overall[rating.LessonId] == nil {
+			overall[rating.LessonId] = &tally{}
+		}
+		overall[rating.LessonId].sum += star
+		overall[rating.LessonId].n++
+
+		key := termKey{rating.LessonId, rating.Year, rating.Term}
+		if terms[key] == nil {
+			terms[key] = &tally{}
+		}
+		terms[key].sum += star
+		terms[key].n++
+
+		trending[rating.LessonId] += Decay(rating.CreatedAt, now, opts.HalfLife)
+	}
+
+	for _, favorite := range favorites {
+		trending[favorite.LessonId] += opts.FavoriteWeight * Decay(favorite.CreatedAt, now, opts.HalfLife)
+	}
+
+	prior := 0.0
+	if total.n > 0 {
+		prior = total.sum / float64(total.n)
+	}
+
+	known := make(map[int]bool, len(lessons))
+	var rankings []*models.LessonRanking
+	for _, lesson := range lessons {
+		known[lesson.ID] = true
+
+		t := overall[lesson.ID]
+		if t == nil {
+			t = &tally{}
+		}
+		rankings = append(rankings, &models.LessonRanking{
+			LessonId:       lesson.ID,
+			BayesStar:      BayesianAverage(t.sum, t.n, prior, opts.PriorWeight),
+			TrendingScore:  trending[lesson.ID],
+			CommentNumbers: t.n,
+			ComputedAt:     now,
+		})
+	}
+
+	var termRankings []*models.LessonRanking
+	for key, t := range terms {
+		if !known[key.lessonID] {
+			continue
+		}
+		termRankings = append(termRankings, &models.LessonRanking{
+			LessonId:       key.lessonID,
+			Year:           key.year,
+			Term:           key.term,
+			BayesStar:      BayesianAverage(t.sum, t.n, prior, opts.PriorWeight),
+			CommentNumbers: t.n,
+			ComputedAt:     now,
+		})
+	}
+
+	sort.Slice(termRankings, func(i, j int) bool {
+		a, b := termRankings[i], termRankings[j]
+		if a.Year != b.Year {
+			return a.Year < b.Year
+		}
+		if a.Term != b.Term {
+			return a.Term < b.Term
+		}
+		return a.LessonId < b.LessonId
+	})
+
+	return append(rankings, termRankings...)
+}
@@ -0,0 +1,95 @@
+package ranking
+
+import (
+	"kstation_backend/internal/models"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestBayesianAverage(t *testing.T) {
+	var tests = []struct {
+		name     string
+		sum      float64
+		n        int
+		expected float64
+	}{
+		{"no reviews", 0, 0, 3},
+		{"one five star review", 5, 1, 3 + 2.0/6},
+		{"many four star reviews", 800, 200, (15 + 800) / 205.0},
+	}
+
+	for _, e := range tests {
+		got := BayesianAverage(e.sum, e.n, 3, 5)
+		if math.Abs(got-e.expected) > 1e-9 {
+			t.Errorf("%s: expected %v but got %v", e.name, e.expected, got)
+		}
+	}
+
+	if BayesianAverage(5, 1, 3, 5) > BayesianAverage(800, 200, 3, 5) {
+		t.Error("a single five star review outranks two hundred four star reviews")
+	}
+
+	if BayesianAverage(0, 0, 3, 0) != 0 {
+		t.Error("expected 0 without reviews or prior")
+	}
+}
+
+func TestDecay(t *testing.T) {
+	now := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	week := time.Hour * 24 * 7
+
+	if Decay(now, now, week) != 1 {
+		t.Error("an event happening now should count fully")
+	}
+
+	if math.Abs(Decay(now.Add(-week), now, week)-0.5) > 1e-9 {
+		t.Error("an event one half life ago should count half")
+	}
+
+	if Decay(now.Add(time.Hour), now, week) != 1 {
+		t.Error("an event in the future should not count more than fully")
+	}
+}
+
+func TestCompute(t *testing.T) {
+	now := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	lessons := []*models.Lesson{{ID: 1}, {ID: 2}, {ID: 3}}
+
+	ratings := []*models.Rating{
+		{LessonId: 1, Star: 5, Year: 2024, Term: "former", CreatedAt: now},
+		{LessonId: 2, Star: 4, Year: 2023, Term: "former", CreatedAt: now.Add(-time.Hour * 24 * 70)},
+		{LessonId: 2, Star: 4, Year: 2023, Term: "former", CreatedAt: now.Add(-time.Hour * 24 * 70)},
+		{LessonId: 2, Star: 4, Year: 2023, Term: "latter", CreatedAt: now.Add(-time.Hour * 24 * 70)},
+		{LessonId: 9, Star: 1, Year: 2023, Term: "former", CreatedAt: now},
+	}
+	favorites := []*models.Favorite{{LessonId: 3, CreatedAt: now}}
+
+	rankings := Compute(lessons, ratings, favorites, DefaultOptions, now)
+	if len(rankings) != 6 {
+		t.Fatalf("expected 3 overall and 3 term rankings but got %d", len(rankings))
+	}
+
+	first, second, third := rankings[0], rankings[1], rankings[2]
+	if first.LessonId != 1 || first.Year != 0 || first.CommentNumbers != 1 {
+		t.Errorf("unexpected first ranking %+v", first)
+	}
+
+	if second.CommentNumbers != 3 || third.CommentNumbers != 0 {
+		t.Errorf("unexpected review counts %d and %d", second.CommentNumbers, third.CommentNumbers)
+	}
+
+	if first.TrendingScore <= second.TrendingScore || third.TrendingScore != DefaultOptions.FavoriteWeight {
+		t.Errorf("unexpected trending scores %v %v %v", first.TrendingScore, second.TrendingScore, third.TrendingScore)
+	}
+
+	// the mean of all stars is 3.6, so lesson 3 without reviews sits at the mean
+	if math.Abs(third.BayesStar-3.6) > 1e-9 {
+		t.Errorf("expected a lesson without reviews at the mean but got %v", third.BayesStar)
+	}
+
+	former := rankings[3]
+	if former.LessonId != 2 || former.Year != 2023 || former.Term != "former" || former.CommentNumbers != 2 {
+		t.Errorf("unexpected term ranking %+v", former)
+	}
+}
@@ -0,0 +1,326 @@
+// Package recommend suggests lessons to users from the reviews and favorites
+// of everyone.
+//
+// Two signals are blended. Collaborative filtering predicts the star a user
+// would give a lesson from the lessons they rated, using the adjusted cosine
+// similarity between lessons that the same people rated. Content similarity
+// matches lessons the user liked (rated 4 or more, or favorited) with lessons
+// from the same department or teacher and with the same kind of assessment.
+package recommend
+
+import (
+	"kstation_backend/internal/models"
+	"math"
+	"sort"
+	"time"
+)
+
+// weights of the content similarity between two lessons
+const (
+	departmentWeight = 0.5
+	teacherWeight    = 0.35
+	assessmentWeight = 0.15
+)
+
+// likedStar is the lowest star that counts as liking a lesson
+const likedStar = 4
+
+type Options struct {
+	// PerUser is how many lessons are kept for each user
+	PerUser int
+	// MinCoRaters is how many users must have rated two lessons before their
+	// ratings are compared
+	MinCoRaters int
+	// RatingWeight is the share of the score that comes from collaborative
+	// filtering; the rest comes from content similarity
+	RatingWeight float64
+}
+
+var DefaultOptions = Options{PerUser: 20, MinCoRaters: 2, RatingWeight: 0.7}
+
+type neighbor struct {
+	lessonID   int
+	similarity float64
+}
+
+type candidate struct {
+	numerator   float64
+	denominator float64
+	ratingFrom  int
+	ratingBest  float64
+	content     float64
+	contentFrom int
+}
+
+// Compute returns the recommendations of every user who rated or favorited a
+// lesson. Lessons the user already reviewed or favorited are never suggested,
+// and only the given lessons are.
+func Compute(lessons []*models.Lesson, ratings []*models.Rating, favorites []*models.Favorite, opts Options, now time.Time) []*models.Recommendation {
+	lessonByID := make(map[int]*models.Lesson, len(lessons))
+	for _, lesson := range lessons {
+		lessonByID[lesson.ID] = lesson
+	}
+
+	assessments := dominantAssessments(ratings)
+
+	userRatings := make(map[int]map[int]int)
+	for _, rating := range ratings {
+		if userRatings[rating.UserId] == nil {
+			userRatings[rating.UserId] = make(map[int]int)
+		}
+		userRatings[rating.UserId][rating.LessonId] = rating.Star
+	}
+
+	userFavorites := make(map[int]map[int]bool)
+	for _, favorite := range favorites {
+		if userFavorites[favorite.UserId] == nil {
+			userFavorites[favorite.UserId] = make(map[int]bool)
+		}
+		userFavorites[favorite.UserId][favorite.LessonId] = true
+	}
+
+	means := make(map[int]float64, len(userRatings))
+	for userID, stars := range userRatings {
+		sum := 0
+		for _, star := range stars {
+			sum += star
+		}
+		means[userID] = float64(sum) / float64(len(stars))
+	}
+
+	neighbors := lessonNeighbors(userRatings, means, opts.MinCoRaters)
+
+	byDepartment := make(map[string][]int)
+	byTeacher := make(map[string][]int)
+	for _, lesson := range lessons {
+		if lesson.Department != "" {
+			byDepartment[lesson.Department] = append(byDepartment[lesson.Department], lesson.ID)
+		}
+		if lesson.TeacherName != "" {
+			byTeacher[lesson.TeacherName] = append(byTeacher[lesson.TeacherName], lesson.ID)
+		}
+	}
+
+	users := make(map[int]bool)
+	for userID := range userRatings {
+		users[userID] = true
+	}
+	for userID := range userFavorites {
+		users[userID] = true
+	}
+	userIDs := make([]int, 0, len(users))
+	for userID := range users {
+		userIDs = append(userIDs, userID)
+	}
+	sort.Ints(userIDs)
+
+	var recommendations []*models.Recommendation
+	for _, userID := range userIDs {
+		stars := userRatings[userID]
+		favorited := userFavorites[userID]
+		excluded := func(lessonID int) bool {
+			_, rated := stars[lessonID]
+			return rated || favorited[lessonID]
+		}
+
+		candidates := make(map[int]*candidate)
+		get := func(lessonID int) *candidate {
+			c, ok := candidates[lessonID]
+			if !ok {
+				c = &candidate{}
+				candidates[lessonID] = c
+			}
+			return c
+		}
+
+		for lessonID, star := range stars {
+			deviation := float64(star) - means[userID]
+			for _, n := range neighbors[lessonID] {
+				if excluded(n.lessonID) || lessonByID[n.lessonID] == nil {
+					continue
+				}
+				c := get(n.lessonID)
+				c.numerator += n.similarity * deviation
+				c.denominator += n.similarity
+				if n.similarity*deviation > c.ratingBest {
+					c.ratingBest = n.similarity * deviation
+					c.ratingFrom = lessonID
+				}
+			}
+		}
+
+		var liked []int
+		for lessonID, star := range stars {
+			if star >= likedStar {
+				liked = append(liked, lessonID)
+			}
+		}
+		for lessonID := range favorited {
+			if stars[lessonID] < likedStar {
+				liked = append(liked, lessonID)
+			}
+		}
+		sort.Ints(liked)
+
+		for _, likedID := range liked {
+			source := lessonByID[likedID]
+			if source == nil {
+				continue
+			}
+			for _, lessonID := range append(byDepartment[source.Department], byTeacher[source.TeacherName]...) {
+				if lessonID == likedID || excluded(lessonID) {
+					continue
+				}
+				similarity := contentSimilarity(source, lessonByID[lessonID], assessments)
+				c := get(lessonID)
+				if similarity > c.content {
+					c.content = similarity
+					c.contentFrom = likedID
+				}
+			}
+		}
+
+		var userRecommendations []*models.Recommendation
+		for lessonID, c := range candidates {
+			ratingScore := 0.0
+			if c.denominator > 0 {
+				predicted := math.Max(1, math.Min(5, means[userID]+c.numerator/c.denominator))
+				ratingScore = opts.RatingWeight * (predicted - 1) / 4
+			}
+			contentScore := (1 - opts.RatingWeight) * c.content
+
+			recommendation := &models.Recommendation{
+				UserId:     userID,
+				LessonId:   lessonID,
+				Score:      ratingScore + contentScore,
+				ComputedAt: now,
+			}
+			if recommendation.Score <= 0 {
+				continue
+			}
+
+			if ratingScore >= contentScore {
+				recommendation.Reason = models.ReasonSimilarRatings
+				recommendation.SourceLessonId = c.ratingFrom
+			} else {
+				recommendation.Reason = contentReason(lessonByID[c.contentFrom], lessonByID[lessonID])
+				recommendation.SourceLessonId = c.contentFrom
+			}
+
+			userRecommendations = append(userRecommendations, recommendation)
+		}
+
+		sort.Slice(userRecommendations, func(i, j int) bool {
+			a, b := userRecommendations[i], userRecommendations[j]
+			if a.Score != b.Score {
+				return a.Score > b.Score
+			}
+			return a.LessonId < b.LessonId
+		})
+		if opts.PerUser > 0 && len(userRecommendations) > opts.PerUser {
+			userRecommendations = userRecommendations[:opts.PerUser]
+		}
+
+		recommendations = append(recommendations, userRecommendations...)
+	}
+
+	return recommendations
+}
+
+// lessonNeighbors returns, for every lesson, the lessons whose ratings go up
+// and down together with its own, by adjusted cosine similarity
+func lessonNeighbors(userRatings map[int]map[int]int, means map[int]float64, minCoRaters int) map[int][]neighbor {
+	type pair struct{ a, b int }
+	dots := make(map[pair]float64)
+	coRaters := make(map[pair]int)
+	norms := make(map[int]float64)
+
+	for userID, stars := range userRatings {
+		lessonIDs := make([]int, 0, len(stars))
+		for lessonID, star := range stars {
+			lessonIDs = append(lessonIDs, lessonID)
+			deviation := float64(star) - means[userID]
+			norms[lessonID] += deviation * deviation
+		}
+		sort.Ints(lessonIDs)
+
+		for i, a := range lessonIDs {
+			for _, b := range lessonIDs[i+1:] {
+				key := pair{a, b}
+				dots[key] += (float64(stars[a]) - means[userID]) * (float64(stars[b]) - means[userID])
+				coRaters[key]++
+			}
+		}
+	}
+
+	neighbors := make(map[int][]neighbor)
+	for key, dot := range dots {
+		if coRaters[key] < minCoRaters || norms[key.a] == 0 || norms[key.b] == 0 {
+			continue
+		}
+
+		similarity := dot / math.Sqrt(norms[key.a]*norms[key.b])
+		if similarity <= 0 {
+			continue
+		}
+
+		neighbors[key.a] = append(neighbors[key.a], neighbor{key.b, similarity})
+		neighbors[key.b] = append(neighbors[key.b], neighbor{key.a, similarity})
+	}
+
+	return neighbors
+}
+
+// dominantAssessments returns the kind of assessment most reviews of each
+// lesson mention
+func dominantAssessments(ratings []*models.Rating) map[int]string {
+	counts := make(map[int]map[string]int)
+	for _, rating := range ratings {
+		if rating.TestOrReport == "" {
+			continue
+		}
+		if counts[rating.LessonId] == nil {
+			counts[rating.LessonId] = make(map[string]int)
+		}
+		counts[rating.LessonId][rating.TestOrReport]++
+	}
+
+	assessments := make(map[int]string, len(counts))
+	for lessonID, kinds := range counts {
+		best := ""
+		for kind, count := range kinds {
+			if count > kinds[best] || (count == kinds[best] && kind < best) {
+				best = kind
+			}
+		}
+		assessments[lessonID] = best
+	}
+
+	return assessments
+}
+
+func contentSimilarity(a, b *models.Lesson, assessments map[int]string) float64 {
+	similarity := 0.0
+	if a.Department != "" && a.Department == b.Department {
+		similarity += departmentWeight
+	}
+	if a.TeacherName != "" && a.TeacherName == b.TeacherName {
+		similarity += teacherWeight
+	}
+	if assessments[a.ID] != "" && assessments[a.ID] == assessments[b.ID] {
+		similarity += assessmentWeight
+	}
+
+	return similarity
+}
+
+func contentReason(source, lesson *models.Lesson) string {
+	switch {
+	case source.TeacherName != "" && source.TeacherName == lesson.TeacherName:
+		return models.ReasonSameTeacher
+	case source.Department != "" && source.Department == lesson.Department:
+		return models.ReasonSameDepartment
+	default:
+		return models.ReasonSameAssessment
+	}
+}
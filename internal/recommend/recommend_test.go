@@ -0,0 +1,105 @@
+package recommend
+
+import (
+	"kstation_backend/internal/models"
+	"testing"
+	"time"
+)
+
+func testLessons() []*models.Lesson {
+	return []*models.Lesson{
+		{ID: 1, LessonName: "Calculus", TeacherName: "Sato", Department: "math"},
+		{ID: 2, LessonName: "Linear Algebra", TeacherName: "Suzuki", Department: "math"},
+		{ID: 3, LessonName: "Statistics", TeacherName: "Sato", Department: "stats"},
+		{ID: 4, LessonName: "Poetry", TeacherName: "Ito", Department: "literature"},
+		{ID: 5, LessonName: "Novels", TeacherName: "Kato", Department: "literature"},
+	}
+}
+
+func star(userID, lessonID, star int) *models.Rating {
+	return &models.Rating{UserId: userID, LessonId: lessonID, Star: star, TestOrReport: "test"}
+}
+
+func forUser(recommendations []*models.Recommendation, userID int) []*models.Recommendation {
+	var mine []*models.Recommendation
+	for _, recommendation := range recommendations {
+		if recommendation.UserId == userID {
+			mine = append(mine, recommendation)
+		}
+	}
+	return mine
+}
+
+func TestComputeCollaborative(t *testing.T) {
+	// users 1 and 2 love lessons 1 and 4 and dislike 5; user 3 shares their
+	// taste in lesson 1 and has not taken lesson 4
+	ratings := []*models.Rating{
+		star(1, 1, 5), star(1, 4, 5), star(1, 5, 1),
+		star(2, 1, 5), star(2, 4, 4), star(2, 5, 2),
+		star(3, 1, 5), star(3, 5, 1),
+	}
+
+	recommendations := forUser(Compute(testLessons(), ratings, nil, DefaultOptions, time.Now()), 3)
+	if len(recommendations) == 0 {
+		t.Fatal("expected recommendations for user 3")
+	}
+
+	first := recommendations[0]
+	if first.LessonId != 4 || first.Reason != models.ReasonSimilarRatings {
+		t.Errorf("expected lesson 4 for similar ratings first but got %+v", first)
+	}
+
+	for _, recommendation := range recommendations {
+		if recommendation.LessonId == 1 || recommendation.LessonId == 5 {
+			t.Errorf("recommended lesson %d that the user already reviewed", recommendation.LessonId)
+		}
+	}
+}
+
+func TestComputeContent(t *testing.T) {
+	favorites := []*models.Favorite{{UserId: 7, LessonId: 1}}
+
+	recommendations := Compute(testLessons(), nil, favorites, DefaultOptions, time.Now())
+	if len(recommendations) != 2 {
+		t.Fatalf("expected two recommendations but got %d", len(recommendations))
+	}
+
+	var tests = []struct {
+		lessonID       int
+		expectedReason string
+	}{
+		{2, models.ReasonSameDepartment},
+		{3, models.ReasonSameTeacher},
+	}
+
+	for i, e := range tests {
+		if recommendations[i].LessonId != e.lessonID || recommendations[i].Reason != e.expectedReason || recommendations[i].SourceLessonId != 1 {
+			t.Errorf("expected lesson %d because of %s but got %+v", e.lessonID, e.expectedReason, recommendations[i])
+		}
+	}
+}
+
+func TestComputePerUser(t *testing.T) {
+	favorites := []*models.Favorite{{UserId: 7, LessonId: 1}}
+	opts := DefaultOptions
+	opts.PerUser = 1
+
+	recommendations := Compute(testLessons(), nil, favorites, opts, time.Now())
+	if len(recommendations) != 1 || recommendations[0].LessonId != 2 {
+		t.Errorf("expected only the best recommendation but got %v", recommendations)
+	}
+}
+
+func Test_dominantAssessments(t *testing.T) {
+	ratings := []*models.Rating{
+		{LessonId: 1, TestOrReport: "report"},
+		{LessonId: 1, TestOrReport: "test"},
+		{LessonId: 1, TestOrReport: "report"},
+		{LessonId: 2, TestOrReport: ""},
+	}
+
+	assessments := dominantAssessments(ratings)
+	if assessments[1] != "report" || assessments[2] != "" {
+		t.Errorf("unexpected assessments %v", assessments)
+	}
+}
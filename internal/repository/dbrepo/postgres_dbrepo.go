@@ -3,20 +3,57 @@ package dbrepo
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"kstation_backend/internal/models"
+	"kstation_backend/internal/repository"
 	"log"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/stdlib"
 	"golang.org/x/crypto/bcrypt"
 )
 
 type PostgresDBRepo struct {
 	DB *sql.DB
+
+	// statsCache holds computed lesson statistics until the next review
+	// mutation through this repo, or until statsTTL has passed. statsGen
+	// counts the mutations per lesson, so statistics computed while one
+	// happened are not cached.
+	statsMu    sync.Mutex
+	statsCache map[int]cachedLessonStats
+	statsGen   map[int]uint64
 }
 
 const dbTimeout = time.Second * 3
 
+// queryer runs queries either straight on the pool or inside a transaction
+type queryer interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// statsTTL bounds how stale cached lesson statistics get. Other instances of
+// the api write to the same database without touching this cache, so their
+// reviews only show up here once the entry expires.
+const statsTTL = time.Second * 30
+
+type cachedLessonStats struct {
+	stats   *models.LessonStats
+	expires time.Time
+}
+
+// isUniqueViolation reports whether err was caused by a unique constraint
+func isUniqueViolation(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "23505"
+}
+
 func (m *PostgresDBRepo) Connection() *sql.DB {
 	return m.DB
 }
@@ -38,8 +75,8 @@ func (m *PostgresDBRepo) InsertUser(user models.User) (int, error) {
 		user.Email,
 		user.FirstName,
 		user.LastName,
-		user.Image,
 		hashedPassword,
+		user.Image,
 		user.IsAdmin,
 		time.Now(),
 		time.Now(),
@@ -58,10 +95,10 @@ func (m *PostgresDBRepo) GetUserByID(id int) (*models.User, error) {
 
 	query := `
 		select
-			id, email, first_name, last_name, password, image, is_admin, created_at, updated_at
+			id, email, first_name, last_name, password, image, is_admin, show_real_name, session_version, created_at, updated_at
 		from users
 		where
-		    id = $1`
+		    id = $1 and deleted_at is null`
 
 	var user models.User
 	row := m.DB.QueryRowContext(ctx, query, id)
@@ -74,6 +111,8 @@ func (m *PostgresDBRepo) GetUserByID(id int) (*models.User, error) {
 		&user.Password,
 		&user.Image,
 		&user.IsAdmin,
+		&user.ShowRealName,
+		&user.SessionVersion,
 		&user.CreatedAt,
 		&user.UpdatedAt,
 	)
@@ -95,8 +134,9 @@ func (m *PostgresDBRepo) UpdateUser(u models.User) error {
 		last_name = $3,
 		image = $4,
 		is_admin = $5,
-		updated_at = $6
-		where id = $7
+		show_real_name = $6,
+		updated_at = $7
+		where id = $8 and deleted_at is null
 	`
 
 	_, err := m.DB.ExecContext(ctx, stmt,
@@ -105,6 +145,7 @@ func (m *PostgresDBRepo) UpdateUser(u models.User) error {
 		u.LastName,
 		u.Image,
 		u.IsAdmin,
+		u.ShowRealName,
 		time.Now(),
 		u.ID,
 	)
@@ -122,10 +163,10 @@ func (m *PostgresDBRepo) GetUserByEmail(email string) (*models.User, error) {
 
 	query := `
 		select
-			id, email, first_name, last_name, password, image, is_admin, created_at, updated_at
+			id, email, first_name, last_name, password, image, is_admin, show_real_name, session_version, created_at, updated_at
 		from users
 		where
-		    email = $1`
+		    email = $1 and deleted_at is null`
 
 	var user models.User
 	row := m.DB.QueryRowContext(ctx, query, email)
@@ -138,6 +179,8 @@ func (m *PostgresDBRepo) GetUserByEmail(email string) (*models.User, error) {
 		&user.Password,
 		&user.Image,
 		&user.IsAdmin,
+		&user.ShowRealName,
+		&user.SessionVersion,
 		&user.CreatedAt,
 		&user.UpdatedAt,
 	)
@@ -158,7 +201,7 @@ func (m *PostgresDBRepo) ResetPassword(id int, password string) error {
 		return err
 	}
 
-	stmt := `update users set password = $1 where id = $2`
+	stmt := `update users set password = $1 where id = $2 and deleted_at is null`
 	_, err = m.DB.ExecContext(ctx, stmt, hashedPassword, id)
 	if err != nil {
 		return err
@@ -172,13 +215,14 @@ func (m *PostgresDBRepo) InsertLesson(lesson models.Lesson) (int, error) {
 	defer cancel()
 
 	var newID int
-	stmt := `insert into lessons (user_id, lesson_name, teacher_name, avg_star, about_avg_star, comment_numbers, created_at, updated_at)
-		values ($1, $2, $3, $4, $5, $6, $7, $8) returning id`
+	stmt := `insert into lessons (user_id, lesson_name, teacher_name, department, avg_star, about_avg_star, comment_numbers, created_at, updated_at)
+		values ($1, $2, $3, $4, $5, $6, $7, $8, $9) returning id`
 
 	err := m.DB.QueryRowContext(ctx, stmt,
 		lesson.UserId,
 		lesson.LessonName,
 		lesson.TeacherName,
+		lesson.Department,
 		lesson.AvgStar,
 		lesson.AboutAvgStar,
 		lesson.CommentNumbers,
@@ -199,10 +243,10 @@ func (m *PostgresDBRepo) GetLessonByID(id int) (*models.Lesson, error) {
 
 	query := `
 		select
-			id, user_id, lesson_name, teacher_name, avg_star, about_avg_star, comment_numbers, created_at, updated_at
+			id, user_id, lesson_name, teacher_name, department, avg_star, about_avg_star, comment_numbers, favorite_count, created_at, updated_at
 		from lessons
 		where
-		    id = $1`
+		    id = $1 and deleted_at is null`
 
 	var lesson models.Lesson
 	row := m.DB.QueryRowContext(ctx, query, id)
@@ -212,9 +256,11 @@ func (m *PostgresDBRepo) GetLessonByID(id int) (*models.Lesson, error) {
 		&lesson.UserId,
 		&lesson.LessonName,
 		&lesson.TeacherName,
+		&lesson.Department,
 		&lesson.AvgStar,
 		&lesson.AboutAvgStar,
 		&lesson.CommentNumbers,
+		&lesson.FavoriteCount,
 		&lesson.CreatedAt,
 		&lesson.UpdatedAt,
 	)
@@ -235,7 +281,7 @@ func (m *PostgresDBRepo) UpdateLesson(l models.Lesson) error {
 		about_avg_star = $2,
 		comment_numbers = $3,
 		updated_at = $4
-		where id = $5
+		where id = $5 and deleted_at is null
 	`
 
 	_, err := m.DB.ExecContext(ctx, stmt,
@@ -257,8 +303,8 @@ func (m *PostgresDBRepo) AllLessons(how int) ([]*models.Lesson, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
 	defer cancel()
 
-	query := `select id, user_id, lesson_name, teacher_name, avg_star, about_avg_star, comment_numbers, created_at, updated_at
-	from lessons order by %s`
+	query := `select id, user_id, lesson_name, teacher_name, department, avg_star, about_avg_star, comment_numbers, favorite_count, created_at, updated_at
+	from lessons where deleted_at is null order by %s`
 
 	if how == 1 {
 		query = fmt.Sprintf(query, "created_at")
@@ -266,6 +312,12 @@ func (m *PostgresDBRepo) AllLessons(how int) ([]*models.Lesson, error) {
 		query = fmt.Sprintf(query, "created_at desc")
 	} else if how == 3 {
 		query = fmt.Sprintf(query, "about_avg_star desc")
+	} else if how == 4 {
+		query = fmt.Sprintf(query, "favorite_count desc, id")
+	} else if how == 5 {
+		query = fmt.Sprintf(query, rankingOrder("bayes_star"))
+	} else if how == 6 {
+		query = fmt.Sprintf(query, rankingOrder("trending_score"))
 	} else if how == 0 {
 		query = fmt.Sprintf(query, "lesson_name")
 	}
@@ -285,9 +337,11 @@ func (m *PostgresDBRepo) AllLessons(how int) ([]*models.Lesson, error) {
 			&lesson.UserId,
 			&lesson.LessonName,
 			&lesson.TeacherName,
+			&lesson.Department,
 			&lesson.AvgStar,
 			&lesson.AboutAvgStar,
 			&lesson.CommentNumbers,
+			&lesson.FavoriteCount,
 			&lesson.CreatedAt,
 			&lesson.UpdatedAt,
 		)
@@ -306,9 +360,9 @@ func (m *PostgresDBRepo) AllLessonsByUser(id int, how int) ([]*models.Lesson, er
 	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
 	defer cancel()
 
-	query := `select id, user_id, lesson_name, teacher_name, avg_star, about_avg_star, comment_numbers, created_at, updated_at
+	query := `select id, user_id, lesson_name, teacher_name, department, avg_star, about_avg_star, comment_numbers, favorite_count, created_at, updated_at
 						from lessons
-						where user_id = $1
+						where user_id = $1 and deleted_at is null
 						order by %s`
 
 	if how == 1 {
@@ -317,6 +371,12 @@ func (m *PostgresDBRepo) AllLessonsByUser(id int, how int) ([]*models.Lesson, er
 		query = fmt.Sprintf(query, "created_at desc")
 	} else if how == 3 {
 		query = fmt.Sprintf(query, "about_avg_star desc")
+	} else if how == 4 {
+		query = fmt.Sprintf(query, "favorite_count desc, id")
+	} else if how == 5 {
+		query = fmt.Sprintf(query, rankingOrder("bayes_star"))
+	} else if how == 6 {
+		query = fmt.Sprintf(query, rankingOrder("trending_score"))
 	} else if how == 0 {
 		query = fmt.Sprintf(query, "lesson_name")
 	}
@@ -336,9 +396,11 @@ func (m *PostgresDBRepo) AllLessonsByUser(id int, how int) ([]*models.Lesson, er
 			&lesson.UserId,
 			&lesson.LessonName,
 			&lesson.TeacherName,
+			&lesson.Department,
 			&lesson.AvgStar,
 			&lesson.AboutAvgStar,
 			&lesson.CommentNumbers,
+			&lesson.FavoriteCount,
 			&lesson.CreatedAt,
 			&lesson.UpdatedAt,
 		)
@@ -357,9 +419,13 @@ func (m *PostgresDBRepo) InsertComment(comment models.Comment) (int, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
 	defer cancel()
 
+	if comment.ModerationStatus == "" {
+		comment.ModerationStatus = models.CommentVisible
+	}
+
 	var newID int
-	stmt := `insert into comments (lesson_id, user_id, year, term, comment, test_or_report, star, created_at, updated_at)
-		values ($1, $2, $3, $4, $5, $6, $7, $8, $9) returning id`
+	stmt := `insert into comments (lesson_id, user_id, year, term, comment, test_or_report, star, moderation_status, created_at, updated_at)
+		values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10) returning id`
 
 	err := m.DB.QueryRowContext(ctx, stmt,
 		comment.LessonId,
@@ -369,14 +435,21 @@ func (m *PostgresDBRepo) InsertComment(comment models.Comment) (int, error) {
 		comment.Comment,
 		comment.TestOrReport,
 		comment.Star,
+		comment.ModerationStatus,
 		time.Now(),
 		time.Now(),
 	).Scan(&newID)
 
+	if isUniqueViolation(err) {
+		return 0, repository.ErrDuplicateComment
+	}
+
 	if err != nil {
 		return 0, err
 	}
 
+	m.invalidateLessonStats(comment.LessonId)
+
 	return newID, nil
 }
 
@@ -386,10 +459,10 @@ func (m *PostgresDBRepo) GetCommentByID(id int) (*models.Comment, error) {
 
 	query := `
 		select
-			id, lesson_id, user_id, year, term, comment, test_or_report, star, created_at, updated_at
+			id, lesson_id, user_id, year, term, comment, test_or_report, star, helpful_count, unhelpful_count, reply_count, moderation_status, edited, created_at, updated_at
 		from comments
 		where
-		    id = $1`
+		    id = $1 and deleted_at is null`
 
 	var comment models.Comment
 	row := m.DB.QueryRowContext(ctx, query, id)
@@ -403,6 +476,11 @@ func (m *PostgresDBRepo) GetCommentByID(id int) (*models.Comment, error) {
 		&comment.Comment,
 		&comment.TestOrReport,
 		&comment.Star,
+		&comment.HelpfulCount,
+		&comment.UnhelpfulCount,
+		&comment.ReplyCount,
+		&comment.ModerationStatus,
+		&comment.Edited,
 		&comment.CreatedAt,
 		&comment.UpdatedAt,
 	)
@@ -414,14 +492,29 @@ func (m *PostgresDBRepo) GetCommentByID(id int) (*models.Comment, error) {
 	return &comment, nil
 }
 
-func (m *PostgresDBRepo) AllCommentsByLessonId(LessonId int) ([]*models.Comment, error) {
+// wilsonScore is the lower bound of the Wilson score interval (95% confidence)
+// for the share of helpful votes on a comment
+const wilsonScore = `case when helpful_count + unhelpful_count = 0 then 0 else
+	((helpful_count + 1.9208) / (helpful_count + unhelpful_count)
+	- 1.96 * sqrt((helpful_count * unhelpful_count)::float / (helpful_count + unhelpful_count) + 0.9604) / (helpful_count + unhelpful_count))
+	/ (1 + 3.8416 / (helpful_count + unhelpful_count)) end`
+
+func (m *PostgresDBRepo) AllCommentsByLessonId(LessonId int, how int) ([]*models.Comment, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
 	defer cancel()
 
-	query := `select id, lesson_id, user_id, year, term, comment, test_or_report, star, created_at, updated_at
+	query := `select id, lesson_id, user_id, year, term, comment, test_or_report, star, helpful_count, unhelpful_count, reply_count, moderation_status, edited, created_at, updated_at
 						from comments
-						where lesson_id = $1
-						order by id desc`
+						where lesson_id = $1 and moderation_status = 'visible' and deleted_at is null
+						order by %s`
+
+	if how == 1 {
+		query = fmt.Sprintf(query, "helpful_count desc, id desc")
+	} else if how == 2 {
+		query = fmt.Sprintf(query, wilsonScore+" desc, id desc")
+	} else {
+		query = fmt.Sprintf(query, "id desc")
+	}
 
 	rows, err := m.DB.QueryContext(ctx, query, LessonId)
 	if err != nil {
@@ -442,6 +535,11 @@ func (m *PostgresDBRepo) AllCommentsByLessonId(LessonId int) ([]*models.Comment,
 			&comment.Comment,
 			&comment.TestOrReport,
 			&comment.Star,
+			&comment.HelpfulCount,
+			&comment.UnhelpfulCount,
+			&comment.ReplyCount,
+			&comment.ModerationStatus,
+			&comment.Edited,
 			&comment.CreatedAt,
 			&comment.UpdatedAt,
 		)
@@ -460,9 +558,9 @@ func (m *PostgresDBRepo) AllCommentsByUserId(UserId int) ([]*models.Comment, err
 	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
 	defer cancel()
 
-	query := `select id, lesson_id, user_id, year, term, comment, test_or_report, star, created_at, updated_at
+	query := `select id, lesson_id, user_id, year, term, comment, test_or_report, star, helpful_count, unhelpful_count, reply_count, moderation_status, edited, created_at, updated_at
 						from comments
-						where user_id = $1
+						where user_id = $1 and deleted_at is null
 						order by id`
 
 	rows, err := m.DB.QueryContext(ctx, query, UserId)
@@ -484,6 +582,11 @@ func (m *PostgresDBRepo) AllCommentsByUserId(UserId int) ([]*models.Comment, err
 			&comment.Comment,
 			&comment.TestOrReport,
 			&comment.Star,
+			&comment.HelpfulCount,
+			&comment.UnhelpfulCount,
+			&comment.ReplyCount,
+			&comment.ModerationStatus,
+			&comment.Edited,
 			&comment.CreatedAt,
 			&comment.UpdatedAt,
 		)
@@ -498,34 +601,66 @@ func (m *PostgresDBRepo) AllCommentsByUserId(UserId int) ([]*models.Comment, err
 	return comments, nil
 }
 
-func (m *PostgresDBRepo) UpdateComment(c models.Comment) error {
+// UpdateComment saves the previous version of the comment as a revision made
+// by editorID before overwriting it
+func (m *PostgresDBRepo) UpdateComment(c models.Comment, editorID int) error {
 	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
 	defer cancel()
 
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = insertCommentRevision(ctx, tx, c.ID, editorID)
+	if err != nil {
+		return err
+	}
+
+	// an empty status keeps the current one, and edits never lift a moderator's
+	// hide or publish a held comment no moderator has seen
 	stmt := `update comments set
 		comment = $1,
 		year = $2,
 		term = $3,
 		test_or_report = $4,
 		star = $5,
-		updated_at = $6
-		where id = $7
+		moderation_status = case
+			when moderation_status in ('hidden', 'pending') then moderation_status
+			else coalesce(nullif($6, ''), moderation_status)
+		end,
+		edited = true,
+		updated_at = $7
+		where id = $8 and deleted_at is null
 	`
 
-	_, err := m.DB.ExecContext(ctx, stmt,
+	_, err = tx.ExecContext(ctx, stmt,
 		c.Comment,
 		c.Year,
 		c.Term,
 		c.TestOrReport,
 		c.Star,
+		c.ModerationStatus,
 		time.Now(),
 		c.ID,
 	)
 
+	if isUniqueViolation(err) {
+		return repository.ErrDuplicateComment
+	}
+
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit()
 	if err != nil {
 		return err
 	}
 
+	m.invalidateLessonStats(c.LessonId)
+
 	return nil
 }
 
@@ -533,12 +668,3888 @@ func (m *PostgresDBRepo) DeleteComment(id int) error {
 	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
 	defer cancel()
 
-	stmt := `delete from comments where id = $1`
+	stmt := `update comments set deleted_at = $1 where id = $2 and deleted_at is null returning lesson_id`
 
-	_, err := m.DB.ExecContext(ctx, stmt, id)
+	var lessonID int
+	err := m.DB.QueryRowContext(ctx, stmt, time.Now(), id).Scan(&lessonID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+
+	m.invalidateLessonStats(lessonID)
+
+	return nil
+}
+
+func (m *PostgresDBRepo) invalidateLessonStats(lessonID int) {
+	m.statsMu.Lock()
+	defer m.statsMu.Unlock()
+
+	delete(m.statsCache, lessonID)
+	if m.statsGen == nil {
+		m.statsGen = make(map[int]uint64)
+	}
+	m.statsGen[lessonID]++
+}
+
+// cachedStats returns the cached statistics of a lesson, if they have not
+// expired, along with the generation a new computation must be stored under
+func (m *PostgresDBRepo) cachedStats(lessonID int) (*models.LessonStats, uint64) {
+	m.statsMu.Lock()
+	defer m.statsMu.Unlock()
+
+	cached, ok := m.statsCache[lessonID]
+	if ok && time.Now().Before(cached.expires) {
+		return copyLessonStats(cached.stats), m.statsGen[lessonID]
+	}
+
+	return nil, m.statsGen[lessonID]
+}
+
+// storeStats caches statistics computed at the given generation, unless the
+// lesson's reviews changed in the meantime
+func (m *PostgresDBRepo) storeStats(lessonID int, gen uint64, stats *models.LessonStats) {
+	m.statsMu.Lock()
+	defer m.statsMu.Unlock()
+
+	if m.statsGen[lessonID] != gen {
+		return
+	}
+
+	if m.statsCache == nil {
+		m.statsCache = make(map[int]cachedLessonStats)
+	}
+	m.statsCache[lessonID] = cachedLessonStats{stats: copyLessonStats(stats), expires: time.Now().Add(statsTTL)}
+}
+
+// copyLessonStats returns a deep copy, so callers can change the statistics
+// they get without touching the cached ones
+func copyLessonStats(stats *models.LessonStats) *models.LessonStats {
+	copied := *stats
+
+	copied.StarHistogram = make(map[int]int, len(stats.StarHistogram))
+	for star, count := range stats.StarHistogram {
+		copied.StarHistogram[star] = count
+	}
+
+	copied.TestOrReport = make(map[string]int, len(stats.TestOrReport))
+	for kind, count := range stats.TestOrReport {
+		copied.TestOrReport[kind] = count
+	}
+
+	copied.ByTerm = make([]*models.TermStats, 0, len(stats.ByTerm))
+	for _, term := range stats.ByTerm {
+		t := *term
+		copied.ByTerm = append(copied.ByTerm, &t)
+	}
+
+	copied.Trend = make([]*models.TrendPoint, 0, len(stats.Trend))
+	for _, point := range stats.Trend {
+		p := *point
+		copied.Trend = append(copied.Trend, &p)
+	}
+
+	return &copied
+}
+
+func (m *PostgresDBRepo) GetLessonStats(id int) (*models.LessonStats, error) {
+	cached, gen := m.cachedStats(id)
+	if cached != nil {
+		return cached, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stats := models.LessonStats{
+		LessonId:      id,
+		StarHistogram: map[int]int{1: 0, 2: 0, 3: 0, 4: 0, 5: 0},
+		TestOrReport:  map[string]int{},
+		ByTerm:        []*models.TermStats{},
+		Trend:         []*models.TrendPoint{},
+	}
+
+	query := `select
+			count(*),
+			coalesce(avg(star), 0),
+			coalesce(percentile_cont(0.5) within group (order by star), 0)
+		from comments
+		where lesson_id = $1 and moderation_status = 'visible' and deleted_at is null`
+
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+		&stats.CommentNumbers,
+		&stats.AvgStar,
+		&stats.MedianStar,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	query = `select star, count(*) from comments where lesson_id = $1 and moderation_status = 'visible' and deleted_at is null group by star`
+
+	rows, err := m.DB.QueryContext(ctx, query, id)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var star, count int
+		if err := rows.Scan(&star, &count); err != nil {
+			rows.Close()
+			log.Println("Error scanning", err)
+			return nil, err
+		}
+		stats.StarHistogram[star] = count
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	query = `select test_or_report, count(*) from comments where lesson_id = $1 and moderation_status = 'visible' and deleted_at is null group by test_or_report`
+
+	rows, err = m.DB.QueryContext(ctx, query, id)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var kind string
+		var count int
+		if err := rows.Scan(&kind, &count); err != nil {
+			rows.Close()
+			log.Println("Error scanning", err)
+			return nil, err
+		}
+		stats.TestOrReport[kind] = count
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	query = `select year, term, count(*), avg(star)
+						from comments
+						where lesson_id = $1 and moderation_status = 'visible' and deleted_at is null
+						group by year, term
+						order by year, term`
+
+	rows, err = m.DB.QueryContext(ctx, query, id)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var term models.TermStats
+		if err := rows.Scan(&term.Year, &term.Term, &term.CommentNumbers, &term.AvgStar); err != nil {
+			rows.Close()
+			log.Println("Error scanning", err)
+			return nil, err
+		}
+		stats.ByTerm = append(stats.ByTerm, &term)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	query = `select date_trunc('month', created_at) as month, count(*), avg(star)
+						from comments
+						where lesson_id = $1 and moderation_status = 'visible' and deleted_at is null
+						group by month
+						order by month`
+
+	rows, err = m.DB.QueryContext(ctx, query, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var point models.TrendPoint
+		if err := rows.Scan(&point.Month, &point.CommentNumbers, &point.AvgStar); err != nil {
+			log.Println("Error scanning", err)
+			return nil, err
+		}
+		stats.Trend = append(stats.Trend, &point)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	m.storeStats(id, gen, &stats)
+
+	return &stats, nil
+}
+
+func (m *PostgresDBRepo) VoteComment(commentID int, userID int, helpful bool) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// one statement, so two first votes by the same user cannot both insert.
+	// A vote that is already the same way is left alone (though still locked)
+	// and returns no row; xmax is 0 only on rows this statement inserted.
+	var inserted bool
+	stmt := `
+		insert into comment_votes (comment_id, user_id, helpful, created_at, updated_at)
+		values ($1, $2, $3, $4, $4)
+		on conflict (comment_id, user_id) do update
+			set helpful = excluded.helpful, updated_at = excluded.updated_at
+			where comment_votes.helpful <> excluded.helpful
+		returning xmax = 0`
+	err = tx.QueryRowContext(ctx, stmt, commentID, userID, helpful, time.Now()).Scan(&inserted)
+
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		// voting the same way again toggles the vote off
+		stmt = `delete from comment_votes where comment_id = $1 and user_id = $2`
+		_, err = tx.ExecContext(ctx, stmt, commentID, userID)
+		if err != nil {
+			return err
+		}
+		err = adjustVoteCounts(ctx, tx, commentID, helpful, -1)
+	case err != nil:
+		return err
+	case inserted:
+		err = adjustVoteCounts(ctx, tx, commentID, helpful, 1)
+	default:
+		// the vote switched sides
+		err = adjustVoteCounts(ctx, tx, commentID, !helpful, -1)
+		if err == nil {
+			err = adjustVoteCounts(ctx, tx, commentID, helpful, 1)
+		}
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func adjustVoteCounts(ctx context.Context, tx *sql.Tx, commentID int, helpful bool, delta int) error {
+	column := "unhelpful_count"
+	if helpful {
+		column = "helpful_count"
+	}
+
+	stmt := fmt.Sprintf(`update comments set %[1]s = %[1]s + $1 where id = $2`, column)
+	_, err := tx.ExecContext(ctx, stmt, delta, commentID)
+
+	return err
+}
+
+func (m *PostgresDBRepo) GetCommentByOffering(userID int, lessonID int, year int, term string) (*models.Comment, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `
+		select
+			id, lesson_id, user_id, year, term, comment, test_or_report, star, helpful_count, unhelpful_count, reply_count, moderation_status, edited, created_at, updated_at
+		from comments
+		where
+		    user_id = $1 and lesson_id = $2 and year = $3 and term = $4 and deleted_at is null`
+
+	var comment models.Comment
+	row := m.DB.QueryRowContext(ctx, query, userID, lessonID, year, term)
+
+	err := row.Scan(
+		&comment.ID,
+		&comment.LessonId,
+		&comment.UserId,
+		&comment.Year,
+		&comment.Term,
+		&comment.Comment,
+		&comment.TestOrReport,
+		&comment.Star,
+		&comment.HelpfulCount,
+		&comment.UnhelpfulCount,
+		&comment.ReplyCount,
+		&comment.ModerationStatus,
+		&comment.Edited,
+		&comment.CreatedAt,
+		&comment.UpdatedAt,
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &comment, nil
+}
+
+// UpsertComment inserts a comment, or updates the user's existing comment
+// for the same lesson, year and term
+func (m *PostgresDBRepo) UpsertComment(comment models.Comment) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	if comment.ModerationStatus == "" {
+		comment.ModerationStatus = models.CommentVisible
+	}
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var existingID int
+	query := `select id from comments
+		where user_id = $1 and lesson_id = $2 and year = $3 and term = $4 and deleted_at is null
+		for update`
+	err = tx.QueryRowContext(ctx, query, comment.UserId, comment.LessonId, comment.Year, comment.Term).Scan(&existingID)
+	if err == nil {
+		err = insertCommentRevision(ctx, tx, existingID, comment.UserId)
+	}
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return 0, err
+	}
+
+	var id int
+	stmt := `insert into comments (lesson_id, user_id, year, term, comment, test_or_report, star, moderation_status, created_at, updated_at)
+		values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		on conflict (user_id, lesson_id, year, term) where deleted_at is null do update set
+			comment = excluded.comment,
+			test_or_report = excluded.test_or_report,
+			star = excluded.star,
+			moderation_status = case
+				when comments.moderation_status in ('hidden', 'pending') then comments.moderation_status
+				else excluded.moderation_status
+			end,
+			edited = true,
+			updated_at = excluded.updated_at
+		returning id`
+
+	err = tx.QueryRowContext(ctx, stmt,
+		comment.LessonId,
+		comment.UserId,
+		comment.Year,
+		comment.Term,
+		comment.Comment,
+		comment.TestOrReport,
+		comment.Star,
+		comment.ModerationStatus,
+		time.Now(),
+		time.Now(),
+	).Scan(&id)
+
+	if err != nil {
+		return 0, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return 0, err
+	}
+
+	m.invalidateLessonStats(comment.LessonId)
+
+	return id, nil
+}
+
+// UpdateLessonAggregates recomputes avg_star, about_avg_star and comment_numbers
+// of a lesson from its comments
+func (m *PostgresDBRepo) UpdateLessonAggregates(id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `update lessons set
+		avg_star = agg.avg_star,
+		about_avg_star = round(agg.avg_star),
+		comment_numbers = agg.comment_numbers,
+		updated_at = $1
+		from (
+			select coalesce(avg(star), 0) as avg_star, count(*) as comment_numbers
+			from comments
+			where lesson_id = $2 and moderation_status = 'visible' and deleted_at is null
+		) as agg
+		where id = $2
+	`
+
+	_, err := m.DB.ExecContext(ctx, stmt, time.Now(), id)
 	if err != nil {
 		return err
 	}
 
 	return nil
-}
\ No newline at end of file
+}
+
+func (m *PostgresDBRepo) InsertReport(report models.Report) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	var newID int
+	stmt := `insert into reports (comment_id, user_id, reason, detail, status, created_at, updated_at)
+		values ($1, $2, $3, $4, $5, $6, $7) returning id`
+
+	err := m.DB.QueryRowContext(ctx, stmt,
+		report.CommentId,
+		report.UserId,
+		report.Reason,
+		report.Detail,
+		models.ReportPending,
+		time.Now(),
+		time.Now(),
+	).Scan(&newID)
+
+	if isUniqueViolation(err) {
+		return 0, repository.ErrDuplicateReport
+	}
+
+	if err != nil {
+		return 0, err
+	}
+
+	return newID, nil
+}
+
+func (m *PostgresDBRepo) GetReportByID(id int) (*models.Report, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `
+		select
+			id, comment_id, user_id, reason, detail, status, created_at, updated_at
+		from reports
+		where
+		    id = $1`
+
+	var report models.Report
+	row := m.DB.QueryRowContext(ctx, query, id)
+
+	err := row.Scan(
+		&report.ID,
+		&report.CommentId,
+		&report.UserId,
+		&report.Reason,
+		&report.Detail,
+		&report.Status,
+		&report.CreatedAt,
+		&report.UpdatedAt,
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &report, nil
+}
+
+// PendingReports returns the moderation queue, oldest report first, with the
+// reported comment attached to each report
+func (m *PostgresDBRepo) PendingReports() ([]*models.Report, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select r.id, r.comment_id, r.user_id, r.reason, r.detail, r.status, r.created_at, r.updated_at,
+							c.id, c.lesson_id, c.user_id, c.year, c.term, c.comment, c.test_or_report, c.star,
+							c.helpful_count, c.unhelpful_count, c.reply_count, c.moderation_status, c.edited, c.created_at, c.updated_at
+						from reports r
+						join comments c on c.id = r.comment_id and c.deleted_at is null
+						where r.status = $1
+						order by r.created_at, r.id`
+
+	rows, err := m.DB.QueryContext(ctx, query, models.ReportPending)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var reports []*models.Report
+
+	for rows.Next() {
+		var report models.Report
+		var comment models.Comment
+		err := rows.Scan(
+			&report.ID,
+			&report.CommentId,
+			&report.UserId,
+			&report.Reason,
+			&report.Detail,
+			&report.Status,
+			&report.CreatedAt,
+			&report.UpdatedAt,
+			&comment.ID,
+			&comment.LessonId,
+			&comment.UserId,
+			&comment.Year,
+			&comment.Term,
+			&comment.Comment,
+			&comment.TestOrReport,
+			&comment.Star,
+			&comment.HelpfulCount,
+			&comment.UnhelpfulCount,
+			&comment.ReplyCount,
+			&comment.ModerationStatus,
+			&comment.Edited,
+			&comment.CreatedAt,
+			&comment.UpdatedAt,
+		)
+		if err != nil {
+			log.Println("Error scanning", err)
+			return nil, err
+		}
+
+		report.Comment = &comment
+		reports = append(reports, &report)
+	}
+
+	return reports, nil
+}
+
+// ModerateReport applies a moderator action to a report and its comment and
+// records the action. Hiding or deleting a comment resolves every pending
+// report on it.
+func (m *PostgresDBRepo) ModerateReport(action models.ModerationAction) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// the status is checked again under the lock, so two moderators acting on
+	// the same report at once cannot both record an action
+	var lessonID int
+	var status string
+	query := `select r.status, c.id, c.user_id, c.lesson_id
+		from reports r
+		join comments c on c.id = r.comment_id and c.deleted_at is null
+		where r.id = $1
+		for update of r`
+	err = tx.QueryRowContext(ctx, query, action.ReportId).Scan(&status, &action.CommentId, &action.UserId, &lessonID)
+	if err != nil {
+		return err
+	}
+	if status != models.ReportPending {
+		return repository.ErrReportHandled
+	}
+
+	stmt := `insert into moderation_actions (report_id, comment_id, moderator_id, user_id, action, note, created_at)
+		values ($1, $2, $3, $4, $5, $6, $7)`
+	_, err = tx.ExecContext(ctx, stmt,
+		action.ReportId,
+		action.CommentId,
+		action.ModeratorId,
+		action.UserId,
+		action.Action,
+		action.Note,
+		time.Now(),
+	)
+	if err != nil {
+		return err
+	}
+
+	status = models.ReportResolved
+	if action.Action == models.ModerationDismiss {
+		status = models.ReportDismissed
+	}
+
+	stmt = `update reports set status = $1, updated_at = $2 where id = $3`
+	_, err = tx.ExecContext(ctx, stmt, status, time.Now(), action.ReportId)
+	if err != nil {
+		return err
+	}
+
+	switch action.Action {
+	case models.ModerationHide:
+		stmt = `update comments set moderation_status = $1, updated_at = $2 where id = $3`
+		_, err = tx.ExecContext(ctx, stmt, models.CommentHidden, time.Now(), action.CommentId)
+	case models.ModerationDelete:
+		stmt = `update comments set deleted_at = $1 where id = $2`
+		_, err = tx.ExecContext(ctx, stmt, time.Now(), action.CommentId)
+	case models.ModerationWarn:
+		// the review stays up, so the author is told through their inbox
+		stmt = `insert into notifications (user_id, kind, lesson_id, comment_id, created_at)
+			values ($1, $2, $3, $4, $5)`
+		_, err = tx.ExecContext(ctx, stmt, action.UserId, models.NotificationWarning, lessonID, action.CommentId, time.Now())
+	}
+	if err != nil {
+		return err
+	}
+
+	if action.Action == models.ModerationHide || action.Action == models.ModerationDelete {
+		stmt = `update reports set status = $1, updated_at = $2 where comment_id = $3 and status = $4`
+		_, err = tx.ExecContext(ctx, stmt, models.ReportResolved, time.Now(), action.CommentId, models.ReportPending)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	m.invalidateLessonStats(lessonID)
+
+	return nil
+}
+
+// HeldComments returns comments held by the content filter, oldest first
+func (m *PostgresDBRepo) HeldComments() ([]*models.Comment, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select id, lesson_id, user_id, year, term, comment, test_or_report, star, helpful_count, unhelpful_count, reply_count, moderation_status, edited, created_at, updated_at
+						from comments
+						where moderation_status = $1 and deleted_at is null
+						order by updated_at, id`
+
+	rows, err := m.DB.QueryContext(ctx, query, models.CommentPending)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var comments []*models.Comment
+
+	for rows.Next() {
+		var comment models.Comment
+		err := rows.Scan(
+			&comment.ID,
+			&comment.LessonId,
+			&comment.UserId,
+			&comment.Year,
+			&comment.Term,
+			&comment.Comment,
+			&comment.TestOrReport,
+			&comment.Star,
+			&comment.HelpfulCount,
+			&comment.UnhelpfulCount,
+			&comment.ReplyCount,
+			&comment.ModerationStatus,
+			&comment.Edited,
+			&comment.CreatedAt,
+			&comment.UpdatedAt,
+		)
+		if err != nil {
+			log.Println("Error scanning", err)
+			return nil, err
+		}
+
+		comments = append(comments, &comment)
+	}
+
+	return comments, nil
+}
+
+func (m *PostgresDBRepo) SetCommentModerationStatus(id int, status string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `update comments set moderation_status = $1 where id = $2 and deleted_at is null returning lesson_id`
+
+	var lessonID int
+	err := m.DB.QueryRowContext(ctx, stmt, status, id).Scan(&lessonID)
+	if err != nil {
+		return err
+	}
+
+	m.invalidateLessonStats(lessonID)
+
+	return nil
+}
+
+func (m *PostgresDBRepo) DeleteLesson(id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// comments share the lesson's deleted_at so RestoreLesson can bring back
+	// exactly the comments removed with it
+	deletedAt := time.Now()
+
+	stmt := `update lessons set deleted_at = $1 where id = $2 and deleted_at is null`
+	res, err := tx.ExecContext(ctx, stmt, deletedAt, id)
+	if err != nil {
+		return err
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return sql.ErrNoRows
+	}
+
+	stmt = `update comments set deleted_at = $1 where lesson_id = $2 and deleted_at is null`
+	_, err = tx.ExecContext(ctx, stmt, deletedAt, id)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	m.invalidateLessonStats(id)
+
+	return nil
+}
+
+// DeleteUser soft deletes a user together with their reviews and replies,
+// which share the user's deleted_at so RestoreUser can bring back exactly
+// those. Their votes are kept but no longer counted, and their sessions end.
+// It returns the lessons whose aggregates must be recomputed.
+func (m *PostgresDBRepo) DeleteUser(id int) ([]int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	deletedAt := time.Now()
+
+	stmt := `update users set deleted_at = $1, session_version = session_version + 1, updated_at = $1
+		where id = $2 and deleted_at is null`
+	res, err := tx.ExecContext(ctx, stmt, deletedAt, id)
+	if err != nil {
+		return nil, err
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+	if affected == 0 {
+		return nil, sql.ErrNoRows
+	}
+
+	rows, err := tx.QueryContext(ctx, `update comments set deleted_at = $1
+		where user_id = $2 and deleted_at is null
+		returning lesson_id`, deletedAt, id)
+	if err != nil {
+		return nil, err
+	}
+	lessonIDs, err := scanLessonIDs(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, stmt := range []struct {
+		query string
+		args  []interface{}
+	}{
+		{`update comments c set reply_count = c.reply_count - r.n
+			from (select comment_id, count(*) as n from comment_replies
+				where user_id = $1 and deleted_at is null group by comment_id) r
+			where c.id = r.comment_id`, []interface{}{id}},
+		{`update comment_replies set deleted_at = $1 where user_id = $2 and deleted_at is null`, []interface{}{deletedAt, id}},
+		{`update comments c set
+			helpful_count = c.helpful_count - v.helpful,
+			unhelpful_count = c.unhelpful_count - v.unhelpful
+			from (select comment_id,
+					count(*) filter (where helpful) as helpful,
+					count(*) filter (where not helpful) as unhelpful
+				from comment_votes where user_id = $1 group by comment_id) v
+			where c.id = v.comment_id`, []interface{}{id}},
+	} {
+		_, err = tx.ExecContext(ctx, stmt.query, stmt.args...)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, lessonID := range lessonIDs {
+		m.invalidateLessonStats(lessonID)
+	}
+
+	return lessonIDs, nil
+}
+
+// scanLessonIDs reads the lesson ids returned by rows once each and closes rows
+func scanLessonIDs(rows *sql.Rows) ([]int, error) {
+	defer rows.Close()
+
+	var lessonIDs []int
+	seen := make(map[int]bool)
+	for rows.Next() {
+		var lessonID int
+		err := rows.Scan(&lessonID)
+		if err != nil {
+			log.Println("Error scanning", err)
+			return nil, err
+		}
+		if !seen[lessonID] {
+			seen[lessonID] = true
+			lessonIDs = append(lessonIDs, lessonID)
+		}
+	}
+
+	return lessonIDs, rows.Err()
+}
+
+// RestoreComment undoes a soft delete and returns the lesson id of the comment
+func (m *PostgresDBRepo) RestoreComment(id int) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `update comments set deleted_at = null where id = $1 and deleted_at is not null returning lesson_id`
+
+	var lessonID int
+	err := m.DB.QueryRowContext(ctx, stmt, id).Scan(&lessonID)
+	if isUniqueViolation(err) {
+		return 0, repository.ErrDuplicateComment
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	m.invalidateLessonStats(lessonID)
+
+	return lessonID, nil
+}
+
+func (m *PostgresDBRepo) RestoreLesson(id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var deletedAt time.Time
+	query := `select deleted_at from lessons where id = $1 and deleted_at is not null for update`
+	err = tx.QueryRowContext(ctx, query, id).Scan(&deletedAt)
+	if err != nil {
+		return err
+	}
+
+	stmt := `update lessons set deleted_at = null where id = $1`
+	_, err = tx.ExecContext(ctx, stmt, id)
+	if err != nil {
+		return err
+	}
+
+	stmt = `update comments set deleted_at = null where lesson_id = $1 and deleted_at = $2`
+	_, err = tx.ExecContext(ctx, stmt, id, deletedAt)
+	if isUniqueViolation(err) {
+		return repository.ErrDuplicateComment
+	}
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	m.invalidateLessonStats(id)
+
+	return nil
+}
+
+// RestoreUser undoes DeleteUser, bringing back the reviews and replies
+// deleted with the user and counting their votes again. It returns the
+// lessons whose aggregates must be recomputed.
+func (m *PostgresDBRepo) RestoreUser(id int) ([]int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var deletedAt time.Time
+	query := `select deleted_at from users where id = $1 and deleted_at is not null for update`
+	err = tx.QueryRowContext(ctx, query, id).Scan(&deletedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	stmt := `update users set deleted_at = null where id = $1`
+	_, err = tx.ExecContext(ctx, stmt, id)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := tx.QueryContext(ctx, `update comments set deleted_at = null
+		where user_id = $1 and deleted_at = $2
+		returning lesson_id`, id, deletedAt)
+	if isUniqueViolation(err) {
+		return nil, repository.ErrDuplicateComment
+	}
+	if err != nil {
+		return nil, err
+	}
+	lessonIDs, err := scanLessonIDs(rows)
+	if isUniqueViolation(err) {
+		return nil, repository.ErrDuplicateComment
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, stmt := range []struct {
+		query string
+		args  []interface{}
+	}{
+		{`update comments c set reply_count = c.reply_count + r.n
+			from (select comment_id, count(*) as n from comment_replies
+				where user_id = $1 and deleted_at = $2 group by comment_id) r
+			where c.id = r.comment_id`, []interface{}{id, deletedAt}},
+		{`update comment_replies set deleted_at = null where user_id = $1 and deleted_at = $2`, []interface{}{id, deletedAt}},
+		{`update comments c set
+			helpful_count = c.helpful_count + v.helpful,
+			unhelpful_count = c.unhelpful_count + v.unhelpful
+			from (select comment_id,
+					count(*) filter (where helpful) as helpful,
+					count(*) filter (where not helpful) as unhelpful
+				from comment_votes where user_id = $1 group by comment_id) v
+			where c.id = v.comment_id`, []interface{}{id}},
+	} {
+		_, err = tx.ExecContext(ctx, stmt.query, stmt.args...)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, lessonID := range lessonIDs {
+		m.invalidateLessonStats(lessonID)
+	}
+
+	return lessonIDs, nil
+}
+
+// PurgeDeleted permanently removes rows soft deleted before the given time.
+// Lessons and users that still own rows are kept until those rows are gone.
+func (m *PostgresDBRepo) PurgeDeleted(before time.Time) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmts := []string{
+		`delete from comment_replies where deleted_at < $1`,
+		`delete from comments where deleted_at < $1`,
+		`delete from lessons l where l.deleted_at < $1
+			and not exists (select 1 from comments c where c.lesson_id = l.id)
+			and not exists (select 1 from attachments a where a.lesson_id = l.id)`,
+		`delete from users u where u.deleted_at < $1
+			and not exists (select 1 from comments c where c.user_id = u.id)
+			and not exists (select 1 from comment_replies r where r.user_id = u.id)
+			and not exists (select 1 from attachments a where a.user_id = u.id)
+			and not exists (select 1 from lessons l where l.user_id = u.id)`,
+	}
+
+	var purged int64
+	for _, stmt := range stmts {
+		res, err := m.DB.ExecContext(ctx, stmt, before)
+		if err != nil {
+			return purged, err
+		}
+
+		affected, err := res.RowsAffected()
+		if err != nil {
+			return purged, err
+		}
+		purged += affected
+	}
+
+	return purged, nil
+}
+
+// insertCommentRevision copies the current version of a comment into comment_revisions
+func insertCommentRevision(ctx context.Context, tx *sql.Tx, commentID int, editorID int) error {
+	stmt := `insert into comment_revisions (comment_id, editor_id, year, term, comment, test_or_report, star, created_at)
+		select id, $1, year, term, comment, test_or_report, star, $2
+		from comments
+		where id = $3 and deleted_at is null`
+
+	_, err := tx.ExecContext(ctx, stmt, editorID, time.Now(), commentID)
+
+	return err
+}
+
+// CommentRevisions returns the previous versions of a comment, newest first
+func (m *PostgresDBRepo) CommentRevisions(commentID int) ([]*models.CommentRevision, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select id, comment_id, editor_id, year, term, comment, test_or_report, star, created_at
+						from comment_revisions
+						where comment_id = $1
+						order by created_at desc, id desc`
+
+	rows, err := m.DB.QueryContext(ctx, query, commentID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var revisions []*models.CommentRevision
+
+	for rows.Next() {
+		var revision models.CommentRevision
+		err := rows.Scan(
+			&revision.ID,
+			&revision.CommentId,
+			&revision.EditorId,
+			&revision.Year,
+			&revision.Term,
+			&revision.Comment,
+			&revision.TestOrReport,
+			&revision.Star,
+			&revision.CreatedAt,
+		)
+		if err != nil {
+			log.Println("Error scanning", err)
+			return nil, err
+		}
+
+		revisions = append(revisions, &revision)
+	}
+
+	return revisions, nil
+}
+
+// GetUsersByIDs returns the users with the given ids keyed by id. Deleted or
+// unknown ids are missing from the map.
+func (m *PostgresDBRepo) GetUsersByIDs(ids []int) (map[int]*models.User, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	users := make(map[int]*models.User)
+	if len(ids) == 0 {
+		return users, nil
+	}
+
+	idList := make([]string, len(ids))
+	for i, id := range ids {
+		idList[i] = strconv.Itoa(id)
+	}
+
+	query := `select id, email, first_name, last_name, password, image, is_admin, show_real_name, session_version, created_at, updated_at
+						from users
+						where id = any($1::integer[]) and deleted_at is null`
+
+	rows, err := m.DB.QueryContext(ctx, query, "{"+strings.Join(idList, ",")+"}")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var user models.User
+		err := rows.Scan(
+			&user.ID,
+			&user.Email,
+			&user.FirstName,
+			&user.LastName,
+			&user.Password,
+			&user.Image,
+			&user.IsAdmin,
+			&user.ShowRealName,
+			&user.SessionVersion,
+			&user.CreatedAt,
+			&user.UpdatedAt,
+		)
+		if err != nil {
+			log.Println("Error scanning", err)
+			return nil, err
+		}
+
+		users[user.ID] = &user
+	}
+
+	return users, nil
+}
+
+func (m *PostgresDBRepo) InsertReply(reply models.Reply) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var parentID sql.NullInt64
+	if reply.ParentId != 0 {
+		parentID = sql.NullInt64{Int64: int64(reply.ParentId), Valid: true}
+	}
+
+	var newID int
+	stmt := `insert into comment_replies (comment_id, parent_id, user_id, depth, body, created_at, updated_at)
+		values ($1, $2, $3, $4, $5, $6, $7) returning id`
+
+	err = tx.QueryRowContext(ctx, stmt,
+		reply.CommentId,
+		parentID,
+		reply.UserId,
+		reply.Depth,
+		reply.Body,
+		time.Now(),
+		time.Now(),
+	).Scan(&newID)
+	if err != nil {
+		return 0, err
+	}
+
+	stmt = `update comments set reply_count = reply_count + 1 where id = $1`
+	_, err = tx.ExecContext(ctx, stmt, reply.CommentId)
+	if err != nil {
+		return 0, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return 0, err
+	}
+
+	return newID, nil
+}
+
+func (m *PostgresDBRepo) GetReplyByID(id int) (*models.Reply, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `
+		select
+			id, comment_id, parent_id, user_id, depth, body, created_at, updated_at
+		from comment_replies
+		where
+		    id = $1 and deleted_at is null`
+
+	var reply models.Reply
+	var parentID sql.NullInt64
+	row := m.DB.QueryRowContext(ctx, query, id)
+
+	err := row.Scan(
+		&reply.ID,
+		&reply.CommentId,
+		&parentID,
+		&reply.UserId,
+		&reply.Depth,
+		&reply.Body,
+		&reply.CreatedAt,
+		&reply.UpdatedAt,
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	reply.ParentId = int(parentID.Int64)
+
+	return &reply, nil
+}
+
+// RepliesByCommentId returns a page of replies to a comment in the order they
+// were written. Clients rebuild the thread from parent_id.
+func (m *PostgresDBRepo) RepliesByCommentId(commentID int, limit int, offset int) ([]*models.Reply, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select id, comment_id, parent_id, user_id, depth, body, created_at, updated_at
+						from comment_replies
+						where comment_id = $1 and deleted_at is null
+						order by created_at, id
+						limit $2 offset $3`
+
+	rows, err := m.DB.QueryContext(ctx, query, commentID, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var replies []*models.Reply
+
+	for rows.Next() {
+		var reply models.Reply
+		var parentID sql.NullInt64
+		err := rows.Scan(
+			&reply.ID,
+			&reply.CommentId,
+			&parentID,
+			&reply.UserId,
+			&reply.Depth,
+			&reply.Body,
+			&reply.CreatedAt,
+			&reply.UpdatedAt,
+		)
+		if err != nil {
+			log.Println("Error scanning", err)
+			return nil, err
+		}
+
+		reply.ParentId = int(parentID.Int64)
+		replies = append(replies, &reply)
+	}
+
+	return replies, nil
+}
+
+func (m *PostgresDBRepo) UpdateReply(reply models.Reply) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `update comment_replies set body = $1, updated_at = $2 where id = $3 and deleted_at is null`
+
+	_, err := m.DB.ExecContext(ctx, stmt, reply.Body, time.Now(), reply.ID)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (m *PostgresDBRepo) DeleteReply(id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var commentID int
+	stmt := `update comment_replies set deleted_at = $1 where id = $2 and deleted_at is null returning comment_id`
+	err = tx.QueryRowContext(ctx, stmt, time.Now(), id).Scan(&commentID)
+	if err != nil {
+		return err
+	}
+
+	stmt = `update comments set reply_count = reply_count - 1 where id = $1`
+	_, err = tx.ExecContext(ctx, stmt, commentID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (m *PostgresDBRepo) InsertAttachment(attachment models.Attachment) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	var newID int
+	stmt := `insert into attachments (lesson_id, user_id, year, term, test_or_report, file_name, content_type, size, storage_key, created_at)
+		values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10) returning id`
+
+	err := m.DB.QueryRowContext(ctx, stmt,
+		attachment.LessonId,
+		attachment.UserId,
+		attachment.Year,
+		attachment.Term,
+		attachment.TestOrReport,
+		attachment.FileName,
+		attachment.ContentType,
+		attachment.Size,
+		attachment.StorageKey,
+		time.Now(),
+	).Scan(&newID)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return newID, nil
+}
+
+func (m *PostgresDBRepo) GetAttachmentByID(id int) (*models.Attachment, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `
+		select
+			a.id, a.lesson_id, a.user_id, a.year, a.term, a.test_or_report, a.file_name, a.content_type, a.size, a.storage_key, a.created_at
+		from attachments a
+		join lessons l on l.id = a.lesson_id
+		where
+		    a.id = $1 and l.deleted_at is null`
+
+	var attachment models.Attachment
+	row := m.DB.QueryRowContext(ctx, query, id)
+
+	err := row.Scan(
+		&attachment.ID,
+		&attachment.LessonId,
+		&attachment.UserId,
+		&attachment.Year,
+		&attachment.Term,
+		&attachment.TestOrReport,
+		&attachment.FileName,
+		&attachment.ContentType,
+		&attachment.Size,
+		&attachment.StorageKey,
+		&attachment.CreatedAt,
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &attachment, nil
+}
+
+// AttachmentsByLessonId returns the files shared on a lesson, newest
+// academic year first
+func (m *PostgresDBRepo) AttachmentsByLessonId(lessonID int) ([]*models.Attachment, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select a.id, a.lesson_id, a.user_id, a.year, a.term, a.test_or_report, a.file_name, a.content_type, a.size, a.storage_key, a.created_at
+						from attachments a
+						join lessons l on l.id = a.lesson_id
+						where a.lesson_id = $1 and l.deleted_at is null
+						order by a.year desc, a.term, a.id desc`
+
+	rows, err := m.DB.QueryContext(ctx, query, lessonID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var attachments []*models.Attachment
+
+	for rows.Next() {
+		var attachment models.Attachment
+		err := rows.Scan(
+			&attachment.ID,
+			&attachment.LessonId,
+			&attachment.UserId,
+			&attachment.Year,
+			&attachment.Term,
+			&attachment.TestOrReport,
+			&attachment.FileName,
+			&attachment.ContentType,
+			&attachment.Size,
+			&attachment.StorageKey,
+			&attachment.CreatedAt,
+		)
+		if err != nil {
+			log.Println("Error scanning", err)
+			return nil, err
+		}
+
+		attachments = append(attachments, &attachment)
+	}
+
+	return attachments, nil
+}
+
+func (m *PostgresDBRepo) DeleteAttachment(id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `delete from attachments where id = $1`
+
+	_, err := m.DB.ExecContext(ctx, stmt, id)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// RevokeSessions invalidates every token issued to a user so far and returns
+// the session version new tokens must carry
+func (m *PostgresDBRepo) RevokeSessions(userID int) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	var version int
+	stmt := `update users set session_version = session_version + 1, updated_at = $1
+		where id = $2 and deleted_at is null returning session_version`
+
+	err := m.DB.QueryRowContext(ctx, stmt, time.Now(), userID).Scan(&version)
+	if err != nil {
+		return 0, err
+	}
+
+	return version, nil
+}
+
+// ChangePassword sets a new password for a user and revokes their sessions
+// in the same update, so no token issued before the change keeps working
+// with the new password. It returns the new session version.
+func (m *PostgresDBRepo) ChangePassword(userID int, password string) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), 12)
+	if err != nil {
+		return 0, err
+	}
+
+	var version int
+	stmt := `update users set password = $1, session_version = session_version + 1, updated_at = $2
+		where id = $3 and deleted_at is null returning session_version`
+
+	err = m.DB.QueryRowContext(ctx, stmt, hashedPassword, time.Now(), userID).Scan(&version)
+	if err != nil {
+		return 0, err
+	}
+
+	return version, nil
+}
+
+// SetPendingImage records the avatar an upload will become once processed.
+// A later upload replaces it, so only the newest upload is ever applied.
+func (m *PostgresDBRepo) SetPendingImage(userID int, image string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `update users set pending_image = $1 where id = $2 and deleted_at is null`
+	res, err := m.DB.ExecContext(ctx, stmt, image, userID)
+	if err != nil {
+		return err
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+// ApplyPendingImage makes image the user's avatar if it is still the pending
+// one and returns the avatar it replaced. It returns sql.ErrNoRows when a
+// newer upload took its place or the user is gone. Only the image columns
+// are written, so changes made to the rest of the user meanwhile are kept.
+func (m *PostgresDBRepo) ApplyPendingImage(userID int, image string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `
+		with old as (
+			select id, image from users
+			where id = $1 and pending_image = $2 and deleted_at is null
+			for update
+		)
+		update users u set image = $2, pending_image = '', updated_at = $3
+		from old
+		where u.id = old.id
+		returning coalesce(old.image, '')`
+
+	var oldImage string
+	err := m.DB.QueryRowContext(ctx, stmt, userID, image, time.Now()).Scan(&oldImage)
+	if err != nil {
+		return "", err
+	}
+
+	return oldImage, nil
+}
+
+// InsertEmailChange stores a pending change of address. Only a hash of the
+// confirmation token is kept.
+func (m *PostgresDBRepo) InsertEmailChange(change models.EmailChange) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `insert into email_changes (user_id, new_email, token_hash, expires_at, created_at)
+		values ($1, $2, $3, $4, $5)`
+
+	_, err := m.DB.ExecContext(ctx, stmt,
+		change.UserId,
+		change.NewEmail,
+		change.TokenHash,
+		change.ExpiresAt,
+		time.Now(),
+	)
+
+	return err
+}
+
+// ConfirmEmailChange applies the pending change with the given token hash to
+// userID, drops the user's other pending changes and revokes their sessions.
+// It returns the new session version.
+func (m *PostgresDBRepo) ConfirmEmailChange(userID int, tokenHash string) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var newEmail string
+	query := `select new_email from email_changes
+		where user_id = $1 and token_hash = $2 and expires_at > $3
+		for update`
+
+	err = tx.QueryRowContext(ctx, query, userID, tokenHash, time.Now()).Scan(&newEmail)
+	if err != nil {
+		return 0, err
+	}
+
+	var taken bool
+	query = `select exists (select 1 from users where lower(email) = lower($1) and id <> $2 and deleted_at is null)`
+	err = tx.QueryRowContext(ctx, query, newEmail, userID).Scan(&taken)
+	if err != nil {
+		return 0, err
+	}
+	if taken {
+		return 0, repository.ErrEmailTaken
+	}
+
+	var version int
+	stmt := `update users set email = $1, session_version = session_version + 1, updated_at = $2
+		where id = $3 and deleted_at is null returning session_version`
+	err = tx.QueryRowContext(ctx, stmt, newEmail, time.Now(), userID).Scan(&version)
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = tx.ExecContext(ctx, `delete from email_changes where user_id = $1`, userID)
+	if err != nil {
+		return 0, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return 0, err
+	}
+
+	return version, nil
+}
+
+func (m *PostgresDBRepo) VotesByUserId(userID int) ([]*models.Vote, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select comment_id, helpful, created_at, updated_at
+						from comment_votes
+						where user_id = $1
+						order by id`
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var votes []*models.Vote
+
+	for rows.Next() {
+		var vote models.Vote
+		err := rows.Scan(
+			&vote.CommentId,
+			&vote.Helpful,
+			&vote.CreatedAt,
+			&vote.UpdatedAt,
+		)
+		if err != nil {
+			log.Println("Error scanning", err)
+			return nil, err
+		}
+
+		votes = append(votes, &vote)
+	}
+
+	return votes, nil
+}
+
+func (m *PostgresDBRepo) RepliesByUserId(userID int) ([]*models.Reply, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select id, comment_id, parent_id, user_id, depth, body, created_at, updated_at
+						from comment_replies
+						where user_id = $1 and deleted_at is null
+						order by id`
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var replies []*models.Reply
+
+	for rows.Next() {
+		var reply models.Reply
+		var parentID sql.NullInt64
+		err := rows.Scan(
+			&reply.ID,
+			&reply.CommentId,
+			&parentID,
+			&reply.UserId,
+			&reply.Depth,
+			&reply.Body,
+			&reply.CreatedAt,
+			&reply.UpdatedAt,
+		)
+		if err != nil {
+			log.Println("Error scanning", err)
+			return nil, err
+		}
+
+		reply.ParentId = int(parentID.Int64)
+		replies = append(replies, &reply)
+	}
+
+	return replies, nil
+}
+
+func (m *PostgresDBRepo) AttachmentsByUserId(userID int) ([]*models.Attachment, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select id, lesson_id, user_id, year, term, test_or_report, file_name, content_type, size, storage_key, created_at
+						from attachments
+						where user_id = $1
+						order by id`
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var attachments []*models.Attachment
+
+	for rows.Next() {
+		var attachment models.Attachment
+		err := rows.Scan(
+			&attachment.ID,
+			&attachment.LessonId,
+			&attachment.UserId,
+			&attachment.Year,
+			&attachment.Term,
+			&attachment.TestOrReport,
+			&attachment.FileName,
+			&attachment.ContentType,
+			&attachment.Size,
+			&attachment.StorageKey,
+			&attachment.CreatedAt,
+		)
+		if err != nil {
+			log.Println("Error scanning", err)
+			return nil, err
+		}
+
+		attachments = append(attachments, &attachment)
+	}
+
+	return attachments, nil
+}
+
+// AttachmentsOfDeletedLessons returns the attachments of lessons soft deleted
+// before the given time. They must go before PurgeDeleted can remove the
+// lessons themselves.
+func (m *PostgresDBRepo) AttachmentsOfDeletedLessons(before time.Time) ([]*models.Attachment, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select a.id, a.lesson_id, a.user_id, a.year, a.term, a.test_or_report, a.file_name, a.content_type, a.size, a.storage_key, a.created_at
+						from attachments a
+						join lessons l on l.id = a.lesson_id
+						where l.deleted_at < $1
+						order by a.id`
+
+	rows, err := m.DB.QueryContext(ctx, query, before)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var attachments []*models.Attachment
+
+	for rows.Next() {
+		var attachment models.Attachment
+		err := rows.Scan(
+			&attachment.ID,
+			&attachment.LessonId,
+			&attachment.UserId,
+			&attachment.Year,
+			&attachment.Term,
+			&attachment.TestOrReport,
+			&attachment.FileName,
+			&attachment.ContentType,
+			&attachment.Size,
+			&attachment.StorageKey,
+			&attachment.CreatedAt,
+		)
+		if err != nil {
+			log.Println("Error scanning", err)
+			return nil, err
+		}
+
+		attachments = append(attachments, &attachment)
+	}
+
+	return attachments, rows.Err()
+}
+
+// DeleteAccount closes a user's account at the user's own request. Personal
+// details are wiped and the account is soft deleted, so its content shows as
+// written by a deleted user. With cascade the user's reviews, replies, votes
+// and uploads are removed as well. It returns the lessons whose aggregates
+// must be recomputed.
+func (m *PostgresDBRepo) DeleteAccount(userID int, cascade bool) ([]int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+
+	stmt := `update users set
+		email = $1,
+		first_name = '',
+		last_name = '',
+		password = '',
+		image = '',
+		pending_image = '',
+		is_admin = 0,
+		show_real_name = false,
+		session_version = session_version + 1,
+		updated_at = $2,
+		deleted_at = $2
+		where id = $3 and deleted_at is null`
+
+	res, err := tx.ExecContext(ctx, stmt, fmt.Sprintf("deleted-%d@invalid", userID), now, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+	if affected == 0 {
+		return nil, sql.ErrNoRows
+	}
+
+	for _, stmt := range []string{
+		`delete from email_changes where user_id = $1`,
+		`delete from reports where user_id = $1`,
+		`update lessons l set favorite_count = l.favorite_count - 1
+			from user_favorites f
+			where f.user_id = $1 and f.lesson_id = l.id`,
+		`delete from user_favorites where user_id = $1`,
+		`delete from timetable_entries where user_id = $1`,
+		`delete from calendar_tokens where user_id = $1`,
+		`delete from lesson_recommendations where user_id = $1`,
+		`delete from lesson_follows where user_id = $1`,
+		`delete from teacher_follows where user_id = $1`,
+		`delete from notifications where user_id = $1`,
+		`delete from digest_preferences where user_id = $1`,
+	} {
+		_, err = tx.ExecContext(ctx, stmt, userID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var lessonIDs []int
+	if cascade {
+		rows, err := tx.QueryContext(ctx, `update comments set deleted_at = $1
+			where user_id = $2 and deleted_at is null
+			returning lesson_id`, now, userID)
+		if err != nil {
+			return nil, err
+		}
+
+		seen := make(map[int]bool)
+		for rows.Next() {
+			var lessonID int
+			err = rows.Scan(&lessonID)
+			if err != nil {
+				rows.Close()
+				return nil, err
+			}
+			if !seen[lessonID] {
+				seen[lessonID] = true
+				lessonIDs = append(lessonIDs, lessonID)
+			}
+		}
+		rows.Close()
+
+		stmts := []struct {
+			query string
+			args  []interface{}
+		}{
+			{`update comments c set reply_count = c.reply_count - r.n
+				from (select comment_id, count(*) as n from comment_replies
+					where user_id = $1 and deleted_at is null group by comment_id) r
+				where c.id = r.comment_id`, []interface{}{userID}},
+			{`update comment_replies set deleted_at = $1 where user_id = $2 and deleted_at is null`, []interface{}{now, userID}},
+			{`update comments c set
+				helpful_count = c.helpful_count - v.helpful,
+				unhelpful_count = c.unhelpful_count - v.unhelpful
+				from (select comment_id,
+						count(*) filter (where helpful) as helpful,
+						count(*) filter (where not helpful) as unhelpful
+					from comment_votes where user_id = $1 group by comment_id) v
+				where c.id = v.comment_id`, []interface{}{userID}},
+			{`delete from comment_votes where user_id = $1`, []interface{}{userID}},
+			{`delete from attachments where user_id = $1`, []interface{}{userID}},
+		}
+		for _, stmt := range stmts {
+			_, err = tx.ExecContext(ctx, stmt.query, stmt.args...)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, lessonID := range lessonIDs {
+		m.invalidateLessonStats(lessonID)
+	}
+
+	return lessonIDs, nil
+}
+
+// AddFavorite bookmarks a lesson for a user. Adding a lesson that is already a
+// favorite is a no-op.
+func (m *PostgresDBRepo) AddFavorite(userID int, lessonID int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var exists bool
+	err = tx.QueryRowContext(ctx, `select true from lessons where id = $1 and deleted_at is null`, lessonID).Scan(&exists)
+	if err != nil {
+		return err
+	}
+
+	stmt := `insert into user_favorites (user_id, lesson_id, created_at)
+		values ($1, $2, $3)
+		on conflict (user_id, lesson_id) do nothing`
+
+	res, err := tx.ExecContext(ctx, stmt, userID, lessonID, time.Now())
+	if err != nil {
+		return err
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if affected > 0 {
+		_, err = tx.ExecContext(ctx, `update lessons set favorite_count = favorite_count + 1 where id = $1`, lessonID)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// RemoveFavorite removes a lesson from a user's favorites. Removing a lesson
+// that is not a favorite is a no-op.
+func (m *PostgresDBRepo) RemoveFavorite(userID int, lessonID int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx, `delete from user_favorites where user_id = $1 and lesson_id = $2`, userID, lessonID)
+	if err != nil {
+		return err
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if affected > 0 {
+		_, err = tx.ExecContext(ctx, `update lessons set favorite_count = favorite_count - 1 where id = $1`, lessonID)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// FavoriteLessons returns a user's favorite lessons, most recently added first
+func (m *PostgresDBRepo) FavoriteLessons(userID int) ([]*models.Lesson, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select l.id, l.user_id, l.lesson_name, l.teacher_name, l.department, l.avg_star, l.about_avg_star, l.comment_numbers, l.favorite_count, l.created_at, l.updated_at
+						from user_favorites f
+						join lessons l on l.id = f.lesson_id
+						where f.user_id = $1 and l.deleted_at is null
+						order by f.created_at desc, f.id desc`
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var lessons []*models.Lesson
+
+	for rows.Next() {
+		var lesson models.Lesson
+		err := rows.Scan(
+			&lesson.ID,
+			&lesson.UserId,
+			&lesson.LessonName,
+			&lesson.TeacherName,
+			&lesson.Department,
+			&lesson.AvgStar,
+			&lesson.AboutAvgStar,
+			&lesson.CommentNumbers,
+			&lesson.FavoriteCount,
+			&lesson.CreatedAt,
+			&lesson.UpdatedAt,
+		)
+		if err != nil {
+			log.Println("Error scanning", err)
+			return nil, err
+		}
+
+		lessons = append(lessons, &lesson)
+	}
+
+	return lessons, nil
+}
+
+// FavoritedLessons reports which of the given lessons the user has favorited
+func (m *PostgresDBRepo) FavoritedLessons(userID int, lessonIDs []int) (map[int]bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	favorited := make(map[int]bool)
+	if len(lessonIDs) == 0 {
+		return favorited, nil
+	}
+
+	idList := make([]string, len(lessonIDs))
+	for i, id := range lessonIDs {
+		idList[i] = strconv.Itoa(id)
+	}
+
+	query := `select lesson_id from user_favorites where user_id = $1 and lesson_id = any($2::integer[])`
+
+	rows, err := m.DB.QueryContext(ctx, query, userID, "{"+strings.Join(idList, ",")+"}")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var lessonID int
+		err := rows.Scan(&lessonID)
+		if err != nil {
+			log.Println("Error scanning", err)
+			return nil, err
+		}
+
+		favorited[lessonID] = true
+	}
+
+	return favorited, nil
+}
+
+// UpsertOffering creates the offering of a lesson for a year and term, or
+// updates its credits and replaces its periods if it already exists
+func (m *PostgresDBRepo) UpsertOffering(offering models.Offering) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var id int
+	stmt := `insert into lesson_offerings (lesson_id, year, term, credits, created_at, updated_at)
+		values ($1, $2, $3, $4, $5, $5)
+		on conflict (lesson_id, year, term) do update set
+			credits = excluded.credits,
+			updated_at = excluded.updated_at
+		returning id`
+
+	err = tx.QueryRowContext(ctx, stmt,
+		offering.LessonId,
+		offering.Year,
+		offering.Term,
+		offering.Credits,
+		time.Now(),
+	).Scan(&id)
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = tx.ExecContext(ctx, `delete from offering_slots where offering_id = $1`, id)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, slot := range offering.Slots {
+		_, err = tx.ExecContext(ctx, `insert into offering_slots (offering_id, day, period) values ($1, $2, $3)
+			on conflict do nothing`, id, slot.Day, slot.Period)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return 0, err
+	}
+
+	return id, nil
+}
+
+func (m *PostgresDBRepo) GetOfferingByID(id int) (*models.Offering, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select o.id, o.lesson_id, o.year, o.term, o.credits, o.created_at, o.updated_at
+						from lesson_offerings o
+						join lessons l on l.id = o.lesson_id
+						where o.id = $1 and l.deleted_at is null`
+
+	var offering models.Offering
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+		&offering.ID,
+		&offering.LessonId,
+		&offering.Year,
+		&offering.Term,
+		&offering.Credits,
+		&offering.CreatedAt,
+		&offering.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	err = m.loadSlots(ctx, m.DB, []*models.Offering{&offering})
+	if err != nil {
+		return nil, err
+	}
+
+	return &offering, nil
+}
+
+// OfferingsByLessonId returns the offerings of a lesson, newest year first
+func (m *PostgresDBRepo) OfferingsByLessonId(lessonID int) ([]*models.Offering, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select id, lesson_id, year, term, credits, created_at, updated_at
+						from lesson_offerings
+						where lesson_id = $1
+						order by year desc, term, id`
+
+	rows, err := m.DB.QueryContext(ctx, query, lessonID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var offerings []*models.Offering
+
+	for rows.Next() {
+		var offering models.Offering
+		err := rows.Scan(
+			&offering.ID,
+			&offering.LessonId,
+			&offering.Year,
+			&offering.Term,
+			&offering.Credits,
+			&offering.CreatedAt,
+			&offering.UpdatedAt,
+		)
+		if err != nil {
+			log.Println("Error scanning", err)
+			return nil, err
+		}
+
+		offerings = append(offerings, &offering)
+	}
+
+	err = m.loadSlots(ctx, m.DB, offerings)
+	if err != nil {
+		return nil, err
+	}
+
+	return offerings, nil
+}
+
+// DeleteOffering removes an offering along with its periods and every
+// timetable entry for it
+func (m *PostgresDBRepo) DeleteOffering(id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	res, err := m.DB.ExecContext(ctx, `delete from lesson_offerings where id = $1`, id)
+	if err != nil {
+		return err
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+// loadSlots fills in the weekly periods of the offerings
+func (m *PostgresDBRepo) loadSlots(ctx context.Context, q queryer, offerings []*models.Offering) error {
+	if len(offerings) == 0 {
+		return nil
+	}
+
+	byID := make(map[int]*models.Offering, len(offerings))
+	idList := make([]string, 0, len(offerings))
+	for _, offering := range offerings {
+		offering.Slots = []models.Slot{}
+		byID[offering.ID] = offering
+		idList = append(idList, strconv.Itoa(offering.ID))
+	}
+
+	query := `select offering_id, day, period
+						from offering_slots
+						where offering_id = any($1::integer[])
+						order by day, period`
+
+	rows, err := q.QueryContext(ctx, query, "{"+strings.Join(idList, ",")+"}")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var offeringID int
+		var slot models.Slot
+		err := rows.Scan(&offeringID, &slot.Day, &slot.Period)
+		if err != nil {
+			log.Println("Error scanning", err)
+			return err
+		}
+
+		byID[offeringID].Slots = append(byID[offeringID].Slots, slot)
+	}
+
+	return rows.Err()
+}
+
+// Timetable returns the lessons a user picked for a year and term
+func (m *PostgresDBRepo) Timetable(userID int, year int, term string) ([]*models.TimetableEntry, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	return m.timetableEntries(ctx, m.DB, `t.user_id = $1 and o.year = $2 and o.term = $3`, userID, year, term)
+}
+
+// TimetablesByUserId returns the timetable entries of a user for every term
+func (m *PostgresDBRepo) TimetablesByUserId(userID int) ([]*models.TimetableEntry, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	return m.timetableEntries(ctx, m.DB, `t.user_id = $1`, userID)
+}
+
+func (m *PostgresDBRepo) timetableEntries(ctx context.Context, q queryer, where string, args ...interface{}) ([]*models.TimetableEntry, error) {
+	query := `select o.id, o.lesson_id, o.year, o.term, o.credits, o.created_at, o.updated_at,
+							l.id, l.user_id, l.lesson_name, l.teacher_name, l.department, l.avg_star, l.about_avg_star, l.comment_numbers, l.favorite_count, l.created_at, l.updated_at,
+							t.created_at
+						from timetable_entries t
+						join lesson_offerings o on o.id = t.offering_id
+						join lessons l on l.id = o.lesson_id
+						where ` + where + ` and l.deleted_at is null
+						order by o.year, o.term, t.created_at, t.id`
+
+	rows, err := q.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []*models.TimetableEntry
+	var offerings []*models.Offering
+
+	for rows.Next() {
+		var offering models.Offering
+		var lesson models.Lesson
+		var entry models.TimetableEntry
+		err := rows.Scan(
+			&offering.ID,
+			&offering.LessonId,
+			&offering.Year,
+			&offering.Term,
+			&offering.Credits,
+			&offering.CreatedAt,
+			&offering.UpdatedAt,
+			&lesson.ID,
+			&lesson.UserId,
+			&lesson.LessonName,
+			&lesson.TeacherName,
+			&lesson.Department,
+			&lesson.AvgStar,
+			&lesson.AboutAvgStar,
+			&lesson.CommentNumbers,
+			&lesson.FavoriteCount,
+			&lesson.CreatedAt,
+			&lesson.UpdatedAt,
+			&entry.AddedAt,
+		)
+		if err != nil {
+			log.Println("Error scanning", err)
+			return nil, err
+		}
+
+		entry.Offering = &offering
+		entry.Lesson = &lesson
+		entries = append(entries, &entry)
+		offerings = append(offerings, &offering)
+	}
+	rows.Close()
+
+	err = m.loadSlots(ctx, q, offerings)
+	if err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+// AddTimetableEntry puts an offering in a user's timetable. Adding it twice is
+// a no-op.
+// AddTimetableEntry adds an offering to a user's timetable once check has
+// accepted the entries the user already has that term. The user row stays
+// locked from reading those entries until the insert commits, so two adds at
+// once cannot both pass check. An error from check is returned as it is.
+func (m *PostgresDBRepo) AddTimetableEntry(userID int, offering *models.Offering, check func(entries []*models.TimetableEntry) error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var id int
+	err = tx.QueryRowContext(ctx, `select id from users where id = $1 and deleted_at is null for update`, userID).Scan(&id)
+	if err != nil {
+		return err
+	}
+
+	entries, err := m.timetableEntries(ctx, tx, `t.user_id = $1 and o.year = $2 and o.term = $3`, userID, offering.Year, offering.Term)
+	if err != nil {
+		return err
+	}
+
+	err = check(entries)
+	if err != nil {
+		return err
+	}
+
+	stmt := `insert into timetable_entries (user_id, offering_id, created_at)
+		values ($1, $2, $3)
+		on conflict (user_id, offering_id) do nothing`
+
+	_, err = tx.ExecContext(ctx, stmt, userID, offering.ID, time.Now())
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (m *PostgresDBRepo) RemoveTimetableEntry(userID int, offeringID int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	res, err := m.DB.ExecContext(ctx, `delete from timetable_entries where user_id = $1 and offering_id = $2`, userID, offeringID)
+	if err != nil {
+		return err
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+// UpsertAcademicTerm sets the first and last day of a term
+func (m *PostgresDBRepo) UpsertAcademicTerm(term models.AcademicTerm) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `insert into academic_terms (year, term, starts_on, ends_on, created_at, updated_at)
+		values ($1, $2, $3, $4, $5, $5)
+		on conflict (year, term) do update set
+			starts_on = excluded.starts_on,
+			ends_on = excluded.ends_on,
+			updated_at = excluded.updated_at`
+
+	_, err := m.DB.ExecContext(ctx, stmt,
+		term.Year,
+		term.Term,
+		term.StartsOn,
+		term.EndsOn,
+		time.Now(),
+	)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (m *PostgresDBRepo) AcademicTerms() ([]*models.AcademicTerm, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select year, term, starts_on, ends_on
+						from academic_terms
+						order by year, starts_on`
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var terms []*models.AcademicTerm
+
+	for rows.Next() {
+		var term models.AcademicTerm
+		err := rows.Scan(
+			&term.Year,
+			&term.Term,
+			&term.StartsOn,
+			&term.EndsOn,
+		)
+		if err != nil {
+			log.Println("Error scanning", err)
+			return nil, err
+		}
+
+		terms = append(terms, &term)
+	}
+
+	return terms, nil
+}
+
+// SetCalendarToken stores the token of a user's calendar subscription,
+// replacing any earlier one
+func (m *PostgresDBRepo) SetCalendarToken(userID int, tokenHash string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `insert into calendar_tokens (user_id, token_hash, created_at)
+		values ($1, $2, $3)
+		on conflict (user_id) do update set
+			token_hash = excluded.token_hash,
+			created_at = excluded.created_at`
+
+	_, err := m.DB.ExecContext(ctx, stmt, userID, tokenHash, time.Now())
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// GetUserIDByCalendarToken returns the user a calendar subscription belongs to
+func (m *PostgresDBRepo) GetUserIDByCalendarToken(tokenHash string) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select c.user_id
+						from calendar_tokens c
+						join users u on u.id = c.user_id
+						where c.token_hash = $1 and u.deleted_at is null`
+
+	var userID int
+	err := m.DB.QueryRowContext(ctx, query, tokenHash).Scan(&userID)
+	if err != nil {
+		return 0, err
+	}
+
+	return userID, nil
+}
+
+// LessonRatings returns the stars of every visible review of a lesson that is
+// not deleted, by a user who is not deleted
+func (m *PostgresDBRepo) LessonRatings() ([]*models.Rating, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select c.user_id, c.lesson_id, c.star, coalesce(c.test_or_report, ''), c.year, c.term, c.created_at
+						from comments c
+						join users u on u.id = c.user_id
+						join lessons l on l.id = c.lesson_id
+						where c.deleted_at is null and c.moderation_status = $1
+							and u.deleted_at is null and l.deleted_at is null
+						order by c.id`
+
+	rows, err := m.DB.QueryContext(ctx, query, models.CommentVisible)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ratings []*models.Rating
+
+	for rows.Next() {
+		var rating models.Rating
+		err := rows.Scan(
+			&rating.UserId,
+			&rating.LessonId,
+			&rating.Star,
+			&rating.TestOrReport,
+			&rating.Year,
+			&rating.Term,
+			&rating.CreatedAt,
+		)
+		if err != nil {
+			log.Println("Error scanning", err)
+			return nil, err
+		}
+
+		ratings = append(ratings, &rating)
+	}
+
+	return ratings, nil
+}
+
+// AllFavorites returns the favorites of users and lessons that are not deleted
+func (m *PostgresDBRepo) AllFavorites() ([]*models.Favorite, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select f.user_id, f.lesson_id, f.created_at
+						from user_favorites f
+						join users u on u.id = f.user_id
+						join lessons l on l.id = f.lesson_id
+						where u.deleted_at is null and l.deleted_at is null
+						order by f.id`
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var favorites []*models.Favorite
+
+	for rows.Next() {
+		var favorite models.Favorite
+		err := rows.Scan(
+			&favorite.UserId,
+			&favorite.LessonId,
+			&favorite.CreatedAt,
+		)
+		if err != nil {
+			log.Println("Error scanning", err)
+			return nil, err
+		}
+
+		favorites = append(favorites, &favorite)
+	}
+
+	return favorites, nil
+}
+
+// insertBatchSize is how many rows are written per insert when a table is
+// refilled
+const insertBatchSize = 500
+
+// insertBatches inserts rows with multi-row inserts of up to insertBatchSize
+// rows each. The statement is completed with the values of each batch.
+func insertBatches(ctx context.Context, tx *sql.Tx, stmt string, rows [][]interface{}) error {
+	for start := 0; start < len(rows); start += insertBatchSize {
+		end := start + insertBatchSize
+		if end > len(rows) {
+			end = len(rows)
+		}
+
+		var values []string
+		var args []interface{}
+		for _, row := range rows[start:end] {
+			placeholders := make([]string, len(row))
+			for i := range row {
+				placeholders[i] = fmt.Sprintf("$%d", len(args)+i+1)
+			}
+			values = append(values, "("+strings.Join(placeholders, ", ")+")")
+			args = append(args, row...)
+		}
+
+		_, err := tx.ExecContext(ctx, stmt+" values "+strings.Join(values, ", "), args...)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ReplaceRecommendations swaps all stored recommendations for a freshly
+// computed set in one transaction, so readers never see a partial set
+func (m *PostgresDBRepo) ReplaceRecommendations(recommendations []*models.Recommendation) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout*10)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `delete from lesson_recommendations`)
+	if err != nil {
+		return err
+	}
+
+	rows := make([][]interface{}, 0, len(recommendations))
+	for _, recommendation := range recommendations {
+		var sourceLessonID sql.NullInt64
+		if recommendation.SourceLessonId != 0 {
+			sourceLessonID = sql.NullInt64{Int64: int64(recommendation.SourceLessonId), Valid: true}
+		}
+		rows = append(rows, []interface{}{
+			recommendation.UserId,
+			recommendation.LessonId,
+			recommendation.Score,
+			recommendation.Reason,
+			sourceLessonID,
+			recommendation.ComputedAt,
+		})
+	}
+
+	err = insertBatches(ctx, tx, `insert into lesson_recommendations (user_id, lesson_id, score, reason, source_lesson_id, computed_at)`, rows)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// RecommendationsByUserId returns a user's recommendations, best first.
+// Lessons the user reviewed or favorited since they were computed are left out.
+func (m *PostgresDBRepo) RecommendationsByUserId(userID int, limit int, offset int) ([]*models.Recommendation, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select r.user_id, r.lesson_id, r.score, r.reason, r.source_lesson_id, r.computed_at,
+							l.id, l.user_id, l.lesson_name, l.teacher_name, l.department, l.avg_star, l.about_avg_star, l.comment_numbers, l.favorite_count, l.created_at, l.updated_at
+						from lesson_recommendations r
+						join lessons l on l.id = r.lesson_id
+						where r.user_id = $1 and l.deleted_at is null
+							and not exists (select 1 from comments c
+								where c.user_id = r.user_id and c.lesson_id = r.lesson_id and c.deleted_at is null)
+							and not exists (select 1 from user_favorites f
+								where f.user_id = r.user_id and f.lesson_id = r.lesson_id)
+						order by r.score desc, r.lesson_id
+						limit $2 offset $3`
+
+	rows, err := m.DB.QueryContext(ctx, query, userID, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var recommendations []*models.Recommendation
+
+	for rows.Next() {
+		var recommendation models.Recommendation
+		var lesson models.Lesson
+		var sourceLessonID sql.NullInt64
+		err := rows.Scan(
+			&recommendation.UserId,
+			&recommendation.LessonId,
+			&recommendation.Score,
+			&recommendation.Reason,
+			&sourceLessonID,
+			&recommendation.ComputedAt,
+			&lesson.ID,
+			&lesson.UserId,
+			&lesson.LessonName,
+			&lesson.TeacherName,
+			&lesson.Department,
+			&lesson.AvgStar,
+			&lesson.AboutAvgStar,
+			&lesson.CommentNumbers,
+			&lesson.FavoriteCount,
+			&lesson.CreatedAt,
+			&lesson.UpdatedAt,
+		)
+		if err != nil {
+			log.Println("Error scanning", err)
+			return nil, err
+		}
+
+		recommendation.SourceLessonId = int(sourceLessonID.Int64)
+		recommendation.Lesson = &lesson
+		recommendations = append(recommendations, &recommendation)
+	}
+
+	return recommendations, nil
+}
+
+// rankingOrder sorts lessons by one of their overall ranking scores, with
+// lessons that were not ranked yet last
+func rankingOrder(score string) string {
+	return `(select r.` + score + ` from lesson_rankings r
+		where r.lesson_id = lessons.id and r.year = 0 and r.term = '') desc nulls last, id`
+}
+
+// ReplaceLessonRankings swaps all stored ranking scores for a freshly
+// computed set in one transaction
+func (m *PostgresDBRepo) ReplaceLessonRankings(rankings []*models.LessonRanking) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout*10)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `delete from lesson_rankings`)
+	if err != nil {
+		return err
+	}
+
+	rows := make([][]interface{}, 0, len(rankings))
+	for _, ranking := range rankings {
+		rows = append(rows, []interface{}{
+			ranking.LessonId,
+			ranking.Year,
+			ranking.Term,
+			ranking.BayesStar,
+			ranking.TrendingScore,
+			ranking.CommentNumbers,
+			ranking.ComputedAt,
+		})
+	}
+
+	err = insertBatches(ctx, tx, `insert into lesson_rankings (lesson_id, year, term, bayes_star, trending_score, comment_numbers, computed_at)`, rows)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// LessonRankings returns a leaderboard: the overall one, or the one of a year
+// and term when the filter has them, optionally for one department only
+func (m *PostgresDBRepo) LessonRankings(filter models.RankingFilter) ([]*models.LessonRanking, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select r.lesson_id, r.year, r.term, r.bayes_star, r.trending_score, r.comment_numbers, r.computed_at,
+							l.id, l.user_id, l.lesson_name, l.teacher_name, l.department, l.avg_star, l.about_avg_star, l.comment_numbers, l.favorite_count, l.created_at, l.updated_at
+						from lesson_rankings r
+						join lessons l on l.id = r.lesson_id
+						where l.deleted_at is null and r.year = $1 and r.term = $2
+							and ($3 = '' or l.department = $3)
+							%s
+						order by %s
+						limit $4 offset $5`
+
+	if filter.Sort == models.RankingTrending {
+		query = fmt.Sprintf(query, "and r.trending_score > 0", "r.trending_score desc, r.bayes_star desc, r.lesson_id")
+	} else {
+		query = fmt.Sprintf(query, "and r.comment_numbers > 0", "r.bayes_star desc, r.comment_numbers desc, r.lesson_id")
+	}
+
+	rows, err := m.DB.QueryContext(ctx, query, filter.Year, filter.Term, filter.Department, filter.Limit, filter.Offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var rankings []*models.LessonRanking
+
+	for rows.Next() {
+		var ranking models.LessonRanking
+		var lesson models.Lesson
+		err := rows.Scan(
+			&ranking.LessonId,
+			&ranking.Year,
+			&ranking.Term,
+			&ranking.BayesStar,
+			&ranking.TrendingScore,
+			&ranking.CommentNumbers,
+			&ranking.ComputedAt,
+			&lesson.ID,
+			&lesson.UserId,
+			&lesson.LessonName,
+			&lesson.TeacherName,
+			&lesson.Department,
+			&lesson.AvgStar,
+			&lesson.AboutAvgStar,
+			&lesson.CommentNumbers,
+			&lesson.FavoriteCount,
+			&lesson.CreatedAt,
+			&lesson.UpdatedAt,
+		)
+		if err != nil {
+			log.Println("Error scanning", err)
+			return nil, err
+		}
+
+		ranking.Rank = filter.Offset + len(rankings) + 1
+		ranking.Lesson = &lesson
+		rankings = append(rankings, &ranking)
+	}
+
+	return rankings, nil
+}
+
+// FollowLesson makes a user follow a lesson. It returns sql.ErrNoRows if the
+// lesson does not exist; following a lesson twice is a no-op.
+func (m *PostgresDBRepo) FollowLesson(userID int, lessonID int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	var exists bool
+	err := m.DB.QueryRowContext(ctx, `select true from lessons where id = $1 and deleted_at is null`, lessonID).Scan(&exists)
+	if err != nil {
+		return err
+	}
+
+	stmt := `insert into lesson_follows (user_id, lesson_id, created_at)
+		values ($1, $2, $3)
+		on conflict (user_id, lesson_id) do nothing`
+
+	_, err = m.DB.ExecContext(ctx, stmt, userID, lessonID, time.Now())
+	return err
+}
+
+// UnfollowLesson stops a user following a lesson
+func (m *PostgresDBRepo) UnfollowLesson(userID int, lessonID int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, `delete from lesson_follows where user_id = $1 and lesson_id = $2`, userID, lessonID)
+	return err
+}
+
+// FollowTeacher makes a user follow a teacher by name. It returns
+// sql.ErrNoRows if no lesson is taught by that name.
+func (m *PostgresDBRepo) FollowTeacher(userID int, teacherName string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	var exists bool
+	err := m.DB.QueryRowContext(ctx, `select true from lessons where teacher_name = $1 and deleted_at is null limit 1`, teacherName).Scan(&exists)
+	if err != nil {
+		return err
+	}
+
+	stmt := `insert into teacher_follows (user_id, teacher_name, created_at)
+		values ($1, $2, $3)
+		on conflict (user_id, teacher_name) do nothing`
+
+	_, err = m.DB.ExecContext(ctx, stmt, userID, teacherName, time.Now())
+	return err
+}
+
+// UnfollowTeacher stops a user following a teacher
+func (m *PostgresDBRepo) UnfollowTeacher(userID int, teacherName string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, `delete from teacher_follows where user_id = $1 and teacher_name = $2`, userID, teacherName)
+	return err
+}
+
+// FollowsByUserId returns the lessons and teachers a user follows, most
+// recently followed first
+func (m *PostgresDBRepo) FollowsByUserId(userID int) (*models.Follows, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select l.id, l.user_id, l.lesson_name, l.teacher_name, l.department, l.avg_star, l.about_avg_star, l.comment_numbers, l.favorite_count, l.created_at, l.updated_at
+						from lesson_follows f
+						join lessons l on l.id = f.lesson_id
+						where f.user_id = $1 and l.deleted_at is null
+						order by f.created_at desc, f.id desc`
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	follows := models.Follows{Lessons: []*models.Lesson{}, Teachers: []string{}}
+
+	for rows.Next() {
+		var lesson models.Lesson
+		err := rows.Scan(
+			&lesson.ID,
+			&lesson.UserId,
+			&lesson.LessonName,
+			&lesson.TeacherName,
+			&lesson.Department,
+			&lesson.AvgStar,
+			&lesson.AboutAvgStar,
+			&lesson.CommentNumbers,
+			&lesson.FavoriteCount,
+			&lesson.CreatedAt,
+			&lesson.UpdatedAt,
+		)
+		if err != nil {
+			log.Println("Error scanning", err)
+			return nil, err
+		}
+
+		follows.Lessons = append(follows.Lessons, &lesson)
+	}
+
+	teacherRows, err := m.DB.QueryContext(ctx, `select teacher_name from teacher_follows where user_id = $1 order by created_at desc, id desc`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer teacherRows.Close()
+
+	for teacherRows.Next() {
+		var teacherName string
+		err := teacherRows.Scan(&teacherName)
+		if err != nil {
+			log.Println("Error scanning", err)
+			return nil, err
+		}
+
+		follows.Teachers = append(follows.Teachers, teacherName)
+	}
+
+	return &follows, nil
+}
+
+// FanOutNotifications writes a notification of the event to every active user
+// following its lesson (new reviews) or the teacher of its lesson (new
+// classes), except the user who caused it, and returns how many were written
+func (m *PostgresDBRepo) FanOutNotifications(event models.FollowEvent) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	var stmt string
+	switch event.Kind {
+	case models.NotificationNewReview:
+		stmt = `insert into notifications (user_id, kind, lesson_id, comment_id, offering_id, created_at)
+			select f.user_id, $1, f.lesson_id, $3, $4, $6
+			from lesson_follows f
+			join users u on u.id = f.user_id
+			where f.lesson_id = $2 and f.user_id <> $5 and u.deleted_at is null`
+	case models.NotificationNewClass:
+		stmt = `insert into notifications (user_id, kind, lesson_id, comment_id, offering_id, created_at)
+			select f.user_id, $1, l.id, $3, $4, $6
+			from lessons l
+			join teacher_follows f on f.teacher_name = l.teacher_name
+			join users u on u.id = f.user_id
+			where l.id = $2 and f.user_id <> $5 and u.deleted_at is null`
+	default:
+		return 0, fmt.Errorf("unknown notification kind %q", event.Kind)
+	}
+
+	var commentID, offeringID sql.NullInt64
+	if event.CommentId != 0 {
+		commentID = sql.NullInt64{Int64: int64(event.CommentId), Valid: true}
+	}
+	if event.OfferingId != 0 {
+		offeringID = sql.NullInt64{Int64: int64(event.OfferingId), Valid: true}
+	}
+
+	res, err := m.DB.ExecContext(ctx, stmt, event.Kind, event.LessonId, commentID, offeringID, event.ActorId, time.Now())
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
+
+// NotificationsByUserId returns a page of a user's notifications, newest
+// first, with their lessons
+func (m *PostgresDBRepo) NotificationsByUserId(userID int, unreadOnly bool, limit int, offset int) ([]*models.Notification, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select n.id, n.user_id, n.kind, n.lesson_id, coalesce(n.comment_id, 0), coalesce(n.offering_id, 0), n.read_at, n.created_at,
+							l.id, l.user_id, l.lesson_name, l.teacher_name, l.department, l.avg_star, l.about_avg_star, l.comment_numbers, l.favorite_count, l.created_at, l.updated_at
+						from notifications n
+						join lessons l on l.id = n.lesson_id
+						where n.user_id = $1 and l.deleted_at is null and (not $2 or n.read_at is null)
+						order by n.created_at desc, n.id desc
+						limit $3 offset $4`
+
+	rows, err := m.DB.QueryContext(ctx, query, userID, unreadOnly, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var notifications []*models.Notification
+
+	for rows.Next() {
+		var notification models.Notification
+		var lesson models.Lesson
+		var readAt sql.NullTime
+		err := rows.Scan(
+			&notification.ID,
+			&notification.UserId,
+			&notification.Kind,
+			&notification.LessonId,
+			&notification.CommentId,
+			&notification.OfferingId,
+			&readAt,
+			&notification.CreatedAt,
+			&lesson.ID,
+			&lesson.UserId,
+			&lesson.LessonName,
+			&lesson.TeacherName,
+			&lesson.Department,
+			&lesson.AvgStar,
+			&lesson.AboutAvgStar,
+			&lesson.CommentNumbers,
+			&lesson.FavoriteCount,
+			&lesson.CreatedAt,
+			&lesson.UpdatedAt,
+		)
+		if err != nil {
+			log.Println("Error scanning", err)
+			return nil, err
+		}
+
+		if readAt.Valid {
+			notification.ReadAt = &readAt.Time
+		}
+		notification.Lesson = &lesson
+		notifications = append(notifications, &notification)
+	}
+
+	return notifications, nil
+}
+
+// UnreadNotificationCount returns how many of a user's notifications are unread
+func (m *PostgresDBRepo) UnreadNotificationCount(userID int) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select count(*)
+						from notifications n
+						join lessons l on l.id = n.lesson_id
+						where n.user_id = $1 and n.read_at is null and l.deleted_at is null`
+
+	var count int
+	err := m.DB.QueryRowContext(ctx, query, userID).Scan(&count)
+	if err != nil {
+		return 0, err
+	}
+
+	return count, nil
+}
+
+// MarkNotificationsRead marks one of a user's notifications read, or all of
+// them when id is 0. It returns sql.ErrNoRows if the user has no
+// notification with that id.
+func (m *PostgresDBRepo) MarkNotificationsRead(userID int, id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	if id == 0 {
+		_, err := m.DB.ExecContext(ctx, `update notifications set read_at = $2 where user_id = $1 and read_at is null`, userID, time.Now())
+		return err
+	}
+
+	stmt := `update notifications set read_at = coalesce(read_at, $3) where id = $1 and user_id = $2`
+
+	res, err := m.DB.ExecContext(ctx, stmt, id, userID, time.Now())
+	if err != nil {
+		return err
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+// Notify sends a payload to everyone listening on a Postgres channel
+func (m *PostgresDBRepo) Notify(channel string, payload string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, `select pg_notify($1, $2)`, channel, payload)
+	return err
+}
+
+// Listen calls handle with the payload of every notification on a Postgres
+// channel. It holds a connection of its own and only returns when ctx is done
+// or the connection fails.
+func (m *PostgresDBRepo) Listen(ctx context.Context, channel string, handle func(payload string)) error {
+	conn, err := m.DB.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	return conn.Raw(func(driverConn interface{}) error {
+		pgxConn := driverConn.(*stdlib.Conn).Conn()
+
+		_, err := pgxConn.Exec(ctx, "listen "+pgx.Identifier{channel}.Sanitize())
+		if err != nil {
+			return err
+		}
+		// a connection that is still listening must not go back to the pool
+		defer pgxConn.Close(context.Background())
+
+		for {
+			notification, err := pgxConn.WaitForNotification(ctx)
+			if err != nil {
+				return err
+			}
+
+			handle(notification.Payload)
+		}
+	})
+}
+
+// InsertWebhook adds a webhook and returns its id
+func (m *PostgresDBRepo) InsertWebhook(webhook models.Webhook) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `insert into webhooks (url, secret, event_types, active, created_at, updated_at)
+		values ($1, $2, $3, $4, $5, $5) returning id`
+
+	var newID int
+	err := m.DB.QueryRowContext(ctx, stmt,
+		webhook.URL,
+		webhook.Secret,
+		strings.Join(webhook.EventTypes, ","),
+		webhook.Active,
+		time.Now(),
+	).Scan(&newID)
+	if err != nil {
+		return 0, err
+	}
+
+	return newID, nil
+}
+
+// UpdateWebhook changes a webhook; its secret is kept when webhook.Secret is
+// empty. It returns sql.ErrNoRows if the webhook does not exist.
+func (m *PostgresDBRepo) UpdateWebhook(webhook models.Webhook) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `update webhooks set
+			url = $2,
+			secret = coalesce(nullif($3, ''), secret),
+			event_types = $4,
+			active = $5,
+			updated_at = $6
+		where id = $1`
+
+	res, err := m.DB.ExecContext(ctx, stmt,
+		webhook.ID,
+		webhook.URL,
+		webhook.Secret,
+		strings.Join(webhook.EventTypes, ","),
+		webhook.Active,
+		time.Now(),
+	)
+	if err != nil {
+		return err
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+func (m *PostgresDBRepo) GetWebhookByID(id int) (*models.Webhook, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select id, url, secret, event_types, active, created_at, updated_at
+						from webhooks
+						where id = $1`
+
+	var webhook models.Webhook
+	var eventTypes string
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+		&webhook.ID,
+		&webhook.URL,
+		&webhook.Secret,
+		&eventTypes,
+		&webhook.Active,
+		&webhook.CreatedAt,
+		&webhook.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	webhook.EventTypes = strings.Split(eventTypes, ",")
+
+	return &webhook, nil
+}
+
+// AllWebhooks returns every webhook, oldest first
+func (m *PostgresDBRepo) AllWebhooks() ([]*models.Webhook, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select id, url, secret, event_types, active, created_at, updated_at
+						from webhooks
+						order by id`
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var webhooks []*models.Webhook
+
+	for rows.Next() {
+		var webhook models.Webhook
+		var eventTypes string
+		err := rows.Scan(
+			&webhook.ID,
+			&webhook.URL,
+			&webhook.Secret,
+			&eventTypes,
+			&webhook.Active,
+			&webhook.CreatedAt,
+			&webhook.UpdatedAt,
+		)
+		if err != nil {
+			log.Println("Error scanning", err)
+			return nil, err
+		}
+
+		webhook.EventTypes = strings.Split(eventTypes, ",")
+		webhooks = append(webhooks, &webhook)
+	}
+
+	return webhooks, nil
+}
+
+// DeleteWebhook removes a webhook with its deliveries. It returns
+// sql.ErrNoRows if the webhook does not exist.
+func (m *PostgresDBRepo) DeleteWebhook(id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	res, err := m.DB.ExecContext(ctx, `delete from webhooks where id = $1`, id)
+	if err != nil {
+		return err
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+// EnqueueWebhookDeliveries queues a payload for every active webhook
+// subscribed to the event type and returns how many deliveries were queued
+func (m *PostgresDBRepo) EnqueueWebhookDeliveries(eventType string, payload []byte) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `insert into webhook_deliveries (webhook_id, event_type, payload, next_attempt_at, created_at, updated_at)
+		select id, $1, $2, $3, $3, $3
+		from webhooks
+		where active and $1 = any(string_to_array(event_types, ','))`
+
+	res, err := m.DB.ExecContext(ctx, stmt, eventType, string(payload), time.Now())
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
+
+// ClaimWebhookDeliveries returns up to limit pending deliveries that are due,
+// with their webhooks, and pushes their next attempt lease into the future so
+// no other worker picks them up meanwhile. Deliveries of inactive webhooks
+// wait until the webhook is active again.
+func (m *PostgresDBRepo) ClaimWebhookDeliveries(limit int, lease time.Duration) ([]*models.WebhookDelivery, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `with due as (
+			select d.id
+			from webhook_deliveries d
+			join webhooks w on w.id = d.webhook_id
+			where d.status = 'pending' and d.next_attempt_at <= $1 and w.active
+			order by d.next_attempt_at, d.id
+			limit $2
+			for update of d skip locked
+		)
+		update webhook_deliveries d set next_attempt_at = $3, updated_at = $1
+		from due, webhooks w
+		where d.id = due.id and w.id = d.webhook_id
+		returning d.id, d.webhook_id, d.event_type, d.payload, d.status, d.attempts, d.next_attempt_at,
+			d.last_status_code, d.last_error, d.delivered_at, d.created_at, d.updated_at, w.url, w.secret`
+
+	now := time.Now()
+	rows, err := m.DB.QueryContext(ctx, stmt, now, limit, now.Add(lease))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var deliveries []*models.WebhookDelivery
+
+	for rows.Next() {
+		delivery, err := scanWebhookDelivery(rows, true)
+		if err != nil {
+			log.Println("Error scanning", err)
+			return nil, err
+		}
+
+		deliveries = append(deliveries, delivery)
+	}
+
+	return deliveries, nil
+}
+
+// scanWebhookDelivery scans the delivery columns, followed by the url and
+// secret of its webhook when withWebhook is set
+func scanWebhookDelivery(rows *sql.Rows, withWebhook bool) (*models.WebhookDelivery, error) {
+	var delivery models.WebhookDelivery
+	var payload string
+	var deliveredAt sql.NullTime
+
+	dest := []interface{}{
+		&delivery.ID,
+		&delivery.WebhookId,
+		&delivery.EventType,
+		&payload,
+		&delivery.Status,
+		&delivery.Attempts,
+		&delivery.NextAttemptAt,
+		&delivery.LastStatusCode,
+		&delivery.LastError,
+		&deliveredAt,
+		&delivery.CreatedAt,
+		&delivery.UpdatedAt,
+	}
+
+	if withWebhook {
+		delivery.Webhook = &models.Webhook{}
+		dest = append(dest, &delivery.Webhook.URL, &delivery.Webhook.Secret)
+	}
+
+	err := rows.Scan(dest...)
+	if err != nil {
+		return nil, err
+	}
+
+	delivery.Payload = []byte(payload)
+	if deliveredAt.Valid {
+		delivery.DeliveredAt = &deliveredAt.Time
+	}
+	if delivery.Webhook != nil {
+		delivery.Webhook.ID = delivery.WebhookId
+	}
+
+	return &delivery, nil
+}
+
+// RecordWebhookAttempt stores the outcome of an attempt to send a delivery
+// claimed with the given lease. It returns sql.ErrNoRows if the delivery is no
+// longer held under that lease, because the lease ran out and it was claimed
+// again, or it was retried in the meantime.
+func (m *PostgresDBRepo) RecordWebhookAttempt(delivery models.WebhookDelivery, lease time.Time) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `update webhook_deliveries set
+			status = $2,
+			attempts = $3,
+			next_attempt_at = $4,
+			last_status_code = $5,
+			last_error = $6,
+			delivered_at = $7,
+			updated_at = $8
+		where id = $1 and status = 'pending' and next_attempt_at = $9`
+
+	res, err := m.DB.ExecContext(ctx, stmt,
+		delivery.ID,
+		delivery.Status,
+		delivery.Attempts,
+		delivery.NextAttemptAt,
+		delivery.LastStatusCode,
+		delivery.LastError,
+		delivery.DeliveredAt,
+		time.Now(),
+		lease,
+	)
+	if err != nil {
+		return err
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+// NextWebhookAttempt returns when the earliest pending delivery of an active
+// webhook is due, or sql.ErrNoRows if there is none
+func (m *PostgresDBRepo) NextWebhookAttempt() (time.Time, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select min(d.next_attempt_at)
+						from webhook_deliveries d
+						join webhooks w on w.id = d.webhook_id
+						where d.status = 'pending' and w.active`
+
+	var next sql.NullTime
+	err := m.DB.QueryRowContext(ctx, query).Scan(&next)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if !next.Valid {
+		return time.Time{}, sql.ErrNoRows
+	}
+
+	return next.Time, nil
+}
+
+// WebhookDeliveries returns a page of a webhook's deliveries, newest first,
+// optionally only those with the given status
+func (m *PostgresDBRepo) WebhookDeliveries(webhookID int, status string, limit int, offset int) ([]*models.WebhookDelivery, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select id, webhook_id, event_type, payload, status, attempts, next_attempt_at,
+							last_status_code, last_error, delivered_at, created_at, updated_at
+						from webhook_deliveries
+						where webhook_id = $1 and ($2 = '' or status = $2)
+						order by created_at desc, id desc
+						limit $3 offset $4`
+
+	rows, err := m.DB.QueryContext(ctx, query, webhookID, status, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var deliveries []*models.WebhookDelivery
+
+	for rows.Next() {
+		delivery, err := scanWebhookDelivery(rows, false)
+		if err != nil {
+			log.Println("Error scanning", err)
+			return nil, err
+		}
+
+		deliveries = append(deliveries, delivery)
+	}
+
+	return deliveries, nil
+}
+
+// RetryWebhookDelivery queues a dead delivery again with a fresh set of
+// attempts. It returns sql.ErrNoRows if there is no dead delivery with that id.
+func (m *PostgresDBRepo) RetryWebhookDelivery(id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `update webhook_deliveries set status = 'pending', attempts = 0, next_attempt_at = $2, updated_at = $2
+		where id = $1 and status = 'dead'`
+
+	res, err := m.DB.ExecContext(ctx, stmt, id, time.Now())
+	if err != nil {
+		return err
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+// DigestRecipients returns up to limit users who have favorite lessons, have
+// not turned the digest off, and were last sent one before checkedBefore or
+// never, longest waiting first
+func (m *PostgresDBRepo) DigestRecipients(checkedBefore time.Time, limit int) ([]*models.DigestRecipient, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select u.id, u.email, u.first_name, coalesce(p.language, 'ja'), p.last_digest_at
+						from users u
+						left join digest_preferences p on p.user_id = u.id
+						where u.deleted_at is null
+							and coalesce(p.enabled, true)
+							and (p.last_digest_at is null or p.last_digest_at < $1)
+							and exists (select 1 from user_favorites f where f.user_id = u.id)
+						order by p.last_digest_at nulls first, u.id
+						limit $2`
+
+	rows, err := m.DB.QueryContext(ctx, query, checkedBefore, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var recipients []*models.DigestRecipient
+
+	for rows.Next() {
+		var recipient models.DigestRecipient
+		var lastDigestAt sql.NullTime
+		err := rows.Scan(
+			&recipient.UserId,
+			&recipient.Email,
+			&recipient.FirstName,
+			&recipient.Language,
+			&lastDigestAt,
+		)
+		if err != nil {
+			log.Println("Error scanning", err)
+			return nil, err
+		}
+
+		if lastDigestAt.Valid {
+			recipient.LastDigestAt = &lastDigestAt.Time
+		}
+		recipients = append(recipients, &recipient)
+	}
+
+	return recipients, nil
+}
+
+// DigestReviews returns up to limit visible reviews written by other users on
+// a user's favorite lessons in [since, until), grouped by lesson
+func (m *PostgresDBRepo) DigestReviews(userID int, since time.Time, until time.Time, limit int) ([]*models.DigestReview, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select l.id, l.lesson_name, l.teacher_name, c.star, c.comment, c.year, c.term, c.created_at
+						from user_favorites f
+						join lessons l on l.id = f.lesson_id
+						join comments c on c.lesson_id = l.id
+						where f.user_id = $1 and l.deleted_at is null
+							and c.user_id <> $1 and c.moderation_status = 'visible' and c.deleted_at is null
+							and c.created_at >= $2 and c.created_at < $3
+						order by l.lesson_name, l.id, c.created_at desc, c.id desc
+						limit $4`
+
+	rows, err := m.DB.QueryContext(ctx, query, userID, since, until, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var reviews []*models.DigestReview
+
+	for rows.Next() {
+		var review models.DigestReview
+		err := rows.Scan(
+			&review.LessonId,
+			&review.LessonName,
+			&review.TeacherName,
+			&review.Star,
+			&review.Comment,
+			&review.Year,
+			&review.Term,
+			&review.CreatedAt,
+		)
+		if err != nil {
+			log.Println("Error scanning", err)
+			return nil, err
+		}
+
+		reviews = append(reviews, &review)
+	}
+
+	return reviews, nil
+}
+
+// MarkDigestSent records that a user's digest covers everything up to at
+func (m *PostgresDBRepo) MarkDigestSent(userID int, at time.Time) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `insert into digest_preferences (user_id, last_digest_at, created_at, updated_at)
+		values ($1, $2, $3, $3)
+		on conflict (user_id) do update set last_digest_at = excluded.last_digest_at, updated_at = excluded.updated_at`
+
+	_, err := m.DB.ExecContext(ctx, stmt, userID, at, time.Now())
+	return err
+}
+
+// GetDigestPreferences returns a user's digest preferences, which default to
+// a Japanese digest for users who never changed them
+func (m *PostgresDBRepo) GetDigestPreferences(userID int) (*models.DigestPreferences, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select enabled, language, last_digest_at from digest_preferences where user_id = $1`
+
+	prefs := models.DigestPreferences{UserId: userID, Enabled: true, Language: models.DigestJapanese}
+	var lastDigestAt sql.NullTime
+	err := m.DB.QueryRowContext(ctx, query, userID).Scan(&prefs.Enabled, &prefs.Language, &lastDigestAt)
+	if err == sql.ErrNoRows {
+		return &prefs, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if lastDigestAt.Valid {
+		prefs.LastDigestAt = &lastDigestAt.Time
+	}
+
+	return &prefs, nil
+}
+
+// UpdateDigestPreferences turns a user's digest on or off and sets its language
+func (m *PostgresDBRepo) UpdateDigestPreferences(prefs models.DigestPreferences) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `insert into digest_preferences (user_id, enabled, language, created_at, updated_at)
+		values ($1, $2, $3, $4, $4)
+		on conflict (user_id) do update set enabled = excluded.enabled, language = excluded.language, updated_at = excluded.updated_at`
+
+	_, err := m.DB.ExecContext(ctx, stmt, prefs.UserId, prefs.Enabled, prefs.Language, time.Now())
+	return err
+}
+
+// jobColumns are the columns scanJob reads
+const jobColumns = `id, kind, payload, status, attempts, max_attempts, run_at, coalesce(unique_key, ''), last_error, finished_at, created_at, updated_at`
+
+// EnqueueJob queues a background job and returns its id. A job with the same
+// unique key as one already queued is dropped, and 0 is returned.
+func (m *PostgresDBRepo) EnqueueJob(job models.Job) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `insert into jobs (kind, payload, max_attempts, run_at, unique_key, created_at, updated_at)
+		values ($1, $2, $3, $4, $5, $6, $6)
+		on conflict (unique_key) do nothing
+		returning id`
+
+	payload := string(job.Payload)
+	if payload == "" {
+		payload = "{}"
+	}
+
+	var uniqueKey sql.NullString
+	if job.UniqueKey != "" {
+		uniqueKey = sql.NullString{String: job.UniqueKey, Valid: true}
+	}
+
+	var id int
+	err := m.DB.QueryRowContext(ctx, stmt, job.Kind, payload, job.MaxAttempts, job.RunAt, uniqueKey, time.Now()).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	return id, nil
+}
+
+// ClaimJobs leases up to limit due jobs of the given kinds, oldest first, and
+// counts an attempt for each. Jobs locked by another worker are skipped, and
+// a claimed job is claimed again if it is still running once the lease runs
+// out, unless that was its last attempt, in which case it fails.
+func (m *PostgresDBRepo) ClaimJobs(kinds []string, limit int, lease time.Duration) ([]*models.Job, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	now := time.Now()
+	stmt := `update jobs set status = 'failed', last_error = 'lease ran out on the last attempt', finished_at = $1, updated_at = $1
+		where status = 'running' and run_at <= $1 and attempts >= max_attempts
+			and kind = any(string_to_array($2, ','))`
+
+	_, err := m.DB.ExecContext(ctx, stmt, now, strings.Join(kinds, ","))
+	if err != nil {
+		return nil, err
+	}
+
+	stmt = `with due as (
+			select id
+			from jobs
+			where (status = 'pending' or (status = 'running' and attempts < max_attempts)) and run_at <= $1
+				and kind = any(string_to_array($2, ','))
+			order by run_at, id
+			limit $3
+			for update skip locked
+		)
+		update jobs j set status = 'running', attempts = j.attempts + 1, run_at = $4, updated_at = $1
+		from due
+		where j.id = due.id
+		returning j.id, j.kind, j.payload, j.status, j.attempts, j.max_attempts, j.run_at, coalesce(j.unique_key, ''),
+			j.last_error, j.finished_at, j.created_at, j.updated_at`
+
+	rows, err := m.DB.QueryContext(ctx, stmt, now, strings.Join(kinds, ","), limit, now.Add(lease))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var jobs []*models.Job
+
+	for rows.Next() {
+		job, err := scanJob(rows)
+		if err != nil {
+			log.Println("Error scanning", err)
+			return nil, err
+		}
+
+		jobs = append(jobs, job)
+	}
+
+	return jobs, nil
+}
+
+// scanJob scans the columns listed in jobColumns
+func scanJob(rows *sql.Rows) (*models.Job, error) {
+	var job models.Job
+	var payload string
+	var finishedAt sql.NullTime
+
+	err := rows.Scan(
+		&job.ID,
+		&job.Kind,
+		&payload,
+		&job.Status,
+		&job.Attempts,
+		&job.MaxAttempts,
+		&job.RunAt,
+		&job.UniqueKey,
+		&job.LastError,
+		&finishedAt,
+		&job.CreatedAt,
+		&job.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	job.Payload = []byte(payload)
+	if finishedAt.Valid {
+		job.FinishedAt = &finishedAt.Time
+	}
+
+	return &job, nil
+}
+
+// RecordJobResult stores the status, next run, error and finish time of a
+// job after an attempt. Every claim counts an attempt, so the attempt number
+// tells whether the job is still the caller's; once it was claimed again, or
+// given up on, ErrJobLeaseLost is returned and nothing is changed.
+func (m *PostgresDBRepo) RecordJobResult(job models.Job) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `update jobs set
+		status = $1,
+		run_at = $2,
+		last_error = $3,
+		finished_at = $4,
+		updated_at = $5
+		where id = $6 and status = 'running' and attempts = $7`
+
+	var finishedAt sql.NullTime
+	if job.FinishedAt != nil {
+		finishedAt = sql.NullTime{Time: *job.FinishedAt, Valid: true}
+	}
+
+	res, err := m.DB.ExecContext(ctx, stmt, job.Status, job.RunAt, job.LastError, finishedAt, time.Now(), job.ID, job.Attempts)
+	if err != nil {
+		return err
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return repository.ErrJobLeaseLost
+	}
+
+	return nil
+}
+
+func (m *PostgresDBRepo) GetJobByID(id int) (*models.Job, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, `select `+jobColumns+` from jobs where id = $1`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		err = rows.Err()
+		if err == nil {
+			err = sql.ErrNoRows
+		}
+		return nil, err
+	}
+
+	return scanJob(rows)
+}
+
+// Jobs returns a page of jobs, newest first, optionally only those with a
+// status or of a kind
+func (m *PostgresDBRepo) Jobs(filter models.JobFilter) ([]*models.Job, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select ` + jobColumns + `
+						from jobs
+						where ($1 = '' or status = $1) and ($2 = '' or kind = $2)
+						order by created_at desc, id desc
+						limit $3 offset $4`
+
+	rows, err := m.DB.QueryContext(ctx, query, filter.Status, filter.Kind, filter.Limit, filter.Offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var jobs []*models.Job
+
+	for rows.Next() {
+		job, err := scanJob(rows)
+		if err != nil {
+			log.Println("Error scanning", err)
+			return nil, err
+		}
+
+		jobs = append(jobs, job)
+	}
+
+	return jobs, nil
+}
+
+// RetryJob queues a failed job again with its attempts reset. It returns
+// sql.ErrNoRows if there is no failed job with that id.
+func (m *PostgresDBRepo) RetryJob(id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `update jobs set status = 'pending', attempts = 0, run_at = $1, finished_at = null, updated_at = $1
+		where id = $2 and status = 'failed'`
+
+	res, err := m.DB.ExecContext(ctx, stmt, time.Now(), id)
+	if err != nil {
+		return err
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+// PruneJobs deletes jobs that succeeded before the given time. Failed jobs
+// are kept until an admin retries them.
+func (m *PostgresDBRepo) PruneJobs(before time.Time) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	res, err := m.DB.ExecContext(ctx, `delete from jobs where status = 'succeeded' and finished_at < $1`, before)
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
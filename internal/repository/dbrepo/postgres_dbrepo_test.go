@@ -2,12 +2,14 @@ package dbrepo
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
 	"math"
 	"kstation_backend/internal/models"
 	"kstation_backend/internal/repository"
 	"log"
 	"os"
+	"sync"
 	"testing"
 	"time"
 
@@ -197,6 +199,26 @@ func TestPostgresDBRepoResetPassword(t *testing.T) {
 	}
 }
 
+func TestPostgresDBRepoChangePassword(t *testing.T) {
+	before, _ := testRepo.GetUserByID(1)
+
+	version, err := testRepo.ChangePassword(1, "password")
+	if err != nil {
+		t.Errorf("change password returned an error: %s", err)
+	}
+
+	user, _ := testRepo.GetUserByID(1)
+	matches, _ := user.PasswordMatches("password")
+	if !matches || version != before.SessionVersion+1 || user.SessionVersion != version {
+		t.Errorf("expected the new password at session version %d, but got %d", before.SessionVersion+1, user.SessionVersion)
+	}
+
+	_, err = testRepo.ChangePassword(9999, "password")
+	if err == nil {
+		t.Error("changed the password of a user who does not exist")
+	}
+}
+
 func TestPostgresDBRepoInsertLesson(t *testing.T) {
 	testLesson := models.Lesson{
 		UserId: 1,
@@ -490,7 +512,7 @@ func TestPostgresDBRepoGetCommentById(t *testing.T) {
 
 func TestPostgresDBRepoAllCommentsByLessonId(t *testing.T) {
 
-	comments, err := testRepo.AllCommentsByLessonId(1)
+	comments, err := testRepo.AllCommentsByLessonId(1, 0)
 	if err != nil {
 		t.Errorf("all comments reports an error: %s", err)
 	}
@@ -513,7 +535,7 @@ func TestPostgresDBRepoAllCommentsByLessonId(t *testing.T) {
 
 	_, _ = testRepo.InsertComment(testComment)
 
-	comments, err = testRepo.AllCommentsByLessonId(2)
+	comments, err = testRepo.AllCommentsByLessonId(2, 0)
 	if err != nil {
 		t.Errorf("all comments reports an error: %s", err)
 	}
@@ -576,7 +598,7 @@ func TestPostgresDBRepoUpdateComment(t *testing.T) {
 	comment.Year = 2020
 	comment.Comment = "Test succeeded"
 
-	err := testRepo.UpdateComment(*comment)
+	err := testRepo.UpdateComment(*comment, 1)
 	if err != nil {
 		t.Errorf("error updating lesson %d: %s", 2, err)
 	}
@@ -597,4 +619,1538 @@ func TestPostgresDBRepoDeleteUser(t *testing.T) {
 	if err == nil {
 		t.Error("retrieved user id 2, who should have been deleted")
 	}
-}
\ No newline at end of file
+}
+
+func TestPostgresDBRepoGetLessonStats(t *testing.T) {
+	stats, err := testRepo.GetLessonStats(2)
+	if err != nil {
+		t.Errorf("error getting lesson stats: %s", err)
+	}
+
+	if stats.CommentNumbers != 1 || stats.StarHistogram[4] != 1 || stats.TestOrReport["Test"] != 1 {
+		t.Errorf("wrong stats returned; expected 1 comment with 4 stars, but got %d", stats.CommentNumbers)
+	}
+
+	testComment := models.Comment{
+		LessonId: 2,
+		UserId: 1,
+		Year: 2023,
+		Term: "test3",
+		Comment: "another test",
+		TestOrReport: "Report",
+		Star: 2,
+		CreatedAt: time.Now(),
+		UpdatedAt: time.Now(),
+	}
+
+	_, _ = testRepo.InsertComment(testComment)
+
+	stats, err = testRepo.GetLessonStats(2)
+	if err != nil {
+		t.Errorf("error getting lesson stats: %s", err)
+	}
+
+	if stats.CommentNumbers != 2 || stats.MedianStar != 3 || len(stats.ByTerm) != 2 {
+		t.Errorf("stats were not refreshed after insert; expected 2 comments with median 3, but got %d %f", stats.CommentNumbers, stats.MedianStar)
+	}
+
+	// callers get their own copy of the cached stats
+	stats.StarHistogram[4] = 100
+	stats.ByTerm[0].CommentNumbers = 100
+
+	stats, _ = testRepo.GetLessonStats(2)
+	if stats.StarHistogram[4] != 1 || stats.ByTerm[0].CommentNumbers == 100 {
+		t.Error("changing returned stats changed the cached ones")
+	}
+
+	// an entry left behind by a write on another instance runs out
+	repo := testRepo.(*PostgresDBRepo)
+	repo.statsMu.Lock()
+	repo.statsCache[2] = cachedLessonStats{stats: &models.LessonStats{LessonId: 2, CommentNumbers: 7}, expires: time.Now().Add(-time.Second)}
+	repo.statsMu.Unlock()
+
+	stats, _ = testRepo.GetLessonStats(2)
+	if stats.CommentNumbers != 2 {
+		t.Errorf("expected expired stats to be computed again, but got %d comments", stats.CommentNumbers)
+	}
+
+	// stats computed while a review changed are not cached
+	repo.invalidateLessonStats(2)
+	_, gen := repo.cachedStats(2)
+	repo.invalidateLessonStats(2)
+	repo.storeStats(2, gen, &models.LessonStats{LessonId: 2, CommentNumbers: 7})
+
+	cached, _ := repo.cachedStats(2)
+	if cached != nil {
+		t.Errorf("expected stats from before a change not to be cached, but got %d comments", cached.CommentNumbers)
+	}
+}
+
+func TestPostgresDBRepoVoteComment(t *testing.T) {
+	err := testRepo.VoteComment(4, 2, true)
+	if err != nil {
+		t.Errorf("error voting on comment: %s", err)
+	}
+
+	comment, _ := testRepo.GetCommentByID(4)
+	if comment.HelpfulCount != 1 || comment.UnhelpfulCount != 0 {
+		t.Errorf("expected 1 helpful vote, but got %d %d", comment.HelpfulCount, comment.UnhelpfulCount)
+	}
+
+	comments, err := testRepo.AllCommentsByLessonId(2, 1)
+	if err != nil {
+		t.Errorf("all comments reports an error: %s", err)
+	}
+
+	if len(comments) != 2 || comments[0].ID != 4 {
+		t.Errorf("wrong order for most helpful; expected comment 4 first")
+	}
+
+	_ = testRepo.VoteComment(3, 1, false)
+
+	comments, err = testRepo.AllCommentsByLessonId(2, 2)
+	if err != nil {
+		t.Errorf("all comments reports an error: %s", err)
+	}
+
+	if len(comments) != 2 || comments[0].ID != 4 {
+		t.Errorf("wrong order for wilson score; expected comment 4 first")
+	}
+
+	err = testRepo.VoteComment(4, 2, false)
+	if err != nil {
+		t.Errorf("error switching vote on comment: %s", err)
+	}
+
+	comment, _ = testRepo.GetCommentByID(4)
+	if comment.HelpfulCount != 0 || comment.UnhelpfulCount != 1 {
+		t.Errorf("expected vote to switch to unhelpful, but got %d %d", comment.HelpfulCount, comment.UnhelpfulCount)
+	}
+
+	err = testRepo.VoteComment(4, 2, false)
+	if err != nil {
+		t.Errorf("error toggling vote on comment: %s", err)
+	}
+
+	comment, _ = testRepo.GetCommentByID(4)
+	if comment.HelpfulCount != 0 || comment.UnhelpfulCount != 0 {
+		t.Errorf("expected vote to be toggled off, but got %d %d", comment.HelpfulCount, comment.UnhelpfulCount)
+	}
+}
+
+func TestPostgresDBRepoVoteCommentConcurrently(t *testing.T) {
+	// the same first vote sent twice at once, as a double click would
+	var wg sync.WaitGroup
+	errs := make([]error, 2)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = testRepo.VoteComment(4, 1, true)
+		}(i)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			t.Errorf("error voting on comment concurrently: %s", err)
+		}
+	}
+
+	var votes int
+	_ = testDB.QueryRow(`select count(*) from comment_votes where comment_id = 4 and helpful`).Scan(&votes)
+
+	comment, _ := testRepo.GetCommentByID(4)
+	if comment.HelpfulCount != votes || comment.UnhelpfulCount != 0 {
+		t.Errorf("expected counts to match %d stored votes, but got %d %d", votes, comment.HelpfulCount, comment.UnhelpfulCount)
+	}
+}
+
+func TestPostgresDBRepoUniqueComment(t *testing.T) {
+	testComment := models.Comment{
+		LessonId: 2,
+		UserId: 1,
+		Year: 2023,
+		Term: "test3",
+		Comment: "duplicate",
+		TestOrReport: "Report",
+		Star: 5,
+	}
+
+	_, err := testRepo.InsertComment(testComment)
+	if !errors.Is(err, repository.ErrDuplicateComment) {
+		t.Errorf("expected duplicate comment error, but got %v", err)
+	}
+
+	existing, err := testRepo.GetCommentByOffering(1, 2, 2023, "test3")
+	if err != nil {
+		t.Errorf("error getting comment by offering: %s", err)
+	}
+
+	id, err := testRepo.UpsertComment(testComment)
+	if err != nil {
+		t.Errorf("upsert comment returned an error: %s", err)
+	}
+
+	if id != existing.ID {
+		t.Errorf("upsert created a new comment; expected id %d but got %d", existing.ID, id)
+	}
+
+	comment, _ := testRepo.GetCommentByID(id)
+	if comment.Comment != "duplicate" || comment.Star != 5 {
+		t.Errorf("upsert did not update the existing comment")
+	}
+
+	err = testRepo.UpdateLessonAggregates(2)
+	if err != nil {
+		t.Errorf("error updating lesson aggregates: %s", err)
+	}
+
+	lesson, _ := testRepo.GetLessonByID(2)
+	if lesson.CommentNumbers != 2 || lesson.AvgStar != 4.5 || lesson.AboutAvgStar != 5 {
+		t.Errorf("wrong aggregates; expected 2 comments averaging 4.5, but got %d %f", lesson.CommentNumbers, lesson.AvgStar)
+	}
+}
+
+func TestPostgresDBRepoReports(t *testing.T) {
+	report := models.Report{
+		CommentId: 4,
+		UserId: 2,
+		Reason: models.ReportAbuse,
+		Detail: "insults the teacher",
+	}
+
+	id, err := testRepo.InsertReport(report)
+	if err != nil {
+		t.Errorf("insert report returned an error: %s", err)
+	}
+
+	_, err = testRepo.InsertReport(report)
+	if !errors.Is(err, repository.ErrDuplicateReport) {
+		t.Errorf("expected duplicate report error, but got %v", err)
+	}
+
+	reports, err := testRepo.PendingReports()
+	if err != nil {
+		t.Errorf("pending reports returned an error: %s", err)
+	}
+
+	if len(reports) != 1 || reports[0].Comment == nil || reports[0].Comment.ID != 4 {
+		t.Errorf("expected one pending report on comment 4")
+	}
+
+	err = testRepo.ModerateReport(models.ModerationAction{ReportId: id, ModeratorId: 1, Action: models.ModerationHide})
+	if err != nil {
+		t.Errorf("moderate report returned an error: %s", err)
+	}
+
+	reported, _ := testRepo.GetReportByID(id)
+	if reported.Status != models.ReportResolved {
+		t.Errorf("expected report to be resolved, but got %s", reported.Status)
+	}
+
+	err = testRepo.ModerateReport(models.ModerationAction{ReportId: id, ModeratorId: 1, Action: models.ModerationDismiss})
+	if !errors.Is(err, repository.ErrReportHandled) {
+		t.Errorf("expected a second action on the report to fail with ErrReportHandled, but got %v", err)
+	}
+
+	comments, _ := testRepo.AllCommentsByLessonId(2, 0)
+	if len(comments) != 1 {
+		t.Errorf("hidden comment is still listed; expected 1 comment, but got %d", len(comments))
+	}
+
+	_ = testRepo.UpdateLessonAggregates(2)
+
+	lesson, _ := testRepo.GetLessonByID(2)
+	if lesson.CommentNumbers != 1 || lesson.AvgStar != 4 {
+		t.Errorf("hidden comment counted in aggregates; expected 1 comment averaging 4, but got %d %f", lesson.CommentNumbers, lesson.AvgStar)
+	}
+
+}
+
+func TestPostgresDBRepoHeldComments(t *testing.T) {
+	testComment := models.Comment{
+		LessonId: 3,
+		UserId: 1,
+		Year: 2023,
+		Term: "former",
+		Comment: "mail me at taro@example.com",
+		TestOrReport: "Test",
+		Star: 5,
+		ModerationStatus: models.CommentPending,
+	}
+
+	id, err := testRepo.InsertComment(testComment)
+	if err != nil {
+		t.Errorf("insert comment returned an error: %s", err)
+	}
+
+	comments, err := testRepo.HeldComments()
+	if err != nil {
+		t.Errorf("held comments returned an error: %s", err)
+	}
+
+	if len(comments) != 1 || comments[0].ID != id {
+		t.Errorf("expected comment %d to be held", id)
+	}
+
+	comments, _ = testRepo.AllCommentsByLessonId(3, 0)
+	if len(comments) != 0 {
+		t.Errorf("held comment is listed; expected 0 comments, but got %d", len(comments))
+	}
+
+	testComment.ID = id
+	testComment.Comment = "mail me"
+	testComment.ModerationStatus = models.CommentVisible
+	err = testRepo.UpdateComment(testComment, 1)
+	if err != nil {
+		t.Errorf("error updating held comment: %s", err)
+	}
+
+	held, _ := testRepo.GetCommentByID(id)
+	if held.ModerationStatus != models.CommentPending {
+		t.Errorf("editing a held comment made it %s", held.ModerationStatus)
+	}
+
+	err = testRepo.SetCommentModerationStatus(id, models.CommentVisible)
+	if err != nil {
+		t.Errorf("error approving held comment: %s", err)
+	}
+
+	comments, _ = testRepo.AllCommentsByLessonId(3, 0)
+	if len(comments) != 1 {
+		t.Errorf("approved comment is not listed; expected 1 comment, but got %d", len(comments))
+	}
+
+	err = testRepo.UpdateComment(models.Comment{ID: 4, LessonId: 2, Year: 2023, Term: "test3", Comment: "edited", TestOrReport: "Report", Star: 5, ModerationStatus: models.CommentVisible}, 1)
+	if err != nil {
+		t.Errorf("error updating hidden comment: %s", err)
+	}
+
+	comment, _ := testRepo.GetCommentByID(4)
+	if comment.ModerationStatus != models.CommentHidden {
+		t.Errorf("editing a hidden comment made it %s", comment.ModerationStatus)
+	}
+}
+
+func TestPostgresDBRepoSoftDelete(t *testing.T) {
+	err := testRepo.DeleteLesson(3)
+	if err != nil {
+		t.Errorf("error deleting lesson 3: %s", err)
+	}
+
+	_, err = testRepo.GetLessonByID(3)
+	if err == nil {
+		t.Error("retrieved lesson 3, which should have been deleted")
+	}
+
+	_, err = testRepo.GetCommentByID(5)
+	if err == nil {
+		t.Error("retrieved comment 5, which should have been deleted with its lesson")
+	}
+
+	err = testRepo.RestoreLesson(3)
+	if err != nil {
+		t.Errorf("error restoring lesson 3: %s", err)
+	}
+
+	_, err = testRepo.GetCommentByID(5)
+	if err != nil {
+		t.Errorf("comment 5 was not restored with its lesson: %s", err)
+	}
+
+	_ = testRepo.DeleteComment(5)
+
+	lessonID, err := testRepo.RestoreComment(5)
+	if err != nil {
+		t.Errorf("error restoring comment 5: %s", err)
+	}
+
+	if lessonID != 3 {
+		t.Errorf("restore comment returned wrong lesson; expected 3, but got %d", lessonID)
+	}
+
+	// a user of its own, so no other test depends on this one deleting it
+	removed := models.User{FirstName: "Saburo", LastName: "Ito", Email: "saburo@example.com", Password: "secret"}
+	userID, _ := testRepo.InsertUser(removed)
+	commentID, _ := testRepo.InsertComment(models.Comment{LessonId: 4, UserId: userID, Year: 2022, Term: "former", Comment: "spam", Star: 1, ModerationStatus: models.CommentVisible})
+	replyID, _ := testRepo.InsertReply(models.Reply{CommentId: 3, UserId: userID, Body: "spam"})
+	_ = testRepo.VoteComment(3, userID, true)
+
+	before, _ := testRepo.GetUserByID(userID)
+	voted, _ := testRepo.GetCommentByID(3)
+
+	lessonIDs, err := testRepo.DeleteUser(userID)
+	if err != nil {
+		t.Errorf("error deleting user %d: %s", userID, err)
+	}
+
+	if len(lessonIDs) != 1 || lessonIDs[0] != 4 {
+		t.Errorf("expected lesson 4 to need new aggregates, but got %v", lessonIDs)
+	}
+
+	_, err = testRepo.GetUserByID(userID)
+	if err == nil {
+		t.Errorf("retrieved user %d, who should have been deleted", userID)
+	}
+
+	_, err = testRepo.GetCommentByID(commentID)
+	if err == nil {
+		t.Error("retrieved a comment of a deleted user")
+	}
+
+	_, err = testRepo.GetReplyByID(replyID)
+	if err == nil {
+		t.Error("retrieved a reply of a deleted user")
+	}
+
+	hidden, _ := testRepo.GetCommentByID(3)
+	if hidden.HelpfulCount != voted.HelpfulCount-1 || hidden.ReplyCount != voted.ReplyCount-1 {
+		t.Errorf("expected the vote and reply of a deleted user to stop counting, but got %d %d", hidden.HelpfulCount, hidden.ReplyCount)
+	}
+
+	var version int
+	_ = testDB.QueryRow(`select session_version from users where id = $1`, userID).Scan(&version)
+	if version != before.SessionVersion+1 {
+		t.Errorf("expected the sessions of a deleted user to be revoked, but the version is %d", version)
+	}
+
+	lessonIDs, err = testRepo.RestoreUser(userID)
+	if err != nil {
+		t.Errorf("error restoring user %d: %s", userID, err)
+	}
+
+	if len(lessonIDs) != 1 || lessonIDs[0] != 4 {
+		t.Errorf("expected lesson 4 to need new aggregates, but got %v", lessonIDs)
+	}
+
+	_, err = testRepo.GetCommentByID(commentID)
+	if err != nil {
+		t.Errorf("comment was not restored with its user: %s", err)
+	}
+
+	_, err = testRepo.GetReplyByID(replyID)
+	if err != nil {
+		t.Errorf("reply was not restored with its user: %s", err)
+	}
+
+	restored, _ := testRepo.GetCommentByID(3)
+	if restored.HelpfulCount != voted.HelpfulCount || restored.ReplyCount != voted.ReplyCount {
+		t.Errorf("expected the vote and reply to count again, but got %d %d", restored.HelpfulCount, restored.ReplyCount)
+	}
+
+	_, _ = testRepo.DeleteUser(userID)
+
+	_, err = testRepo.PurgeDeleted(time.Now())
+	if err != nil {
+		t.Errorf("error purging deleted rows: %s", err)
+	}
+
+	var left int
+	_ = testDB.QueryRow(`select count(*) from users where id = $1`, userID).Scan(&left)
+	if left != 0 {
+		t.Errorf("expected user %d to be purged with their content", userID)
+	}
+
+	_, err = testRepo.RestoreUser(userID)
+	if err == nil {
+		t.Errorf("restored user %d, who should have been purged", userID)
+	}
+}
+
+func TestPostgresDBRepoCommentRevisions(t *testing.T) {
+	revisions, err := testRepo.CommentRevisions(1)
+	if err != nil {
+		t.Errorf("comment revisions returned an error: %s", err)
+	}
+
+	if len(revisions) != 1 || revisions[0].Comment != "this is a test" || revisions[0].Year != 2023 || revisions[0].EditorId != 1 {
+		t.Errorf("expected one revision with the original comment of comment 1")
+	}
+
+	comment, _ := testRepo.GetCommentByID(1)
+	if !comment.Edited {
+		t.Error("comment 1 should be marked as edited")
+	}
+
+	comment.Star = 4
+	_ = testRepo.UpdateComment(*comment, 1)
+
+	revisions, _ = testRepo.CommentRevisions(1)
+	if len(revisions) != 2 || revisions[0].Comment != "Test succeeded" || revisions[0].Year != 2020 {
+		t.Errorf("expected the latest revision first")
+	}
+
+	comment, _ = testRepo.GetCommentByID(5)
+	if comment.Edited {
+		t.Error("comment 5 was never edited")
+	}
+}
+
+func TestPostgresDBRepoGetUsersByIDs(t *testing.T) {
+	user, _ := testRepo.GetUserByID(2)
+	user.ShowRealName = true
+	_ = testRepo.UpdateUser(*user)
+
+	users, err := testRepo.GetUsersByIDs([]int{1, 2, 9999})
+	if err != nil {
+		t.Errorf("get users by ids returned an error: %s", err)
+	}
+
+	if len(users) != 2 || users[1] == nil || users[2] == nil {
+		t.Errorf("expected users 1 and 2, but got %d users", len(users))
+	}
+
+	if users[1].ShowRealName || !users[2].ShowRealName {
+		t.Error("wrong privacy setting returned for users 1 and 2")
+	}
+}
+
+func TestPostgresDBRepoReplies(t *testing.T) {
+	firstID, err := testRepo.InsertReply(models.Reply{CommentId: 5, UserId: 2, Body: "was the final open-book?"})
+	if err != nil {
+		t.Errorf("insert reply returned an error: %s", err)
+	}
+
+	secondID, err := testRepo.InsertReply(models.Reply{CommentId: 5, ParentId: firstID, UserId: 1, Depth: 1, Body: "yes"})
+	if err != nil {
+		t.Errorf("insert nested reply returned an error: %s", err)
+	}
+
+	comment, _ := testRepo.GetCommentByID(5)
+	if comment.ReplyCount != 2 {
+		t.Errorf("expected comment 5 to have 2 replies, but got %d", comment.ReplyCount)
+	}
+
+	reply, err := testRepo.GetReplyByID(secondID)
+	if err != nil {
+		t.Errorf("get reply returned an error: %s", err)
+	}
+
+	if reply.ParentId != firstID || reply.Depth != 1 {
+		t.Errorf("expected reply %d to be nested under %d", secondID, firstID)
+	}
+
+	reply.Body = "yes, with one page of notes"
+	err = testRepo.UpdateReply(*reply)
+	if err != nil {
+		t.Errorf("update reply returned an error: %s", err)
+	}
+
+	replies, err := testRepo.RepliesByCommentId(5, 1, 1)
+	if err != nil {
+		t.Errorf("replies by comment id returned an error: %s", err)
+	}
+
+	if len(replies) != 1 || replies[0].Body != "yes, with one page of notes" {
+		t.Error("expected the second page to hold the edited reply")
+	}
+
+	err = testRepo.DeleteReply(firstID)
+	if err != nil {
+		t.Errorf("delete reply returned an error: %s", err)
+	}
+
+	replies, _ = testRepo.RepliesByCommentId(5, 10, 0)
+	if len(replies) != 1 {
+		t.Errorf("expected one reply left, but got %d", len(replies))
+	}
+
+	comment, _ = testRepo.GetCommentByID(5)
+	if comment.ReplyCount != 1 {
+		t.Errorf("expected comment 5 to have 1 reply, but got %d", comment.ReplyCount)
+	}
+}
+
+func TestPostgresDBRepoAttachments(t *testing.T) {
+	attachment := models.Attachment{
+		LessonId:     2,
+		UserId:       2,
+		Year:         2022,
+		Term:         "latter",
+		TestOrReport: "test",
+		FileName:     "final.pdf",
+		ContentType:  "application/pdf",
+		Size:         1024,
+		StorageKey:   "attachments/2/a",
+	}
+
+	olderID, err := testRepo.InsertAttachment(attachment)
+	if err != nil {
+		t.Errorf("insert attachment returned an error: %s", err)
+	}
+
+	attachment.Year = 2023
+	attachment.StorageKey = "attachments/2/b"
+	newerID, _ := testRepo.InsertAttachment(attachment)
+
+	_, err = testRepo.InsertAttachment(attachment)
+	if err == nil {
+		t.Error("expected a duplicate storage key to be refused")
+	}
+
+	got, err := testRepo.GetAttachmentByID(olderID)
+	if err != nil {
+		t.Errorf("get attachment returned an error: %s", err)
+	}
+
+	if got.StorageKey != "attachments/2/a" || got.Size != 1024 || got.Year != 2022 {
+		t.Errorf("unexpected attachment %+v", got)
+	}
+
+	attachments, err := testRepo.AttachmentsByLessonId(2)
+	if err != nil {
+		t.Errorf("attachments by lesson returned an error: %s", err)
+	}
+
+	if len(attachments) != 2 || attachments[0].ID != newerID {
+		t.Error("expected the attachment from the newest year first")
+	}
+
+	err = testRepo.DeleteAttachment(olderID)
+	if err != nil {
+		t.Errorf("delete attachment returned an error: %s", err)
+	}
+
+	_, err = testRepo.GetAttachmentByID(olderID)
+	if err == nil {
+		t.Error("deleted attachment was still returned")
+	}
+}
+
+func TestPostgresDBRepoPurgeLessonAttachments(t *testing.T) {
+	lessonID, _ := testRepo.InsertLesson(models.Lesson{
+		UserId:      1,
+		LessonName:  "Purged Lesson",
+		TeacherName: "Suzuki",
+		CreatedAt:   time.Now(),
+		UpdatedAt:   time.Now(),
+	})
+
+	attachmentID, err := testRepo.InsertAttachment(models.Attachment{
+		LessonId:     lessonID,
+		UserId:       1,
+		Year:         2021,
+		Term:         "former",
+		TestOrReport: "report",
+		FileName:     "report.pdf",
+		ContentType:  "application/pdf",
+		Size:         10,
+		StorageKey:   "attachments/purged/a",
+	})
+	if err != nil {
+		t.Fatalf("insert attachment returned an error: %s", err)
+	}
+
+	_ = testRepo.DeleteLesson(lessonID)
+
+	attachments, err := testRepo.AttachmentsOfDeletedLessons(time.Now())
+	if err != nil {
+		t.Errorf("attachments of deleted lessons returned an error: %s", err)
+	}
+
+	if len(attachments) != 1 || attachments[0].ID != attachmentID {
+		t.Fatalf("expected the attachment of the deleted lesson but got %v", attachments)
+	}
+
+	_ = testRepo.DeleteAttachment(attachmentID)
+
+	_, err = testRepo.PurgeDeleted(time.Now())
+	if err != nil {
+		t.Errorf("error purging deleted rows: %s", err)
+	}
+
+	var left int
+	_ = testDB.QueryRow(`select count(*) from lessons where id = $1`, lessonID).Scan(&left)
+	if left != 0 {
+		t.Errorf("expected lesson %d to be purged once its attachments were gone", lessonID)
+	}
+}
+
+func TestPostgresDBRepoUserImage(t *testing.T) {
+	user, _ := testRepo.GetUserByID(2)
+	if user.Image != "test" {
+		t.Errorf("expected image of user 2 to be test, but got %s", user.Image)
+	}
+
+	matches, _ := user.PasswordMatches("secret")
+	if !matches {
+		t.Error("password of user 2 should match 'secret'")
+	}
+
+	user.Image = "/media/avatars/2/abc/256.jpg"
+	_ = testRepo.UpdateUser(*user)
+
+	user, _ = testRepo.GetUserByID(2)
+	if user.Image != "/media/avatars/2/abc/256.jpg" {
+		t.Errorf("expected the avatar url to be saved, but got %s", user.Image)
+	}
+
+	// two uploads, the older one finishing last
+	email := user.Email
+	_ = testRepo.SetPendingImage(2, "/media/avatars/2/old/256.jpg")
+	_ = testRepo.SetPendingImage(2, "/media/avatars/2/new/256.jpg")
+
+	previous, err := testRepo.ApplyPendingImage(2, "/media/avatars/2/new/256.jpg")
+	if err != nil || previous != "/media/avatars/2/abc/256.jpg" {
+		t.Errorf("expected the pending avatar to replace abc, but got %q, %v", previous, err)
+	}
+
+	_, err = testRepo.ApplyPendingImage(2, "/media/avatars/2/old/256.jpg")
+	if !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("expected a superseded upload to be refused, but got %v", err)
+	}
+
+	user, _ = testRepo.GetUserByID(2)
+	if user.Image != "/media/avatars/2/new/256.jpg" || user.Email != email {
+		t.Errorf("expected only the image to change, but got %s %s", user.Image, user.Email)
+	}
+
+	err = testRepo.SetPendingImage(9999, "/media/avatars/9999/x/256.jpg")
+	if !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("expected no user 9999, but got %v", err)
+	}
+}
+
+func TestPostgresDBRepoRevokeSessions(t *testing.T) {
+	version, err := testRepo.RevokeSessions(2)
+	if err != nil {
+		t.Errorf("revoke sessions returned an error: %s", err)
+	}
+
+	user, _ := testRepo.GetUserByID(2)
+	if version != 1 || user.SessionVersion != 1 {
+		t.Errorf("expected session version 1, but got %d and %d", version, user.SessionVersion)
+	}
+
+	_, err = testRepo.RevokeSessions(9999)
+	if err == nil {
+		t.Error("revoked sessions of a user who does not exist")
+	}
+}
+
+func TestPostgresDBRepoEmailChange(t *testing.T) {
+	changes := []models.EmailChange{
+		{UserId: 2, NewEmail: "expired@example.com", TokenHash: "expired", ExpiresAt: time.Now().Add(-time.Hour)},
+		{UserId: 2, NewEmail: "jane@smith.com", TokenHash: "taken", ExpiresAt: time.Now().Add(time.Hour)},
+		{UserId: 2, NewEmail: "futo@example.com", TokenHash: "valid", ExpiresAt: time.Now().Add(time.Hour)},
+	}
+	for _, change := range changes {
+		err := testRepo.InsertEmailChange(change)
+		if err != nil {
+			t.Errorf("insert email change returned an error: %s", err)
+		}
+	}
+
+	_, err := testRepo.ConfirmEmailChange(2, "expired")
+	if !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("expected an expired change to be refused, but got %v", err)
+	}
+
+	_, err = testRepo.ConfirmEmailChange(2, "taken")
+	if !errors.Is(err, repository.ErrEmailTaken) {
+		t.Errorf("expected ErrEmailTaken, but got %v", err)
+	}
+
+	_, err = testRepo.ConfirmEmailChange(1, "valid")
+	if !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("expected a change to be confirmed only by its own user, but got %v", err)
+	}
+
+	version, err := testRepo.ConfirmEmailChange(2, "valid")
+	if err != nil {
+		t.Errorf("confirm email change returned an error: %s", err)
+	}
+
+	user, _ := testRepo.GetUserByID(2)
+	if user.Email != "futo@example.com" || user.SessionVersion != version || version != 2 {
+		t.Errorf("expected email futo@example.com at session version 2, but got %s at %d", user.Email, user.SessionVersion)
+	}
+
+	_, err = testRepo.ConfirmEmailChange(2, "valid")
+	if err == nil {
+		t.Error("a confirmation token was accepted twice")
+	}
+}
+
+func TestPostgresDBRepoDeleteAccount(t *testing.T) {
+	leaver := models.User{FirstName: "Hanako", LastName: "Sato", Email: "hanako@example.com", Password: "secret"}
+	cascadeID, _ := testRepo.InsertUser(leaver)
+	leaver.Email = "jiro@example.com"
+	anonymizeID, _ := testRepo.InsertUser(leaver)
+
+	cascadeComment, _ := testRepo.InsertComment(models.Comment{LessonId: 4, UserId: cascadeID, Year: 2023, Term: "former", Comment: "bye", Star: 1})
+	keptComment, _ := testRepo.InsertComment(models.Comment{LessonId: 5, UserId: anonymizeID, Year: 2023, Term: "former", Comment: "kept", Star: 2})
+	_ = testRepo.VoteComment(3, cascadeID, true)
+	_, _ = testRepo.InsertReply(models.Reply{CommentId: 5, UserId: cascadeID, Body: "bye"})
+
+	before, _ := testRepo.GetCommentByID(5)
+	voted, _ := testRepo.GetCommentByID(3)
+
+	lessonIDs, err := testRepo.DeleteAccount(cascadeID, true)
+	if err != nil {
+		t.Errorf("cascading account deletion returned an error: %s", err)
+	}
+
+	if len(lessonIDs) != 1 || lessonIDs[0] != 4 {
+		t.Errorf("expected lesson 4 to need new aggregates, but got %v", lessonIDs)
+	}
+
+	_, err = testRepo.GetCommentByID(cascadeComment)
+	if err == nil {
+		t.Error("review of a cascaded account is still visible")
+	}
+
+	after, _ := testRepo.GetCommentByID(5)
+	if after.ReplyCount != before.ReplyCount-1 {
+		t.Errorf("expected reply count %d, but got %d", before.ReplyCount-1, after.ReplyCount)
+	}
+
+	unvoted, _ := testRepo.GetCommentByID(3)
+	if unvoted.HelpfulCount != voted.HelpfulCount-1 {
+		t.Errorf("expected helpful count %d, but got %d", voted.HelpfulCount-1, unvoted.HelpfulCount)
+	}
+
+	lessonIDs, err = testRepo.DeleteAccount(anonymizeID, false)
+	if err != nil || len(lessonIDs) != 0 {
+		t.Errorf("anonymizing account deletion returned %v, %v", lessonIDs, err)
+	}
+
+	_, err = testRepo.GetCommentByID(keptComment)
+	if err != nil {
+		t.Error("review of an anonymized account should stay visible")
+	}
+
+	users, _ := testRepo.GetUsersByIDs([]int{cascadeID, anonymizeID})
+	if len(users) != 0 {
+		t.Error("deleted accounts are still returned")
+	}
+
+	_, err = testRepo.GetUserByEmail("jiro@example.com")
+	if err == nil {
+		t.Error("email of an anonymized account was kept")
+	}
+
+	_, err = testRepo.DeleteAccount(anonymizeID, false)
+	if !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("expected deleting twice to fail, but got %v", err)
+	}
+}
+
+func TestPostgresDBRepoFavorites(t *testing.T) {
+	before, _ := testRepo.GetLessonByID(4)
+
+	for i := 0; i < 2; i++ {
+		err := testRepo.AddFavorite(1, 4)
+		if err != nil {
+			t.Errorf("add favorite returned an error: %s", err)
+		}
+	}
+	_ = testRepo.AddFavorite(1, 5)
+
+	lesson, _ := testRepo.GetLessonByID(4)
+	if lesson.FavoriteCount != before.FavoriteCount+1 {
+		t.Errorf("expected favorite count %d after adding twice, but got %d", before.FavoriteCount+1, lesson.FavoriteCount)
+	}
+
+	err := testRepo.AddFavorite(1, 1000)
+	if err == nil {
+		t.Error("favorited a lesson that does not exist")
+	}
+
+	lessons, err := testRepo.FavoriteLessons(1)
+	if err != nil || len(lessons) != 2 || lessons[0].ID != 5 {
+		t.Errorf("expected lessons 5 and 4, but got %v, %v", lessons, err)
+	}
+
+	favorited, _ := testRepo.FavoritedLessons(1, []int{4, 5, 6})
+	if !favorited[4] || !favorited[5] || favorited[6] {
+		t.Errorf("unexpected favorited lessons %v", favorited)
+	}
+
+	lessons, _ = testRepo.AllLessons(4)
+	if len(lessons) == 0 || lessons[0].FavoriteCount == 0 {
+		t.Error("expected the most favorited lesson first")
+	}
+
+	for i := 0; i < 2; i++ {
+		err = testRepo.RemoveFavorite(1, 4)
+		if err != nil {
+			t.Errorf("remove favorite returned an error: %s", err)
+		}
+	}
+
+	lesson, _ = testRepo.GetLessonByID(4)
+	if lesson.FavoriteCount != before.FavoriteCount {
+		t.Errorf("expected favorite count %d after removing twice, but got %d", before.FavoriteCount, lesson.FavoriteCount)
+	}
+}
+
+func TestPostgresDBRepoTimetable(t *testing.T) {
+	first, err := testRepo.UpsertOffering(models.Offering{LessonId: 4, Year: 2024, Term: "former", Credits: 2, Slots: []models.Slot{{Day: 1, Period: 2}, {Day: 1, Period: 1}}})
+	if err != nil {
+		t.Errorf("upsert offering returned an error: %s", err)
+	}
+
+	again, _ := testRepo.UpsertOffering(models.Offering{LessonId: 4, Year: 2024, Term: "former", Credits: 4, Slots: []models.Slot{{Day: 2, Period: 3}}})
+	if again != first {
+		t.Errorf("expected the same offering to be updated, but got %d and %d", first, again)
+	}
+
+	offering, _ := testRepo.GetOfferingByID(first)
+	if offering.Credits != 4 || len(offering.Slots) != 1 || offering.Slots[0] != (models.Slot{Day: 2, Period: 3}) {
+		t.Errorf("offering was not replaced: %+v", offering)
+	}
+
+	second, _ := testRepo.UpsertOffering(models.Offering{LessonId: 5, Year: 2024, Term: "former", Credits: 2})
+	_, _ = testRepo.UpsertOffering(models.Offering{LessonId: 5, Year: 2024, Term: "latter", Credits: 2})
+
+	offerings, err := testRepo.OfferingsByLessonId(5)
+	if err != nil || len(offerings) != 2 || offerings[0].Slots == nil {
+		t.Errorf("expected two offerings of lesson 5, but got %v, %v", offerings, err)
+	}
+
+	accept := func(entries []*models.TimetableEntry) error { return nil }
+	firstOffering, _ := testRepo.GetOfferingByID(first)
+	secondOffering, _ := testRepo.GetOfferingByID(second)
+
+	for i := 0; i < 2; i++ {
+		err = testRepo.AddTimetableEntry(1, firstOffering, accept)
+		if err != nil {
+			t.Errorf("add timetable entry returned an error: %s", err)
+		}
+	}
+	_ = testRepo.AddTimetableEntry(1, secondOffering, accept)
+
+	refused := errors.New("refused")
+	err = testRepo.AddTimetableEntry(1, secondOffering, func(entries []*models.TimetableEntry) error {
+		if len(entries) != 2 {
+			t.Errorf("expected the check to see both entries, but got %d", len(entries))
+		}
+		return refused
+	})
+	if !errors.Is(err, refused) {
+		t.Errorf("expected the error of the check, but got %v", err)
+	}
+
+	entries, err := testRepo.Timetable(1, 2024, "former")
+	if err != nil || len(entries) != 2 {
+		t.Fatalf("expected two timetable entries, but got %v, %v", entries, err)
+	}
+
+	if entries[0].Lesson.ID != 4 || len(entries[0].Offering.Slots) != 1 {
+		t.Errorf("unexpected first entry %+v", entries[0].Offering)
+	}
+
+	entries, _ = testRepo.Timetable(1, 2024, "latter")
+	if len(entries) != 0 {
+		t.Errorf("expected an empty timetable for the latter term, but got %d entries", len(entries))
+	}
+
+	err = testRepo.RemoveTimetableEntry(1, second)
+	if err != nil {
+		t.Errorf("remove timetable entry returned an error: %s", err)
+	}
+
+	err = testRepo.RemoveTimetableEntry(1, second)
+	if !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("expected removing twice to fail, but got %v", err)
+	}
+
+	err = testRepo.DeleteOffering(first)
+	if err != nil {
+		t.Errorf("delete offering returned an error: %s", err)
+	}
+
+	entries, _ = testRepo.TimetablesByUserId(1)
+	if len(entries) != 0 {
+		t.Errorf("entries of a deleted offering were kept: %d", len(entries))
+	}
+}
+
+func TestPostgresDBRepoAddTimetableEntryConcurrently(t *testing.T) {
+	var offerings []*models.Offering
+	for _, lessonID := range []int{4, 5} {
+		id, _ := testRepo.UpsertOffering(models.Offering{LessonId: lessonID, Year: 2025, Term: "former", Credits: 2})
+		offering, _ := testRepo.GetOfferingByID(id)
+		offerings = append(offerings, offering)
+	}
+
+	// a limit of one lesson a term, checked by two adds at once
+	onlyOne := func(entries []*models.TimetableEntry) error {
+		if len(entries) > 0 {
+			return errors.New("over the limit")
+		}
+		time.Sleep(time.Millisecond * 50)
+		return nil
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(offerings))
+	for i, offering := range offerings {
+		wg.Add(1)
+		go func(i int, offering *models.Offering) {
+			defer wg.Done()
+			errs[i] = testRepo.AddTimetableEntry(1, offering, onlyOne)
+		}(i, offering)
+	}
+	wg.Wait()
+
+	if (errs[0] == nil) == (errs[1] == nil) {
+		t.Errorf("expected exactly one add to pass the check, but got %v and %v", errs[0], errs[1])
+	}
+
+	entries, _ := testRepo.Timetable(1, 2025, "former")
+	if len(entries) != 1 {
+		t.Errorf("expected one timetable entry, but got %d", len(entries))
+	}
+
+	for _, offering := range offerings {
+		_ = testRepo.DeleteOffering(offering.ID)
+	}
+}
+
+func TestPostgresDBRepoAcademicTerms(t *testing.T) {
+	term := models.AcademicTerm{Year: 2024, Term: "former", StartsOn: time.Date(2024, 4, 10, 0, 0, 0, 0, time.UTC), EndsOn: time.Date(2024, 8, 9, 0, 0, 0, 0, time.UTC)}
+	err := testRepo.UpsertAcademicTerm(term)
+	if err != nil {
+		t.Errorf("upsert academic term returned an error: %s", err)
+	}
+
+	term.EndsOn = time.Date(2024, 8, 2, 0, 0, 0, 0, time.UTC)
+	_ = testRepo.UpsertAcademicTerm(term)
+
+	terms, err := testRepo.AcademicTerms()
+	if err != nil || len(terms) != 1 {
+		t.Fatalf("expected one term, but got %v, %v", terms, err)
+	}
+
+	if y, m, d := terms[0].EndsOn.Date(); y != 2024 || m != time.August || d != 2 {
+		t.Errorf("expected the term to end on 2024-08-02, but got %s", terms[0].EndsOn)
+	}
+}
+
+func TestPostgresDBRepoCalendarTokens(t *testing.T) {
+	_ = testRepo.SetCalendarToken(1, "first")
+	err := testRepo.SetCalendarToken(1, "second")
+	if err != nil {
+		t.Errorf("set calendar token returned an error: %s", err)
+	}
+
+	userID, err := testRepo.GetUserIDByCalendarToken("second")
+	if err != nil || userID != 1 {
+		t.Errorf("expected user 1, but got %d, %v", userID, err)
+	}
+
+	_, err = testRepo.GetUserIDByCalendarToken("first")
+	if !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("replaced token still works: %v", err)
+	}
+}
+
+func TestPostgresDBRepoRecommendations(t *testing.T) {
+	ratings, err := testRepo.LessonRatings()
+	if err != nil || len(ratings) == 0 {
+		t.Errorf("expected ratings, but got %d, %v", len(ratings), err)
+	}
+
+	_, err = testRepo.AllFavorites()
+	if err != nil {
+		t.Errorf("all favorites returned an error: %s", err)
+	}
+
+	now := time.Now()
+	err = testRepo.ReplaceRecommendations([]*models.Recommendation{
+		{UserId: 1, LessonId: 4, Score: 0.4, Reason: models.ReasonSameTeacher, SourceLessonId: 5, ComputedAt: now},
+		{UserId: 1, LessonId: 5, Score: 0.9, Reason: models.ReasonSimilarRatings, ComputedAt: now},
+	})
+	if err != nil {
+		t.Errorf("replace recommendations returned an error: %s", err)
+	}
+
+	err = testRepo.ReplaceRecommendations([]*models.Recommendation{
+		{UserId: 1, LessonId: 4, Score: 0.2, Reason: models.ReasonSameDepartment, ComputedAt: now},
+	})
+	if err != nil {
+		t.Errorf("replace recommendations returned an error: %s", err)
+	}
+
+	recommendations, err := testRepo.RecommendationsByUserId(1, 10, 0)
+	if err != nil {
+		t.Errorf("recommendations by user returned an error: %s", err)
+	}
+
+	for _, recommendation := range recommendations {
+		if recommendation.LessonId != 4 || recommendation.Reason != models.ReasonSameDepartment {
+			t.Errorf("recommendation %+v should have been replaced", recommendation)
+		}
+	}
+}
+
+func TestPostgresDBRepoLessonRankings(t *testing.T) {
+	now := time.Now()
+	err := testRepo.ReplaceLessonRankings([]*models.LessonRanking{
+		{LessonId: 4, BayesStar: 3.2, TrendingScore: 0.5, CommentNumbers: 2, ComputedAt: now},
+		{LessonId: 5, BayesStar: 4.1, TrendingScore: 0, CommentNumbers: 3, ComputedAt: now},
+		{LessonId: 5, Year: 2023, Term: "spring", BayesStar: 4.3, CommentNumbers: 1, ComputedAt: now},
+	})
+	if err != nil {
+		t.Errorf("replace lesson rankings returned an error: %s", err)
+	}
+
+	rankings, err := testRepo.LessonRankings(models.RankingFilter{Sort: models.RankingTop, Limit: 10})
+	if err != nil {
+		t.Errorf("lesson rankings returned an error: %s", err)
+	}
+
+	if len(rankings) != 2 || rankings[0].LessonId != 5 || rankings[0].Rank != 1 || rankings[0].Lesson == nil {
+		t.Errorf("expected lesson 5 to top the overall ranking, but got %d rankings", len(rankings))
+	}
+
+	rankings, err = testRepo.LessonRankings(models.RankingFilter{Sort: models.RankingTrending, Limit: 10})
+	if err != nil {
+		t.Errorf("lesson rankings returned an error: %s", err)
+	}
+
+	if len(rankings) != 1 || rankings[0].LessonId != 4 {
+		t.Errorf("expected only lesson 4 to be trending, but got %d rankings", len(rankings))
+	}
+
+	rankings, err = testRepo.LessonRankings(models.RankingFilter{Sort: models.RankingTop, Year: 2023, Term: "spring", Limit: 10})
+	if err != nil {
+		t.Errorf("lesson rankings returned an error: %s", err)
+	}
+
+	if len(rankings) != 1 || rankings[0].BayesStar != 4.3 {
+		t.Errorf("expected one ranking for spring 2023, but got %d", len(rankings))
+	}
+
+	_, err = testRepo.AllLessons(5)
+	if err != nil {
+		t.Errorf("all lessons by ranking returned an error: %s", err)
+	}
+}
+
+func TestPostgresDBRepoFollowsAndNotifications(t *testing.T) {
+	lesson, err := testRepo.GetLessonByID(4)
+	if err != nil {
+		t.Fatalf("error getting lesson 4: %s", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		err = testRepo.FollowLesson(2, 4)
+		if err != nil {
+			t.Errorf("follow lesson returned an error: %s", err)
+		}
+	}
+
+	err = testRepo.FollowLesson(2, 1000)
+	if err == nil {
+		t.Error("followed a lesson that does not exist")
+	}
+
+	err = testRepo.FollowTeacher(2, lesson.TeacherName)
+	if err != nil {
+		t.Errorf("follow teacher returned an error: %s", err)
+	}
+
+	err = testRepo.FollowTeacher(2, "nobody teaches this")
+	if err == nil {
+		t.Error("followed a teacher without lessons")
+	}
+
+	follows, err := testRepo.FollowsByUserId(2)
+	if err != nil || len(follows.Lessons) != 1 || len(follows.Teachers) != 1 {
+		t.Errorf("expected one lesson and one teacher, but got %+v, %v", follows, err)
+	}
+
+	count, err := testRepo.FanOutNotifications(models.FollowEvent{Kind: models.NotificationNewReview, LessonId: 4, ActorId: 1})
+	if err != nil || count != 1 {
+		t.Errorf("expected one new review notification, but got %d, %v", count, err)
+	}
+
+	count, _ = testRepo.FanOutNotifications(models.FollowEvent{Kind: models.NotificationNewReview, LessonId: 4, ActorId: 2})
+	if count != 0 {
+		t.Errorf("notified user 2 of their own review")
+	}
+
+	count, err = testRepo.FanOutNotifications(models.FollowEvent{Kind: models.NotificationNewClass, LessonId: 4, ActorId: 1})
+	if err != nil || count != 1 {
+		t.Errorf("expected one new class notification, but got %d, %v", count, err)
+	}
+
+	unread, _ := testRepo.UnreadNotificationCount(2)
+	if unread != 2 {
+		t.Errorf("expected 2 unread notifications, but got %d", unread)
+	}
+
+	notifications, err := testRepo.NotificationsByUserId(2, true, 10, 0)
+	if err != nil || len(notifications) != 2 || notifications[0].Lesson == nil {
+		t.Fatalf("expected 2 notifications, but got %d, %v", len(notifications), err)
+	}
+
+	err = testRepo.MarkNotificationsRead(1, notifications[0].ID)
+	if err == nil {
+		t.Error("marked another user's notification read")
+	}
+
+	err = testRepo.MarkNotificationsRead(2, notifications[0].ID)
+	if err != nil {
+		t.Errorf("mark notification read returned an error: %s", err)
+	}
+
+	unread, _ = testRepo.UnreadNotificationCount(2)
+	if unread != 1 {
+		t.Errorf("expected 1 unread notification, but got %d", unread)
+	}
+
+	_ = testRepo.MarkNotificationsRead(2, 0)
+
+	notifications, _ = testRepo.NotificationsByUserId(2, true, 10, 0)
+	if len(notifications) != 0 {
+		t.Errorf("expected no unread notifications, but got %d", len(notifications))
+	}
+
+	_ = testRepo.UnfollowLesson(2, 4)
+	_ = testRepo.UnfollowTeacher(2, lesson.TeacherName)
+
+	follows, _ = testRepo.FollowsByUserId(2)
+	if len(follows.Lessons) != 0 || len(follows.Teachers) != 0 {
+		t.Errorf("expected no follows after unfollowing, but got %+v", follows)
+	}
+}
+
+func TestPostgresDBRepoWebhooks(t *testing.T) {
+	id, err := testRepo.InsertWebhook(models.Webhook{
+		URL:        "https://bot.example.com/hook",
+		Secret:     "0123456789abcdef",
+		EventTypes: []string{models.WebhookReviewCreated, models.WebhookReviewDeleted},
+		Active:     true,
+	})
+	if err != nil {
+		t.Fatalf("insert webhook returned an error: %s", err)
+	}
+
+	err = testRepo.UpdateWebhook(models.Webhook{ID: id, URL: "https://bot.example.com/v2", EventTypes: []string{models.WebhookReviewCreated}, Active: true})
+	if err != nil {
+		t.Errorf("update webhook returned an error: %s", err)
+	}
+
+	webhook, _ := testRepo.GetWebhookByID(id)
+	if webhook.URL != "https://bot.example.com/v2" || webhook.Secret != "0123456789abcdef" || len(webhook.EventTypes) != 1 {
+		t.Errorf("unexpected webhook after update %+v", webhook)
+	}
+
+	count, err := testRepo.EnqueueWebhookDeliveries(models.WebhookReviewCreated, []byte(`{"event":"review.created"}`))
+	if err != nil || count != 1 {
+		t.Errorf("expected one queued delivery, but got %d, %v", count, err)
+	}
+
+	count, _ = testRepo.EnqueueWebhookDeliveries(models.WebhookReviewDeleted, []byte(`{"event":"review.deleted"}`))
+	if count != 0 {
+		t.Errorf("queued a delivery for an event the webhook no longer subscribes to")
+	}
+
+	deliveries, err := testRepo.ClaimWebhookDeliveries(10, time.Minute)
+	if err != nil || len(deliveries) != 1 || deliveries[0].Webhook.Secret != "0123456789abcdef" {
+		t.Fatalf("expected to claim one delivery, but got %d, %v", len(deliveries), err)
+	}
+
+	again, _ := testRepo.ClaimWebhookDeliveries(10, time.Minute)
+	if len(again) != 0 {
+		t.Errorf("claimed a leased delivery twice")
+	}
+
+	next, err := testRepo.NextWebhookAttempt()
+	if err != nil || !next.Equal(deliveries[0].NextAttemptAt) {
+		t.Errorf("expected the next attempt when the lease runs out at %s, but got %s, %v", deliveries[0].NextAttemptAt, next, err)
+	}
+
+	delivery := deliveries[0]
+	lease := delivery.NextAttemptAt
+	delivery.Attempts = 1
+	delivery.Status = models.DeliveryDead
+	delivery.LastStatusCode = 500
+	delivery.LastError = "receiver answered 500 Internal Server Error"
+
+	err = testRepo.RecordWebhookAttempt(*delivery, lease.Add(-time.Minute))
+	if !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("expected an attempt under an old lease to be refused, but got %v", err)
+	}
+
+	err = testRepo.RecordWebhookAttempt(*delivery, lease)
+	if err != nil {
+		t.Errorf("record webhook attempt returned an error: %s", err)
+	}
+
+	err = testRepo.RecordWebhookAttempt(*delivery, lease)
+	if !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("expected a second record of the same attempt to be refused, but got %v", err)
+	}
+
+	_, err = testRepo.NextWebhookAttempt()
+	if !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("expected no next attempt once the delivery is dead, but got %v", err)
+	}
+
+	dead, _ := testRepo.WebhookDeliveries(id, models.DeliveryDead, 10, 0)
+	if len(dead) != 1 || dead[0].LastStatusCode != 500 || string(dead[0].Payload) != `{"event":"review.created"}` {
+		t.Errorf("expected the dead delivery in the log, but got %+v", dead)
+	}
+
+	err = testRepo.RetryWebhookDelivery(delivery.ID)
+	if err != nil {
+		t.Errorf("retry webhook delivery returned an error: %s", err)
+	}
+
+	err = testRepo.RetryWebhookDelivery(delivery.ID)
+	if err == nil {
+		t.Error("retried a delivery that is not dead")
+	}
+
+	deliveries, _ = testRepo.ClaimWebhookDeliveries(10, time.Minute)
+	if len(deliveries) != 1 || deliveries[0].Attempts != 0 {
+		t.Errorf("expected the retried delivery to be due again, but got %d", len(deliveries))
+	}
+
+	err = testRepo.DeleteWebhook(id)
+	if err != nil {
+		t.Errorf("delete webhook returned an error: %s", err)
+	}
+
+	webhooks, _ := testRepo.AllWebhooks()
+	if len(webhooks) != 0 {
+		t.Errorf("expected no webhooks after deleting, but got %d", len(webhooks))
+	}
+}
+
+func TestPostgresDBRepoDigest(t *testing.T) {
+	reader := models.User{FirstName: "Yoko", LastName: "Ito", Email: "yoko@example.com", Password: "secret"}
+	readerID, _ := testRepo.InsertUser(reader)
+	reader.Email = "kenji@example.com"
+	writerID, _ := testRepo.InsertUser(reader)
+
+	_ = testRepo.AddFavorite(readerID, 5)
+	_, _ = testRepo.InsertComment(models.Comment{LessonId: 5, UserId: writerID, Year: 2024, Term: "digest", Comment: "new", Star: 4, ModerationStatus: models.CommentVisible})
+	_, _ = testRepo.InsertComment(models.Comment{LessonId: 5, UserId: writerID, Year: 2023, Term: "digest", Comment: "held", Star: 1, ModerationStatus: models.CommentPending})
+	_, _ = testRepo.InsertComment(models.Comment{LessonId: 5, UserId: readerID, Year: 2024, Term: "digest", Comment: "mine", Star: 5, ModerationStatus: models.CommentVisible})
+
+	now := time.Now().Add(time.Minute)
+
+	prefs, err := testRepo.GetDigestPreferences(readerID)
+	if err != nil || !prefs.Enabled || prefs.Language != models.DigestJapanese || prefs.LastDigestAt != nil {
+		t.Errorf("expected default digest preferences, but got %+v, %v", prefs, err)
+	}
+
+	recipients, err := testRepo.DigestRecipients(now, 100)
+	if err != nil {
+		t.Fatalf("digest recipients returned an error: %s", err)
+	}
+
+	found := false
+	for _, recipient := range recipients {
+		if recipient.UserId == writerID {
+			t.Error("a user without favorites is due a digest")
+		}
+		if recipient.UserId == readerID {
+			found = true
+		}
+	}
+	if !found {
+		t.Error("expected the user with favorites to be due a digest")
+	}
+
+	reviews, err := testRepo.DigestReviews(readerID, now.Add(-time.Hour), now, 50)
+	if err != nil || len(reviews) != 1 || reviews[0].Comment != "new" || reviews[0].LessonId != 5 {
+		t.Errorf("expected only the other user's visible review, but got %v, %v", reviews, err)
+	}
+
+	err = testRepo.MarkDigestSent(readerID, now)
+	if err != nil {
+		t.Errorf("mark digest sent returned an error: %s", err)
+	}
+
+	recipients, _ = testRepo.DigestRecipients(now.Add(-time.Hour), 100)
+	for _, recipient := range recipients {
+		if recipient.UserId == readerID {
+			t.Error("a user is due another digest right after one was sent")
+		}
+	}
+
+	err = testRepo.UpdateDigestPreferences(models.DigestPreferences{UserId: readerID, Enabled: false, Language: models.DigestEnglish})
+	if err != nil {
+		t.Errorf("update digest preferences returned an error: %s", err)
+	}
+
+	prefs, _ = testRepo.GetDigestPreferences(readerID)
+	if prefs.Enabled || prefs.Language != models.DigestEnglish || prefs.LastDigestAt == nil {
+		t.Errorf("expected the digest off in English with the last digest kept, but got %+v", prefs)
+	}
+
+	recipients, _ = testRepo.DigestRecipients(now.Add(time.Hour*24*365), 100)
+	for _, recipient := range recipients {
+		if recipient.UserId == readerID {
+			t.Error("a user who turned the digest off is due one")
+		}
+	}
+}
+
+func TestPostgresDBRepoJobLeases(t *testing.T) {
+	id, _ := testRepo.EnqueueJob(models.Job{Kind: "lease_test", MaxAttempts: 3, RunAt: time.Now().Add(-time.Second)})
+
+	// a lease that has already run out lets the job be claimed again at once
+	first, _ := testRepo.ClaimJobs([]string{"lease_test"}, 1, -time.Second)
+	second, _ := testRepo.ClaimJobs([]string{"lease_test"}, 1, time.Minute)
+	if len(first) != 1 || len(second) != 1 || second[0].ID != id || second[0].Attempts != 2 {
+		t.Fatalf("expected the job to be claimed again after its lease ran out, but got %d and %d", len(first), len(second))
+	}
+
+	first[0].Status = models.JobSucceeded
+	err := testRepo.RecordJobResult(*first[0])
+	if !errors.Is(err, repository.ErrJobLeaseLost) {
+		t.Errorf("expected the first worker's result to be refused, but got %v", err)
+	}
+
+	second[0].Status = models.JobPending
+	second[0].LastError = "connection refused"
+	err = testRepo.RecordJobResult(*second[0])
+	if err != nil {
+		t.Errorf("record job result returned an error: %s", err)
+	}
+
+	job, _ := testRepo.GetJobByID(id)
+	if job.Status != models.JobPending || job.LastError != "connection refused" {
+		t.Errorf("expected the second worker's result to be kept, but got %+v", job)
+	}
+
+	last, _ := testRepo.EnqueueJob(models.Job{Kind: "lease_test_last", MaxAttempts: 1, RunAt: time.Now().Add(-time.Second)})
+	_, _ = testRepo.ClaimJobs([]string{"lease_test_last"}, 1, -time.Second)
+
+	claimed, err := testRepo.ClaimJobs([]string{"lease_test_last"}, 1, time.Minute)
+	if err != nil || len(claimed) != 0 {
+		t.Errorf("claimed a job again after its last attempt, got %d, %v", len(claimed), err)
+	}
+
+	job, _ = testRepo.GetJobByID(last)
+	if job.Status != models.JobFailed || job.Attempts != 1 || job.FinishedAt == nil {
+		t.Errorf("expected a job whose last lease ran out to fail, but got %+v", job)
+	}
+}
+
+func TestPostgresDBRepoJobs(t *testing.T) {
+	now := time.Now()
+
+	id, err := testRepo.EnqueueJob(models.Job{Kind: "repair_lesson_aggregates", Payload: []byte(`{"lesson_id":4}`), MaxAttempts: 2, RunAt: now.Add(-time.Second), UniqueKey: "repair@1"})
+	if err != nil || id == 0 {
+		t.Fatalf("enqueue job returned %d, %v", id, err)
+	}
+
+	again, err := testRepo.EnqueueJob(models.Job{Kind: "repair_lesson_aggregates", MaxAttempts: 2, RunAt: now, UniqueKey: "repair@1"})
+	if err != nil || again != 0 {
+		t.Errorf("expected a job with the same unique key to be dropped, but got %d, %v", again, err)
+	}
+
+	later, _ := testRepo.EnqueueJob(models.Job{Kind: "repair_lesson_aggregates", MaxAttempts: 2, RunAt: now.Add(time.Hour)})
+	other, _ := testRepo.EnqueueJob(models.Job{Kind: "send_digests", MaxAttempts: 2, RunAt: now.Add(-time.Second)})
+
+	jobs, err := testRepo.ClaimJobs([]string{"repair_lesson_aggregates", "compute_rankings"}, 10, time.Minute)
+	if err != nil || len(jobs) != 1 || jobs[0].ID != id {
+		t.Fatalf("expected to claim only the due job of a handled kind, but got %d, %v", len(jobs), err)
+	}
+
+	job := jobs[0]
+	if job.Status != models.JobRunning || job.Attempts != 1 || string(job.Payload) != `{"lesson_id":4}` || job.UniqueKey != "repair@1" {
+		t.Errorf("unexpected claimed job %+v", job)
+	}
+
+	claimed, _ := testRepo.ClaimJobs([]string{"repair_lesson_aggregates"}, 10, time.Minute)
+	if len(claimed) != 0 {
+		t.Errorf("claimed a leased job twice")
+	}
+
+	finished := time.Now()
+	job.Status = models.JobFailed
+	job.LastError = "connection refused"
+	job.FinishedAt = &finished
+	err = testRepo.RecordJobResult(*job)
+	if err != nil {
+		t.Errorf("record job result returned an error: %s", err)
+	}
+
+	failed, _ := testRepo.Jobs(models.JobFilter{Status: models.JobFailed, Limit: 10})
+	if len(failed) != 1 || failed[0].ID != id || failed[0].LastError != "connection refused" || failed[0].FinishedAt == nil {
+		t.Errorf("expected the failed job in the list, but got %+v", failed)
+	}
+
+	digests, _ := testRepo.Jobs(models.JobFilter{Kind: "send_digests", Limit: 10})
+	if len(digests) != 1 || digests[0].ID != other {
+		t.Errorf("expected only the digest job, but got %d", len(digests))
+	}
+
+	err = testRepo.RetryJob(id)
+	if err != nil {
+		t.Errorf("retry job returned an error: %s", err)
+	}
+
+	err = testRepo.RetryJob(later)
+	if err == nil {
+		t.Error("retried a job that has not failed")
+	}
+
+	retried, err := testRepo.GetJobByID(id)
+	if err != nil || retried.Status != models.JobPending || retried.Attempts != 0 || retried.FinishedAt != nil {
+		t.Errorf("expected the retried job to be pending again, but got %+v, %v", retried, err)
+	}
+
+	jobs, _ = testRepo.ClaimJobs([]string{"repair_lesson_aggregates"}, 10, time.Minute)
+	if len(jobs) != 1 || jobs[0].ID != id {
+		t.Fatalf("expected the retried job to be due, but got %d", len(jobs))
+	}
+
+	finished = time.Now().Add(-time.Hour)
+	jobs[0].Status = models.JobSucceeded
+	jobs[0].LastError = ""
+	jobs[0].FinishedAt = &finished
+	_ = testRepo.RecordJobResult(*jobs[0])
+
+	pruned, err := testRepo.PruneJobs(time.Now())
+	if err != nil || pruned != 1 {
+		t.Errorf("expected the succeeded job to be pruned, but got %d, %v", pruned, err)
+	}
+
+	_, err = testRepo.GetJobByID(id)
+	if err == nil {
+		t.Error("found a pruned job")
+	}
+}
+
+func TestPostgresDBRepoModerationWarning(t *testing.T) {
+	// a warning leaves the review up and tells its author
+	commentID, _ := testRepo.InsertComment(models.Comment{
+		LessonId:     1,
+		UserId:       1,
+		Year:         2019,
+		Term:         "latter",
+		Comment:      "the teacher is useless",
+		TestOrReport: "Test",
+		Star:         1,
+	})
+	id, _ := testRepo.InsertReport(models.Report{CommentId: commentID, UserId: 2, Reason: models.ReportAbuse})
+
+	err := testRepo.ModerateReport(models.ModerationAction{ReportId: id, ModeratorId: 2, Action: models.ModerationWarn})
+	if err != nil {
+		t.Errorf("moderate report returned an error: %s", err)
+	}
+
+	warned, err := testRepo.GetCommentByID(commentID)
+	if err != nil || warned.ModerationStatus != models.CommentVisible {
+		t.Errorf("expected a warned comment to stay visible, but got %v", err)
+	}
+
+	notifications, _ := testRepo.NotificationsByUserId(1, true, 10, 0)
+	if len(notifications) != 1 || notifications[0].Kind != models.NotificationWarning || notifications[0].CommentId != commentID {
+		t.Errorf("expected the author to be notified of the warning, but got %d notifications", len(notifications))
+	}
+
+	_ = testRepo.DeleteComment(commentID)
+}
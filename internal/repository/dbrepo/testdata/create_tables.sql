@@ -10,9 +10,13 @@ CREATE TABLE public.users (
     email character varying(255),
     password character varying(255),
     image character varying(255),
+    pending_image character varying(255) DEFAULT ''::character varying NOT NULL,
     is_admin integer,
+    show_real_name boolean DEFAULT false NOT NULL,
+    session_version integer DEFAULT 0 NOT NULL,
     created_at timestamp without time zone,
-    updated_at timestamp without time zone
+    updated_at timestamp without time zone,
+    deleted_at timestamp without time zone
 );
 
 --
@@ -37,11 +41,14 @@ CREATE TABLE public.lessons (
     user_id integer,
     lesson_name character varying(255),
     teacher_name character varying(255),
+    department character varying(255) DEFAULT '' NOT NULL,
     avg_star float,
     about_avg_star integer,
     comment_numbers integer,
+    favorite_count integer DEFAULT 0 NOT NULL,
     created_at timestamp without time zone,
-    updated_at timestamp without time zone
+    updated_at timestamp without time zone,
+    deleted_at timestamp without time zone
 );
 
 --
@@ -70,8 +77,14 @@ CREATE TABLE public.comments (
     comment character varying(255),
     test_or_report character varying(255),
     star integer,
+    helpful_count integer DEFAULT 0 NOT NULL,
+    unhelpful_count integer DEFAULT 0 NOT NULL,
+    reply_count integer DEFAULT 0 NOT NULL,
+    moderation_status character varying(20) DEFAULT 'visible' NOT NULL,
+    edited boolean DEFAULT false NOT NULL,
     created_at timestamp without time zone,
-    updated_at timestamp without time zone
+    updated_at timestamp without time zone,
+    deleted_at timestamp without time zone
 );
 
 --
@@ -88,46 +101,1171 @@ ALTER TABLE public.comments ALTER COLUMN id ADD GENERATED ALWAYS AS IDENTITY (
 );
 
 --
--- Name: users users_pkey; Type: CONSTRAINT; Schema: public; Owner: -
+-- Name: comment_votes; Type: TABLE; Schema: public; Owner: -
 --
 
-ALTER TABLE ONLY public.users
-    ADD CONSTRAINT users_pkey PRIMARY KEY (id);
+CREATE TABLE public.comment_votes (
+    id integer NOT NULL,
+    comment_id integer NOT NULL,
+    user_id integer NOT NULL,
+    helpful boolean NOT NULL,
+    created_at timestamp without time zone,
+    updated_at timestamp without time zone
+);
 
 --
--- Name: lessons lessons_pkey; Type: CONSTRAINT; Schema: public; Owner: -
+-- Name: comment_votes_id_seq; Type: SEQUENCE; Schema: public; Owner: -
 --
 
-ALTER TABLE ONLY public.lessons
-    ADD CONSTRAINT lessons_pkey PRIMARY KEY (id);
+ALTER TABLE public.comment_votes ALTER COLUMN id ADD GENERATED ALWAYS AS IDENTITY (
+    SEQUENCE NAME public.comment_votes_id_seq
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1
+);
 
 --
--- Name: comments comments_pkey; Type: CONSTRAINT; Schema: public; Owner: -
+-- Name: reports; Type: TABLE; Schema: public; Owner: -
 --
 
-ALTER TABLE ONLY public.comments
-    ADD CONSTRAINT comments_pkey PRIMARY KEY (id);
+CREATE TABLE public.reports (
+    id integer NOT NULL,
+    comment_id integer NOT NULL,
+    user_id integer NOT NULL,
+    reason character varying(50) NOT NULL,
+    detail character varying(255),
+    status character varying(20) DEFAULT 'pending' NOT NULL,
+    created_at timestamp without time zone,
+    updated_at timestamp without time zone
+);
 
 --
--- Name: comments comments_lesson_id_fkey; Type: FK CONSTRAINT; Schema: public; Owner: -
+-- Name: reports_id_seq; Type: SEQUENCE; Schema: public; Owner: -
 --
 
-ALTER TABLE ONLY public.comments
-    ADD CONSTRAINT comments_lesson_id_fkey FOREIGN KEY (lesson_id) REFERENCES public.lessons(id) ON UPDATE CASCADE ON DELETE CASCADE;
+ALTER TABLE public.reports ALTER COLUMN id ADD GENERATED ALWAYS AS IDENTITY (
+    SEQUENCE NAME public.reports_id_seq
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1
+);
 
 --
--- Name: comments comments_user_id_fkey; Type: FK CONSTRAINT; Schema: public; Owner: -
+-- Name: moderation_actions; Type: TABLE; Schema: public; Owner: -
 --
 
-ALTER TABLE ONLY public.comments
-    ADD CONSTRAINT comments_user_id_fkey FOREIGN KEY (user_id) REFERENCES public.users(id) ON UPDATE CASCADE ON DELETE CASCADE;
+CREATE TABLE public.moderation_actions (
+    id integer NOT NULL,
+    report_id integer,
+    comment_id integer,
+    moderator_id integer,
+    user_id integer,
+    action character varying(20) NOT NULL,
+    note character varying(255),
+    created_at timestamp without time zone
+);
 
 --
--- Name: lessons lessons_user_id_fkey; Type: FK CONSTRAINT; Schema: public; Owner: -
+-- Name: moderation_actions_id_seq; Type: SEQUENCE; Schema: public; Owner: -
 --
 
-ALTER TABLE ONLY public.lessons
-    ADD CONSTRAINT lessons_user_id_fkey FOREIGN KEY (user_id) REFERENCES public.users(id) ON UPDATE CASCADE ON DELETE CASCADE;
+ALTER TABLE public.moderation_actions ALTER COLUMN id ADD GENERATED ALWAYS AS IDENTITY (
+    SEQUENCE NAME public.moderation_actions_id_seq
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1
+);
+
+--
+-- Name: comment_revisions; Type: TABLE; Schema: public; Owner: -
+--
+
+CREATE TABLE public.comment_revisions (
+    id integer NOT NULL,
+    comment_id integer NOT NULL,
+    editor_id integer,
+    year integer,
+    term character varying(255),
+    comment character varying(255),
+    test_or_report character varying(255),
+    star integer,
+    created_at timestamp without time zone
+);
+
+--
+-- Name: comment_revisions_id_seq; Type: SEQUENCE; Schema: public; Owner: -
+--
+
+ALTER TABLE public.comment_revisions ALTER COLUMN id ADD GENERATED ALWAYS AS IDENTITY (
+    SEQUENCE NAME public.comment_revisions_id_seq
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1
+);
+
+--
+-- Name: comment_replies; Type: TABLE; Schema: public; Owner: -
+--
+
+CREATE TABLE public.comment_replies (
+    id integer NOT NULL,
+    comment_id integer NOT NULL,
+    parent_id integer,
+    user_id integer NOT NULL,
+    depth integer DEFAULT 0 NOT NULL,
+    body character varying(255),
+    created_at timestamp without time zone,
+    updated_at timestamp without time zone,
+    deleted_at timestamp without time zone
+);
+
+--
+-- Name: comment_replies_id_seq; Type: SEQUENCE; Schema: public; Owner: -
+--
+
+ALTER TABLE public.comment_replies ALTER COLUMN id ADD GENERATED ALWAYS AS IDENTITY (
+    SEQUENCE NAME public.comment_replies_id_seq
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1
+);
+
+--
+-- Name: attachments; Type: TABLE; Schema: public; Owner: -
+--
+
+CREATE TABLE public.attachments (
+    id integer NOT NULL,
+    lesson_id integer NOT NULL,
+    user_id integer NOT NULL,
+    year integer NOT NULL,
+    term character varying(255) NOT NULL,
+    test_or_report character varying(255),
+    file_name character varying(255) NOT NULL,
+    content_type character varying(255) NOT NULL,
+    size bigint NOT NULL,
+    storage_key character varying(255) NOT NULL,
+    created_at timestamp without time zone
+);
+
+--
+-- Name: attachments_id_seq; Type: SEQUENCE; Schema: public; Owner: -
+--
+
+ALTER TABLE public.attachments ALTER COLUMN id ADD GENERATED ALWAYS AS IDENTITY (
+    SEQUENCE NAME public.attachments_id_seq
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1
+);
+
+--
+-- Name: email_changes; Type: TABLE; Schema: public; Owner: -
+--
+
+CREATE TABLE public.email_changes (
+    id integer NOT NULL,
+    user_id integer NOT NULL,
+    new_email character varying(255) NOT NULL,
+    token_hash character varying(64) NOT NULL,
+    expires_at timestamp without time zone NOT NULL,
+    created_at timestamp without time zone
+);
+
+--
+-- Name: email_changes_id_seq; Type: SEQUENCE; Schema: public; Owner: -
+--
+
+ALTER TABLE public.email_changes ALTER COLUMN id ADD GENERATED ALWAYS AS IDENTITY (
+    SEQUENCE NAME public.email_changes_id_seq
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1
+);
+
+--
+-- Name: user_favorites; Type: TABLE; Schema: public; Owner: -
+--
+
+CREATE TABLE public.user_favorites (
+    id integer NOT NULL,
+    user_id integer NOT NULL,
+    lesson_id integer NOT NULL,
+    created_at timestamp without time zone
+);
+
+--
+-- Name: user_favorites_id_seq; Type: SEQUENCE; Schema: public; Owner: -
+--
+
+ALTER TABLE public.user_favorites ALTER COLUMN id ADD GENERATED ALWAYS AS IDENTITY (
+    SEQUENCE NAME public.user_favorites_id_seq
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1
+);
+
+--
+-- Name: lesson_offerings; Type: TABLE; Schema: public; Owner: -
+--
+
+CREATE TABLE public.lesson_offerings (
+    id integer NOT NULL,
+    lesson_id integer NOT NULL,
+    year integer NOT NULL,
+    term character varying(255) NOT NULL,
+    credits integer DEFAULT 0 NOT NULL,
+    created_at timestamp without time zone,
+    updated_at timestamp without time zone
+);
+
+--
+-- Name: lesson_offerings_id_seq; Type: SEQUENCE; Schema: public; Owner: -
+--
+
+ALTER TABLE public.lesson_offerings ALTER COLUMN id ADD GENERATED ALWAYS AS IDENTITY (
+    SEQUENCE NAME public.lesson_offerings_id_seq
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1
+);
+
+--
+-- Name: offering_slots; Type: TABLE; Schema: public; Owner: -
+--
+
+CREATE TABLE public.offering_slots (
+    id integer NOT NULL,
+    offering_id integer NOT NULL,
+    day integer NOT NULL,
+    period integer NOT NULL
+);
+
+--
+-- Name: offering_slots_id_seq; Type: SEQUENCE; Schema: public; Owner: -
+--
+
+ALTER TABLE public.offering_slots ALTER COLUMN id ADD GENERATED ALWAYS AS IDENTITY (
+    SEQUENCE NAME public.offering_slots_id_seq
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1
+);
+
+--
+-- Name: timetable_entries; Type: TABLE; Schema: public; Owner: -
+--
+
+CREATE TABLE public.timetable_entries (
+    id integer NOT NULL,
+    user_id integer NOT NULL,
+    offering_id integer NOT NULL,
+    created_at timestamp without time zone
+);
+
+--
+-- Name: timetable_entries_id_seq; Type: SEQUENCE; Schema: public; Owner: -
+--
+
+ALTER TABLE public.timetable_entries ALTER COLUMN id ADD GENERATED ALWAYS AS IDENTITY (
+    SEQUENCE NAME public.timetable_entries_id_seq
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1
+);
+
+--
+-- Name: academic_terms; Type: TABLE; Schema: public; Owner: -
+--
+
+CREATE TABLE public.academic_terms (
+    id integer NOT NULL,
+    year integer NOT NULL,
+    term character varying(255) NOT NULL,
+    starts_on date NOT NULL,
+    ends_on date NOT NULL,
+    created_at timestamp without time zone,
+    updated_at timestamp without time zone
+);
+
+--
+-- Name: academic_terms_id_seq; Type: SEQUENCE; Schema: public; Owner: -
+--
+
+ALTER TABLE public.academic_terms ALTER COLUMN id ADD GENERATED ALWAYS AS IDENTITY (
+    SEQUENCE NAME public.academic_terms_id_seq
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1
+);
+
+--
+-- Name: calendar_tokens; Type: TABLE; Schema: public; Owner: -
+--
+
+CREATE TABLE public.calendar_tokens (
+    id integer NOT NULL,
+    user_id integer NOT NULL,
+    token_hash character varying(64) NOT NULL,
+    created_at timestamp without time zone
+);
+
+--
+-- Name: calendar_tokens_id_seq; Type: SEQUENCE; Schema: public; Owner: -
+--
+
+ALTER TABLE public.calendar_tokens ALTER COLUMN id ADD GENERATED ALWAYS AS IDENTITY (
+    SEQUENCE NAME public.calendar_tokens_id_seq
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1
+);
+
+--
+-- Name: lesson_recommendations; Type: TABLE; Schema: public; Owner: -
+--
+
+CREATE TABLE public.lesson_recommendations (
+    id integer NOT NULL,
+    user_id integer NOT NULL,
+    lesson_id integer NOT NULL,
+    score double precision NOT NULL,
+    reason character varying(255) NOT NULL,
+    source_lesson_id integer,
+    computed_at timestamp without time zone NOT NULL
+);
+
+--
+-- Name: lesson_recommendations_id_seq; Type: SEQUENCE; Schema: public; Owner: -
+--
+
+ALTER TABLE public.lesson_recommendations ALTER COLUMN id ADD GENERATED ALWAYS AS IDENTITY (
+    SEQUENCE NAME public.lesson_recommendations_id_seq
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1
+);
+
+--
+-- Name: lesson_rankings; Type: TABLE; Schema: public; Owner: -
+--
+
+CREATE TABLE public.lesson_rankings (
+    id integer NOT NULL,
+    lesson_id integer NOT NULL,
+    year integer DEFAULT 0 NOT NULL,
+    term character varying(255) DEFAULT '' NOT NULL,
+    bayes_star double precision NOT NULL,
+    trending_score double precision DEFAULT 0 NOT NULL,
+    comment_numbers integer DEFAULT 0 NOT NULL,
+    computed_at timestamp without time zone NOT NULL
+);
+
+--
+-- Name: lesson_rankings_id_seq; Type: SEQUENCE; Schema: public; Owner: -
+--
+
+ALTER TABLE public.lesson_rankings ALTER COLUMN id ADD GENERATED ALWAYS AS IDENTITY (
+    SEQUENCE NAME public.lesson_rankings_id_seq
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1
+);
+
+--
+-- Name: lesson_follows; Type: TABLE; Schema: public; Owner: -
+--
+
+CREATE TABLE public.lesson_follows (
+    id integer NOT NULL,
+    user_id integer NOT NULL,
+    lesson_id integer NOT NULL,
+    created_at timestamp without time zone NOT NULL
+);
+
+--
+-- Name: lesson_follows_id_seq; Type: SEQUENCE; Schema: public; Owner: -
+--
+
+ALTER TABLE public.lesson_follows ALTER COLUMN id ADD GENERATED ALWAYS AS IDENTITY (
+    SEQUENCE NAME public.lesson_follows_id_seq
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1
+);
+
+--
+-- Name: teacher_follows; Type: TABLE; Schema: public; Owner: -
+--
+
+CREATE TABLE public.teacher_follows (
+    id integer NOT NULL,
+    user_id integer NOT NULL,
+    teacher_name character varying(255) NOT NULL,
+    created_at timestamp without time zone NOT NULL
+);
+
+--
+-- Name: teacher_follows_id_seq; Type: SEQUENCE; Schema: public; Owner: -
+--
+
+ALTER TABLE public.teacher_follows ALTER COLUMN id ADD GENERATED ALWAYS AS IDENTITY (
+    SEQUENCE NAME public.teacher_follows_id_seq
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1
+);
+
+--
+-- Name: notifications; Type: TABLE; Schema: public; Owner: -
+--
+
+CREATE TABLE public.notifications (
+    id integer NOT NULL,
+    user_id integer NOT NULL,
+    kind character varying(32) NOT NULL,
+    lesson_id integer NOT NULL,
+    comment_id integer,
+    offering_id integer,
+    read_at timestamp without time zone,
+    created_at timestamp without time zone NOT NULL
+);
+
+--
+-- Name: notifications_id_seq; Type: SEQUENCE; Schema: public; Owner: -
+--
+
+ALTER TABLE public.notifications ALTER COLUMN id ADD GENERATED ALWAYS AS IDENTITY (
+    SEQUENCE NAME public.notifications_id_seq
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1
+);
+
+--
+-- Name: webhooks; Type: TABLE; Schema: public; Owner: -
+--
+
+CREATE TABLE public.webhooks (
+    id integer NOT NULL,
+    url character varying(2048) NOT NULL,
+    secret character varying(255) NOT NULL,
+    event_types character varying(255) NOT NULL,
+    active boolean DEFAULT true NOT NULL,
+    created_at timestamp without time zone NOT NULL,
+    updated_at timestamp without time zone NOT NULL
+);
+
+--
+-- Name: webhooks_id_seq; Type: SEQUENCE; Schema: public; Owner: -
+--
+
+ALTER TABLE public.webhooks ALTER COLUMN id ADD GENERATED ALWAYS AS IDENTITY (
+    SEQUENCE NAME public.webhooks_id_seq
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1
+);
+
+--
+-- Name: webhook_deliveries; Type: TABLE; Schema: public; Owner: -
+--
+
+CREATE TABLE public.webhook_deliveries (
+    id integer NOT NULL,
+    webhook_id integer NOT NULL,
+    event_type character varying(64) NOT NULL,
+    payload text NOT NULL,
+    status character varying(16) DEFAULT 'pending' NOT NULL,
+    attempts integer DEFAULT 0 NOT NULL,
+    next_attempt_at timestamp without time zone NOT NULL,
+    last_status_code integer DEFAULT 0 NOT NULL,
+    last_error text DEFAULT '' NOT NULL,
+    delivered_at timestamp without time zone,
+    created_at timestamp without time zone NOT NULL,
+    updated_at timestamp without time zone NOT NULL
+);
+
+--
+-- Name: webhook_deliveries_id_seq; Type: SEQUENCE; Schema: public; Owner: -
+--
+
+ALTER TABLE public.webhook_deliveries ALTER COLUMN id ADD GENERATED ALWAYS AS IDENTITY (
+    SEQUENCE NAME public.webhook_deliveries_id_seq
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1
+);
+
+--
+-- Name: digest_preferences; Type: TABLE; Schema: public; Owner: -
+--
+
+CREATE TABLE public.digest_preferences (
+    id integer NOT NULL,
+    user_id integer NOT NULL,
+    enabled boolean DEFAULT true NOT NULL,
+    language character varying(8) DEFAULT 'ja'::character varying NOT NULL,
+    last_digest_at timestamp without time zone,
+    created_at timestamp without time zone NOT NULL,
+    updated_at timestamp without time zone NOT NULL
+);
+
+--
+-- Name: digest_preferences_id_seq; Type: SEQUENCE; Schema: public; Owner: -
+--
+
+ALTER TABLE public.digest_preferences ALTER COLUMN id ADD GENERATED ALWAYS AS IDENTITY (
+    SEQUENCE NAME public.digest_preferences_id_seq
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1
+);
+
+--
+-- Name: jobs; Type: TABLE; Schema: public; Owner: -
+--
+
+CREATE TABLE public.jobs (
+    id integer NOT NULL,
+    kind character varying(64) NOT NULL,
+    payload text DEFAULT '{}'::text NOT NULL,
+    status character varying(16) DEFAULT 'pending'::character varying NOT NULL,
+    attempts integer DEFAULT 0 NOT NULL,
+    max_attempts integer NOT NULL,
+    run_at timestamp without time zone NOT NULL,
+    unique_key character varying(255),
+    last_error text DEFAULT ''::text NOT NULL,
+    finished_at timestamp without time zone,
+    created_at timestamp without time zone NOT NULL,
+    updated_at timestamp without time zone NOT NULL
+);
+
+--
+-- Name: jobs_id_seq; Type: SEQUENCE; Schema: public; Owner: -
+--
+
+ALTER TABLE public.jobs ALTER COLUMN id ADD GENERATED ALWAYS AS IDENTITY (
+    SEQUENCE NAME public.jobs_id_seq
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1
+);
+
+--
+-- Name: users users_pkey; Type: CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.users
+    ADD CONSTRAINT users_pkey PRIMARY KEY (id);
+
+--
+-- Name: lessons lessons_pkey; Type: CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.lessons
+    ADD CONSTRAINT lessons_pkey PRIMARY KEY (id);
+
+--
+-- Name: comments comments_pkey; Type: CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.comments
+    ADD CONSTRAINT comments_pkey PRIMARY KEY (id);
+
+--
+-- Name: comments_user_id_lesson_id_year_term_key; Type: INDEX; Schema: public; Owner: -
+--
+
+CREATE UNIQUE INDEX comments_user_id_lesson_id_year_term_key ON public.comments USING btree (user_id, lesson_id, year, term) WHERE (deleted_at IS NULL);
+
+--
+-- Name: webhook_deliveries_due_idx; Type: INDEX; Schema: public; Owner: -
+--
+
+CREATE INDEX webhook_deliveries_due_idx ON public.webhook_deliveries USING btree (next_attempt_at) WHERE ((status)::text = 'pending'::text);
+
+--
+-- Name: jobs_due_idx; Type: INDEX; Schema: public; Owner: -
+--
+
+CREATE INDEX jobs_due_idx ON public.jobs USING btree (run_at) WHERE ((status)::text = ANY ((ARRAY['pending'::character varying, 'running'::character varying])::text[]));
+
+--
+-- Name: comments comments_lesson_id_fkey; Type: FK CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.comments
+    ADD CONSTRAINT comments_lesson_id_fkey FOREIGN KEY (lesson_id) REFERENCES public.lessons(id) ON UPDATE CASCADE ON DELETE RESTRICT;
+
+--
+-- Name: comments comments_user_id_fkey; Type: FK CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.comments
+    ADD CONSTRAINT comments_user_id_fkey FOREIGN KEY (user_id) REFERENCES public.users(id) ON UPDATE CASCADE ON DELETE RESTRICT;
+
+--
+-- Name: lessons lessons_user_id_fkey; Type: FK CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.lessons
+    ADD CONSTRAINT lessons_user_id_fkey FOREIGN KEY (user_id) REFERENCES public.users(id) ON UPDATE CASCADE ON DELETE RESTRICT;
+
+--
+-- Name: comment_votes comment_votes_pkey; Type: CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.comment_votes
+    ADD CONSTRAINT comment_votes_pkey PRIMARY KEY (id);
+
+--
+-- Name: comment_votes comment_votes_comment_id_user_id_key; Type: CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.comment_votes
+    ADD CONSTRAINT comment_votes_comment_id_user_id_key UNIQUE (comment_id, user_id);
+
+--
+-- Name: comment_votes comment_votes_comment_id_fkey; Type: FK CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.comment_votes
+    ADD CONSTRAINT comment_votes_comment_id_fkey FOREIGN KEY (comment_id) REFERENCES public.comments(id) ON UPDATE CASCADE ON DELETE CASCADE;
+
+--
+-- Name: comment_votes comment_votes_user_id_fkey; Type: FK CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.comment_votes
+    ADD CONSTRAINT comment_votes_user_id_fkey FOREIGN KEY (user_id) REFERENCES public.users(id) ON UPDATE CASCADE ON DELETE CASCADE;
+
+--
+-- Name: reports reports_pkey; Type: CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.reports
+    ADD CONSTRAINT reports_pkey PRIMARY KEY (id);
+
+--
+-- Name: reports reports_comment_id_user_id_key; Type: CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.reports
+    ADD CONSTRAINT reports_comment_id_user_id_key UNIQUE (comment_id, user_id);
+
+--
+-- Name: reports reports_comment_id_fkey; Type: FK CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.reports
+    ADD CONSTRAINT reports_comment_id_fkey FOREIGN KEY (comment_id) REFERENCES public.comments(id) ON UPDATE CASCADE ON DELETE CASCADE;
+
+--
+-- Name: reports reports_user_id_fkey; Type: FK CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.reports
+    ADD CONSTRAINT reports_user_id_fkey FOREIGN KEY (user_id) REFERENCES public.users(id) ON UPDATE CASCADE ON DELETE CASCADE;
+
+--
+-- Name: moderation_actions moderation_actions_pkey; Type: CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.moderation_actions
+    ADD CONSTRAINT moderation_actions_pkey PRIMARY KEY (id);
+
+--
+-- Name: moderation_actions moderation_actions_report_id_fkey; Type: FK CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.moderation_actions
+    ADD CONSTRAINT moderation_actions_report_id_fkey FOREIGN KEY (report_id) REFERENCES public.reports(id) ON UPDATE CASCADE ON DELETE SET NULL;
+
+--
+-- Name: moderation_actions moderation_actions_comment_id_fkey; Type: FK CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.moderation_actions
+    ADD CONSTRAINT moderation_actions_comment_id_fkey FOREIGN KEY (comment_id) REFERENCES public.comments(id) ON UPDATE CASCADE ON DELETE SET NULL;
+
+--
+-- Name: moderation_actions moderation_actions_moderator_id_fkey; Type: FK CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.moderation_actions
+    ADD CONSTRAINT moderation_actions_moderator_id_fkey FOREIGN KEY (moderator_id) REFERENCES public.users(id) ON UPDATE CASCADE ON DELETE SET NULL;
+
+--
+-- Name: moderation_actions moderation_actions_user_id_fkey; Type: FK CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.moderation_actions
+    ADD CONSTRAINT moderation_actions_user_id_fkey FOREIGN KEY (user_id) REFERENCES public.users(id) ON UPDATE CASCADE ON DELETE SET NULL;
+
+--
+-- Name: comment_revisions comment_revisions_pkey; Type: CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.comment_revisions
+    ADD CONSTRAINT comment_revisions_pkey PRIMARY KEY (id);
+
+--
+-- Name: comment_revisions comment_revisions_comment_id_fkey; Type: FK CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.comment_revisions
+    ADD CONSTRAINT comment_revisions_comment_id_fkey FOREIGN KEY (comment_id) REFERENCES public.comments(id) ON UPDATE CASCADE ON DELETE CASCADE;
+
+--
+-- Name: comment_replies comment_replies_pkey; Type: CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.comment_replies
+    ADD CONSTRAINT comment_replies_pkey PRIMARY KEY (id);
+
+--
+-- Name: comment_replies comment_replies_comment_id_fkey; Type: FK CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.comment_replies
+    ADD CONSTRAINT comment_replies_comment_id_fkey FOREIGN KEY (comment_id) REFERENCES public.comments(id) ON UPDATE CASCADE ON DELETE CASCADE;
+
+--
+-- Name: comment_replies comment_replies_parent_id_fkey; Type: FK CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.comment_replies
+    ADD CONSTRAINT comment_replies_parent_id_fkey FOREIGN KEY (parent_id) REFERENCES public.comment_replies(id) ON UPDATE CASCADE ON DELETE SET NULL;
+
+--
+-- Name: comment_replies comment_replies_user_id_fkey; Type: FK CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.comment_replies
+    ADD CONSTRAINT comment_replies_user_id_fkey FOREIGN KEY (user_id) REFERENCES public.users(id) ON UPDATE CASCADE ON DELETE RESTRICT;
+
+--
+-- Name: attachments attachments_pkey; Type: CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.attachments
+    ADD CONSTRAINT attachments_pkey PRIMARY KEY (id);
+
+--
+-- Name: attachments attachments_storage_key_key; Type: CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.attachments
+    ADD CONSTRAINT attachments_storage_key_key UNIQUE (storage_key);
+
+--
+-- Name: attachments attachments_lesson_id_fkey; Type: FK CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.attachments
+    ADD CONSTRAINT attachments_lesson_id_fkey FOREIGN KEY (lesson_id) REFERENCES public.lessons(id) ON UPDATE CASCADE ON DELETE RESTRICT;
+
+--
+-- Name: attachments attachments_user_id_fkey; Type: FK CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.attachments
+    ADD CONSTRAINT attachments_user_id_fkey FOREIGN KEY (user_id) REFERENCES public.users(id) ON UPDATE CASCADE ON DELETE RESTRICT;
+
+--
+-- Name: email_changes email_changes_pkey; Type: CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.email_changes
+    ADD CONSTRAINT email_changes_pkey PRIMARY KEY (id);
+
+--
+-- Name: email_changes email_changes_token_hash_key; Type: CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.email_changes
+    ADD CONSTRAINT email_changes_token_hash_key UNIQUE (token_hash);
+
+--
+-- Name: email_changes email_changes_user_id_fkey; Type: FK CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.email_changes
+    ADD CONSTRAINT email_changes_user_id_fkey FOREIGN KEY (user_id) REFERENCES public.users(id) ON UPDATE CASCADE ON DELETE CASCADE;
+
+--
+-- Name: user_favorites user_favorites_pkey; Type: CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.user_favorites
+    ADD CONSTRAINT user_favorites_pkey PRIMARY KEY (id);
+
+--
+-- Name: user_favorites user_favorites_user_id_lesson_id_key; Type: CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.user_favorites
+    ADD CONSTRAINT user_favorites_user_id_lesson_id_key UNIQUE (user_id, lesson_id);
+
+--
+-- Name: user_favorites user_favorites_lesson_id_fkey; Type: FK CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.user_favorites
+    ADD CONSTRAINT user_favorites_lesson_id_fkey FOREIGN KEY (lesson_id) REFERENCES public.lessons(id) ON UPDATE CASCADE ON DELETE CASCADE;
+
+--
+-- Name: user_favorites user_favorites_user_id_fkey; Type: FK CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.user_favorites
+    ADD CONSTRAINT user_favorites_user_id_fkey FOREIGN KEY (user_id) REFERENCES public.users(id) ON UPDATE CASCADE ON DELETE CASCADE;
+
+--
+-- Name: lesson_offerings lesson_offerings_pkey; Type: CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.lesson_offerings
+    ADD CONSTRAINT lesson_offerings_pkey PRIMARY KEY (id);
+
+--
+-- Name: lesson_offerings lesson_offerings_lesson_id_year_term_key; Type: CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.lesson_offerings
+    ADD CONSTRAINT lesson_offerings_lesson_id_year_term_key UNIQUE (lesson_id, year, term);
+
+--
+-- Name: lesson_offerings lesson_offerings_lesson_id_fkey; Type: FK CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.lesson_offerings
+    ADD CONSTRAINT lesson_offerings_lesson_id_fkey FOREIGN KEY (lesson_id) REFERENCES public.lessons(id) ON UPDATE CASCADE ON DELETE CASCADE;
+
+--
+-- Name: offering_slots offering_slots_pkey; Type: CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.offering_slots
+    ADD CONSTRAINT offering_slots_pkey PRIMARY KEY (id);
+
+--
+-- Name: offering_slots offering_slots_offering_id_day_period_key; Type: CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.offering_slots
+    ADD CONSTRAINT offering_slots_offering_id_day_period_key UNIQUE (offering_id, day, period);
+
+--
+-- Name: offering_slots offering_slots_offering_id_fkey; Type: FK CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.offering_slots
+    ADD CONSTRAINT offering_slots_offering_id_fkey FOREIGN KEY (offering_id) REFERENCES public.lesson_offerings(id) ON UPDATE CASCADE ON DELETE CASCADE;
+
+--
+-- Name: timetable_entries timetable_entries_pkey; Type: CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.timetable_entries
+    ADD CONSTRAINT timetable_entries_pkey PRIMARY KEY (id);
+
+--
+-- Name: timetable_entries timetable_entries_user_id_offering_id_key; Type: CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.timetable_entries
+    ADD CONSTRAINT timetable_entries_user_id_offering_id_key UNIQUE (user_id, offering_id);
+
+--
+-- Name: timetable_entries timetable_entries_offering_id_fkey; Type: FK CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.timetable_entries
+    ADD CONSTRAINT timetable_entries_offering_id_fkey FOREIGN KEY (offering_id) REFERENCES public.lesson_offerings(id) ON UPDATE CASCADE ON DELETE CASCADE;
+
+--
+-- Name: timetable_entries timetable_entries_user_id_fkey; Type: FK CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.timetable_entries
+    ADD CONSTRAINT timetable_entries_user_id_fkey FOREIGN KEY (user_id) REFERENCES public.users(id) ON UPDATE CASCADE ON DELETE CASCADE;
+
+--
+-- Name: academic_terms academic_terms_pkey; Type: CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.academic_terms
+    ADD CONSTRAINT academic_terms_pkey PRIMARY KEY (id);
+
+--
+-- Name: academic_terms academic_terms_year_term_key; Type: CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.academic_terms
+    ADD CONSTRAINT academic_terms_year_term_key UNIQUE (year, term);
+
+--
+-- Name: calendar_tokens calendar_tokens_pkey; Type: CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.calendar_tokens
+    ADD CONSTRAINT calendar_tokens_pkey PRIMARY KEY (id);
+
+--
+-- Name: calendar_tokens calendar_tokens_user_id_key; Type: CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.calendar_tokens
+    ADD CONSTRAINT calendar_tokens_user_id_key UNIQUE (user_id);
+
+--
+-- Name: calendar_tokens calendar_tokens_token_hash_key; Type: CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.calendar_tokens
+    ADD CONSTRAINT calendar_tokens_token_hash_key UNIQUE (token_hash);
+
+--
+-- Name: calendar_tokens calendar_tokens_user_id_fkey; Type: FK CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.calendar_tokens
+    ADD CONSTRAINT calendar_tokens_user_id_fkey FOREIGN KEY (user_id) REFERENCES public.users(id) ON UPDATE CASCADE ON DELETE CASCADE;
+
+--
+-- Name: lesson_recommendations lesson_recommendations_pkey; Type: CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.lesson_recommendations
+    ADD CONSTRAINT lesson_recommendations_pkey PRIMARY KEY (id);
+
+--
+-- Name: lesson_recommendations lesson_recommendations_user_id_lesson_id_key; Type: CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.lesson_recommendations
+    ADD CONSTRAINT lesson_recommendations_user_id_lesson_id_key UNIQUE (user_id, lesson_id);
+
+--
+-- Name: lesson_recommendations lesson_recommendations_lesson_id_fkey; Type: FK CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.lesson_recommendations
+    ADD CONSTRAINT lesson_recommendations_lesson_id_fkey FOREIGN KEY (lesson_id) REFERENCES public.lessons(id) ON UPDATE CASCADE ON DELETE CASCADE;
+
+--
+-- Name: lesson_recommendations lesson_recommendations_user_id_fkey; Type: FK CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.lesson_recommendations
+    ADD CONSTRAINT lesson_recommendations_user_id_fkey FOREIGN KEY (user_id) REFERENCES public.users(id) ON UPDATE CASCADE ON DELETE CASCADE;
+
+--
+-- Name: lesson_rankings lesson_rankings_pkey; Type: CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.lesson_rankings
+    ADD CONSTRAINT lesson_rankings_pkey PRIMARY KEY (id);
+
+--
+-- Name: lesson_rankings lesson_rankings_lesson_id_year_term_key; Type: CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.lesson_rankings
+    ADD CONSTRAINT lesson_rankings_lesson_id_year_term_key UNIQUE (lesson_id, year, term);
+
+--
+-- Name: lesson_rankings lesson_rankings_lesson_id_fkey; Type: FK CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.lesson_rankings
+    ADD CONSTRAINT lesson_rankings_lesson_id_fkey FOREIGN KEY (lesson_id) REFERENCES public.lessons(id) ON UPDATE CASCADE ON DELETE CASCADE;
+
+--
+-- Name: lesson_follows lesson_follows_pkey; Type: CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.lesson_follows
+    ADD CONSTRAINT lesson_follows_pkey PRIMARY KEY (id);
+
+--
+-- Name: lesson_follows lesson_follows_user_id_lesson_id_key; Type: CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.lesson_follows
+    ADD CONSTRAINT lesson_follows_user_id_lesson_id_key UNIQUE (user_id, lesson_id);
+
+--
+-- Name: lesson_follows lesson_follows_user_id_fkey; Type: FK CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.lesson_follows
+    ADD CONSTRAINT lesson_follows_user_id_fkey FOREIGN KEY (user_id) REFERENCES public.users(id) ON UPDATE CASCADE ON DELETE CASCADE;
+
+--
+-- Name: lesson_follows lesson_follows_lesson_id_fkey; Type: FK CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.lesson_follows
+    ADD CONSTRAINT lesson_follows_lesson_id_fkey FOREIGN KEY (lesson_id) REFERENCES public.lessons(id) ON UPDATE CASCADE ON DELETE CASCADE;
+
+--
+-- Name: teacher_follows teacher_follows_pkey; Type: CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.teacher_follows
+    ADD CONSTRAINT teacher_follows_pkey PRIMARY KEY (id);
+
+--
+-- Name: teacher_follows teacher_follows_user_id_teacher_name_key; Type: CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.teacher_follows
+    ADD CONSTRAINT teacher_follows_user_id_teacher_name_key UNIQUE (user_id, teacher_name);
+
+--
+-- Name: teacher_follows teacher_follows_user_id_fkey; Type: FK CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.teacher_follows
+    ADD CONSTRAINT teacher_follows_user_id_fkey FOREIGN KEY (user_id) REFERENCES public.users(id) ON UPDATE CASCADE ON DELETE CASCADE;
+
+--
+-- Name: notifications notifications_pkey; Type: CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.notifications
+    ADD CONSTRAINT notifications_pkey PRIMARY KEY (id);
+
+--
+-- Name: notifications notifications_user_id_fkey; Type: FK CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.notifications
+    ADD CONSTRAINT notifications_user_id_fkey FOREIGN KEY (user_id) REFERENCES public.users(id) ON UPDATE CASCADE ON DELETE CASCADE;
+
+--
+-- Name: notifications notifications_lesson_id_fkey; Type: FK CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.notifications
+    ADD CONSTRAINT notifications_lesson_id_fkey FOREIGN KEY (lesson_id) REFERENCES public.lessons(id) ON UPDATE CASCADE ON DELETE CASCADE;
+
+--
+-- Name: notifications notifications_comment_id_fkey; Type: FK CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.notifications
+    ADD CONSTRAINT notifications_comment_id_fkey FOREIGN KEY (comment_id) REFERENCES public.comments(id) ON UPDATE CASCADE ON DELETE CASCADE;
+
+--
+-- Name: notifications notifications_offering_id_fkey; Type: FK CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.notifications
+    ADD CONSTRAINT notifications_offering_id_fkey FOREIGN KEY (offering_id) REFERENCES public.lesson_offerings(id) ON UPDATE CASCADE ON DELETE CASCADE;
+
+--
+-- Name: webhooks webhooks_pkey; Type: CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.webhooks
+    ADD CONSTRAINT webhooks_pkey PRIMARY KEY (id);
+
+--
+-- Name: webhook_deliveries webhook_deliveries_pkey; Type: CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.webhook_deliveries
+    ADD CONSTRAINT webhook_deliveries_pkey PRIMARY KEY (id);
+
+--
+-- Name: webhook_deliveries webhook_deliveries_webhook_id_fkey; Type: FK CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.webhook_deliveries
+    ADD CONSTRAINT webhook_deliveries_webhook_id_fkey FOREIGN KEY (webhook_id) REFERENCES public.webhooks(id) ON UPDATE CASCADE ON DELETE CASCADE;
+
+--
+-- Name: digest_preferences digest_preferences_pkey; Type: CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.digest_preferences
+    ADD CONSTRAINT digest_preferences_pkey PRIMARY KEY (id);
+
+--
+-- Name: digest_preferences digest_preferences_user_id_key; Type: CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.digest_preferences
+    ADD CONSTRAINT digest_preferences_user_id_key UNIQUE (user_id);
+
+--
+-- Name: digest_preferences digest_preferences_user_id_fkey; Type: FK CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.digest_preferences
+    ADD CONSTRAINT digest_preferences_user_id_fkey FOREIGN KEY (user_id) REFERENCES public.users(id) ON UPDATE CASCADE ON DELETE CASCADE;
+
+--
+-- Name: jobs jobs_pkey; Type: CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.jobs
+    ADD CONSTRAINT jobs_pkey PRIMARY KEY (id);
+
+--
+-- Name: jobs jobs_unique_key_key; Type: CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.jobs
+    ADD CONSTRAINT jobs_unique_key_key UNIQUE (unique_key);
 
 --
 -- PostgreSQL database dump complete
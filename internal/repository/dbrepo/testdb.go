@@ -1,10 +1,12 @@
 package dbrepo
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"time"
 	"kstation_backend/internal/models"
+	"kstation_backend/internal/repository"
 )
 
 type TestDBRepo struct{}
@@ -29,7 +31,7 @@ func (m *TestDBRepo) GetUserByID(id int) (*models.User, error) {
 		return &user, nil
 	}
 
-	return nil, errors.New("user not found")
+	return nil, sql.ErrNoRows
 }
 
 func (m *TestDBRepo) GetUserByEmail(email string) (*models.User, error) {
@@ -98,7 +100,7 @@ func (m *TestDBRepo) GetLessonByID(id int) (*models.Lesson, error) {
 }
 
 func (m *TestDBRepo) AllLessons(how int) ([]*models.Lesson, error) {
-	if how == 0 || how == 1 || how == 2 || how == 3 {
+	if how >= 0 && how <= 6 {
 		var lessons []*models.Lesson
 		return lessons, nil
 	}
@@ -106,7 +108,7 @@ func (m *TestDBRepo) AllLessons(how int) ([]*models.Lesson, error) {
 }
 
 func (m *TestDBRepo) AllLessonsByUser(id int, how int) ([]*models.Lesson, error) {
-	if how == 0 || how == 1 || how == 2 || how == 3 {
+	if how >= 0 && how <= 6 {
 		if id == 1 || id == 2 {
 			var lessons []*models.Lesson
 			return lessons, nil
@@ -130,6 +132,26 @@ func (m *TestDBRepo) GetCommentByID(id int) (*models.Comment, error) {
 			Comment: "this is a test",
 			TestOrReport: "report",
 			Star: 3,
+			ModerationStatus: models.CommentVisible,
+			CreatedAt: time.Now(),
+			UpdatedAt: time.Now(),
+		}
+
+		return &comment, nil
+	}
+
+	// held for review, so only its author and moderators may see it
+	if id == 9 {
+		comment := models.Comment{
+			ID: 9,
+			LessonId: 1,
+			UserId: 3,
+			Year: 2023,
+			Term: "former",
+			Comment: "mail me at taro@example.com",
+			TestOrReport: "report",
+			Star: 4,
+			ModerationStatus: models.CommentPending,
 			CreatedAt: time.Now(),
 			UpdatedAt: time.Now(),
 		}
@@ -140,14 +162,11 @@ func (m *TestDBRepo) GetCommentByID(id int) (*models.Comment, error) {
 	return nil, errors.New("comment not found")
 }
 
-func (m *TestDBRepo) AllCommentsByLessonId(LessonId int) ([]*models.Comment, error) {
-	if LessonId == 1 {
-		var comments []*models.Comment
-
-		return comments, nil
-	}
+func (m *TestDBRepo) AllCommentsByLessonId(LessonId int, how int) ([]*models.Comment, error) {
+	// like the real query, a lesson without comments is not an error
+	var comments []*models.Comment
 
-	return nil, errors.New("comments are not found")
+	return comments, nil
 }
 
 func (m *TestDBRepo) AllCommentsByUserId(UserId int) ([]*models.Comment, error) {
@@ -160,7 +179,7 @@ func (m *TestDBRepo) AllCommentsByUserId(UserId int) ([]*models.Comment, error)
 	return nil, errors.New("comments are not found")
 }
 
-func (m *TestDBRepo) UpdateComment(c models.Comment) error {
+func (m *TestDBRepo) UpdateComment(c models.Comment, editorID int) error {
 	if c.ID == 1 {
 		return nil
 	}
@@ -174,4 +193,779 @@ func (m *TestDBRepo) DeleteComment(id int) error {
 	}
 
 	return errors.New("commet not found")
-}
\ No newline at end of file
+}
+
+func (m *TestDBRepo) GetLessonStats(id int) (*models.LessonStats, error) {
+	if id == 1 {
+		stats := models.LessonStats{
+			LessonId: 1,
+			CommentNumbers: 1,
+			AvgStar: 3,
+			MedianStar: 3,
+			StarHistogram: map[int]int{1: 0, 2: 0, 3: 1, 4: 0, 5: 0},
+			TestOrReport: map[string]int{"report": 1},
+			ByTerm: []*models.TermStats{},
+			Trend: []*models.TrendPoint{},
+		}
+		return &stats, nil
+	}
+
+	return nil, errors.New("lesson not found")
+}
+
+func (m *TestDBRepo) VoteComment(commentID int, userID int, helpful bool) error {
+	if commentID == 1 {
+		return nil
+	}
+
+	return errors.New("comment not found")
+}
+
+func (m *TestDBRepo) GetCommentByOffering(userID int, lessonID int, year int, term string) (*models.Comment, error) {
+	if userID == 1 && lessonID == 1 && year == 2023 && term == "former" {
+		return m.GetCommentByID(1)
+	}
+
+	return nil, sql.ErrNoRows
+}
+
+func (m *TestDBRepo) UpsertComment(comment models.Comment) (int, error) {
+	if comment.UserId == 1 && comment.LessonId == 1 && comment.Year == 2023 && comment.Term == "former" {
+		return 1, nil
+	}
+
+	return 2, nil
+}
+
+func (m *TestDBRepo) UpdateLessonAggregates(id int) error {
+	if id == 1 {
+		return nil
+	}
+
+	return errors.New("lesson not found")
+}
+
+func (m *TestDBRepo) InsertReport(report models.Report) (int, error) {
+	if report.CommentId == 1 && report.UserId == 1 {
+		return 0, repository.ErrDuplicateReport
+	}
+
+	return 1, nil
+}
+
+func (m *TestDBRepo) GetReportByID(id int) (*models.Report, error) {
+	if id == 1 || id == 3 {
+		report := models.Report{
+			ID: id,
+			CommentId: 1,
+			UserId: 2,
+			Reason: models.ReportAbuse,
+			Status: models.ReportPending,
+			CreatedAt: time.Now(),
+			UpdatedAt: time.Now(),
+		}
+		return &report, nil
+	}
+
+	return nil, sql.ErrNoRows
+}
+
+func (m *TestDBRepo) PendingReports() ([]*models.Report, error) {
+	report, _ := m.GetReportByID(1)
+	report.Comment, _ = m.GetCommentByID(1)
+
+	return []*models.Report{report}, nil
+}
+
+func (m *TestDBRepo) ModerateReport(action models.ModerationAction) error {
+	if action.ReportId == 1 {
+		return nil
+	}
+	if action.ReportId == 3 {
+		return repository.ErrReportHandled
+	}
+
+	return sql.ErrNoRows
+}
+
+func (m *TestDBRepo) HeldComments() ([]*models.Comment, error) {
+	var comments []*models.Comment
+
+	return comments, nil
+}
+
+func (m *TestDBRepo) SetCommentModerationStatus(id int, status string) error {
+	if id == 1 {
+		return nil
+	}
+
+	return sql.ErrNoRows
+}
+
+func (m *TestDBRepo) DeleteLesson(id int) error {
+	if id == 1 {
+		return nil
+	}
+
+	return sql.ErrNoRows
+}
+
+func (m *TestDBRepo) DeleteUser(id int) ([]int, error) {
+	if id == 1 {
+		return []int{1}, nil
+	}
+
+	return nil, sql.ErrNoRows
+}
+
+func (m *TestDBRepo) RestoreComment(id int) (int, error) {
+	if id == 2 {
+		return 1, nil
+	}
+	if id == 3 {
+		return 0, repository.ErrDuplicateComment
+	}
+
+	return 0, sql.ErrNoRows
+}
+
+func (m *TestDBRepo) RestoreLesson(id int) error {
+	if id == 1 {
+		return nil
+	}
+
+	return sql.ErrNoRows
+}
+
+func (m *TestDBRepo) RestoreUser(id int) ([]int, error) {
+	if id == 2 {
+		return []int{1}, nil
+	}
+
+	return nil, sql.ErrNoRows
+}
+
+func (m *TestDBRepo) PurgeDeleted(before time.Time) (int64, error) {
+	return 0, nil
+}
+
+func (m *TestDBRepo) CommentRevisions(commentID int) ([]*models.CommentRevision, error) {
+	var revisions []*models.CommentRevision
+	if commentID == 1 {
+		revision := models.CommentRevision{
+			ID: 1,
+			CommentId: 1,
+			EditorId: 1,
+			Year: 2023,
+			Term: "former",
+			Comment: "this was the first version",
+			TestOrReport: "report",
+			Star: 2,
+			CreatedAt: time.Now(),
+		}
+		revisions = append(revisions, &revision)
+	}
+
+	return revisions, nil
+}
+
+func (m *TestDBRepo) GetUsersByIDs(ids []int) (map[int]*models.User, error) {
+	users := make(map[int]*models.User)
+	for _, id := range ids {
+		user, err := m.GetUserByID(id)
+		if err == nil {
+			users[id] = user
+		}
+	}
+
+	return users, nil
+}
+
+func (m *TestDBRepo) InsertReply(reply models.Reply) (int, error) {
+	return 2, nil
+}
+
+func (m *TestDBRepo) GetReplyByID(id int) (*models.Reply, error) {
+	if id == 1 || id == 3 {
+		reply := models.Reply{
+			ID: id,
+			CommentId: 1,
+			UserId: 1,
+			Body: "was the final open-book?",
+			CreatedAt: time.Now(),
+			UpdatedAt: time.Now(),
+		}
+		if id == 3 {
+			reply.ParentId = 2
+			reply.Depth = models.MaxReplyDepth
+		}
+		return &reply, nil
+	}
+
+	return nil, sql.ErrNoRows
+}
+
+func (m *TestDBRepo) RepliesByCommentId(commentID int, limit int, offset int) ([]*models.Reply, error) {
+	var replies []*models.Reply
+	if commentID == 1 && offset == 0 {
+		reply, _ := m.GetReplyByID(1)
+		replies = append(replies, reply)
+	}
+
+	return replies, nil
+}
+
+func (m *TestDBRepo) UpdateReply(reply models.Reply) error {
+	if reply.ID == 1 || reply.ID == 3 {
+		return nil
+	}
+
+	return sql.ErrNoRows
+}
+
+func (m *TestDBRepo) DeleteReply(id int) error {
+	if id == 1 || id == 3 {
+		return nil
+	}
+
+	return sql.ErrNoRows
+}
+
+func (m *TestDBRepo) InsertAttachment(attachment models.Attachment) (int, error) {
+	return 2, nil
+}
+
+func (m *TestDBRepo) GetAttachmentByID(id int) (*models.Attachment, error) {
+	if id == 1 {
+		attachment := models.Attachment{
+			ID: 1,
+			LessonId: 1,
+			UserId: 1,
+			Year: 2023,
+			Term: "former",
+			TestOrReport: "test",
+			FileName: "final.pdf",
+			ContentType: "application/pdf",
+			Size: 18,
+			StorageKey: "attachments/1/test",
+			CreatedAt: time.Now(),
+		}
+		return &attachment, nil
+	}
+
+	return nil, sql.ErrNoRows
+}
+
+func (m *TestDBRepo) AttachmentsByLessonId(lessonID int) ([]*models.Attachment, error) {
+	var attachments []*models.Attachment
+	if lessonID == 1 {
+		attachment, _ := m.GetAttachmentByID(1)
+		attachments = append(attachments, attachment)
+	}
+
+	return attachments, nil
+}
+
+func (m *TestDBRepo) DeleteAttachment(id int) error {
+	if id == 1 {
+		return nil
+	}
+
+	return sql.ErrNoRows
+}
+
+func (m *TestDBRepo) RevokeSessions(userID int) (int, error) {
+	if userID == 1 {
+		return 1, nil
+	}
+
+	return 0, sql.ErrNoRows
+}
+
+func (m *TestDBRepo) ChangePassword(userID int, password string) (int, error) {
+	return m.RevokeSessions(userID)
+}
+
+func (m *TestDBRepo) InsertEmailChange(change models.EmailChange) error {
+	return nil
+}
+
+func (m *TestDBRepo) ConfirmEmailChange(userID int, tokenHash string) (int, error) {
+	// sha256 of "valid-token" and "taken-token"
+	switch {
+	case userID == 1 && tokenHash == "397a2a9c5bf5e2ccec38c2596b682bb1bd05fe6e4ecea6c10cf42755ff225403":
+		return 1, nil
+	case userID == 1 && tokenHash == "f3eb5f8b5363268def35016d3ecd1dde8de142fa123d60246f4b798672c819e3":
+		return 0, repository.ErrEmailTaken
+	}
+
+	return 0, sql.ErrNoRows
+}
+
+func (m *TestDBRepo) VotesByUserId(userID int) ([]*models.Vote, error) {
+	var votes []*models.Vote
+	if userID == 1 {
+		votes = append(votes, &models.Vote{CommentId: 1, Helpful: true, CreatedAt: time.Now(), UpdatedAt: time.Now()})
+	}
+
+	return votes, nil
+}
+
+func (m *TestDBRepo) RepliesByUserId(userID int) ([]*models.Reply, error) {
+	return m.RepliesByCommentId(userID, 10, 0)
+}
+
+func (m *TestDBRepo) AttachmentsByUserId(userID int) ([]*models.Attachment, error) {
+	return m.AttachmentsByLessonId(userID)
+}
+
+func (m *TestDBRepo) AttachmentsOfDeletedLessons(before time.Time) ([]*models.Attachment, error) {
+	return nil, nil
+}
+
+func (m *TestDBRepo) DeleteAccount(userID int, cascade bool) ([]int, error) {
+	if userID != 1 {
+		return nil, sql.ErrNoRows
+	}
+
+	if cascade {
+		return []int{1}, nil
+	}
+
+	return nil, nil
+}
+
+func (m *TestDBRepo) AddFavorite(userID int, lessonID int) error {
+	if lessonID == 1 {
+		return nil
+	}
+
+	return sql.ErrNoRows
+}
+
+func (m *TestDBRepo) RemoveFavorite(userID int, lessonID int) error {
+	return nil
+}
+
+func (m *TestDBRepo) FavoriteLessons(userID int) ([]*models.Lesson, error) {
+	var lessons []*models.Lesson
+	if userID == 1 {
+		lesson, _ := m.GetLessonByID(1)
+		lessons = append(lessons, lesson)
+	}
+
+	return lessons, nil
+}
+
+func (m *TestDBRepo) FavoritedLessons(userID int, lessonIDs []int) (map[int]bool, error) {
+	favorited := make(map[int]bool)
+	for _, lessonID := range lessonIDs {
+		if userID == 1 && lessonID == 1 {
+			favorited[lessonID] = true
+		}
+	}
+
+	return favorited, nil
+}
+
+// test offerings of lesson 1 in 2023 former: 1 is in user 1's timetable, 2
+// clashes with it, 3 has too many credits and 4 fits
+var testOfferings = map[int]*models.Offering{
+	1: {ID: 1, LessonId: 1, Year: 2023, Term: "former", Credits: 2, Slots: []models.Slot{{Day: 1, Period: 1}, {Day: 1, Period: 2}}},
+	2: {ID: 2, LessonId: 1, Year: 2023, Term: "former", Credits: 2, Slots: []models.Slot{{Day: 1, Period: 2}}},
+	3: {ID: 3, LessonId: 1, Year: 2023, Term: "former", Credits: 30, Slots: []models.Slot{{Day: 2, Period: 1}}},
+	4: {ID: 4, LessonId: 1, Year: 2023, Term: "former", Credits: 2, Slots: []models.Slot{{Day: 3, Period: 3}}},
+}
+
+func (m *TestDBRepo) UpsertOffering(offering models.Offering) (int, error) {
+	return 5, nil
+}
+
+func (m *TestDBRepo) GetOfferingByID(id int) (*models.Offering, error) {
+	offering, ok := testOfferings[id]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+
+	copied := *offering
+	return &copied, nil
+}
+
+func (m *TestDBRepo) OfferingsByLessonId(lessonID int) ([]*models.Offering, error) {
+	var offerings []*models.Offering
+	if lessonID == 1 {
+		for id := 1; id <= len(testOfferings); id++ {
+			offering, _ := m.GetOfferingByID(id)
+			offerings = append(offerings, offering)
+		}
+	}
+
+	return offerings, nil
+}
+
+func (m *TestDBRepo) DeleteOffering(id int) error {
+	_, err := m.GetOfferingByID(id)
+	return err
+}
+
+func (m *TestDBRepo) Timetable(userID int, year int, term string) ([]*models.TimetableEntry, error) {
+	var entries []*models.TimetableEntry
+	if userID == 1 && year == 2023 && term == "former" {
+		offering, _ := m.GetOfferingByID(1)
+		lesson, _ := m.GetLessonByID(1)
+		lesson.AvgStar = 3
+		lesson.CommentNumbers = 1
+		entries = append(entries, &models.TimetableEntry{Offering: offering, Lesson: lesson, AddedAt: time.Now()})
+	}
+
+	return entries, nil
+}
+
+func (m *TestDBRepo) TimetablesByUserId(userID int) ([]*models.TimetableEntry, error) {
+	return m.Timetable(userID, 2023, "former")
+}
+
+func (m *TestDBRepo) AddTimetableEntry(userID int, offering *models.Offering, check func(entries []*models.TimetableEntry) error) error {
+	entries, _ := m.Timetable(userID, offering.Year, offering.Term)
+
+	return check(entries)
+}
+
+func (m *TestDBRepo) RemoveTimetableEntry(userID int, offeringID int) error {
+	if userID == 1 && offeringID == 1 {
+		return nil
+	}
+
+	return sql.ErrNoRows
+}
+
+func (m *TestDBRepo) UpsertAcademicTerm(term models.AcademicTerm) error {
+	return nil
+}
+
+func (m *TestDBRepo) AcademicTerms() ([]*models.AcademicTerm, error) {
+	terms := []*models.AcademicTerm{
+		{Year: 2023, Term: "former", StartsOn: time.Date(2023, 4, 10, 0, 0, 0, 0, time.UTC), EndsOn: time.Date(2023, 8, 9, 0, 0, 0, 0, time.UTC)},
+	}
+
+	return terms, nil
+}
+
+func (m *TestDBRepo) SetCalendarToken(userID int, tokenHash string) error {
+	return nil
+}
+
+func (m *TestDBRepo) GetUserIDByCalendarToken(tokenHash string) (int, error) {
+	// sha256 of "valid-token"
+	if tokenHash == "397a2a9c5bf5e2ccec38c2596b682bb1bd05fe6e4ecea6c10cf42755ff225403" {
+		return 1, nil
+	}
+
+	return 0, sql.ErrNoRows
+}
+
+func (m *TestDBRepo) LessonRatings() ([]*models.Rating, error) {
+	ratings := []*models.Rating{
+		{UserId: 1, LessonId: 1, Star: 3, TestOrReport: "report"},
+	}
+
+	return ratings, nil
+}
+
+func (m *TestDBRepo) AllFavorites() ([]*models.Favorite, error) {
+	favorites := []*models.Favorite{
+		{UserId: 1, LessonId: 1, CreatedAt: time.Now()},
+	}
+
+	return favorites, nil
+}
+
+func (m *TestDBRepo) ReplaceRecommendations(recommendations []*models.Recommendation) error {
+	return nil
+}
+
+func (m *TestDBRepo) RecommendationsByUserId(userID int, limit int, offset int) ([]*models.Recommendation, error) {
+	var recommendations []*models.Recommendation
+	if userID == 1 && offset == 0 {
+		lesson, _ := m.GetLessonByID(1)
+		lesson.ID = 2
+		recommendations = append(recommendations, &models.Recommendation{
+			UserId:         1,
+			LessonId:       2,
+			Score:          0.5,
+			Reason:         models.ReasonSameTeacher,
+			SourceLessonId: 1,
+			Lesson:         lesson,
+			ComputedAt:     time.Now(),
+		})
+	}
+
+	return recommendations, nil
+}
+
+func (m *TestDBRepo) ReplaceLessonRankings(rankings []*models.LessonRanking) error {
+	return nil
+}
+
+func (m *TestDBRepo) LessonRankings(filter models.RankingFilter) ([]*models.LessonRanking, error) {
+	var rankings []*models.LessonRanking
+	if filter.Department == "" || filter.Department == "math" {
+		lesson, _ := m.GetLessonByID(1)
+		rankings = append(rankings, &models.LessonRanking{
+			Rank:           filter.Offset + 1,
+			LessonId:       1,
+			Year:           filter.Year,
+			Term:           filter.Term,
+			BayesStar:      3.5,
+			TrendingScore:  1.2,
+			CommentNumbers: 1,
+			Lesson:         lesson,
+			ComputedAt:     time.Now(),
+		})
+	}
+
+	return rankings, nil
+}
+
+func (m *TestDBRepo) FollowLesson(userID int, lessonID int) error {
+	if lessonID == 1 {
+		return nil
+	}
+
+	return sql.ErrNoRows
+}
+
+func (m *TestDBRepo) UnfollowLesson(userID int, lessonID int) error {
+	return nil
+}
+
+func (m *TestDBRepo) FollowTeacher(userID int, teacherName string) error {
+	if teacherName == "Yamada" || teacherName == "山田 太郎" {
+		return nil
+	}
+
+	return sql.ErrNoRows
+}
+
+func (m *TestDBRepo) UnfollowTeacher(userID int, teacherName string) error {
+	return nil
+}
+
+func (m *TestDBRepo) FollowsByUserId(userID int) (*models.Follows, error) {
+	follows := models.Follows{Lessons: []*models.Lesson{}, Teachers: []string{}}
+	if userID == 1 {
+		lesson, _ := m.GetLessonByID(1)
+		follows.Lessons = append(follows.Lessons, lesson)
+		follows.Teachers = append(follows.Teachers, "Yamada")
+	}
+
+	return &follows, nil
+}
+
+func (m *TestDBRepo) FanOutNotifications(event models.FollowEvent) (int64, error) {
+	return 1, nil
+}
+
+func (m *TestDBRepo) NotificationsByUserId(userID int, unreadOnly bool, limit int, offset int) ([]*models.Notification, error) {
+	var notifications []*models.Notification
+	if userID == 1 {
+		lesson, _ := m.GetLessonByID(1)
+		notifications = append(notifications, &models.Notification{
+			ID:        1,
+			UserId:    1,
+			Kind:      models.NotificationNewReview,
+			LessonId:  1,
+			CommentId: 2,
+			Lesson:    lesson,
+			CreatedAt: time.Now(),
+		})
+	}
+
+	return notifications, nil
+}
+
+func (m *TestDBRepo) UnreadNotificationCount(userID int) (int, error) {
+	if userID == 1 {
+		return 1, nil
+	}
+
+	return 0, nil
+}
+
+func (m *TestDBRepo) MarkNotificationsRead(userID int, id int) error {
+	if id == 0 || (userID == 1 && id == 1) {
+		return nil
+	}
+
+	return sql.ErrNoRows
+}
+
+func (m *TestDBRepo) Notify(channel string, payload string) error {
+	return nil
+}
+
+func (m *TestDBRepo) Listen(ctx context.Context, channel string, handle func(payload string)) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func (m *TestDBRepo) InsertWebhook(webhook models.Webhook) (int, error) {
+	return 2, nil
+}
+
+func (m *TestDBRepo) UpdateWebhook(webhook models.Webhook) error {
+	if webhook.ID == 1 {
+		return nil
+	}
+
+	return sql.ErrNoRows
+}
+
+func (m *TestDBRepo) GetWebhookByID(id int) (*models.Webhook, error) {
+	if id == 1 {
+		webhook := models.Webhook{
+			ID:         1,
+			URL:        "https://bot.example.com/kstation",
+			Secret:     "verysecret",
+			EventTypes: []string{models.WebhookReviewCreated},
+			Active:     true,
+			CreatedAt:  time.Now(),
+			UpdatedAt:  time.Now(),
+		}
+		return &webhook, nil
+	}
+
+	return nil, sql.ErrNoRows
+}
+
+func (m *TestDBRepo) AllWebhooks() ([]*models.Webhook, error) {
+	webhook, _ := m.GetWebhookByID(1)
+	return []*models.Webhook{webhook}, nil
+}
+
+func (m *TestDBRepo) DeleteWebhook(id int) error {
+	_, err := m.GetWebhookByID(id)
+	return err
+}
+
+func (m *TestDBRepo) EnqueueWebhookDeliveries(eventType string, payload []byte) (int64, error) {
+	return 1, nil
+}
+
+func (m *TestDBRepo) ClaimWebhookDeliveries(limit int, lease time.Duration) ([]*models.WebhookDelivery, error) {
+	return nil, nil
+}
+
+func (m *TestDBRepo) RecordWebhookAttempt(delivery models.WebhookDelivery, lease time.Time) error {
+	return nil
+}
+
+func (m *TestDBRepo) NextWebhookAttempt() (time.Time, error) {
+	return time.Time{}, sql.ErrNoRows
+}
+
+func (m *TestDBRepo) WebhookDeliveries(webhookID int, status string, limit int, offset int) ([]*models.WebhookDelivery, error) {
+	var deliveries []*models.WebhookDelivery
+	if webhookID == 1 && (status == "" || status == models.DeliveryDead) {
+		deliveries = append(deliveries, &models.WebhookDelivery{
+			ID:             1,
+			WebhookId:      1,
+			EventType:      models.WebhookReviewCreated,
+			Payload:        []byte(`{"event":"review.created"}`),
+			Status:         models.DeliveryDead,
+			Attempts:       8,
+			LastStatusCode: 500,
+			LastError:      "receiver answered 500 Internal Server Error",
+			CreatedAt:      time.Now(),
+			UpdatedAt:      time.Now(),
+		})
+	}
+
+	return deliveries, nil
+}
+
+func (m *TestDBRepo) RetryWebhookDelivery(id int) error {
+	if id == 1 {
+		return nil
+	}
+
+	return sql.ErrNoRows
+}
+
+func (m *TestDBRepo) DigestRecipients(checkedBefore time.Time, limit int) ([]*models.DigestRecipient, error) {
+	return nil, nil
+}
+
+func (m *TestDBRepo) DigestReviews(userID int, since time.Time, until time.Time, limit int) ([]*models.DigestReview, error) {
+	return nil, nil
+}
+
+func (m *TestDBRepo) MarkDigestSent(userID int, at time.Time) error {
+	return nil
+}
+
+func (m *TestDBRepo) GetDigestPreferences(userID int) (*models.DigestPreferences, error) {
+	return &models.DigestPreferences{UserId: userID, Enabled: true, Language: models.DigestJapanese}, nil
+}
+
+func (m *TestDBRepo) UpdateDigestPreferences(prefs models.DigestPreferences) error {
+	return nil
+}
+
+func (m *TestDBRepo) EnqueueJob(job models.Job) (int, error) {
+	return 1, nil
+}
+
+func (m *TestDBRepo) ClaimJobs(kinds []string, limit int, lease time.Duration) ([]*models.Job, error) {
+	return nil, nil
+}
+
+func (m *TestDBRepo) RecordJobResult(job models.Job) error {
+	return nil
+}
+
+func (m *TestDBRepo) GetJobByID(id int) (*models.Job, error) {
+	if id == 1 {
+		return &models.Job{ID: 1, Kind: "compute_rankings", Payload: []byte(`{}`), Status: models.JobFailed, Attempts: 5, MaxAttempts: 5, LastError: "connection refused"}, nil
+	}
+
+	return nil, sql.ErrNoRows
+}
+
+func (m *TestDBRepo) Jobs(filter models.JobFilter) ([]*models.Job, error) {
+	var jobs []*models.Job
+	if filter.Status == "" || filter.Status == models.JobFailed {
+		job, _ := m.GetJobByID(1)
+		jobs = append(jobs, job)
+	}
+
+	return jobs, nil
+}
+
+func (m *TestDBRepo) RetryJob(id int) error {
+	if id == 1 {
+		return nil
+	}
+
+	return sql.ErrNoRows
+}
+
+func (m *TestDBRepo) PruneJobs(before time.Time) (int64, error) {
+	return 0, nil
+}
+
+func (m *TestDBRepo) SetPendingImage(userID int, image string) error {
+	if userID == 1 {
+		return nil
+	}
+
+	return sql.ErrNoRows
+}
+
+func (m *TestDBRepo) ApplyPendingImage(userID int, image string) (string, error) {
+	if userID == 1 {
+		return "", nil
+	}
+
+	return "", sql.ErrNoRows
+}
@@ -1,10 +1,29 @@
 package repository
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"kstation_backend/internal/models"
+	"time"
 )
 
+// ErrDuplicateComment is returned when a user already reviewed the same lesson offering
+var ErrDuplicateComment = errors.New("comment already exists for this lesson, year and term")
+
+// ErrDuplicateReport is returned when a user reports the same comment twice
+var ErrDuplicateReport = errors.New("comment already reported by this user")
+
+// ErrReportHandled is returned when another moderator acted on a report first
+var ErrReportHandled = errors.New("report has already been handled")
+
+// ErrJobLeaseLost is returned when a job's result is recorded by a worker whose
+// lease ran out and whose job was claimed again since
+var ErrJobLeaseLost = errors.New("job was claimed again after its lease ran out")
+
+// ErrEmailTaken is returned when another account already uses an email address
+var ErrEmailTaken = errors.New("email address is already in use")
+
 type DatabaseRepo interface {
 	Connection() *sql.DB
 	InsertUser(user models.User) (int, error)
@@ -19,8 +38,103 @@ type DatabaseRepo interface {
 	AllLessonsByUser(id int, how int) ([]*models.Lesson, error)
 	InsertComment(comment models.Comment) (int, error)
 	GetCommentByID(id int) (*models.Comment, error)
-	AllCommentsByLessonId(LessonId int) ([]*models.Comment, error)
+	AllCommentsByLessonId(LessonId int, how int) ([]*models.Comment, error)
 	AllCommentsByUserId(UserId int) ([]*models.Comment, error)
-	UpdateComment(c models.Comment) error
+	UpdateComment(c models.Comment, editorID int) error
 	DeleteComment(id int) error
+	GetLessonStats(id int) (*models.LessonStats, error)
+	VoteComment(commentID int, userID int, helpful bool) error
+	GetCommentByOffering(userID int, lessonID int, year int, term string) (*models.Comment, error)
+	UpsertComment(comment models.Comment) (int, error)
+	UpdateLessonAggregates(id int) error
+	InsertReport(report models.Report) (int, error)
+	GetReportByID(id int) (*models.Report, error)
+	PendingReports() ([]*models.Report, error)
+	ModerateReport(action models.ModerationAction) error
+	HeldComments() ([]*models.Comment, error)
+	SetCommentModerationStatus(id int, status string) error
+	DeleteLesson(id int) error
+	DeleteUser(id int) ([]int, error)
+	RestoreComment(id int) (int, error)
+	RestoreLesson(id int) error
+	RestoreUser(id int) ([]int, error)
+	PurgeDeleted(before time.Time) (int64, error)
+	CommentRevisions(commentID int) ([]*models.CommentRevision, error)
+	GetUsersByIDs(ids []int) (map[int]*models.User, error)
+	InsertReply(reply models.Reply) (int, error)
+	GetReplyByID(id int) (*models.Reply, error)
+	RepliesByCommentId(commentID int, limit int, offset int) ([]*models.Reply, error)
+	UpdateReply(reply models.Reply) error
+	DeleteReply(id int) error
+	InsertAttachment(attachment models.Attachment) (int, error)
+	GetAttachmentByID(id int) (*models.Attachment, error)
+	AttachmentsByLessonId(lessonID int) ([]*models.Attachment, error)
+	DeleteAttachment(id int) error
+	RevokeSessions(userID int) (int, error)
+	ChangePassword(userID int, password string) (int, error)
+	SetPendingImage(userID int, image string) error
+	ApplyPendingImage(userID int, image string) (string, error)
+	InsertEmailChange(change models.EmailChange) error
+	ConfirmEmailChange(userID int, tokenHash string) (int, error)
+	VotesByUserId(userID int) ([]*models.Vote, error)
+	RepliesByUserId(userID int) ([]*models.Reply, error)
+	AttachmentsByUserId(userID int) ([]*models.Attachment, error)
+	AttachmentsOfDeletedLessons(before time.Time) ([]*models.Attachment, error)
+	DeleteAccount(userID int, cascade bool) ([]int, error)
+	AddFavorite(userID int, lessonID int) error
+	RemoveFavorite(userID int, lessonID int) error
+	FavoriteLessons(userID int) ([]*models.Lesson, error)
+	FavoritedLessons(userID int, lessonIDs []int) (map[int]bool, error)
+	UpsertOffering(offering models.Offering) (int, error)
+	GetOfferingByID(id int) (*models.Offering, error)
+	OfferingsByLessonId(lessonID int) ([]*models.Offering, error)
+	DeleteOffering(id int) error
+	Timetable(userID int, year int, term string) ([]*models.TimetableEntry, error)
+	TimetablesByUserId(userID int) ([]*models.TimetableEntry, error)
+	AddTimetableEntry(userID int, offering *models.Offering, check func(entries []*models.TimetableEntry) error) error
+	RemoveTimetableEntry(userID int, offeringID int) error
+	UpsertAcademicTerm(term models.AcademicTerm) error
+	AcademicTerms() ([]*models.AcademicTerm, error)
+	SetCalendarToken(userID int, tokenHash string) error
+	GetUserIDByCalendarToken(tokenHash string) (int, error)
+	LessonRatings() ([]*models.Rating, error)
+	AllFavorites() ([]*models.Favorite, error)
+	ReplaceRecommendations(recommendations []*models.Recommendation) error
+	RecommendationsByUserId(userID int, limit int, offset int) ([]*models.Recommendation, error)
+	ReplaceLessonRankings(rankings []*models.LessonRanking) error
+	LessonRankings(filter models.RankingFilter) ([]*models.LessonRanking, error)
+	FollowLesson(userID int, lessonID int) error
+	UnfollowLesson(userID int, lessonID int) error
+	FollowTeacher(userID int, teacherName string) error
+	UnfollowTeacher(userID int, teacherName string) error
+	FollowsByUserId(userID int) (*models.Follows, error)
+	FanOutNotifications(event models.FollowEvent) (int64, error)
+	NotificationsByUserId(userID int, unreadOnly bool, limit int, offset int) ([]*models.Notification, error)
+	UnreadNotificationCount(userID int) (int, error)
+	MarkNotificationsRead(userID int, id int) error
+	Notify(channel string, payload string) error
+	Listen(ctx context.Context, channel string, handle func(payload string)) error
+	InsertWebhook(webhook models.Webhook) (int, error)
+	UpdateWebhook(webhook models.Webhook) error
+	GetWebhookByID(id int) (*models.Webhook, error)
+	AllWebhooks() ([]*models.Webhook, error)
+	DeleteWebhook(id int) error
+	EnqueueWebhookDeliveries(eventType string, payload []byte) (int64, error)
+	ClaimWebhookDeliveries(limit int, lease time.Duration) ([]*models.WebhookDelivery, error)
+	RecordWebhookAttempt(delivery models.WebhookDelivery, lease time.Time) error
+	NextWebhookAttempt() (time.Time, error)
+	WebhookDeliveries(webhookID int, status string, limit int, offset int) ([]*models.WebhookDelivery, error)
+	RetryWebhookDelivery(id int) error
+	DigestRecipients(checkedBefore time.Time, limit int) ([]*models.DigestRecipient, error)
+	DigestReviews(userID int, since time.Time, until time.Time, limit int) ([]*models.DigestReview, error)
+	MarkDigestSent(userID int, at time.Time) error
+	GetDigestPreferences(userID int) (*models.DigestPreferences, error)
+	UpdateDigestPreferences(prefs models.DigestPreferences) error
+	EnqueueJob(job models.Job) (int, error)
+	ClaimJobs(kinds []string, limit int, lease time.Duration) ([]*models.Job, error)
+	RecordJobResult(job models.Job) error
+	GetJobByID(id int) (*models.Job, error)
+	Jobs(filter models.JobFilter) ([]*models.Job, error)
+	RetryJob(id int) error
+	PruneJobs(before time.Time) (int64, error)
 }
\ No newline at end of file
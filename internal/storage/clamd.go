@@ -0,0 +1,86 @@
+package storage
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// ClamdScanner sends uploads to a clamd daemon using its INSTREAM command
+type ClamdScanner struct {
+	Network string
+	Addr    string
+	Timeout time.Duration
+}
+
+func NewClamdScanner(addr string) *ClamdScanner {
+	network := "tcp"
+	if strings.HasPrefix(addr, "/") {
+		network = "unix"
+	}
+
+	return &ClamdScanner{Network: network, Addr: addr, Timeout: time.Minute}
+}
+
+func (s *ClamdScanner) Scan(ctx context.Context, r io.Reader) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, s.Network, s.Addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	err = conn.SetDeadline(time.Now().Add(s.Timeout))
+	if err != nil {
+		return err
+	}
+
+	_, err = conn.Write([]byte("zINSTREAM\x00"))
+	if err != nil {
+		return err
+	}
+
+	chunk := make([]byte, 32<<10)
+	size := make([]byte, 4)
+	for {
+		n, readErr := r.Read(chunk)
+		if n > 0 {
+			binary.BigEndian.PutUint32(size, uint32(n))
+			_, err = conn.Write(append(size, chunk[:n]...))
+			if err != nil {
+				return err
+			}
+		}
+		if readErr == io.EOF {
+			break
+		} else if readErr != nil {
+			return readErr
+		}
+	}
+
+	// a zero length chunk ends the stream
+	_, err = conn.Write([]byte{0, 0, 0, 0})
+	if err != nil {
+		return err
+	}
+
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	reply = strings.TrimRight(reply, "\x00\n")
+
+	switch {
+	case strings.HasSuffix(reply, "OK"):
+		return nil
+	case strings.HasSuffix(reply, "FOUND"):
+		return fmt.Errorf("%w: %s", ErrInfected, strings.TrimPrefix(reply, "stream: "))
+	default:
+		return fmt.Errorf("clamd: %s", reply)
+	}
+}
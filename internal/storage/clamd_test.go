@@ -0,0 +1,73 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+// fakeClamd answers INSTREAM requests, reporting any stream containing
+// "EICAR" as infected
+func fakeClamd(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+
+			go func(conn net.Conn) {
+				defer conn.Close()
+
+				command := make([]byte, len("zINSTREAM\x00"))
+				io.ReadFull(conn, command)
+
+				var data bytes.Buffer
+				size := make([]byte, 4)
+				for {
+					if _, err := io.ReadFull(conn, size); err != nil {
+						return
+					}
+					n := binary.BigEndian.Uint32(size)
+					if n == 0 {
+						break
+					}
+					io.CopyN(&data, conn, int64(n))
+				}
+
+				if bytes.Contains(data.Bytes(), []byte("EICAR")) {
+					conn.Write([]byte("stream: Eicar-Test-Signature FOUND\x00"))
+					return
+				}
+				conn.Write([]byte("stream: OK\x00"))
+			}(conn)
+		}
+	}()
+
+	return ln.Addr().String()
+}
+
+func TestClamdScanner(t *testing.T) {
+	scanner := NewClamdScanner(fakeClamd(t))
+
+	err := scanner.Scan(context.Background(), strings.NewReader("%PDF-1.4 past exam"))
+	if err != nil {
+		t.Errorf("expected a clean file to pass but got %s", err)
+	}
+
+	err = scanner.Scan(context.Background(), strings.NewReader(strings.Repeat("x", 100000)+"EICAR"))
+	if !errors.Is(err, ErrInfected) {
+		t.Errorf("expected ErrInfected but got %v", err)
+	}
+}
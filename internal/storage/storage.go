@@ -0,0 +1,68 @@
+// Package storage keeps uploaded files outside the database.
+//
+// A BlobStore saves and loads opaque objects by key. LocalStore writes them
+// below a directory on disk and S3Store talks to any S3-compatible service.
+// Uploads can be passed through a Scanner before they are stored, and a
+// Signer produces download links that stop working after a deadline.
+package storage
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+)
+
+var ErrNotFound = errors.New("object not found")
+
+// ErrInfected is returned by scanners that found malware in an upload
+var ErrInfected = errors.New("file failed virus scan")
+
+type BlobStore interface {
+	Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	Delete(ctx context.Context, key string) error
+}
+
+// Scanner checks an upload before it is stored. Implementations return an
+// error wrapping ErrInfected when the file must be refused.
+type Scanner interface {
+	Scan(ctx context.Context, r io.Reader) error
+}
+
+// ScannerFunc lets a plain function be used as a Scanner
+type ScannerFunc func(ctx context.Context, r io.Reader) error
+
+func (f ScannerFunc) Scan(ctx context.Context, r io.Reader) error {
+	return f(ctx, r)
+}
+
+// Signer signs a resource name together with an expiry time, so a link to the
+// resource can be handed out without requiring the holder to log in
+type Signer struct {
+	Secret []byte
+}
+
+func (s Signer) Sign(resource string, expires time.Time) string {
+	mac := hmac.New(sha256.New, s.Secret)
+	fmt.Fprintf(mac, "%s:%d", resource, expires.Unix())
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify checks a signature made by Sign. expires is the unix time from the link.
+func (s Signer) Verify(resource, expires, signature string, now time.Time) bool {
+	unix, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil || now.Unix() > unix {
+		return false
+	}
+
+	expected := s.Sign(resource, time.Unix(unix, 0))
+
+	return hmac.Equal([]byte(expected), []byte(signature))
+}
@@ -0,0 +1,99 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testBlobStore runs the same round trip against any BlobStore
+func testBlobStore(t *testing.T, store BlobStore) {
+	ctx := context.Background()
+	data := []byte("%PDF-1.4 past exam")
+
+	err := store.Put(ctx, "attachments/1/exam.pdf", bytes.NewReader(data), int64(len(data)), "application/pdf")
+	if err != nil {
+		t.Fatalf("put returned an error: %s", err)
+	}
+
+	r, err := store.Get(ctx, "attachments/1/exam.pdf")
+	if err != nil {
+		t.Fatalf("get returned an error: %s", err)
+	}
+	got, _ := io.ReadAll(r)
+	r.Close()
+
+	if !bytes.Equal(got, data) {
+		t.Errorf("expected %q but got %q", data, got)
+	}
+
+	err = store.Delete(ctx, "attachments/1/exam.pdf")
+	if err != nil {
+		t.Errorf("delete returned an error: %s", err)
+	}
+
+	_, err = store.Get(ctx, "attachments/1/exam.pdf")
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound after delete but got %v", err)
+	}
+}
+
+func TestLocalStore(t *testing.T) {
+	store := NewLocalStore(t.TempDir())
+	testBlobStore(t, store)
+
+	err := store.Put(context.Background(), "../escape", strings.NewReader("x"), 1, "text/plain")
+	if err == nil {
+		t.Error("expected a key outside the root to be refused")
+	}
+}
+
+func TestSigner(t *testing.T) {
+	signer := Signer{Secret: []byte("secret")}
+	now := time.Unix(1700000000, 0)
+	expires := now.Add(time.Minute)
+	signature := signer.Sign("attachments/1", expires)
+
+	var tests = []struct {
+		name      string
+		resource  string
+		expires   string
+		signature string
+		now       time.Time
+		expected  bool
+	}{
+		{"valid", "attachments/1", "1700000060", signature, now, true},
+		{"expired", "attachments/1", "1700000060", signature, now.Add(time.Hour), false},
+		{"other resource", "attachments/2", "1700000060", signature, now, false},
+		{"extended expiry", "attachments/1", "1800000000", signature, now, false},
+		{"bad expiry", "attachments/1", "soon", signature, now, false},
+	}
+
+	for _, e := range tests {
+		if signer.Verify(e.resource, e.expires, e.signature, e.now) != e.expected {
+			t.Errorf("%s: expected %t", e.name, e.expected)
+		}
+	}
+}
+
+func TestScannerFunc(t *testing.T) {
+	scanner := ScannerFunc(func(ctx context.Context, r io.Reader) error {
+		data, _ := io.ReadAll(r)
+		if bytes.Contains(data, []byte("EICAR")) {
+			return ErrInfected
+		}
+		return nil
+	})
+
+	if scanner.Scan(context.Background(), strings.NewReader("clean")) != nil {
+		t.Error("expected clean data to pass")
+	}
+
+	if !errors.Is(scanner.Scan(context.Background(), strings.NewReader("EICAR test")), ErrInfected) {
+		t.Error("expected infected data to be refused")
+	}
+}
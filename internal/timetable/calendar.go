@@ -0,0 +1,125 @@
+package timetable
+
+import (
+	"errors"
+	"fmt"
+	"kstation_backend/internal/ical"
+	"kstation_backend/internal/models"
+	"strings"
+	"time"
+)
+
+// DefaultPeriods are the class periods of a day, in the format ParsePeriods reads
+const DefaultPeriods = "08:40-09:55,10:10-11:25,12:15-13:30,13:45-15:00,15:15-16:30,16:45-18:00"
+
+// Period is when a class period starts and ends, as times of day
+type Period struct {
+	Start time.Duration
+	End   time.Duration
+}
+
+// ParsePeriods reads a comma separated list of HH:MM-HH:MM ranges, the first
+// being period 1
+func ParsePeriods(s string) ([]Period, error) {
+	var periods []Period
+	for _, part := range strings.Split(s, ",") {
+		start, end, ok := strings.Cut(strings.TrimSpace(part), "-")
+		if !ok {
+			return nil, fmt.Errorf("period %q is not a HH:MM-HH:MM range", part)
+		}
+
+		var period Period
+		var err error
+		period.Start, err = parseTimeOfDay(start)
+		if err == nil {
+			period.End, err = parseTimeOfDay(end)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("period %q: %w", part, err)
+		}
+		if period.End <= period.Start {
+			return nil, fmt.Errorf("period %q ends before it starts", part)
+		}
+
+		periods = append(periods, period)
+	}
+
+	return periods, nil
+}
+
+func parseTimeOfDay(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, errors.New("times must be written as HH:MM")
+	}
+
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// CalendarOptions are the school-wide settings a timetable calendar needs
+type CalendarOptions struct {
+	Terms    []*models.AcademicTerm
+	Periods  []Period
+	Location *time.Location
+	Now      time.Time
+}
+
+// Calendar turns a user's timetable into one weekly event per class period,
+// repeating from the first to the last day of its term. Entries of terms
+// without dates and periods outside the school day are left out. Event UIDs
+// only depend on the user, offering and period, so calendar apps update the
+// events they already have when the calendar is fetched again.
+func Calendar(userID int, entries []*models.TimetableEntry, opts CalendarOptions) ical.Calendar {
+	type termKey struct {
+		year int
+		term string
+	}
+	terms := make(map[termKey]*models.AcademicTerm, len(opts.Terms))
+	for _, term := range opts.Terms {
+		terms[termKey{term.Year, term.Term}] = term
+	}
+
+	calendar := ical.Calendar{
+		ProdID:   "-//Kstation//Timetable//EN",
+		Name:     "Kstation timetable",
+		Location: opts.Location,
+	}
+
+	for _, entry := range entries {
+		term, ok := terms[termKey{entry.Offering.Year, entry.Offering.Term}]
+		if !ok {
+			continue
+		}
+
+		y, m, d := term.StartsOn.Date()
+		firstDay := time.Date(y, m, d, 0, 0, 0, 0, opts.Location)
+		y, m, d = term.EndsOn.Date()
+		lastDay := time.Date(y, m, d, 0, 0, 0, 0, opts.Location)
+
+		for _, slot := range entry.Offering.Slots {
+			if slot.Period < 1 || slot.Period > len(opts.Periods) {
+				continue
+			}
+
+			// days run from 1 (Monday) to 7 (Sunday), time.Weekday from 0 (Sunday)
+			offset := (slot.Day%7 - int(firstDay.Weekday()) + 7) % 7
+			day := firstDay.AddDate(0, 0, offset)
+			if day.After(lastDay) {
+				continue
+			}
+
+			period := opts.Periods[slot.Period-1]
+			calendar.Events = append(calendar.Events, ical.Event{
+				UID:         fmt.Sprintf("timetable-%d-%d-%d-%d@kstation", userID, entry.Offering.ID, slot.Day, slot.Period),
+				Summary:     entry.Lesson.LessonName,
+				Description: fmt.Sprintf("Teacher: %s\nCredits: %d", entry.Lesson.TeacherName, entry.Offering.Credits),
+				Start:       day.Add(period.Start),
+				End:         day.Add(period.End),
+				Until:       lastDay,
+				Stamp:       opts.Now,
+			})
+		}
+	}
+
+	return calendar
+}
@@ -0,0 +1,75 @@
+package timetable
+
+import (
+	"kstation_backend/internal/models"
+	"testing"
+	"time"
+)
+
+func TestParsePeriods(t *testing.T) {
+	periods, err := ParsePeriods(DefaultPeriods)
+	if err != nil || len(periods) != 6 {
+		t.Fatalf("expected six default periods but got %v, %v", periods, err)
+	}
+
+	if periods[0].Start != 8*time.Hour+40*time.Minute || periods[0].End != 9*time.Hour+55*time.Minute {
+		t.Errorf("unexpected first period %v", periods[0])
+	}
+
+	for _, bad := range []string{"", "08:40", "8:40-x", "10:00-09:00"} {
+		_, err = ParsePeriods(bad)
+		if err == nil {
+			t.Errorf("%q: expected an error", bad)
+		}
+	}
+}
+
+func TestCalendar(t *testing.T) {
+	jst := time.FixedZone("Asia/Tokyo", 9*60*60)
+	periods, _ := ParsePeriods(DefaultPeriods)
+
+	entries := []*models.TimetableEntry{
+		{
+			Offering: &models.Offering{ID: 7, Year: 2024, Term: "former", Credits: 2, Slots: []models.Slot{{Day: 1, Period: 2}, {Day: 7, Period: 1}, {Day: 3, Period: 9}}},
+			Lesson:   &models.Lesson{LessonName: "Math", TeacherName: "Yamada"},
+		},
+		{
+			Offering: &models.Offering{ID: 8, Year: 2025, Term: "former", Slots: []models.Slot{{Day: 1, Period: 1}}},
+			Lesson:   &models.Lesson{LessonName: "Undated"},
+		},
+	}
+
+	opts := CalendarOptions{
+		// 2024-04-10 is a Wednesday
+		Terms:    []*models.AcademicTerm{{Year: 2024, Term: "former", StartsOn: time.Date(2024, 4, 10, 0, 0, 0, 0, time.UTC), EndsOn: time.Date(2024, 8, 9, 0, 0, 0, 0, time.UTC)}},
+		Periods:  periods,
+		Location: jst,
+		Now:      time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC),
+	}
+
+	calendar := Calendar(1, entries, opts)
+	if len(calendar.Events) != 2 {
+		t.Fatalf("expected two events but got %d", len(calendar.Events))
+	}
+
+	monday := calendar.Events[0]
+	if monday.UID != "timetable-1-7-1-2@kstation" {
+		t.Errorf("unexpected uid %s", monday.UID)
+	}
+	if !monday.Start.Equal(time.Date(2024, 4, 15, 10, 10, 0, 0, jst)) || !monday.End.Equal(time.Date(2024, 4, 15, 11, 25, 0, 0, jst)) {
+		t.Errorf("expected the first monday second period but got %s - %s", monday.Start, monday.End)
+	}
+	if !monday.Until.Equal(time.Date(2024, 8, 9, 0, 0, 0, 0, jst)) {
+		t.Errorf("expected the event to repeat until the end of the term but got %s", monday.Until)
+	}
+
+	sunday := calendar.Events[1]
+	if !sunday.Start.Equal(time.Date(2024, 4, 14, 8, 40, 0, 0, jst)) {
+		t.Errorf("expected the first sunday but got %s", sunday.Start)
+	}
+
+	again := Calendar(1, entries, opts)
+	if again.Events[0].UID != monday.UID {
+		t.Error("uids are not stable")
+	}
+}
@@ -0,0 +1,124 @@
+// Package timetable checks and summarises the lessons a student picked for
+// one term.
+package timetable
+
+import (
+	"kstation_backend/internal/models"
+	"sort"
+)
+
+// Conflict is a period claimed by two offerings
+type Conflict struct {
+	Slot       models.Slot `json:"slot"`
+	OfferingId int         `json:"offering_id"`
+	LessonId   int         `json:"lesson_id"`
+}
+
+// Summary describes a timetable as a whole. AvgStar is the mean rating of the
+// reviewed lessons, weighted by credits.
+type Summary struct {
+	Lessons        int        `json:"lessons"`
+	Credits        int        `json:"credits"`
+	CreditLimit    int        `json:"credit_limit,omitempty"`
+	OverLimit      bool       `json:"over_limit"`
+	RatedLessons   int        `json:"rated_lessons"`
+	AvgStar        float32    `json:"avg_star"`
+	CommentNumbers int        `json:"comment_numbers"`
+	Conflicts      []Conflict `json:"conflicts"`
+}
+
+// Conflicts returns the periods of candidate that are already taken by an
+// entry. An entry for the candidate itself never conflicts.
+func Conflicts(entries []*models.TimetableEntry, candidate *models.Offering) []Conflict {
+	taken := make(map[models.Slot]bool, len(candidate.Slots))
+	for _, slot := range candidate.Slots {
+		taken[slot] = true
+	}
+
+	conflicts := []Conflict{}
+	for _, entry := range entries {
+		if entry.Offering.ID == candidate.ID {
+			continue
+		}
+
+		for _, slot := range entry.Offering.Slots {
+			if taken[slot] {
+				conflicts = append(conflicts, Conflict{Slot: slot, OfferingId: entry.Offering.ID, LessonId: entry.Offering.LessonId})
+			}
+		}
+	}
+
+	sortConflicts(conflicts)
+	return conflicts
+}
+
+// Credits returns the total credits of the entries
+func Credits(entries []*models.TimetableEntry) int {
+	credits := 0
+	for _, entry := range entries {
+		credits += entry.Offering.Credits
+	}
+
+	return credits
+}
+
+// Summarize totals a timetable. A creditLimit of 0 means no limit. Conflicts
+// lists every period that more than one entry claims, which can happen when a
+// lesson's schedule changes after it was added.
+func Summarize(entries []*models.TimetableEntry, creditLimit int) Summary {
+	summary := Summary{
+		Lessons:     len(entries),
+		Credits:     Credits(entries),
+		CreditLimit: creditLimit,
+		Conflicts:   []Conflict{},
+	}
+	summary.OverLimit = creditLimit > 0 && summary.Credits > creditLimit
+
+	var weighted, weights float32
+	claims := make(map[models.Slot][]*models.Offering)
+	for _, entry := range entries {
+		if entry.Lesson != nil && entry.Lesson.CommentNumbers > 0 {
+			weight := float32(entry.Offering.Credits)
+			if weight <= 0 {
+				weight = 1
+			}
+			weighted += entry.Lesson.AvgStar * weight
+			weights += weight
+			summary.RatedLessons++
+			summary.CommentNumbers += entry.Lesson.CommentNumbers
+		}
+
+		for _, slot := range entry.Offering.Slots {
+			claims[slot] = append(claims[slot], entry.Offering)
+		}
+	}
+
+	for slot, offerings := range claims {
+		if len(offerings) < 2 {
+			continue
+		}
+		for _, offering := range offerings {
+			summary.Conflicts = append(summary.Conflicts, Conflict{Slot: slot, OfferingId: offering.ID, LessonId: offering.LessonId})
+		}
+	}
+
+	if weights > 0 {
+		summary.AvgStar = weighted / weights
+	}
+
+	sortConflicts(summary.Conflicts)
+	return summary
+}
+
+func sortConflicts(conflicts []Conflict) {
+	sort.Slice(conflicts, func(i, j int) bool {
+		a, b := conflicts[i], conflicts[j]
+		if a.Slot.Day != b.Slot.Day {
+			return a.Slot.Day < b.Slot.Day
+		}
+		if a.Slot.Period != b.Slot.Period {
+			return a.Slot.Period < b.Slot.Period
+		}
+		return a.OfferingId < b.OfferingId
+	})
+}
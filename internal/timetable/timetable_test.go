@@ -0,0 +1,77 @@
+package timetable
+
+import (
+	"kstation_backend/internal/models"
+	"testing"
+)
+
+func entry(id, credits int, star float32, comments int, slots ...models.Slot) *models.TimetableEntry {
+	return &models.TimetableEntry{
+		Offering: &models.Offering{ID: id, LessonId: id * 10, Credits: credits, Slots: slots},
+		Lesson:   &models.Lesson{ID: id * 10, AvgStar: star, CommentNumbers: comments},
+	}
+}
+
+func TestConflicts(t *testing.T) {
+	entries := []*models.TimetableEntry{
+		entry(1, 2, 0, 0, models.Slot{Day: 1, Period: 1}, models.Slot{Day: 1, Period: 2}),
+		entry(2, 2, 0, 0, models.Slot{Day: 3, Period: 4}),
+	}
+
+	var tests = []struct {
+		name              string
+		candidate         *models.Offering
+		expectedConflicts []int
+	}{
+		{"free period", &models.Offering{ID: 3, Slots: []models.Slot{{Day: 2, Period: 1}}}, nil},
+		{"same period", &models.Offering{ID: 3, Slots: []models.Slot{{Day: 1, Period: 2}}}, []int{1}},
+		{"two clashes", &models.Offering{ID: 3, Slots: []models.Slot{{Day: 3, Period: 4}, {Day: 1, Period: 1}}}, []int{1, 2}},
+		{"already added", &models.Offering{ID: 1, Slots: []models.Slot{{Day: 1, Period: 1}}}, nil},
+		{"no periods", &models.Offering{ID: 3}, nil},
+	}
+
+	for _, e := range tests {
+		conflicts := Conflicts(entries, e.candidate)
+		if len(conflicts) != len(e.expectedConflicts) {
+			t.Errorf("%s: expected %d conflicts but got %v", e.name, len(e.expectedConflicts), conflicts)
+			continue
+		}
+
+		for i, conflict := range conflicts {
+			if conflict.OfferingId != e.expectedConflicts[i] || conflict.LessonId != e.expectedConflicts[i]*10 {
+				t.Errorf("%s: unexpected conflict %v", e.name, conflict)
+			}
+		}
+	}
+}
+
+func TestSummarize(t *testing.T) {
+	entries := []*models.TimetableEntry{
+		entry(1, 2, 4, 10, models.Slot{Day: 1, Period: 1}),
+		entry(2, 4, 1, 2, models.Slot{Day: 1, Period: 1}, models.Slot{Day: 2, Period: 1}),
+		entry(3, 2, 0, 0, models.Slot{Day: 1, Period: 1}),
+	}
+
+	summary := Summarize(entries, 6)
+
+	if summary.Lessons != 3 || summary.Credits != 8 || !summary.OverLimit {
+		t.Errorf("expected 3 lessons and 8 credits over the limit but got %+v", summary)
+	}
+
+	if summary.RatedLessons != 2 || summary.CommentNumbers != 12 {
+		t.Errorf("expected 2 rated lessons with 12 comments but got %+v", summary)
+	}
+
+	if summary.AvgStar != 2 {
+		t.Errorf("expected a credit weighted rating of 2 but got %v", summary.AvgStar)
+	}
+
+	if len(summary.Conflicts) != 3 {
+		t.Errorf("expected three offerings on monday first period but got %v", summary.Conflicts)
+	}
+
+	empty := Summarize(nil, 0)
+	if empty.OverLimit || empty.AvgStar != 0 || empty.Conflicts == nil {
+		t.Errorf("unexpected summary of an empty timetable %+v", empty)
+	}
+}
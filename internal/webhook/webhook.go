@@ -0,0 +1,129 @@
+// Package webhook signs and sends webhook payloads.
+//
+// Every request carries the event type, the delivery id, a Unix timestamp and
+// a signature: the hex HMAC-SHA256, keyed with the webhook's secret, of the
+// timestamp, a dot and the body. Receivers recompute it with Verify and should
+// reject old timestamps to stop replays.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// headers set on every webhook request
+const (
+	EventHeader     = "X-Kstation-Event"
+	DeliveryHeader  = "X-Kstation-Delivery"
+	TimestampHeader = "X-Kstation-Timestamp"
+	SignatureHeader = "X-Kstation-Signature"
+)
+
+const signaturePrefix = "sha256="
+
+// Sign returns the signature header value of a body sent at timestamp
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+
+	return signaturePrefix + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify reports whether signature is the signature of a body sent at
+// timestamp
+func Verify(secret string, signature string, timestamp int64, body []byte) bool {
+	if !strings.HasPrefix(signature, signaturePrefix) {
+		return false
+	}
+
+	return hmac.Equal([]byte(signature), []byte(Sign(secret, timestamp, body)))
+}
+
+// Request is one attempt to deliver a payload
+type Request struct {
+	URL        string
+	Secret     string
+	EventType  string
+	DeliveryID int
+	Body       []byte
+}
+
+// Sender posts signed payloads
+type Sender struct {
+	Client    *http.Client
+	UserAgent string
+}
+
+// Send posts the request and returns the receiver's status code. Any status
+// outside 2xx is an error; a status code of 0 means no response was received.
+func (s *Sender) Send(ctx context.Context, req Request, now time.Time) (int, error) {
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, req.URL, bytes.NewReader(req.Body))
+	if err != nil {
+		return 0, err
+	}
+
+	timestamp := now.Unix()
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set("User-Agent", s.UserAgent)
+	httpReq.Header.Set(EventHeader, req.EventType)
+	httpReq.Header.Set(DeliveryHeader, strconv.Itoa(req.DeliveryID))
+	httpReq.Header.Set(TimestampHeader, strconv.FormatInt(timestamp, 10))
+	httpReq.Header.Set(SignatureHeader, Sign(req.Secret, timestamp, req.Body))
+
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	resp, err := client.Do(httpReq)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	// drain a little of the body so the connection can be reused
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("receiver answered %s", resp.Status)
+	}
+
+	return resp.StatusCode, nil
+}
+
+// RetryPolicy decides when failed deliveries are tried again. The wait doubles
+// after every attempt, from BaseDelay up to MaxDelay.
+type RetryPolicy struct {
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+}
+
+// Next returns how long to wait after the given number of failed attempts,
+// or false when the delivery should be given up on
+func (p RetryPolicy) Next(attempts int) (time.Duration, bool) {
+	if attempts >= p.MaxAttempts {
+		return 0, false
+	}
+
+	delay := p.BaseDelay
+	for i := 1; i < attempts && delay < p.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+
+	return delay, true
+}
@@ -0,0 +1,104 @@
+package webhook
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestSignAndVerify(t *testing.T) {
+	body := []byte(`{"event":"review.created"}`)
+	signature := Sign("secret", 1700000000, body)
+
+	var tests = []struct {
+		name      string
+		secret    string
+		signature string
+		timestamp int64
+		body      []byte
+		expected  bool
+	}{
+		{"valid", "secret", signature, 1700000000, body, true},
+		{"wrong secret", "other", signature, 1700000000, body, false},
+		{"wrong timestamp", "secret", signature, 1700000001, body, false},
+		{"tampered body", "secret", signature, 1700000000, []byte(`{"event":"review.deleted"}`), false},
+		{"missing prefix", "secret", signature[len(signaturePrefix):], 1700000000, body, false},
+	}
+
+	for _, e := range tests {
+		if Verify(e.secret, e.signature, e.timestamp, e.body) != e.expected {
+			t.Errorf("%s: expected %t", e.name, e.expected)
+		}
+	}
+}
+
+func TestSenderSend(t *testing.T) {
+	status := http.StatusNoContent
+	var received *http.Request
+	var receivedBody []byte
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r
+		receivedBody, _ = io.ReadAll(r.Body)
+		w.WriteHeader(status)
+	}))
+	defer ts.Close()
+
+	sender := &Sender{Client: ts.Client(), UserAgent: "kstation-webhooks"}
+	req := Request{URL: ts.URL, Secret: "secret", EventType: "review.created", DeliveryID: 7, Body: []byte(`{"id":1}`)}
+	now := time.Unix(1700000000, 0)
+
+	code, err := sender.Send(context.Background(), req, now)
+	if err != nil || code != http.StatusNoContent {
+		t.Fatalf("expected %d but got %d, %v", http.StatusNoContent, code, err)
+	}
+
+	if received.Header.Get(EventHeader) != "review.created" || received.Header.Get(DeliveryHeader) != "7" {
+		t.Errorf("unexpected headers %v", received.Header)
+	}
+
+	timestamp, _ := strconv.ParseInt(received.Header.Get(TimestampHeader), 10, 64)
+	if !Verify("secret", received.Header.Get(SignatureHeader), timestamp, receivedBody) {
+		t.Error("the receiver could not verify the signature")
+	}
+
+	status = http.StatusInternalServerError
+	code, err = sender.Send(context.Background(), req, now)
+	if err == nil || code != http.StatusInternalServerError {
+		t.Errorf("expected an error with status %d but got %d, %v", http.StatusInternalServerError, code, err)
+	}
+
+	ts.Close()
+	code, err = sender.Send(context.Background(), req, now)
+	if err == nil || code != 0 {
+		t.Errorf("expected an error without status when the receiver is down but got %d, %v", code, err)
+	}
+}
+
+func TestRetryPolicyNext(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 5, BaseDelay: time.Minute, MaxDelay: time.Minute * 5}
+
+	var tests = []struct {
+		attempts      int
+		expectedDelay time.Duration
+		expectedRetry bool
+	}{
+		{1, time.Minute, true},
+		{2, time.Minute * 2, true},
+		{3, time.Minute * 4, true},
+		{4, time.Minute * 5, true},
+		{5, 0, false},
+		{6, 0, false},
+	}
+
+	for _, e := range tests {
+		delay, retry := policy.Next(e.attempts)
+		if delay != e.expectedDelay || retry != e.expectedRetry {
+			t.Errorf("after %d attempts: expected %s, %t but got %s, %t", e.attempts, e.expectedDelay, e.expectedRetry, delay, retry)
+		}
+	}
+}